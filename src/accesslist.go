@@ -2,9 +2,16 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"io"
 	"log"
 	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
 
+	"imuslab.com/zoraxy/mod/geodb"
 	"imuslab.com/zoraxy/mod/utils"
 )
 
@@ -16,6 +23,26 @@ import (
 	banning / whitelist a specific IP address or country code
 */
 
+// Parse the optional comment and ttl (in seconds) of a new blacklist / whitelist entry
+func getAccessEntryFromRequest(r *http.Request) (*geodb.AccessEntry, error) {
+	comment, _ := utils.PostPara(r, "comment")
+	entry := geodb.AccessEntry{
+		Comment: strings.TrimSpace(comment),
+		Source:  geodb.EntrySource_Manual,
+	}
+
+	ttl, err := utils.PostPara(r, "ttl")
+	if err == nil && ttl != "0" {
+		ttlSeconds, err := utils.StringToInt64(ttl)
+		if err != nil || ttlSeconds < 0 {
+			return nil, errors.New("invalid ttl given")
+		}
+		entry.ExpireAt = time.Now().Unix() + ttlSeconds
+	}
+
+	return &entry, nil
+}
+
 /*
 	Blacklist Related
 */
@@ -27,14 +54,14 @@ func handleListBlacklisted(w http.ResponseWriter, r *http.Request) {
 		log.Println("invalid or empty blacklist type, default to country")
 	}
 
-	resulst := []string{}
+	resulst := []*geodb.AccessEntry{}
 	switch bltype {
 	case "country":
-		resulst = geodbStore.GetAllBlacklistedCountryCode()
+		resulst = geodbStore.GetAllBlacklistedCountryCodeEntries()
 	case "ip":
-		resulst = geodbStore.GetAllBlacklistedIp()
+		resulst = geodbStore.GetAllBlacklistedIpEntries()
 	default:
-		resulst = geodbStore.GetAllBlacklistedCountryCode()
+		resulst = geodbStore.GetAllBlacklistedCountryCodeEntries()
 	}
 
 	js, _ := json.Marshal(resulst)
@@ -49,7 +76,13 @@ func handleCountryBlacklistAdd(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	geodbStore.AddCountryCodeToBlackList(countryCode)
+	entry, err := getAccessEntryFromRequest(r)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+
+	geodbStore.AddCountryCodeToBlackListWithEntry(countryCode, entry)
 
 	utils.SendOK(w)
 }
@@ -73,7 +106,14 @@ func handleIpBlacklistAdd(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	geodbStore.AddIPToBlackList(ipAddr)
+	entry, err := getAccessEntryFromRequest(r)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+
+	geodbStore.AddIPToBlackListWithEntry(ipAddr, entry)
+	utils.SendOK(w)
 }
 
 func handleIpBlacklistRemove(w http.ResponseWriter, r *http.Request) {
@@ -120,14 +160,14 @@ func handleListWhitelisted(w http.ResponseWriter, r *http.Request) {
 		log.Println("invalid or empty whitelist type, default to country")
 	}
 
-	resulst := []string{}
+	resulst := []*geodb.AccessEntry{}
 	switch wltype {
 	case "country":
-		resulst = geodbStore.GetAllWhitelistedCountryCode()
+		resulst = geodbStore.GetAllWhitelistedCountryCodeEntries()
 	case "ip":
-		resulst = geodbStore.GetAllWhitelistedIp()
+		resulst = geodbStore.GetAllWhitelistedIpEntries()
 	default:
-		resulst = geodbStore.GetAllWhitelistedCountryCode()
+		resulst = geodbStore.GetAllWhitelistedCountryCodeEntries()
 	}
 
 	js, _ := json.Marshal(resulst)
@@ -142,7 +182,13 @@ func handleCountryWhitelistAdd(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	geodbStore.AddCountryCodeToWhitelist(countryCode)
+	entry, err := getAccessEntryFromRequest(r)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+
+	geodbStore.AddCountryCodeToWhitelistWithEntry(countryCode, entry)
 
 	utils.SendOK(w)
 }
@@ -166,7 +212,14 @@ func handleIpWhitelistAdd(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	geodbStore.AddIPToWhiteList(ipAddr)
+	entry, err := getAccessEntryFromRequest(r)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+
+	geodbStore.AddIPToWhiteListWithEntry(ipAddr, entry)
+	utils.SendOK(w)
 }
 
 func handleIpWhitelistRemove(w http.ResponseWriter, r *http.Request) {
@@ -202,3 +255,133 @@ func handleWhitelistEnable(w http.ResponseWriter, r *http.Request) {
 
 	utils.SendOK(w)
 }
+
+/*
+	IP Feeds Related
+*/
+
+// List all the imported ip blocklist / allowlist feeds
+func handleListIpFeeds(w http.ResponseWriter, r *http.Request) {
+	feeds := geodbStore.ListIpFeeds()
+	sort.Slice(feeds, func(i, j int) bool {
+		return feeds[i].Name < feeds[j].Name
+	})
+	js, _ := json.Marshal(feeds)
+	utils.SendJSONResponse(w, string(js))
+}
+
+// Add a named ip feed that is loaded from a local file path or URL
+func handleAddIpFeed(w http.ResponseWriter, r *http.Request) {
+	name, err := utils.PostPara(r, "name")
+	if err != nil {
+		utils.SendErrorResponse(w, "invalid or empty feed name")
+		return
+	}
+
+	source, err := utils.PostPara(r, "source")
+	if err != nil {
+		utils.SendErrorResponse(w, "invalid or empty feed source")
+		return
+	}
+
+	target, err := utils.PostPara(r, "target")
+	if err != nil {
+		target = geodb.IpFeedTarget_Blacklist
+	}
+
+	var refreshInterval int64 = 0
+	interval, err := utils.PostPara(r, "interval")
+	if err == nil {
+		refreshInterval, err = utils.StringToInt64(interval)
+		if err != nil {
+			utils.SendErrorResponse(w, "invalid refresh interval")
+			return
+		}
+	}
+
+	err = geodbStore.AddIpFeed(strings.TrimSpace(name), strings.TrimSpace(source), target, refreshInterval)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+
+	utils.SendOK(w)
+}
+
+// Import a netset or CIDR text file as a static ip feed
+func handleImportIpFeed(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	err := r.ParseMultipartForm(64 << 20) // 64 MB
+	if err != nil {
+		utils.SendErrorResponse(w, "failed to parse form data")
+		return
+	}
+
+	name := strings.TrimSpace(r.FormValue("name"))
+	target := r.FormValue("target")
+	if target == "" {
+		target = geodb.IpFeedTarget_Blacklist
+	}
+
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		utils.SendErrorResponse(w, "failed to get file")
+		return
+	}
+	defer file.Close()
+
+	if name == "" {
+		//Use the filename as feed name
+		name = strings.TrimSuffix(header.Filename, filepath.Ext(header.Filename))
+	}
+
+	content, err := io.ReadAll(file)
+	if err != nil {
+		utils.SendErrorResponse(w, "failed to read file")
+		return
+	}
+
+	err = geodbStore.ImportIpFeed(name, target, content)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+
+	utils.SendOK(w)
+}
+
+func handleRemoveIpFeed(w http.ResponseWriter, r *http.Request) {
+	name, err := utils.PostPara(r, "name")
+	if err != nil {
+		utils.SendErrorResponse(w, "invalid or empty feed name")
+		return
+	}
+
+	err = geodbStore.RemoveIpFeed(name)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+
+	utils.SendOK(w)
+}
+
+func handleRefreshIpFeed(w http.ResponseWriter, r *http.Request) {
+	name, err := utils.PostPara(r, "name")
+	if err != nil {
+		utils.SendErrorResponse(w, "invalid or empty feed name")
+		return
+	}
+
+	err = geodbStore.RefreshIpFeed(name)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+
+	utils.SendOK(w)
+}
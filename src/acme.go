@@ -6,8 +6,11 @@ import (
 	"log"
 	"math/rand"
 	"net/http"
+	"os"
+	"path/filepath"
 	"regexp"
 	"strconv"
+	"strings"
 
 	"imuslab.com/zoraxy/mod/acme"
 	"imuslab.com/zoraxy/mod/dynamicproxy"
@@ -36,7 +39,13 @@ func initACME() *acme.ACMEHandler {
 		port = getRandomPort(30000)
 	}
 
-	return acme.NewACME("https://acme-staging-v02.api.letsencrypt.org/directory", strconv.Itoa(port))
+	//Load the user defined CAs and EAB credentials
+	caStore, err := acme.NewCAStore(sysdb, "./conf/acme_secret.key")
+	if err != nil {
+		log.Println("[ACME] Unable to load CA store: " + err.Error())
+	}
+
+	return acme.NewACME("https://acme-staging-v02.api.letsencrypt.org/directory", strconv.Itoa(port), caStore, tlsCertManager)
 }
 
 // create the special routing rule for ACME
@@ -82,6 +91,17 @@ func acmeRegisterSpecialRoutingRule() {
 
 // This function check if the renew setup is satisfied. If not, toggle them automatically
 func AcmeCheckAndHandleRenewCertificate(w http.ResponseWriter, r *http.Request) {
+	challenge, _ := utils.PostPara(r, "challenge")
+	if challenge == acme.Challenge_TLSALPN01 {
+		//TLS-ALPN-01 challenge is answered by the main TLS listener on port 443
+		if !dynamicProxyRouter.Option.UseTls || dynamicProxyRouter.Option.Port != 443 || !dynamicProxyRouter.Running {
+			utils.SendErrorResponse(w, "TLS-ALPN-01 challenge requires the reverse proxy serving TLS on port 443")
+			return
+		}
+		acmeHandler.HandleRenewCertificate(w, r)
+		return
+	}
+
 	isForceHttpsRedirectEnabledOriginally := false
 	switch dynamicProxyRouter.Option.Port {
 	case 443:
@@ -110,3 +130,38 @@ func AcmeCheckAndHandleRenewCertificate(w http.ResponseWriter, r *http.Request)
 		}
 	}
 }
+
+// Revoke the certificate at the CA and remove it from the certificate store
+func AcmeHandleRevokeCertificate(w http.ResponseWriter, r *http.Request) {
+	certName, err := utils.PostPara(r, "name")
+	if err != nil || strings.ContainsAny(certName, "/\\") || strings.Contains(certName, "..") {
+		utils.SendErrorResponse(w, "invalid certificate name given")
+		return
+	}
+
+	reason := 0
+	reasonString, err := utils.PostPara(r, "reason")
+	if err == nil {
+		reason, err = strconv.Atoi(reasonString)
+		if err != nil || reason < 0 {
+			utils.SendErrorResponse(w, "invalid revocation reason given")
+			return
+		}
+	}
+
+	err = acmeHandler.RevokeCert(certName, uint(reason))
+	if err != nil {
+		utils.SendErrorResponse(w, "unable to revoke certificate: "+err.Error())
+		return
+	}
+
+	//Certificate revoked. Remove it and its ACME info from the cert store
+	err = tlsCertManager.RemoveCert(certName)
+	if err != nil {
+		utils.SendErrorResponse(w, "certificate revoked but failed to remove: "+err.Error())
+		return
+	}
+	os.Remove(filepath.Join(tlsCertManager.CertStore, certName+".json"))
+
+	utils.SendOK(w)
+}
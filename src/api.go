@@ -54,6 +54,8 @@ func initAPIs() {
 	authRouter.HandleFunc("/api/proxy/setIncoming", HandleIncomingPortSet)
 	authRouter.HandleFunc("/api/proxy/useHttpsRedirect", HandleUpdateHttpsRedirect)
 	authRouter.HandleFunc("/api/proxy/requestIsProxied", HandleManagementProxyCheck)
+	authRouter.HandleFunc("/api/proxy/autocert/status", HandleAutoCertStatus)
+	authRouter.HandleFunc("/api/proxy/autocert/retry", HandleAutoCertRetry)
 	//Reverse proxy root related APIs
 	authRouter.HandleFunc("/api/proxy/root/listOptions", HandleRootRouteOptionList)
 	authRouter.HandleFunc("/api/proxy/root/updateOptions", HandleRootRouteOptionsUpdate)
@@ -65,7 +67,11 @@ func initAPIs() {
 	//TLS / SSL config
 	authRouter.HandleFunc("/api/cert/tls", handleToggleTLSProxy)
 	authRouter.HandleFunc("/api/cert/tlsRequireLatest", handleSetTlsRequireLatest)
+	authRouter.HandleFunc("/api/cert/tlsPolicy", handleTLSPolicy)
+	authRouter.HandleFunc("/api/cert/tlsPolicy/host/set", handleTLSPolicyHostSet)
+	authRouter.HandleFunc("/api/cert/tlsPolicy/host/remove", handleTLSPolicyHostRemove)
 	authRouter.HandleFunc("/api/cert/upload", handleCertUpload)
+	authRouter.HandleFunc("/api/cert/export", handleCertExport)
 	authRouter.HandleFunc("/api/cert/list", handleListCertificate)
 	authRouter.HandleFunc("/api/cert/listdomains", handleListDomains)
 	authRouter.HandleFunc("/api/cert/checkDefault", handleDefaultCertCheck)
@@ -92,11 +98,43 @@ func initAPIs() {
 	authRouter.HandleFunc("/api/whitelist/ip/remove", handleIpWhitelistRemove)
 	authRouter.HandleFunc("/api/whitelist/enable", handleWhitelistEnable)
 
+	//IP blocklist / allowlist feed APIs
+	authRouter.HandleFunc("/api/ipfeed/list", handleListIpFeeds)
+	authRouter.HandleFunc("/api/ipfeed/add", handleAddIpFeed)
+	authRouter.HandleFunc("/api/ipfeed/import", handleImportIpFeed)
+	authRouter.HandleFunc("/api/ipfeed/remove", handleRemoveIpFeed)
+	authRouter.HandleFunc("/api/ipfeed/refresh", handleRefreshIpFeed)
+
+	//Autoban APIs
+	authRouter.HandleFunc("/api/autoban/list", autobanTracker.HandleListBans)
+	authRouter.HandleFunc("/api/autoban/unban", autobanTracker.HandleUnban)
+	authRouter.HandleFunc("/api/autoban/thresholds/list", autobanTracker.HandleListThresholds)
+	authRouter.HandleFunc("/api/autoban/thresholds/update", autobanTracker.HandleUpdateThreshold)
+
 	//Path Blocker APIs
 	authRouter.HandleFunc("/api/pathrule/add", pathRuleHandler.HandleAddBlockingPath)
 	authRouter.HandleFunc("/api/pathrule/list", pathRuleHandler.HandleListBlockingPath)
 	authRouter.HandleFunc("/api/pathrule/remove", pathRuleHandler.HandleRemoveBlockingPath)
 
+	//Web Application Firewall APIs
+	authRouter.HandleFunc("/api/waf/rules/list", wafEngine.HandleListRules)
+	authRouter.HandleFunc("/api/waf/rules/add", wafEngine.HandleAddRule)
+	authRouter.HandleFunc("/api/waf/rules/remove", wafEngine.HandleRemoveRule)
+	authRouter.HandleFunc("/api/waf/rules/toggle", wafEngine.HandleToggleRule)
+
+	//Access log APIs
+	authRouter.HandleFunc("/api/accesslog/tail", accessLogger.HandleTail)
+	authRouter.HandleFunc("/api/accesslog/search", accessLogger.HandleSearch)
+
+	//Prometheus metrics, scrapers can use bearer token instead of login if set
+	if *metricsListenAddr == "" {
+		if *metricsToken != "" {
+			http.HandleFunc("/metrics", metricsCollector.HandleMetrics)
+		} else {
+			authRouter.HandleFunc("/metrics", metricsCollector.HandleMetrics)
+		}
+	}
+
 	//Statistic & uptime monitoring API
 	authRouter.HandleFunc("/api/stats/summary", statisticCollector.HandleTodayStatLoad)
 	authRouter.HandleFunc("/api/stats/countries", HandleCountryDistrSummary)
@@ -129,6 +167,12 @@ func initAPIs() {
 	authRouter.HandleFunc("/api/tcpprox/config/status", tcpProxyManager.HandleGetProxyStatus)
 	authRouter.HandleFunc("/api/tcpprox/config/validate", tcpProxyManager.HandleConfigValidate)
 
+	//SNI Passthrough
+	authRouter.HandleFunc("/api/sniproxy/route/add", sniProxyManager.HandleAddRoute)
+	authRouter.HandleFunc("/api/sniproxy/route/edit", sniProxyManager.HandleEditRoute)
+	authRouter.HandleFunc("/api/sniproxy/route/list", sniProxyManager.HandleListRoutes)
+	authRouter.HandleFunc("/api/sniproxy/route/delete", sniProxyManager.HandleRemoveRoute)
+
 	//mDNS APIs
 	authRouter.HandleFunc("/api/mdns/list", HandleMdnsListing)
 	authRouter.HandleFunc("/api/mdns/discover", HandleMdnsScanning)
@@ -139,6 +183,27 @@ func initAPIs() {
 	authRouter.HandleFunc("/api/analytic/loadRange", AnalyticLoader.HandleLoadTargetRangeSummary)
 	authRouter.HandleFunc("/api/analytic/exportRange", AnalyticLoader.HandleRangeExport)
 	authRouter.HandleFunc("/api/analytic/resetRange", AnalyticLoader.HandleRangeReset)
+	authRouter.HandleFunc("/api/analytic/listMonthly", AnalyticLoader.HandleMonthlySummaryList)
+	authRouter.HandleFunc("/api/analytic/loadMonth", AnalyticLoader.HandleLoadTargetMonthSummary)
+	authRouter.HandleFunc("/api/analytic/endpoints", AnalyticLoader.HandleEndpointList)
+	authRouter.HandleFunc("/api/analytic/loadEndpointRange", AnalyticLoader.HandleLoadEndpointRangeSummary)
+	authRouter.HandleFunc("/api/analytic/exportEndpointRange", AnalyticLoader.HandleEndpointRangeExport)
+	authRouter.HandleFunc("/api/analytic/query", AnalyticLoader.HandleTimeSeriesQuery)
+
+	//Notification APIs
+	authRouter.HandleFunc("/api/notify/channels/list", notificationManager.HandleListChannels)
+	authRouter.HandleFunc("/api/notify/channels/set", notificationManager.HandleSetChannel)
+	authRouter.HandleFunc("/api/notify/channels/remove", notificationManager.HandleRemoveChannel)
+	authRouter.HandleFunc("/api/notify/channels/test", notificationManager.HandleTestChannel)
+	authRouter.HandleFunc("/api/notify/rules/list", notificationManager.HandleListRules)
+	authRouter.HandleFunc("/api/notify/rules/set", notificationManager.HandleSetRule)
+	authRouter.HandleFunc("/api/notify/rules/remove", notificationManager.HandleRemoveRule)
+	authRouter.HandleFunc("/api/notify/alerts", notificationManager.HandleListAlerts)
+	authRouter.HandleFunc("/api/notify/history", notificationManager.HandleDeliveryHistory)
+
+	//Live request stream
+	authRouter.HandleFunc("/api/stream/ws", liveStreamHub.HandleWebSocket)
+	authRouter.HandleFunc("/api/stream/sse", liveStreamHub.HandleSSE)
 
 	//Network utilities
 	authRouter.HandleFunc("/api/tools/ipscan", HandleIpScan)
@@ -166,11 +231,30 @@ func initAPIs() {
 	authRouter.HandleFunc("/api/acme/autoRenew/listDomains", acmeAutoRenewer.HandleLoadAutoRenewDomains)
 	authRouter.HandleFunc("/api/acme/autoRenew/renewPolicy", acmeAutoRenewer.HandleRenewPolicy)
 	authRouter.HandleFunc("/api/acme/autoRenew/renewNow", acmeAutoRenewer.HandleRenewNow)
+	authRouter.HandleFunc("/api/acme/autoRenew/ca", acmeAutoRenewer.HandleRenewCA)
+	authRouter.HandleFunc("/api/acme/ca/list", acmeHandler.HandleListCA)
+	authRouter.HandleFunc("/api/acme/ca/set", acmeHandler.HandleSetCA)
+	authRouter.HandleFunc("/api/acme/ca/remove", acmeHandler.HandleRemoveCA)
+	authRouter.HandleFunc("/api/acme/accounts/list", acmeHandler.HandleListAccounts)
+	authRouter.HandleFunc("/api/acme/accounts/remove", acmeHandler.HandleRemoveAccount)
+	authRouter.HandleFunc("/api/acme/revoke", AcmeHandleRevokeCertificate)
+	authRouter.HandleFunc("/api/acme/ondemand/config", acmeOnDemandIssuer.HandleConfig)
+	authRouter.HandleFunc("/api/acme/ondemand/status", acmeOnDemandIssuer.HandleStatus)
+	authRouter.HandleFunc("/api/acme/ondemand/clear", acmeOnDemandIssuer.HandleClearFailure)
 	authRouter.HandleFunc("/api/acme/wizard", acmewizard.HandleGuidedStepCheck) //ACME Wizard
 
+	//Private CA
+	authRouter.HandleFunc("/api/pki/status", pkiManager.HandleStatus)
+	authRouter.HandleFunc("/api/pki/config", pkiManager.HandleSetConfig)
+	authRouter.HandleFunc("/api/pki/root", pkiManager.HandleExportRoot)
+	authRouter.HandleFunc("/api/pki/issue", pkiManager.HandleIssue)
+	http.HandleFunc("/pki/acme/", pkiManager.HandleACMEServer("/pki/acme")) //Embedded ACME server, authenticated by ACME accounts
+
 	//Others
 	http.HandleFunc("/api/info/x", HandleZoraxyInfo)
 	authRouter.HandleFunc("/api/info/geoip", HandleGeoIpLookup)
+	authRouter.HandleFunc("/api/geoip/status", HandleGeoIpDatabaseStatus)
+	authRouter.HandleFunc("/api/geoip/reload", HandleGeoIpDatabaseReload)
 	authRouter.HandleFunc("/api/conf/export", ExportConfigAsZip)
 	authRouter.HandleFunc("/api/conf/import", ImportConfigFromZip)
 
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"imuslab.com/zoraxy/mod/acme"
+	"imuslab.com/zoraxy/mod/notify"
+	"imuslab.com/zoraxy/mod/utils"
+)
+
+/*
+	autocert.go
+
+	Obtain certificates for proxy endpoints that has automatic
+	certificate enabled, and add them to the auto renew list.
+	Domains managed by the private CA are issued by it instead
+*/
+
+const (
+	AutoCert_Pending = "pending"
+	AutoCert_Issued  = "issued"
+	AutoCert_Failed  = "failed"
+)
+
+// Certificate issuance status of a proxy endpoint
+type AutoCertStatus struct {
+	Domain     string
+	State      string
+	Error      string
+	UpdateTime int64
+}
+
+var (
+	autoCertStatus      = map[string]*AutoCertStatus{}
+	autoCertStatusMutex sync.Mutex
+)
+
+func setAutoCertStatus(domain string, state string, errMsg string) {
+	autoCertStatusMutex.Lock()
+	defer autoCertStatusMutex.Unlock()
+	autoCertStatus[domain] = &AutoCertStatus{
+		Domain:     domain,
+		State:      state,
+		Error:      errMsg,
+		UpdateTime: time.Now().Unix(),
+	}
+}
+
+// Obtain the certificate of the domain in background if it does not exists yet
+func requestAutoCert(domain string) {
+	domain = strings.ToLower(strings.TrimSpace(domain))
+	if pkiManager.ManagesDomain(domain) {
+		requestPrivateCert(domain)
+		return
+	}
+	if net.ParseIP(domain) != nil || strings.Contains(domain, "*") || !strings.Contains(domain, ".") {
+		setAutoCertStatus(domain, AutoCert_Failed, "certificate can only be obtained for public domain names")
+		return
+	}
+
+	certFile := filepath.Join(tlsCertManager.CertStore, domain+".crt")
+	if utils.FileExists(certFile) {
+		//Certificate already exists, make sure it is renewed
+		acmeAutoRenewer.AddFileToRenew(domain)
+		setAutoCertStatus(domain, AutoCert_Issued, "")
+		return
+	}
+
+	renewerConfig := acmeAutoRenewer.GetRenewerConfig()
+	if renewerConfig.Email == "" {
+		setAutoCertStatus(domain, AutoCert_Failed, "ACME email is not set")
+		return
+	}
+
+	//Pick the challenge that can be answered on the current listening port
+	challenge := ""
+	if dynamicProxyRouter.Option.UseTls && dynamicProxyRouter.Option.Port == 443 {
+		challenge = acme.Challenge_TLSALPN01
+	} else if !dynamicProxyRouter.Option.UseTls && dynamicProxyRouter.Option.Port == 80 {
+		challenge = acme.Challenge_HTTP01
+	} else {
+		setAutoCertStatus(domain, AutoCert_Failed, "automatic certificate requires the reverse proxy listening on port 80 or 443")
+		return
+	}
+
+	autoCertStatusMutex.Lock()
+	if status, ok := autoCertStatus[domain]; ok && status.State == AutoCert_Pending {
+		//Already obtaining the certificate of this domain
+		autoCertStatusMutex.Unlock()
+		return
+	}
+	autoCertStatus[domain] = &AutoCertStatus{
+		Domain:     domain,
+		State:      AutoCert_Pending,
+		UpdateTime: time.Now().Unix(),
+	}
+	autoCertStatusMutex.Unlock()
+
+	go func() {
+		log.Println("[AutoCert] Obtaining certificate for " + domain)
+		_, err := acmeHandler.ObtainCert([]string{domain}, domain, renewerConfig.Email, renewerConfig.CA, renewerConfig.CAUrl, false, &acme.CertOptions{
+			Challenge: challenge,
+		})
+		if err != nil {
+			log.Println("[AutoCert] Unable to obtain certificate for " + domain + ": " + err.Error())
+			setAutoCertStatus(domain, AutoCert_Failed, err.Error())
+			notificationManager.Notify(&notify.Event{
+				Source:   notify.Source_Certificate,
+				Type:     "issue_failed",
+				Key:      domain,
+				Severity: notify.Severity_Warning,
+				Title:    "Unable to obtain certificate for " + domain,
+				Message:  "Automatic certificate issuance for proxy endpoint " + domain + " failed: " + err.Error(),
+				Fields:   map[string]string{"domains": domain},
+			})
+			return
+		}
+
+		acmeAutoRenewer.AddFileToRenew(domain)
+		setAutoCertStatus(domain, AutoCert_Issued, "")
+		log.Println("[AutoCert] Certificate obtained for " + domain)
+	}()
+}
+
+// Issue the certificate of a domain managed by the private CA if it does not
+// exists yet. Issued certificates are rotated by the private CA
+func requestPrivateCert(domain string) {
+	certFile := filepath.Join(tlsCertManager.CertStore, domain+".crt")
+	if certBytes, err := os.ReadFile(certFile); err == nil && pkiManager.IsIssuedByCA(certBytes) {
+		setAutoCertStatus(domain, AutoCert_Issued, "")
+		return
+	}
+
+	err := pkiManager.IssueToStore(domain, []string{domain})
+	if err != nil {
+		log.Println("[AutoCert] Unable to issue private certificate for " + domain + ": " + err.Error())
+		setAutoCertStatus(domain, AutoCert_Failed, err.Error())
+		return
+	}
+	setAutoCertStatus(domain, AutoCert_Issued, "")
+}
+
+// Request certificates for all endpoints with automatic certificate enabled
+// or managed by the private CA
+func checkAutoCertEndpoints() {
+	for domain, endpoint := range dynamicProxyRouter.GetSDProxyEndpointsAsMap() {
+		if endpoint.AutoCert || pkiManager.ManagesDomain(domain) {
+			requestAutoCert(domain)
+		}
+	}
+}
+
+// List the certificate issuance status of endpoints
+func HandleAutoCertStatus(w http.ResponseWriter, r *http.Request) {
+	autoCertStatusMutex.Lock()
+	results := []*AutoCertStatus{}
+	for _, status := range autoCertStatus {
+		results = append(results, status)
+	}
+	autoCertStatusMutex.Unlock()
+
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Domain < results[j].Domain
+	})
+	js, _ := json.Marshal(results)
+	utils.SendJSONResponse(w, string(js))
+}
+
+// Retry the certificate issuance of an endpoint
+func HandleAutoCertRetry(w http.ResponseWriter, r *http.Request) {
+	domain, err := utils.PostPara(r, "domain")
+	if err != nil {
+		utils.SendErrorResponse(w, "domain not defined")
+		return
+	}
+
+	endpoint, err := dynamicProxyRouter.LoadProxy("subd", domain)
+	if err != nil || !(endpoint.AutoCert || pkiManager.ManagesDomain(endpoint.RootOrMatchingDomain)) {
+		utils.SendErrorResponse(w, "automatic certificate is not enabled on this endpoint")
+		return
+	}
+
+	requestAutoCert(endpoint.RootOrMatchingDomain)
+	utils.SendOK(w)
+}
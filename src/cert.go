@@ -10,9 +10,11 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 
+	"imuslab.com/zoraxy/mod/tlscert"
 	"imuslab.com/zoraxy/mod/utils"
 )
 
@@ -32,7 +34,8 @@ func handleDefaultCertCheck(w http.ResponseWriter, r *http.Request) {
 	utils.SendJSONResponse(w, string(js))
 }
 
-// Return a list of domains where the certificates covers
+// Return a list of domains where the certificates covers. With date=true,
+// the metadata of each certificate and the endpoints using it are returned
 func handleListCertificate(w http.ResponseWriter, r *http.Request) {
 	filenames, err := tlsCertManager.ListCertDomains()
 	if err != nil {
@@ -43,54 +46,50 @@ func handleListCertificate(w http.ResponseWriter, r *http.Request) {
 	showDate, _ := utils.GetPara(r, "date")
 	if showDate == "true" {
 		type CertInfo struct {
+			*tlscert.CertInfo
 			Domain           string
 			LastModifiedDate string
 			ExpireDate       string
 			RemainingDays    int
+			UsedBy           []string //Proxy endpoints served with this certificate
 		}
 
-		results := []*CertInfo{}
+		//Resolve which certificate each endpoint is served with
+		usedBy := map[string][]string{}
+		for domain := range dynamicProxyRouter.GetSDProxyEndpointsAsMap() {
+			certName := tlsCertManager.MatchCert(domain)
+			if certName == "" && tlsCertManager.DefaultCertExists() {
+				certName = "default"
+			}
+			if certName != "" {
+				usedBy[certName] = append(usedBy[certName], domain)
+			}
+		}
 
-		for _, filename := range filenames {
-			certFilepath := filepath.Join(tlsCertManager.CertStore, filename+".crt")
-			//keyFilepath := filepath.Join(tlsCertManager.CertStore, filename+".key")
-			fileInfo, err := os.Stat(certFilepath)
-			if err != nil {
-				utils.SendErrorResponse(w, "invalid domain certificate discovered: "+filename)
-				return
+		results := []*CertInfo{}
+		for _, info := range tlsCertManager.ListCertInfo() {
+			endpoints := usedBy[info.Name]
+			if endpoints == nil {
+				endpoints = []string{}
 			}
-			modifiedTime := fileInfo.ModTime().Format("2006-01-02 15:04:05")
+			sort.Strings(endpoints)
 
 			certExpireTime := "Unknown"
-			certBtyes, err := os.ReadFile(certFilepath)
 			expiredIn := 0
-			if err != nil {
-				//Unable to load this file
-				continue
-			} else {
-				//Cert loaded. Check its expire time
-				block, _ := pem.Decode(certBtyes)
-				if block != nil {
-					cert, err := x509.ParseCertificate(block.Bytes)
-					if err == nil {
-						certExpireTime = cert.NotAfter.Format("2006-01-02 15:04:05")
-
-						duration := cert.NotAfter.Sub(time.Now())
-
-						// Convert the duration to days
-						expiredIn = int(duration.Hours() / 24)
-					}
-				}
+			if info.NotAfter > 0 {
+				notAfter := time.Unix(info.NotAfter, 0)
+				certExpireTime = notAfter.Format("2006-01-02 15:04:05")
+				expiredIn = int(time.Until(notAfter).Hours() / 24)
 			}
 
-			thisCertInfo := CertInfo{
-				Domain:           filename,
-				LastModifiedDate: modifiedTime,
+			results = append(results, &CertInfo{
+				CertInfo:         info,
+				Domain:           info.Name,
+				LastModifiedDate: time.Unix(info.LastModified, 0).Format("2006-01-02 15:04:05"),
 				ExpireDate:       certExpireTime,
 				RemainingDays:    expiredIn,
-			}
-
-			results = append(results, &thisCertInfo)
+				UsedBy:           endpoints,
+			})
 		}
 
 		js, _ := json.Marshal(results)
@@ -225,7 +224,117 @@ func handleSetTlsRequireLatest(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// Handle upload of the certificate
+// Split a comma separated parameter into a list of trimmed values
+func splitCommaList(value string) []string {
+	results := []string{}
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			results = append(results, item)
+		}
+	}
+	return results
+}
+
+// Apply and save the TLS policy
+func saveTLSPolicy(policy *tlscert.TLSPolicy) error {
+	err := tlsCertManager.SetPolicy(policy)
+	if err != nil {
+		return err
+	}
+	return sysdb.Write("settings", "tlsPolicy", policy)
+}
+
+// Handle the GET and SET of the TLS security profile, cipher suites and curves
+func handleTLSPolicy(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		cipherSuites, curves, versions := tlscert.SupportedTLSOptions()
+		js, _ := json.Marshal(struct {
+			Policy       *tlscert.TLSPolicy
+			CipherSuites []string
+			Curves       []string
+			Versions     []string
+		}{
+			Policy:       tlsCertManager.GetPolicy(),
+			CipherSuites: cipherSuites,
+			Curves:       curves,
+			Versions:     versions,
+		})
+		utils.SendJSONResponse(w, string(js))
+		return
+	}
+
+	policy := tlsCertManager.GetPolicy()
+	policy.Profile, _ = utils.PostPara(r, "profile")
+	policy.MinVersion = ""
+	policy.CipherSuites = []string{}
+	policy.Curves = []string{}
+	if policy.Profile == tlscert.TLSProfile_Custom {
+		policy.MinVersion, _ = utils.PostPara(r, "minVersion")
+		cipherSuites, _ := utils.PostPara(r, "cipherSuites")
+		policy.CipherSuites = splitCommaList(cipherSuites)
+		curves, _ := utils.PostPara(r, "curves")
+		policy.Curves = splitCommaList(curves)
+	}
+
+	err := saveTLSPolicy(policy)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+	log.Println("[TLS] TLS policy updated")
+	utils.SendOK(w)
+}
+
+// Set the minimum TLS version and ALPN protocols override of a host
+func handleTLSPolicyHostSet(w http.ResponseWriter, r *http.Request) {
+	host, err := utils.PostPara(r, "host")
+	if err != nil || strings.TrimSpace(host) == "" {
+		utils.SendErrorResponse(w, "host not defined")
+		return
+	}
+
+	hostPolicy := tlscert.HostTLSPolicy{}
+	hostPolicy.MinVersion, _ = utils.PostPara(r, "minVersion")
+	alpn, _ := utils.PostPara(r, "alpn")
+	hostPolicy.ALPN = splitCommaList(alpn)
+
+	policy := tlsCertManager.GetPolicy()
+	policy.Hosts[strings.ToLower(strings.TrimSpace(host))] = &hostPolicy
+	err = saveTLSPolicy(policy)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+	utils.SendOK(w)
+}
+
+// Remove the TLS override of a host
+func handleTLSPolicyHostRemove(w http.ResponseWriter, r *http.Request) {
+	host, err := utils.PostPara(r, "host")
+	if err != nil {
+		utils.SendErrorResponse(w, "host not defined")
+		return
+	}
+	host = strings.ToLower(strings.TrimSpace(host))
+
+	policy := tlsCertManager.GetPolicy()
+	if _, ok := policy.Hosts[host]; !ok {
+		utils.SendErrorResponse(w, "no TLS override for this host")
+		return
+	}
+	delete(policy.Hosts, host)
+	err = saveTLSPolicy(policy)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+	utils.SendOK(w)
+}
+
+// Handle upload of the certificate. Supported key types are pub (certificate
+// or full-chain PEM bundle, optionally with the private key), pri (PKCS#1, EC
+// or PKCS#8 private key) and pfx (PKCS#12 archive with optional password)
 func handleCertUpload(w http.ResponseWriter, r *http.Request) {
 	// check if request method is POST
 	if r.Method != "POST" {
@@ -235,9 +344,8 @@ func handleCertUpload(w http.ResponseWriter, r *http.Request) {
 
 	// get the key type
 	keytype, err := utils.GetPara(r, "ktype")
-	overWriteFilename := ""
 	if err != nil {
-		http.Error(w, "Not defined key type (pub / pri)", http.StatusBadRequest)
+		http.Error(w, "Not defined key type (pub / pri / pfx)", http.StatusBadRequest)
 		return
 	}
 
@@ -247,13 +355,12 @@ func handleCertUpload(w http.ResponseWriter, r *http.Request) {
 		//Assume localhost
 		domain = "default"
 	}
+	if strings.ContainsAny(domain, "/\\") || strings.Contains(domain, "..") {
+		http.Error(w, "Invalid domain given", http.StatusBadRequest)
+		return
+	}
 
-	switch keytype {
-	case "pub":
-		overWriteFilename = fmt.Sprintf("%s.crt", domain)
-	case "pri":
-		overWriteFilename = fmt.Sprintf("%s.key", domain)
-	default:
+	if keytype != "pub" && keytype != "pri" && keytype != "pfx" {
 		http.Error(w, fmt.Sprintf("Not supported keytype: %s", keytype), http.StatusBadRequest)
 		return
 	}
@@ -273,24 +380,80 @@ func handleCertUpload(w http.ResponseWriter, r *http.Request) {
 	}
 	defer file.Close()
 
-	// create file in upload directory
+	content, err := io.ReadAll(file)
+	if err != nil {
+		http.Error(w, "Failed to read file", http.StatusBadRequest)
+		return
+	}
+
 	os.MkdirAll("./conf/certs", 0775)
-	f, err := os.Create(filepath.Join("./conf/certs", overWriteFilename))
+	switch keytype {
+	case "pfx":
+		certPEM, keyPEM, err := tlscert.ParsePKCS12(content, r.FormValue("password"))
+		if err != nil {
+			http.Error(w, "Failed to open PFX archive: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = tlsCertManager.ImportKeyPair(domain, certPEM, keyPEM)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	case "pub":
+		certPEM, keyPEM, err := tlscert.SplitPEMBundle(content)
+		if err != nil {
+			http.Error(w, "Invalid certificate: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if keyPEM != nil {
+			//Bundle with private key
+			err = tlsCertManager.ImportKeyPair(domain, certPEM, keyPEM)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		} else {
+			err = os.WriteFile(filepath.Join("./conf/certs", domain+".crt"), content, 0644)
+			if err != nil {
+				http.Error(w, "Failed to save file", http.StatusInternalServerError)
+				return
+			}
+		}
+	case "pri":
+		_, err = tlscert.ParsePrivateKeyPEM(content)
+		if err != nil {
+			http.Error(w, "Invalid private key: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = tlscert.WritePrivateKeyFile(filepath.Join("./conf/certs", domain+".key"), content)
+		if err != nil {
+			http.Error(w, "Failed to save file", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// send response
+	fmt.Fprintln(w, "File upload successful!")
+}
+
+// Export the certificate and private key as a PKCS#12 / PFX archive
+func handleCertExport(w http.ResponseWriter, r *http.Request) {
+	domain, err := utils.PostPara(r, "domain")
 	if err != nil {
-		http.Error(w, "Failed to create file", http.StatusInternalServerError)
+		utils.SendErrorResponse(w, "invalid domain given")
 		return
 	}
-	defer f.Close()
+	password := r.PostFormValue("password")
 
-	// copy file contents to destination file
-	_, err = io.Copy(f, file)
+	pfxData, err := tlsCertManager.ExportPKCS12(domain, password)
 	if err != nil {
-		http.Error(w, "Failed to save file", http.StatusInternalServerError)
+		utils.SendErrorResponse(w, err.Error())
 		return
 	}
 
-	// send response
-	fmt.Fprintln(w, "File upload successful!")
+	w.Header().Set("Content-Type", "application/x-pkcs12")
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+domain+".pfx\"")
+	w.Write(pfxData)
 }
 
 // Handle cert remove
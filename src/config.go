@@ -33,6 +33,11 @@ type Record struct {
 	RequireBasicAuth        bool
 	BasicAuthCredentials    []*dynamicproxy.BasicAuthCredentials
 	BasicAuthExceptionRules []*dynamicproxy.BasicAuthExceptionRule
+	WafMode                 string //WAF mode, empty string for disabled
+	AccessLogFormat         string //Access log format, empty string for default format
+	AutoCert                bool   //Obtain the certificate of the matching domain with ACME automatically
+	HttpsRedirect           string //HTTP to HTTPS redirect mode, empty string for default
+	HSTS                    *dynamicproxy.HSTSPolicy
 }
 
 // Save a reverse proxy config record to file
@@ -113,6 +118,11 @@ func ConvertProxyEndpointToRecord(targetProxyEndpoint *dynamicproxy.ProxyEndpoin
 		RequireBasicAuth:        targetProxyEndpoint.RequireBasicAuth,
 		BasicAuthCredentials:    targetProxyEndpoint.BasicAuthCredentials,
 		BasicAuthExceptionRules: targetProxyEndpoint.BasicAuthExceptionRules,
+		WafMode:                 targetProxyEndpoint.WafMode,
+		AccessLogFormat:         targetProxyEndpoint.AccessLogFormat,
+		AutoCert:                targetProxyEndpoint.AutoCert,
+		HttpsRedirect:           targetProxyEndpoint.HttpsRedirect,
+		HSTS:                    targetProxyEndpoint.HSTS,
 	}
 
 	return &thisProxyConfigRecord, nil
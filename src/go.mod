@@ -5,6 +5,7 @@ go 1.16
 require (
 	github.com/boltdb/bolt v1.3.1
 	github.com/go-acme/lego/v4 v4.14.0
+	github.com/go-jose/go-jose/v3 v3.0.3
 	github.com/go-ping/ping v1.1.0
 	github.com/google/uuid v1.3.1
 	github.com/gorilla/sessions v1.2.1
@@ -13,6 +14,7 @@ require (
 	github.com/likexian/whois v1.15.1
 	github.com/microcosm-cc/bluemonday v1.0.25
 	golang.org/x/net v0.14.0
-	golang.org/x/sys v0.11.0
+	golang.org/x/sys v0.17.0
 	golang.org/x/tools v0.12.0 // indirect
+	software.sslmate.com/src/go-pkcs12 v0.4.0
 )
@@ -12,22 +12,31 @@ import (
 	"time"
 
 	"github.com/google/uuid"
+	"imuslab.com/zoraxy/mod/accesslog"
 	"imuslab.com/zoraxy/mod/acme"
 	"imuslab.com/zoraxy/mod/aroz"
 	"imuslab.com/zoraxy/mod/auth"
+	"imuslab.com/zoraxy/mod/autoban"
 	"imuslab.com/zoraxy/mod/database"
 	"imuslab.com/zoraxy/mod/dynamicproxy/redirection"
+	"imuslab.com/zoraxy/mod/dynamicproxy/waf"
 	"imuslab.com/zoraxy/mod/email"
 	"imuslab.com/zoraxy/mod/ganserv"
 	"imuslab.com/zoraxy/mod/geodb"
+	"imuslab.com/zoraxy/mod/livestream"
 	"imuslab.com/zoraxy/mod/mdns"
+	"imuslab.com/zoraxy/mod/metrics"
 	"imuslab.com/zoraxy/mod/netstat"
+	"imuslab.com/zoraxy/mod/notify"
 	"imuslab.com/zoraxy/mod/pathrule"
+	"imuslab.com/zoraxy/mod/pki"
+	"imuslab.com/zoraxy/mod/sniproxy"
 	"imuslab.com/zoraxy/mod/sshprox"
 	"imuslab.com/zoraxy/mod/statistic"
 	"imuslab.com/zoraxy/mod/statistic/analytic"
 	"imuslab.com/zoraxy/mod/tcpprox"
 	"imuslab.com/zoraxy/mod/tlscert"
+	"imuslab.com/zoraxy/mod/tracing"
 	"imuslab.com/zoraxy/mod/uptime"
 	"imuslab.com/zoraxy/mod/utils"
 )
@@ -41,6 +50,20 @@ var ztAuthToken = flag.String("ztauth", "", "ZeroTier authtoken for the local no
 var ztAPIPort = flag.Int("ztport", 9993, "ZeroTier controller API port")
 var acmeAutoRenewInterval = flag.Int("autorenew", 86400, "ACME auto TLS/SSL certificate renew check interval (seconds)")
 var enableHighSpeedGeoIPLookup = flag.Bool("fastgeoip", false, "Enable high speed geoip lookup, require 1GB extra memory (Not recommend for low end devices)")
+var geoipDatabase = flag.String("geoipdb", "./conf/geodb/country.mmdb", "Path to GeoIP country database in MMDB format, use embedded database if not exists")
+var asnDatabase = flag.String("asndb", "./conf/geodb/asn.mmdb", "Path to ASN database in MMDB format, ASN lookup is disabled if not exists")
+var statsTopKSize = flag.Int("statstopk", 1000, "Number of top IPs, URLs, referers and useragents kept in the daily statistic")
+var statsRetentionDays = flag.Int("statsretention", 0, "Days to keep the daily statistic before rolling up to monthly statistic, 0 to keep forever")
+var statsMonthlyRetention = flag.Int("statsmonthlyretention", 0, "Months to keep the monthly statistic, 0 to keep forever")
+var statsInterval = flag.Int("statsinterval", 3600, "Interval of the statistic time series buckets in seconds, must be a multiple of 60")
+var liveStreamViewers = flag.Int("streamviewers", 16, "Max number of concurrent viewers of the live request stream")
+var metricsListenAddr = flag.String("metrics", "", "Serve Prometheus metrics on a seperate listener, e.g. :9100. Leave empty to serve at /metrics of the management interface")
+var metricsToken = flag.String("metricstoken", "", "Bearer token required to scrape the metrics. If not set, /metrics on the management interface require login")
+var accessLogFormat = flag.String("accesslog", "combined", "Default access log format of proxy endpoints, support combined, json or off")
+var tracingEndpoint = flag.String("tracing", "", "OTLP/HTTP endpoint to export traces of proxied requests, e.g. http://localhost:4318/v1/traces. Leave empty to disable tracing")
+var tracingHeaders = flag.String("tracingheaders", "", "Extra headers sent to the tracing collector, in key=value pairs seperated by comma")
+var tracingSampleRatio = flag.Float64("tracingsample", 1, "Ratio of new traces to be sampled, from 0 to 1")
+var tracingParentBased = flag.Bool("tracingparent", true, "Follow the sampling decision of incoming traceparent header")
 var (
 	name        = "Zoraxy"
 	version     = "2.6.6"
@@ -57,22 +80,33 @@ var (
 	/*
 		Handler Modules
 	*/
-	handler            *aroz.ArozHandler       //Handle arozos managed permission system
-	sysdb              *database.Database      //System database
-	authAgent          *auth.AuthAgent         //Authentication agent
-	tlsCertManager     *tlscert.Manager        //TLS / SSL management
-	redirectTable      *redirection.RuleTable  //Handle special redirection rule sets
-	pathRuleHandler    *pathrule.Handler       //Handle specific path blocking or custom headers
-	geodbStore         *geodb.Store            //GeoIP database, also handle black list and whitelist features
-	netstatBuffers     *netstat.NetStatBuffers //Realtime graph buffers
-	statisticCollector *statistic.Collector    //Collecting statistic from visitors
-	uptimeMonitor      *uptime.Monitor         //Uptime monitor service worker
-	mdnsScanner        *mdns.MDNSHost          //mDNS discovery services
-	ganManager         *ganserv.NetworkManager //Global Area Network Manager
-	webSshManager      *sshprox.Manager        //Web SSH connection service
-	tcpProxyManager    *tcpprox.Manager        //TCP Proxy Manager
-	acmeHandler        *acme.ACMEHandler       //Handler for ACME Certificate renew
-	acmeAutoRenewer    *acme.AutoRenewer       //Handler for ACME auto renew ticking
+	handler             *aroz.ArozHandler       //Handle arozos managed permission system
+	sysdb               *database.Database      //System database
+	authAgent           *auth.AuthAgent         //Authentication agent
+	tlsCertManager      *tlscert.Manager        //TLS / SSL management
+	redirectTable       *redirection.RuleTable  //Handle special redirection rule sets
+	pathRuleHandler     *pathrule.Handler       //Handle specific path blocking or custom headers
+	geodbStore          *geodb.Store            //GeoIP database, also handle black list and whitelist features
+	netstatBuffers      *netstat.NetStatBuffers //Realtime graph buffers
+	statisticCollector  *statistic.Collector    //Collecting statistic from visitors
+	uptimeMonitor       *uptime.Monitor         //Uptime monitor service worker
+	mdnsScanner         *mdns.MDNSHost          //mDNS discovery services
+	ganManager          *ganserv.NetworkManager //Global Area Network Manager
+	webSshManager       *sshprox.Manager        //Web SSH connection service
+	tcpProxyManager     *tcpprox.Manager        //TCP Proxy Manager
+	sniProxyManager     *sniproxy.Manager       //TLS passthrough routing by SNI on the proxy port
+	acmeHandler         *acme.ACMEHandler       //Handler for ACME Certificate renew
+	acmeAutoRenewer     *acme.AutoRenewer       //Handler for ACME auto renew ticking
+	acmeOnDemandIssuer  *acme.OnDemandIssuer    //Issue certificates for unknown domains at TLS handshake
+	pkiManager          *pki.Manager            //Built-in private CA for LAN services
+	wafEngine           *waf.RuleEngine         //Web application firewall rule engine
+	autobanTracker      *autoban.Tracker        //Auto ban abusive clients by their behaviour
+	accessLogger        *accesslog.Logger       //Access log writer for proxy requests
+	metricsCollector    *metrics.Collector      //Prometheus metrics collector
+	requestTracer       *tracing.Tracer         //Distributed tracing exporter, nil if tracing is disabled
+	liveStreamHub       *livestream.Hub         //Live request stream for the admin UI
+	notificationManager *notify.Manager         //Alerting engine that deliver notifications to channels
+	trafficMonitor      *notify.TrafficMonitor  //Traffic anomaly detector for alerting
 
 	//Helper modules
 	EmailSender    *email.Sender        //Email sender that handle email sending
@@ -92,6 +126,17 @@ func SetupCloseHandler() {
 
 func ShutdownSeq() {
 	fmt.Println("- Shutting down " + name)
+	fmt.Println("- Flushing Access Logs")
+	accessLogger.Close()
+	if requestTracer != nil {
+		fmt.Println("- Flushing Traces")
+		requestTracer.Close()
+	}
+	fmt.Println("- Stopping Notification Manager")
+	trafficMonitor.Close()
+	notificationManager.Close()
+	fmt.Println("- Stopping Autoban Tracker")
+	autobanTracker.Close()
 	fmt.Println("- Closing GeoDB ")
 	geodbStore.Close()
 	fmt.Println("- Closing Netstats Listener")
@@ -107,6 +152,8 @@ func ShutdownSeq() {
 	mdnsScanner.Close()
 	fmt.Println("- Closing Certificates Auto Renewer")
 	acmeAutoRenewer.Close()
+	fmt.Println("- Stopping private CA certificate rotation")
+	pkiManager.Close()
 	//Remove the tmp folder
 	fmt.Println("- Cleaning up tmp files")
 	os.RemoveAll("./tmp")
@@ -136,6 +183,11 @@ func main() {
 		os.Exit(0)
 	}
 
+	if *statsInterval < 60 || *statsInterval%60 != 0 {
+		fmt.Println("Invalid statistic interval: -statsinterval must be a multiple of 60 seconds")
+		os.Exit(1)
+	}
+
 	SetupCloseHandler()
 
 	//Read or create the system uuid
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"imuslab.com/zoraxy/mod/metrics"
+	"imuslab.com/zoraxy/mod/tcpprox"
+)
+
+/*
+	Metrics.go
+
+	This script register the metrics of other modules to the
+	Prometheus metrics collector and serve the /metrics endpoint
+*/
+
+// Register the metric sources of system modules
+func registerMetricSources() {
+	metricsCollector.AddSource(func(w *metrics.Writer) {
+		w.Gauge("zoraxy_build_info", "Build information of Zoraxy", 1, "version", version, "node_uuid", nodeUUID)
+		w.Gauge("zoraxy_uptime_seconds", "Number of seconds since Zoraxy started", float64(time.Now().Unix()-bootTime))
+	})
+
+	//Certificate expiry
+	metricsCollector.AddSource(func(w *metrics.Writer) {
+		expiryTimes, err := tlsCertManager.GetCertExpiryTimes()
+		if err != nil {
+			return
+		}
+
+		w.Declare("zoraxy_certificate_expiry_timestamp_seconds", "Expiry time of the certificates in cert store since unix epoch", metrics.Type_Gauge)
+		for domain, expiryTime := range expiryTimes {
+			w.WriteSample("zoraxy_certificate_expiry_timestamp_seconds", float64(expiryTime.Unix()), "domain", domain)
+		}
+	})
+
+	//Uptime monitor state
+	metricsCollector.AddSource(func(w *metrics.Writer) {
+		if uptimeMonitor == nil {
+			return
+		}
+
+		latestRecords := uptimeMonitor.GetLatestRecords()
+		w.Declare("zoraxy_uptime_target_up", "Online state of uptime monitor targets in their last check", metrics.Type_Gauge)
+		for _, record := range latestRecords {
+			online := 0.0
+			if record.Online {
+				online = 1
+			}
+			w.WriteSample("zoraxy_uptime_target_up", online, "id", record.ID, "name", record.Name, "url", record.URL)
+		}
+
+		w.Declare("zoraxy_uptime_target_latency_seconds", "Latency of uptime monitor targets in their last check", metrics.Type_Gauge)
+		for _, record := range latestRecords {
+			w.WriteSample("zoraxy_uptime_target_latency_seconds", float64(record.Latency)/1000, "id", record.ID, "name", record.Name, "url", record.URL)
+		}
+	})
+
+	//Tracing exporter state
+	metricsCollector.AddSource(func(w *metrics.Writer) {
+		if requestTracer == nil {
+			return
+		}
+
+		exported, dropped, failed := requestTracer.GetStats()
+		w.Declare("zoraxy_tracing_spans_total", "Number of sampled spans by export result", metrics.Type_Counter)
+		w.WriteSample("zoraxy_tracing_spans_total", float64(exported), "result", "exported")
+		w.WriteSample("zoraxy_tracing_spans_total", float64(dropped), "result", "dropped")
+		w.WriteSample("zoraxy_tracing_spans_total", float64(failed), "result", "failed")
+	})
+
+	//TCP proxy byte counters
+	metricsCollector.AddSource(func(w *metrics.Writer) {
+		w.Declare("zoraxy_tcpprox_running", "Running state of TCP proxy configs", metrics.Type_Gauge)
+		for _, config := range tcpProxyManager.Configs {
+			running := 0.0
+			if config.IsRunning() {
+				running = 1
+			}
+			w.WriteSample("zoraxy_tcpprox_running", running, "uuid", config.UUID, "name", config.Name)
+		}
+
+		w.Declare("zoraxy_tcpprox_transferred_bytes_total", "Total bytes transferred by TCP proxy configs", metrics.Type_Counter)
+		for _, config := range tcpProxyManager.Configs {
+			aTob, bToa := config.GetTransferredBytes()
+			w.WriteSample("zoraxy_tcpprox_transferred_bytes_total", float64(aTob), "uuid", config.UUID, "name", config.Name, "direction", "a_to_b")
+			w.WriteSample("zoraxy_tcpprox_transferred_bytes_total", float64(bToa), "uuid", config.UUID, "name", config.Name, "direction", "b_to_a")
+		}
+
+		w.Declare("zoraxy_tcpprox_udp_sessions", "Active client sessions of UDP proxy configs", metrics.Type_Gauge)
+		for _, config := range tcpProxyManager.Configs {
+			if config.Mode == tcpprox.ProxyMode_UDPListen || config.Mode == tcpprox.ProxyMode_UDPTransport {
+				w.WriteSample("zoraxy_tcpprox_udp_sessions", float64(config.GetUDPSessionCount()), "uuid", config.UUID, "name", config.Name)
+			}
+		}
+
+		w.Declare("zoraxy_sniproxy_transferred_bytes_total", "Total bytes transferred by SNI passthrough routes", metrics.Type_Counter)
+		for _, route := range sniProxyManager.ListRoutes() {
+			w.WriteSample("zoraxy_sniproxy_transferred_bytes_total", float64(route.AToBTransferredBytes), "uuid", route.UUID, "hostname", route.Hostname, "direction", "a_to_b")
+			w.WriteSample("zoraxy_sniproxy_transferred_bytes_total", float64(route.BToATransferredBytes), "uuid", route.UUID, "hostname", route.Hostname, "direction", "b_to_a")
+		}
+	})
+}
+
+// Serve the metrics endpoint on a seperate listener
+func startMetricsListener(listenAddr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", metricsCollector.HandleMetrics)
+	go func() {
+		log.Println("[Metrics] Serving metrics at " + listenAddr + "/metrics")
+		err := http.ListenAndServe(listenAddr, mux)
+		if err != nil {
+			log.Println("[Metrics] Unable to start metrics listener: " + err.Error())
+		}
+	}()
+}
@@ -0,0 +1,280 @@
+package accesslog
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+	Access Log
+
+	This module writes a structured record of every proxied request
+	into size / time rotated log files in Combined Log Format or JSON.
+	Entries are queued and written in background so logging never
+	blocks the proxy, and the most recent entries are kept in memory
+	for the tail and search APIs
+*/
+
+const (
+	Format_Default  = ""         //Use the default format of the logger
+	Format_Combined = "combined" //Apache / Nginx combined log format with extra fields
+	Format_JSON     = "json"     //One JSON object per line
+	Format_Off      = "off"      //Do not write access log
+)
+
+type Entry struct {
+	Timestamp         time.Time `json:"timestamp"`
+	RequestID         string    `json:"request_id"`
+	ClientIP          string    `json:"client_ip"`
+	Host              string    `json:"host"`
+	Method            string    `json:"method"`
+	URI               string    `json:"uri"`
+	Protocol          string    `json:"protocol"`
+	StatusCode        int       `json:"status"`
+	BytesIn           int64     `json:"bytes_in"`
+	BytesOut          int64     `json:"bytes_out"`
+	Referer           string    `json:"referer"`
+	UserAgent         string    `json:"user_agent"`
+	Upstream          string    `json:"upstream"`            //Upstream address, empty if not proxied
+	UpstreamLatencyMs float64   `json:"upstream_latency_ms"` //Time to first response byte from upstream
+	DurationMs        float64   `json:"duration_ms"`         //Total time used to serve the request
+	TLSVersion        string    `json:"tls_version"`         //Empty for plain http requests
+	Endpoint          string    `json:"endpoint"`            //Matching domain or root of the proxy endpoint
+	ForwardType       string    `json:"forward_type"`
+}
+
+type Options struct {
+	LogFolder      string        //Folder to store the access log files
+	DefaultFormat  string        //Format for endpoints that did not set their own
+	MaxFileSize    int64         //Rotate the log file when it exceed this size in bytes, 0 to disable
+	RotateInterval time.Duration //Rotate the log file after this duration, 0 to disable
+	MaxBackups     int           //Max number of rotated files to keep, 0 to keep all
+	Compress       bool          //Gzip the rotated log files
+	QueueSize      int           //Size of the background write queue
+	RecentSize     int           //Number of recent entries kept in memory for tail and search
+}
+
+type queuedEntry struct {
+	entry  *Entry
+	format string
+}
+
+type Logger struct {
+	dropped uint64 //Number of entries dropped due to full queue, keep first for 64 bit alignment
+	Option  *Options
+
+	queue      chan *queuedEntry
+	writers    map[string]*rotatingFile //Log file writers, one per format
+	done       chan bool
+	closed     bool
+	closeMutex sync.RWMutex
+
+	recent      []*Entry //Ring buffer of recent entries
+	recentNext  int
+	recentFull  bool
+	recentMutex sync.RWMutex
+}
+
+// Check if the given format is valid for endpoint settings
+func IsValidFormat(format string) bool {
+	return format == Format_Default || format == Format_Combined || format == Format_JSON || format == Format_Off
+}
+
+// Create a new access logger
+func NewLogger(option *Options) (*Logger, error) {
+	if option.DefaultFormat != Format_Combined && option.DefaultFormat != Format_JSON && option.DefaultFormat != Format_Off {
+		return nil, errors.New("invalid default access log format")
+	}
+
+	if option.QueueSize <= 0 {
+		option.QueueSize = 4096
+	}
+
+	if option.RecentSize <= 0 {
+		option.RecentSize = 1000
+	}
+
+	err := os.MkdirAll(option.LogFolder, 0775)
+	if err != nil {
+		return nil, err
+	}
+
+	thisLogger := Logger{
+		Option: option,
+		queue:  make(chan *queuedEntry, option.QueueSize),
+		writers: map[string]*rotatingFile{
+			Format_Combined: newRotatingFile(option, "access", ".log"),
+			Format_JSON:     newRotatingFile(option, "access", ".json"),
+		},
+		done:   make(chan bool),
+		recent: make([]*Entry, option.RecentSize),
+	}
+
+	go thisLogger.writeLoop()
+	return &thisLogger, nil
+}
+
+// Log an entry with the given format. The entry is written in background
+// and dropped if the write queue is full
+func (l *Logger) Log(entry *Entry, format string) {
+	if format == Format_Default {
+		format = l.Option.DefaultFormat
+	}
+
+	if format == Format_Off {
+		return
+	}
+
+	l.addRecent(entry)
+
+	l.closeMutex.RLock()
+	defer l.closeMutex.RUnlock()
+	if l.closed {
+		return
+	}
+
+	select {
+	case l.queue <- &queuedEntry{entry: entry, format: format}:
+	default:
+		atomic.AddUint64(&l.dropped, 1)
+	}
+}
+
+// Get the number of entries dropped due to full queue
+func (l *Logger) DroppedCount() uint64 {
+	return atomic.LoadUint64(&l.dropped)
+}
+
+func (l *Logger) writeLoop() {
+	for queued := range l.queue {
+		writer, ok := l.writers[queued.format]
+		if !ok {
+			continue
+		}
+
+		line := FormatEntry(queued.entry, queued.format)
+		err := writer.Write(append(line, '\n'))
+		if err != nil {
+			log.Println("[AccessLog] Unable to write access log: " + err.Error())
+		}
+
+		if len(l.queue) == 0 {
+			//Queue drained. Flush buffered lines to disk
+			for _, w := range l.writers {
+				w.Flush()
+			}
+		}
+	}
+
+	for _, w := range l.writers {
+		w.Close()
+	}
+	l.done <- true
+}
+
+// Flush all the queued entries and close the log files
+func (l *Logger) Close() {
+	l.closeMutex.Lock()
+	if l.closed {
+		l.closeMutex.Unlock()
+		return
+	}
+	l.closed = true
+	close(l.queue)
+	l.closeMutex.Unlock()
+	<-l.done
+}
+
+func (l *Logger) addRecent(entry *Entry) {
+	l.recentMutex.Lock()
+	defer l.recentMutex.Unlock()
+	l.recent[l.recentNext] = entry
+	l.recentNext++
+	if l.recentNext >= len(l.recent) {
+		l.recentNext = 0
+		l.recentFull = true
+	}
+}
+
+// Get the recent entries, oldest first
+func (l *Logger) GetRecentEntries() []*Entry {
+	l.recentMutex.RLock()
+	defer l.recentMutex.RUnlock()
+	results := []*Entry{}
+	if l.recentFull {
+		results = append(results, l.recent[l.recentNext:]...)
+	}
+	results = append(results, l.recent[:l.recentNext]...)
+	return results
+}
+
+/*
+	Formatters
+*/
+
+// Format an entry into a log line without the trailing new line
+func FormatEntry(entry *Entry, format string) []byte {
+	if format == Format_JSON {
+		js, _ := json.Marshal(entry)
+		return js
+	}
+
+	return []byte(formatCombined(entry))
+}
+
+// Format the entry in combined log format, followed by the extra fields
+// Example: 1.2.3.4 - - [19/Oct/2026:17:09:27 +0000] "GET / HTTP/1.1" 200 512 "-" "curl/8.0" host="a.com" upstream="10.0.0.2:80" rt=0.012 ut=0.010 in=0 tls="TLSv1.3" rid="..."
+func formatCombined(entry *Entry) string {
+	var sb strings.Builder
+	sb.WriteString(dashIfEmpty(entry.ClientIP))
+	sb.WriteString(" - - [")
+	sb.WriteString(entry.Timestamp.Format("02/Jan/2006:15:04:05 -0700"))
+	sb.WriteString("] ")
+	sb.WriteString(strconv.Quote(entry.Method + " " + entry.URI + " " + entry.Protocol))
+	sb.WriteString(" ")
+	sb.WriteString(strconv.Itoa(entry.StatusCode))
+	sb.WriteString(" ")
+	sb.WriteString(strconv.FormatInt(entry.BytesOut, 10))
+	sb.WriteString(" ")
+	sb.WriteString(strconv.Quote(dashIfEmpty(entry.Referer)))
+	sb.WriteString(" ")
+	sb.WriteString(strconv.Quote(dashIfEmpty(entry.UserAgent)))
+	sb.WriteString(" host=" + strconv.Quote(entry.Host))
+	sb.WriteString(" upstream=" + strconv.Quote(dashIfEmpty(entry.Upstream)))
+	sb.WriteString(" rt=" + strconv.FormatFloat(entry.DurationMs/1000, 'f', 3, 64))
+	sb.WriteString(" ut=" + strconv.FormatFloat(entry.UpstreamLatencyMs/1000, 'f', 3, 64))
+	sb.WriteString(" in=" + strconv.FormatInt(entry.BytesIn, 10))
+	sb.WriteString(" tls=" + strconv.Quote(dashIfEmpty(entry.TLSVersion)))
+	sb.WriteString(" rid=" + strconv.Quote(entry.RequestID))
+	return sb.String()
+}
+
+func dashIfEmpty(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+// Get the name of a TLS version, e.g. TLSv1.3
+func TLSVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "TLSv1.0"
+	case tls.VersionTLS11:
+		return "TLSv1.1"
+	case tls.VersionTLS12:
+		return "TLSv1.2"
+	case tls.VersionTLS13:
+		return "TLSv1.3"
+	}
+	return "0x" + strconv.FormatUint(uint64(version), 16)
+}
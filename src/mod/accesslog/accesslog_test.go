@@ -0,0 +1,125 @@
+package accesslog_test
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"imuslab.com/zoraxy/mod/accesslog"
+)
+
+func newTestEntry(uri string, status int) *accesslog.Entry {
+	return &accesslog.Entry{
+		Timestamp:         time.Date(2026, 10, 19, 17, 9, 27, 0, time.UTC),
+		RequestID:         "abc123",
+		ClientIP:          "203.0.113.7",
+		Host:              "example.com",
+		Method:            "GET",
+		URI:               uri,
+		Protocol:          "HTTP/1.1",
+		StatusCode:        status,
+		BytesOut:          512,
+		UserAgent:         "curl/8.0",
+		Upstream:          "10.0.0.2:80",
+		UpstreamLatencyMs: 12,
+		DurationMs:        15,
+		TLSVersion:        "TLSv1.3",
+	}
+}
+
+func TestFormatEntry(t *testing.T) {
+	entry := newTestEntry("/index.html", 200)
+
+	combined := string(accesslog.FormatEntry(entry, accesslog.Format_Combined))
+	expectedPrefix := `203.0.113.7 - - [19/Oct/2026:17:09:27 +0000] "GET /index.html HTTP/1.1" 200 512 "-" "curl/8.0" host="example.com" upstream="10.0.0.2:80" rt=0.015 ut=0.012`
+	if !strings.HasPrefix(combined, expectedPrefix) {
+		t.Errorf("unexpected combined log line: %s", combined)
+	}
+
+	parsed := accesslog.Entry{}
+	err := json.Unmarshal(accesslog.FormatEntry(entry, accesslog.Format_JSON), &parsed)
+	if err != nil {
+		t.Fatalf("invalid json log line: %v", err)
+	}
+	if parsed.RequestID != "abc123" || parsed.StatusCode != 200 || parsed.TLSVersion != "TLSv1.3" {
+		t.Errorf("unexpected json log entry: %+v", parsed)
+	}
+}
+
+func TestRotationAndSearch(t *testing.T) {
+	logFolder := t.TempDir()
+	logger, err := accesslog.NewLogger(&accesslog.Options{
+		LogFolder:     logFolder,
+		DefaultFormat: accesslog.Format_JSON,
+		MaxFileSize:   1024,
+		MaxBackups:    2,
+		Compress:      true,
+	})
+	if err != nil {
+		t.Fatalf("error creating logger: %v", err)
+	}
+
+	for i := 0; i < 20; i++ {
+		status := 200
+		if i%5 == 0 {
+			status = 404
+		}
+		logger.Log(newTestEntry("/page/"+string(rune('a'+i)), status), accesslog.Format_Default)
+	}
+	logger.Log(newTestEntry("/combined", 200), accesslog.Format_Combined)
+	logger.Log(newTestEntry("/off", 200), accesslog.Format_Off)
+	logger.Close()
+
+	if _, err := os.Stat(filepath.Join(logFolder, "access.json")); err != nil {
+		t.Errorf("expected current json log to exist: %v", err)
+	}
+
+	content, err := os.ReadFile(filepath.Join(logFolder, "access.log"))
+	if err != nil || !strings.Contains(string(content), "/combined") {
+		t.Errorf("expected combined format entry in access.log")
+	}
+
+	//Wait for background compression and cleanup
+	time.Sleep(200 * time.Millisecond)
+	backups, _ := filepath.Glob(filepath.Join(logFolder, "access-*.json.gz"))
+	if len(backups) != 2 {
+		t.Fatalf("expected 2 compressed backups, got %d", len(backups))
+	}
+	uncompressed, _ := filepath.Glob(filepath.Join(logFolder, "access-*.json"))
+	if len(uncompressed) != 0 {
+		t.Errorf("expected all backups to be compressed, got %v", uncompressed)
+	}
+
+	f, err := os.Open(backups[0])
+	if err != nil {
+		t.Fatalf("error opening backup: %v", err)
+	}
+	defer f.Close()
+	gzipReader, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("invalid gzip backup: %v", err)
+	}
+	decompressed, _ := io.ReadAll(gzipReader)
+	if !strings.Contains(string(decompressed), "\"request_id\":\"abc123\"") {
+		t.Errorf("unexpected backup content")
+	}
+
+	notFound := logger.Search(&accesslog.SearchFilter{StatusCode: 404})
+	if len(notFound) != 4 {
+		t.Errorf("expected 4 entries with status 404, got %d", len(notFound))
+	}
+
+	tail := logger.Search(&accesslog.SearchFilter{Limit: 1})
+	if len(tail) != 1 || tail[0].URI != "/combined" {
+		t.Errorf("expected newest entry first in tail results")
+	}
+
+	if len(logger.Search(&accesslog.SearchFilter{Keyword: "/off"})) != 0 {
+		t.Errorf("entries with log format off should not be recorded")
+	}
+}
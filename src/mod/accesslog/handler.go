@@ -0,0 +1,131 @@
+package accesslog
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"imuslab.com/zoraxy/mod/utils"
+)
+
+/*
+	Handler.go
+
+	Handlers for tailing and searching the recent access log entries
+*/
+
+const defaultResultLimit = 100
+
+// Search filter for recent entries, empty fields match everything
+type SearchFilter struct {
+	ClientIP   string //Exact match of client ip
+	Host       string //Substring match of host
+	Method     string //Exact match of method, case insensitive
+	StatusCode int    //Exact match of status code, 0 for any
+	Keyword    string //Substring match of uri, user agent, upstream or request id
+	Since      int64  //Unix timestamp, only return entries after this time
+	Limit      int    //Max number of results, newest first
+}
+
+func (f *SearchFilter) match(entry *Entry) bool {
+	if f.ClientIP != "" && entry.ClientIP != f.ClientIP {
+		return false
+	}
+
+	if f.Host != "" && !strings.Contains(entry.Host, f.Host) {
+		return false
+	}
+
+	if f.Method != "" && !strings.EqualFold(entry.Method, f.Method) {
+		return false
+	}
+
+	if f.StatusCode != 0 && entry.StatusCode != f.StatusCode {
+		return false
+	}
+
+	if f.Since > 0 && entry.Timestamp.Before(time.Unix(f.Since, 0)) {
+		return false
+	}
+
+	if f.Keyword != "" {
+		if !strings.Contains(entry.URI, f.Keyword) &&
+			!strings.Contains(entry.UserAgent, f.Keyword) &&
+			!strings.Contains(entry.Upstream, f.Keyword) &&
+			entry.RequestID != f.Keyword {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Search the recent entries with the given filter, newest first
+func (l *Logger) Search(filter *SearchFilter) []*Entry {
+	if filter.Limit <= 0 {
+		filter.Limit = defaultResultLimit
+	}
+
+	results := []*Entry{}
+	entries := l.GetRecentEntries()
+	for i := len(entries) - 1; i >= 0 && len(results) < filter.Limit; i-- {
+		if filter.match(entries[i]) {
+			results = append(results, entries[i])
+		}
+	}
+	return results
+}
+
+// Return the last n entries, newest first
+func (l *Logger) HandleTail(w http.ResponseWriter, r *http.Request) {
+	limit := defaultResultLimit
+	n, err := utils.GetPara(r, "n")
+	if err == nil {
+		limit, err = strconv.Atoi(n)
+		if err != nil || limit <= 0 {
+			utils.SendErrorResponse(w, "invalid n given")
+			return
+		}
+	}
+
+	js, _ := json.Marshal(l.Search(&SearchFilter{Limit: limit}))
+	utils.SendJSONResponse(w, string(js))
+}
+
+// Search the recent entries by ip, host, method, status, keyword and time
+func (l *Logger) HandleSearch(w http.ResponseWriter, r *http.Request) {
+	filter := SearchFilter{}
+	filter.ClientIP, _ = utils.GetPara(r, "ip")
+	filter.Host, _ = utils.GetPara(r, "host")
+	filter.Method, _ = utils.GetPara(r, "method")
+	filter.Keyword, _ = utils.GetPara(r, "keyword")
+
+	if status, err := utils.GetPara(r, "status"); err == nil {
+		filter.StatusCode, err = strconv.Atoi(status)
+		if err != nil {
+			utils.SendErrorResponse(w, "invalid status given")
+			return
+		}
+	}
+
+	if since, err := utils.GetPara(r, "since"); err == nil {
+		filter.Since, err = utils.StringToInt64(since)
+		if err != nil {
+			utils.SendErrorResponse(w, "invalid since given")
+			return
+		}
+	}
+
+	if limit, err := utils.GetPara(r, "limit"); err == nil {
+		filter.Limit, err = strconv.Atoi(limit)
+		if err != nil {
+			utils.SendErrorResponse(w, "invalid limit given")
+			return
+		}
+	}
+
+	js, _ := json.Marshal(l.Search(&filter))
+	utils.SendJSONResponse(w, string(js))
+}
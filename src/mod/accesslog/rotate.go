@@ -0,0 +1,217 @@
+package accesslog
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"imuslab.com/zoraxy/mod/utils"
+)
+
+/*
+	rotate.go
+
+	Size and time based rotating log file. When rotation is due,
+	the current file is renamed with a timestamp suffix and optionally
+	gzip compressed in background. Old rotated files are removed
+	when the number of backups exceed the limit, after the compression
+	of the rotated file is done
+*/
+
+type rotatingFile struct {
+	option    *Options
+	prefix    string //File name prefix, e.g. access
+	extension string //File extension, e.g. .log
+
+	file     *os.File
+	writer   *bufio.Writer
+	size     int64
+	openedAt time.Time
+
+	maintainMutex sync.Mutex //Only one rotated file is compressed and cleaned up at a time
+}
+
+func newRotatingFile(option *Options, prefix string, extension string) *rotatingFile {
+	return &rotatingFile{
+		option:    option,
+		prefix:    prefix,
+		extension: extension,
+	}
+}
+
+func (f *rotatingFile) filename() string {
+	return filepath.Join(f.option.LogFolder, f.prefix+f.extension)
+}
+
+// Open the current log file for append, lazily on first write
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.filename(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0664)
+	if err != nil {
+		return err
+	}
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	f.file = file
+	f.writer = bufio.NewWriterSize(file, 64*1024)
+	f.size = fileInfo.Size()
+	f.openedAt = time.Now()
+	if f.size > 0 {
+		//Continue from an existing file, count its age from its last write
+		f.openedAt = fileInfo.ModTime()
+	}
+	return nil
+}
+
+func (f *rotatingFile) Write(line []byte) error {
+	if f.file == nil {
+		if err := f.open(); err != nil {
+			return err
+		}
+	}
+
+	if f.rotationDue(int64(len(line))) {
+		if err := f.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := f.writer.Write(line)
+	f.size += int64(n)
+	return err
+}
+
+func (f *rotatingFile) rotationDue(nextWriteSize int64) bool {
+	if f.size == 0 {
+		return false
+	}
+
+	if f.option.MaxFileSize > 0 && f.size+nextWriteSize > f.option.MaxFileSize {
+		return true
+	}
+
+	if f.option.RotateInterval > 0 && time.Since(f.openedAt) >= f.option.RotateInterval {
+		return true
+	}
+
+	return false
+}
+
+// Rotate the current file and open a new one
+func (f *rotatingFile) rotate() error {
+	f.Close()
+
+	timestamp := time.Now().Format("2006-01-02T15-04-05.000")
+	rotatedName := filepath.Join(f.option.LogFolder, f.prefix+"-"+timestamp+f.extension)
+	for i := 1; utils.FileExists(rotatedName) || utils.FileExists(rotatedName+".gz"); i++ {
+		//Rotated more than once within the same millisecond
+		rotatedName = filepath.Join(f.option.LogFolder, f.prefix+"-"+timestamp+"-"+strconv.Itoa(i)+f.extension)
+	}
+	err := os.Rename(f.filename(), rotatedName)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		f.maintainMutex.Lock()
+		defer f.maintainMutex.Unlock()
+		if f.option.Compress {
+			err := compressFile(rotatedName)
+			if err != nil {
+				log.Println("[AccessLog] Unable to compress rotated log: " + err.Error())
+			}
+		}
+		f.removeOldBackups()
+	}()
+
+	return f.open()
+}
+
+// Gzip the given file and remove the original
+func compressFile(filename string) error {
+	src, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(filename+".gz", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0664)
+	if err != nil {
+		return err
+	}
+
+	gzipWriter := gzip.NewWriter(dst)
+	_, err = io.Copy(gzipWriter, src)
+	if err == nil {
+		err = gzipWriter.Close()
+	}
+	dst.Close()
+	if err != nil {
+		os.Remove(filename + ".gz")
+		return err
+	}
+
+	src.Close()
+	return os.Remove(filename)
+}
+
+// Remove the oldest rotated files if the backup count exceed the limit
+func (f *rotatingFile) removeOldBackups() {
+	if f.option.MaxBackups <= 0 {
+		return
+	}
+
+	backups, err := f.listBackups()
+	if err != nil || len(backups) <= f.option.MaxBackups {
+		return
+	}
+
+	for _, backup := range backups[:len(backups)-f.option.MaxBackups] {
+		os.Remove(backup)
+	}
+}
+
+// List the rotated files of this log, oldest first
+func (f *rotatingFile) listBackups() ([]string, error) {
+	plain, err := filepath.Glob(filepath.Join(f.option.LogFolder, f.prefix+"-*"+f.extension))
+	if err != nil {
+		return nil, err
+	}
+
+	compressed, err := filepath.Glob(filepath.Join(f.option.LogFolder, f.prefix+"-*"+f.extension+".gz"))
+	if err != nil {
+		return nil, err
+	}
+
+	//Timestamp in file name keeps them sortable
+	backups := append(plain, compressed...)
+	sort.Strings(backups)
+	return backups, nil
+}
+
+func (f *rotatingFile) Flush() {
+	if f.writer != nil {
+		f.writer.Flush()
+	}
+}
+
+func (f *rotatingFile) Close() {
+	if f.file == nil {
+		return
+	}
+	f.writer.Flush()
+	f.file.Close()
+	f.file = nil
+	f.writer = nil
+}
@@ -0,0 +1,279 @@
+package acme
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-acme/lego/v4/certcrypto"
+	"github.com/go-acme/lego/v4/lego"
+	"github.com/go-acme/lego/v4/registration"
+	"imuslab.com/zoraxy/mod/utils"
+)
+
+/*
+	Account.go
+
+	ACME accounts are persisted per CA directory and email, so the
+	same account key and registration is reused for every certificate
+	instead of registering a new account on each request. Account
+	keys are encrypted with the CA store secret key
+*/
+
+// Account entry written to the database
+type storedAccount struct {
+	Email        string
+	DirectoryURL string
+	EncryptedKey string //PEM encoded account private key, encrypted
+	Registration *registration.Resource
+	CreatedAt    int64
+}
+
+// Account information returned to the UI
+type AccountInfo struct {
+	Email        string
+	DirectoryURL string
+	AccountURI   string
+	CreatedAt    int64
+}
+
+func accountDatabaseKey(directoryURL string, email string) string {
+	hash := sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(email)) + "|" + strings.TrimSuffix(directoryURL, "/")))
+	return "account/" + hex.EncodeToString(hash[:])
+}
+
+// Load the account of the email registered at the given CA directory
+func (s *CAStore) LoadAccount(directoryURL string, email string) (*ACMEUser, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	key := accountDatabaseKey(directoryURL, email)
+	if !s.database.KeyExists("acme", key) {
+		return nil, errors.New("account not found")
+	}
+
+	account := storedAccount{}
+	err := s.database.Read("acme", key, &account)
+	if err != nil {
+		return nil, err
+	}
+
+	keyPEM, err := s.decrypt(account.EncryptedKey)
+	if err != nil {
+		return nil, err
+	}
+	privateKey, err := certcrypto.ParsePEMPrivateKey([]byte(keyPEM))
+	if err != nil {
+		return nil, err
+	}
+
+	return &ACMEUser{
+		Email:        account.Email,
+		Registration: account.Registration,
+		key:          privateKey,
+	}, nil
+}
+
+// Save the registered account for the given CA directory
+func (s *CAStore) SaveAccount(directoryURL string, user *ACMEUser) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	encryptedKey, err := s.encrypt(string(certcrypto.PEMEncode(user.key)))
+	if err != nil {
+		return err
+	}
+
+	return s.database.Write("acme", accountDatabaseKey(directoryURL, user.Email), storedAccount{
+		Email:        user.Email,
+		DirectoryURL: directoryURL,
+		EncryptedKey: encryptedKey,
+		Registration: user.Registration,
+		CreatedAt:    time.Now().Unix(),
+	})
+}
+
+// Remove the saved account. The account is not deactivated at the CA
+func (s *CAStore) RemoveAccount(directoryURL string, email string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	key := accountDatabaseKey(directoryURL, email)
+	if !s.database.KeyExists("acme", key) {
+		return errors.New("account not found")
+	}
+	return s.database.Delete("acme", key)
+}
+
+// List the saved accounts
+func (s *CAStore) ListAccounts() []*AccountInfo {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	results := []*AccountInfo{}
+	entries, err := s.database.ListTable("acme")
+	if err != nil {
+		return results
+	}
+	for _, keypairs := range entries {
+		if !strings.HasPrefix(string(keypairs[0]), "account/") {
+			continue
+		}
+		account := storedAccount{}
+		if json.Unmarshal(keypairs[1], &account) != nil {
+			continue
+		}
+		info := AccountInfo{
+			Email:        account.Email,
+			DirectoryURL: account.DirectoryURL,
+			CreatedAt:    account.CreatedAt,
+		}
+		if account.Registration != nil {
+			info.AccountURI = account.Registration.URI
+		}
+		results = append(results, &info)
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].CreatedAt < results[j].CreatedAt
+	})
+	return results
+}
+
+// Create an ACME client of the given CA with the saved account of the email.
+// A new account is registered and saved if there is no usable account
+func (a *ACMEHandler) getACMEClient(email string, caConfig *CAConfig, keyType certcrypto.KeyType) (*lego.Client, error) {
+	var user *ACMEUser
+	if a.CAStore != nil {
+		savedUser, err := a.CAStore.LoadAccount(caConfig.DirectoryURL, email)
+		if err == nil {
+			user = savedUser
+		}
+	}
+
+	if user == nil {
+		// generate private key for the new account
+		privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		user = NewACMEUser(email, privateKey)
+	}
+
+	client, err := a.newLegoClient(user, caConfig, keyType)
+	if err != nil {
+		return nil, err
+	}
+
+	if user.Registration != nil {
+		// check if the saved account is still valid at the CA
+		_, err := client.Registration.QueryRegistration()
+		if err == nil {
+			return client, nil
+		}
+		log.Println("[ACME] Saved account is no longer valid, registering a new account: " + err.Error())
+		user.Registration = nil
+		client, err = a.newLegoClient(user, caConfig, keyType)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// New users will need to register, with external account binding if the CA requires it
+	var reg *registration.Resource
+	if caConfig.EABKeyID != "" {
+		log.Println("[INFO] Registering ACME account with external account binding " + caConfig.EABKeyID)
+		reg, err = client.Registration.RegisterWithExternalAccountBinding(registration.RegisterEABOptions{
+			TermsOfServiceAgreed: true,
+			Kid:                  caConfig.EABKeyID,
+			HmacEncoded:          caConfig.EABHmacKey,
+		})
+	} else {
+		reg, err = client.Registration.Register(registration.RegisterOptions{TermsOfServiceAgreed: true})
+	}
+	if err != nil {
+		return nil, err
+	}
+	user.Registration = reg
+
+	if a.CAStore != nil {
+		err = a.CAStore.SaveAccount(caConfig.DirectoryURL, user)
+		if err != nil {
+			log.Println("[ACME] Unable to save ACME account: " + err.Error())
+		}
+	}
+
+	return client, nil
+}
+
+// Create a lego client for the user with the CA directory and TLS settings
+func (a *ACMEHandler) newLegoClient(user registration.User, caConfig *CAConfig, keyType certcrypto.KeyType) (*lego.Client, error) {
+	config := lego.NewConfig(user)
+	config.CADirURL = caConfig.DirectoryURL
+	config.Certificate.KeyType = keyType
+	if caConfig.SkipTLS || caConfig.RootCAs != "" {
+		transport, err := createCATransport(caConfig)
+		if err != nil {
+			return nil, err
+		}
+		config.HTTPClient.Transport = transport
+	}
+	return lego.NewClient(config)
+}
+
+// Signer of revocation requests using the certificate private key instead of an account
+type certKeyUser struct {
+	key crypto.PrivateKey
+}
+
+func (u *certKeyUser) GetEmail() string                        { return "" }
+func (u *certKeyUser) GetRegistration() *registration.Resource { return nil }
+func (u *certKeyUser) GetPrivateKey() crypto.PrivateKey        { return u.key }
+
+// List the saved ACME accounts
+func (a *ACMEHandler) HandleListAccounts(w http.ResponseWriter, r *http.Request) {
+	results := []*AccountInfo{}
+	if a.CAStore != nil {
+		results = a.CAStore.ListAccounts()
+	}
+	js, _ := json.Marshal(results)
+	utils.SendJSONResponse(w, string(js))
+}
+
+// Remove a saved ACME account, a new account will be registered on next request
+func (a *ACMEHandler) HandleRemoveAccount(w http.ResponseWriter, r *http.Request) {
+	if a.CAStore == nil {
+		utils.SendErrorResponse(w, "CA store not available")
+		return
+	}
+
+	directoryURL, err := utils.PostPara(r, "url")
+	if err != nil {
+		utils.SendErrorResponse(w, "directory url not set")
+		return
+	}
+
+	email, err := utils.PostPara(r, "email")
+	if err != nil {
+		utils.SendErrorResponse(w, "email not set")
+		return
+	}
+
+	err = a.CAStore.RemoveAccount(directoryURL, email)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+
+	utils.SendOK(w)
+}
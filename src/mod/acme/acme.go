@@ -2,13 +2,10 @@ package acme
 
 import (
 	"crypto"
-	"crypto/ecdsa"
-	"crypto/elliptic"
-	"crypto/rand"
-	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"log"
 	"net"
@@ -22,15 +19,48 @@ import (
 	"github.com/go-acme/lego/v4/certcrypto"
 	"github.com/go-acme/lego/v4/certificate"
 	"github.com/go-acme/lego/v4/challenge/http01"
-	"github.com/go-acme/lego/v4/lego"
 	"github.com/go-acme/lego/v4/registration"
 	"imuslab.com/zoraxy/mod/utils"
 )
 
 type CertificateInfoJSON struct {
-	AcmeName string `json:"acme_name"`
-	AcmeUrl  string `json:"acme_url"`
-	SkipTLS  bool   `json:"skip_tls"`
+	AcmeName       string `json:"acme_name"`
+	AcmeUrl        string `json:"acme_url"`
+	SkipTLS        bool   `json:"skip_tls"`
+	Email          string `json:"email,omitempty"`
+	KeyType        string `json:"key_type,omitempty"`
+	MustStaple     bool   `json:"must_staple,omitempty"`
+	PreferredChain string `json:"preferred_chain,omitempty"`
+	Challenge      string `json:"challenge,omitempty"`
+}
+
+// Supported certificate key types
+const (
+	KeyType_RSA2048 = "rsa2048"
+	KeyType_RSA4096 = "rsa4096"
+	KeyType_EC256   = "ec256"
+	KeyType_EC384   = "ec384"
+)
+
+var keyTypes = map[string]certcrypto.KeyType{
+	KeyType_RSA2048: certcrypto.RSA2048,
+	KeyType_RSA4096: certcrypto.RSA4096,
+	KeyType_EC256:   certcrypto.EC256,
+	KeyType_EC384:   certcrypto.EC384,
+}
+
+// Per certificate options of an obtain request
+type CertOptions struct {
+	KeyType        string //One of the KeyType_* constants, default to RSA 2048
+	MustStaple     bool   //Add the OCSP must-staple extension to the certificate
+	PreferredChain string //Common name of the preferred root CA of the issued chain
+	Challenge      string //One of the Challenge_* constants, default to HTTP-01
+}
+
+// Check if the key type is supported. Empty key type use the default
+func IsValidKeyType(keyType string) bool {
+	_, ok := keyTypes[keyType]
+	return ok || keyType == ""
 }
 
 // ACMEUser represents a user in the ACME system.
@@ -40,6 +70,14 @@ type ACMEUser struct {
 	key          crypto.PrivateKey
 }
 
+// NewACMEUser creates an unregistered ACME user with the given account key.
+func NewACMEUser(email string, key crypto.PrivateKey) *ACMEUser {
+	return &ACMEUser{
+		Email: email,
+		key:   key,
+	}
+}
+
 // GetEmail returns the email of the ACMEUser.
 func (u *ACMEUser) GetEmail() string {
 	return u.Email
@@ -59,101 +97,69 @@ func (u *ACMEUser) GetPrivateKey() crypto.PrivateKey {
 type ACMEHandler struct {
 	DefaultAcmeServer string
 	Port              string
+	CAStore           *CAStore           //User defined CAs and EAB credentials, can be nil
+	ChallengeStore    ChallengeCertStore //Serve TLS-ALPN-01 challenge certificates, can be nil
 }
 
 // NewACME creates a new ACMEHandler instance.
-func NewACME(acmeServer string, port string) *ACMEHandler {
+func NewACME(acmeServer string, port string, caStore *CAStore, challengeStore ChallengeCertStore) *ACMEHandler {
 	return &ACMEHandler{
 		DefaultAcmeServer: acmeServer,
 		Port:              port,
+		CAStore:           caStore,
+		ChallengeStore:    challengeStore,
 	}
 }
 
 // ObtainCert obtains a certificate for the specified domains.
-func (a *ACMEHandler) ObtainCert(domains []string, certificateName string, email string, caName string, caUrl string, skipTLS bool) (bool, error) {
+// The ACME account of the email is reused if it was registered at the same CA before
+func (a *ACMEHandler) ObtainCert(domains []string, certificateName string, email string, caName string, caUrl string, skipTLS bool, options *CertOptions) (bool, error) {
 	log.Println("[ACME] Obtaining certificate...")
 
-	// generate private key
-	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
-	if err != nil {
-		log.Println(err)
-		return false, err
+	if options == nil {
+		options = &CertOptions{}
 	}
-
-	// create a admin user for our new generation
-	adminUser := ACMEUser{
-		Email: email,
-		key:   privateKey,
-	}
-
-	// create config
-	config := lego.NewConfig(&adminUser)
-
-	// skip TLS verify if need
-	// Ref: https://github.com/go-acme/lego/blob/6af2c756ac73a9cb401621afca722d0f4112b1b8/lego/client_config.go#L74
-	if skipTLS {
-		log.Println("[INFO] Ignore TLS/SSL Verification Error for ACME Server")
-		config.HTTPClient.Transport = &http.Transport{
-			Proxy: http.ProxyFromEnvironment,
-			DialContext: (&net.Dialer{
-				Timeout:   30 * time.Second,
-				KeepAlive: 30 * time.Second,
-			}).DialContext,
-			TLSHandshakeTimeout:   30 * time.Second,
-			ResponseHeaderTimeout: 30 * time.Second,
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: true,
-			},
-		}
+	if !IsValidKeyType(options.KeyType) {
+		return false, errors.New("unsupported key type " + options.KeyType)
 	}
-
-	// setup the custom ACME url endpoint.
-	if caUrl != "" {
-		config.CADirURL = caUrl
+	if !IsValidChallenge(options.Challenge) {
+		return false, errors.New("unsupported challenge type " + options.Challenge)
 	}
-
-	// if not custom ACME url, load it from ca.json
-	if caName == "custom" {
-		log.Printf("[INFO] Using Custom ACME %s for CA Directory URL\n", caUrl)
-	} else {
-		caLinkOverwrite, err := loadCAApiServerFromName(caName)
-		if err == nil {
-			config.CADirURL = caLinkOverwrite
-			log.Printf("[INFO] Using %s for CA Directory URL\n", caLinkOverwrite)
-		} else {
-			// (caName == "" || caUrl == "") will use default acme
-			config.CADirURL = a.DefaultAcmeServer
-			log.Printf("[INFO] Using Default ACME %s for CA Directory URL\n", a.DefaultAcmeServer)
-		}
+	if options.Challenge == Challenge_TLSALPN01 && a.ChallengeStore == nil {
+		return false, errors.New("TLS-ALPN-01 challenge is not available")
+	}
+	keyType := certcrypto.RSA2048
+	if options.KeyType != "" {
+		keyType = keyTypes[options.KeyType]
 	}
 
-	config.Certificate.KeyType = certcrypto.RSA2048
+	// resolve the CA directory, EAB credentials and TLS settings
+	caConfig := a.resolveCA(caName, caUrl, skipTLS)
 
-	client, err := lego.NewClient(config)
+	// load or register the ACME account
+	client, err := a.getACMEClient(email, caConfig, keyType)
 	if err != nil {
 		log.Println(err)
 		return false, err
 	}
 
 	// setup how to receive challenge
-	err = client.Challenge.SetHTTP01Provider(http01.NewProviderServer("", a.Port))
-	if err != nil {
-		log.Println(err)
-		return false, err
+	if options.Challenge == Challenge_TLSALPN01 {
+		err = client.Challenge.SetTLSALPN01Provider(&tlsALPNProvider{store: a.ChallengeStore})
+	} else {
+		err = client.Challenge.SetHTTP01Provider(http01.NewProviderServer("", a.Port))
 	}
-
-	// New users will need to register
-	reg, err := client.Registration.Register(registration.RegisterOptions{TermsOfServiceAgreed: true})
 	if err != nil {
 		log.Println(err)
 		return false, err
 	}
-	adminUser.Registration = reg
 
 	// obtain the certificate
 	request := certificate.ObtainRequest{
-		Domains: domains,
-		Bundle:  true,
+		Domains:        domains,
+		Bundle:         true,
+		MustStaple:     options.MustStaple,
+		PreferredChain: options.PreferredChain,
 	}
 	certificates, err := client.Certificate.Obtain(request)
 	if err != nil {
@@ -176,9 +182,14 @@ func (a *ACMEHandler) ObtainCert(domains []string, certificateName string, email
 
 	// Save certificate's ACME info for renew usage
 	certInfo := &CertificateInfoJSON{
-		AcmeName: caName,
-		AcmeUrl:  caUrl,
-		SkipTLS:  skipTLS,
+		AcmeName:       caName,
+		AcmeUrl:        caUrl,
+		SkipTLS:        skipTLS,
+		Email:          email,
+		KeyType:        options.KeyType,
+		MustStaple:     options.MustStaple,
+		PreferredChain: options.PreferredChain,
+		Challenge:      options.Challenge,
 	}
 
 	certInfoBytes, err := json.Marshal(certInfo)
@@ -196,6 +207,62 @@ func (a *ACMEHandler) ObtainCert(domains []string, certificateName string, email
 	return true, nil
 }
 
+// Revocation reason codes accepted by ACME CAs (RFC 5280 section 5.3.1)
+var revocationReasons = []uint{0, 1, 3, 4, 5}
+
+// RevokeCert revokes the certificate at the CA that issued it. The saved ACME
+// account is used if available, otherwise the request is signed with the certificate key
+func (a *ACMEHandler) RevokeCert(certificateName string, reason uint) error {
+	validReason := false
+	for _, r := range revocationReasons {
+		if r == reason {
+			validReason = true
+		}
+	}
+	if !validReason {
+		return errors.New("invalid revocation reason")
+	}
+
+	certBytes, err := os.ReadFile(fmt.Sprintf("./conf/certs/%s.crt", certificateName))
+	if err != nil {
+		return errors.New("certificate not found")
+	}
+
+	certInfo, err := loadCertInfoJSON(fmt.Sprintf("./conf/certs/%s.json", certificateName))
+	if err != nil {
+		return errors.New("certificate was not obtained via ACME")
+	}
+	caConfig := a.resolveCA(certInfo.AcmeName, certInfo.AcmeUrl, certInfo.SkipTLS)
+
+	var user registration.User
+	if a.CAStore != nil && certInfo.Email != "" {
+		savedUser, err := a.CAStore.LoadAccount(caConfig.DirectoryURL, certInfo.Email)
+		if err == nil {
+			user = savedUser
+		}
+	}
+	if user == nil {
+		//No saved account, sign the revocation with the certificate private key
+		keyBytes, err := os.ReadFile(fmt.Sprintf("./conf/certs/%s.key", certificateName))
+		if err != nil {
+			return errors.New("no ACME account or private key found for this certificate")
+		}
+		privateKey, err := certcrypto.ParsePEMPrivateKey(keyBytes)
+		if err != nil {
+			return err
+		}
+		user = &certKeyUser{key: privateKey}
+	}
+
+	client, err := a.newLegoClient(user, caConfig, certcrypto.RSA2048)
+	if err != nil {
+		return err
+	}
+
+	log.Println("[ACME] Revoking certificate " + certificateName)
+	return client.Certificate.RevokeWithReason(certBytes, &reason)
+}
+
 // CheckCertificate returns a list of domains that are in expired certificates.
 // It will return all domains that is in expired certificates
 // *** if there is a vaild certificate contains the domain and there is a expired certificate contains the same domain
@@ -313,6 +380,11 @@ func (a *ACMEHandler) HandleRenewCertificate(w http.ResponseWriter, r *http.Requ
 		}
 	}
 
+	if ca != "" && ca != "custom" && !a.IsValidCA(ca) {
+		utils.SendErrorResponse(w, "CA "+jsonEscape(ca)+" is not supported")
+		return
+	}
+
 	var skipTLS bool
 
 	if skipTLSString, err := utils.PostPara(r, "skipTLS"); err != nil {
@@ -323,8 +395,22 @@ func (a *ACMEHandler) HandleRenewCertificate(w http.ResponseWriter, r *http.Requ
 		skipTLS = true
 	}
 
+	options := CertOptions{}
+	options.KeyType, _ = utils.PostPara(r, "keyType")
+	if !IsValidKeyType(options.KeyType) {
+		utils.SendErrorResponse(w, "key type "+jsonEscape(options.KeyType)+" is not supported")
+		return
+	}
+	options.MustStaple, _ = utils.PostBool(r, "mustStaple")
+	options.PreferredChain, _ = utils.PostPara(r, "preferredChain")
+	options.Challenge, _ = utils.PostPara(r, "challenge")
+	if !IsValidChallenge(options.Challenge) {
+		utils.SendErrorResponse(w, "challenge type "+jsonEscape(options.Challenge)+" is not supported")
+		return
+	}
+
 	domains := strings.Split(domainPara, ",")
-	result, err := a.ObtainCert(domains, filename, email, ca, caUrl, skipTLS)
+	result, err := a.ObtainCert(domains, filename, email, ca, caUrl, skipTLS, &options)
 	if err != nil {
 		utils.SendErrorResponse(w, jsonEscape(err.Error()))
 		return
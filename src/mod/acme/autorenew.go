@@ -10,8 +10,10 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
+	"imuslab.com/zoraxy/mod/notify"
 	"imuslab.com/zoraxy/mod/utils"
 )
 
@@ -26,6 +28,8 @@ type AutoRenewConfig struct {
 	Email        string   //Email for acme
 	RenewAll     bool     //Renew all or selective renew with the slice below
 	FilesToRenew []string //If RenewAll is false, renew these certificate files
+	CA           string   //CA used for certificates without ACME info, empty for default
+	CAUrl        string   //Directory URL if CA is custom
 }
 
 type AutoRenewer struct {
@@ -35,17 +39,21 @@ type AutoRenewer struct {
 	RenewerConfig     *AutoRenewConfig
 	RenewTickInterval int64
 	TickerstopChan    chan bool
+	Notifier          *notify.Manager   //Notify certificate expiry and renew results, can be nil
+	ExcludeCert       func([]byte) bool //Skip certificates not issued by ACME (e.g. private CA), can be nil
+	configMutex       sync.RWMutex      //Protect the renewer config, which is also modified outside the handlers
 }
 
 type ExpiredCerts struct {
 	Domains  []string
 	Filepath string
 	CA       string
+	Expired  bool //Already expired instead of expiring soon
 }
 
 // Create an auto renew agent, require config filepath and auto scan & renew interval (seconds)
 // Set renew check interval to 0 for auto (1 day)
-func NewAutoRenewer(config string, certFolder string, renewCheckInterval int64, AcmeHandler *ACMEHandler) (*AutoRenewer, error) {
+func NewAutoRenewer(config string, certFolder string, renewCheckInterval int64, AcmeHandler *ACMEHandler, notifier *notify.Manager) (*AutoRenewer, error) {
 	if renewCheckInterval == 0 {
 		renewCheckInterval = 86400 //1 day
 	}
@@ -83,6 +91,7 @@ func NewAutoRenewer(config string, certFolder string, renewCheckInterval int64,
 		AcmeHandler:       AcmeHandler,
 		RenewerConfig:     &renewerConfig,
 		RenewTickInterval: renewCheckInterval,
+		Notifier:          notifier,
 	}
 
 	if thisRenewer.RenewerConfig.Enabled {
@@ -159,13 +168,17 @@ func (a *AutoRenewer) HandleSetAutoRenewDomains(w http.ResponseWriter, r *http.R
 		}
 
 		//Update the configs
+		a.configMutex.Lock()
 		a.RenewerConfig.RenewAll = false
 		a.RenewerConfig.FilesToRenew = matchingRuleFiles
 		a.saveRenewConfigToFile()
+		a.configMutex.Unlock()
 		utils.SendOK(w)
 	case "setAuto":
+		a.configMutex.Lock()
 		a.RenewerConfig.RenewAll = true
 		a.saveRenewConfigToFile()
+		a.configMutex.Unlock()
 		utils.SendOK(w)
 	default:
 		break
@@ -175,13 +188,15 @@ func (a *AutoRenewer) HandleSetAutoRenewDomains(w http.ResponseWriter, r *http.R
 // if auto renew all is true (aka auto scan), it will return []string{"*"}
 func (a *AutoRenewer) HandleLoadAutoRenewDomains(w http.ResponseWriter, r *http.Request) {
 	results := []string{}
+	a.configMutex.RLock()
 	if a.RenewerConfig.RenewAll {
 		//Auto pick which cert to renew.
 		results = append(results, "*")
 	} else {
 		//Manually set the files to renew
-		results = a.RenewerConfig.FilesToRenew
+		results = append(results, a.RenewerConfig.FilesToRenew...)
 	}
+	a.configMutex.RUnlock()
 
 	js, _ := json.Marshal(results)
 	utils.SendJSONResponse(w, string(js))
@@ -189,7 +204,9 @@ func (a *AutoRenewer) HandleLoadAutoRenewDomains(w http.ResponseWriter, r *http.
 
 func (a *AutoRenewer) HandleRenewPolicy(w http.ResponseWriter, r *http.Request) {
 	//Load the current value
+	a.configMutex.RLock()
 	js, _ := json.Marshal(a.RenewerConfig.RenewAll)
+	a.configMutex.RUnlock()
 	utils.SendJSONResponse(w, string(js))
 }
 
@@ -214,23 +231,27 @@ func (a *AutoRenewer) HandleRenewNow(w http.ResponseWriter, r *http.Request) {
 func (a *AutoRenewer) HandleAutoRenewEnable(w http.ResponseWriter, r *http.Request) {
 	val, err := utils.PostPara(r, "enable")
 	if err != nil {
-		js, _ := json.Marshal(a.RenewerConfig.Enabled)
+		js, _ := json.Marshal(a.GetRenewerConfig().Enabled)
 		utils.SendJSONResponse(w, string(js))
 	} else {
 		if val == "true" {
 			//Check if the email is not empty
-			if a.RenewerConfig.Email == "" {
+			if a.GetRenewerConfig().Email == "" {
 				utils.SendErrorResponse(w, "Email is not set")
 				return
 			}
 
+			a.configMutex.Lock()
 			a.RenewerConfig.Enabled = true
 			a.saveRenewConfigToFile()
+			a.configMutex.Unlock()
 			log.Println("[ACME] ACME auto renew enabled")
 			a.StartAutoRenewTicker()
 		} else {
+			a.configMutex.Lock()
 			a.RenewerConfig.Enabled = false
 			a.saveRenewConfigToFile()
+			a.configMutex.Unlock()
 			log.Println("[ACME] ACME auto renew disabled")
 			a.StopAutoRenewTicker()
 		}
@@ -241,7 +262,7 @@ func (a *AutoRenewer) HandleACMEEmail(w http.ResponseWriter, r *http.Request) {
 	email, err := utils.PostPara(r, "set")
 	if err != nil {
 		//Return the current email to user
-		js, _ := json.Marshal(a.RenewerConfig.Email)
+		js, _ := json.Marshal(a.GetRenewerConfig().Email)
 		utils.SendJSONResponse(w, string(js))
 	} else {
 		//Check if the email is valid
@@ -252,12 +273,55 @@ func (a *AutoRenewer) HandleACMEEmail(w http.ResponseWriter, r *http.Request) {
 		}
 
 		//Set the new config
+		a.configMutex.Lock()
 		a.RenewerConfig.Email = email
 		a.saveRenewConfigToFile()
+		a.configMutex.Unlock()
 	}
 
 }
 
+// Get or set the CA used for renewing certificates that has no ACME info
+func (a *AutoRenewer) HandleRenewCA(w http.ResponseWriter, r *http.Request) {
+	ca, err := utils.PostPara(r, "ca")
+	if err != nil {
+		//Return the current CA settings
+		config := a.GetRenewerConfig()
+		js, _ := json.Marshal(struct {
+			CA    string
+			CAUrl string
+		}{
+			CA:    config.CA,
+			CAUrl: config.CAUrl,
+		})
+		utils.SendJSONResponse(w, string(js))
+		return
+	}
+
+	caUrl := ""
+	if ca == "custom" {
+		caUrl, err = utils.PostPara(r, "caURL")
+		if err != nil {
+			utils.SendErrorResponse(w, "Custom CA set but no URL provided")
+			return
+		}
+	} else if !a.AcmeHandler.IsValidCA(ca) {
+		utils.SendErrorResponse(w, "CA is not supported")
+		return
+	}
+
+	a.configMutex.Lock()
+	a.RenewerConfig.CA = ca
+	a.RenewerConfig.CAUrl = caUrl
+	err = a.saveRenewConfigToFile()
+	a.configMutex.Unlock()
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+	utils.SendOK(w)
+}
+
 // Check and renew certificates. This check all the certificates in the
 // certificate folder and return a list of certs that is renewed in this call
 // Return string array with length 0 when no cert is expired
@@ -269,8 +333,14 @@ func (a *AutoRenewer) CheckAndRenewCertificates() ([]string, error) {
 		return []string{}, err
 	}
 
+	//Take a snapshot as the files to renew can be added while renewing
+	a.configMutex.RLock()
+	renewAll := a.RenewerConfig.RenewAll
+	filesToRenew := append([]string{}, a.RenewerConfig.FilesToRenew...)
+	a.configMutex.RUnlock()
+
 	expiredCertList := []*ExpiredCerts{}
-	if a.RenewerConfig.RenewAll {
+	if renewAll {
 		//Scan and renew all
 		for _, file := range files {
 			if filepath.Ext(file.Name()) == ".crt" || filepath.Ext(file.Name()) == ".pem" {
@@ -279,6 +349,9 @@ func (a *AutoRenewer) CheckAndRenewCertificates() ([]string, error) {
 				if err != nil {
 					continue
 				}
+				if a.ExcludeCert != nil && a.ExcludeCert(certBytes) {
+					continue
+				}
 				if CertExpireSoon(certBytes) || CertIsExpired(certBytes) {
 					//This cert is expired
 					CAName, err := ExtractIssuerName(certBytes)
@@ -299,6 +372,7 @@ func (a *AutoRenewer) CheckAndRenewCertificates() ([]string, error) {
 						Filepath: filepath.Join(certFolder, file.Name()),
 						CA:       CAName,
 						Domains:  DNSName,
+						Expired:  CertIsExpired(certBytes),
 					})
 				}
 			}
@@ -308,12 +382,15 @@ func (a *AutoRenewer) CheckAndRenewCertificates() ([]string, error) {
 		for _, file := range files {
 			fileName := file.Name()
 			certName := fileName[:len(fileName)-len(filepath.Ext(fileName))]
-			if contains(a.RenewerConfig.FilesToRenew, certName) {
+			if contains(filesToRenew, certName) {
 				//This is the one to auto renew
 				certBytes, err := os.ReadFile(filepath.Join(certFolder, file.Name()))
 				if err != nil {
 					continue
 				}
+				if a.ExcludeCert != nil && a.ExcludeCert(certBytes) {
+					continue
+				}
 				if CertExpireSoon(certBytes) || CertIsExpired(certBytes) {
 					//This cert is expired
 					CAName, err := ExtractIssuerName(certBytes)
@@ -334,6 +411,7 @@ func (a *AutoRenewer) CheckAndRenewCertificates() ([]string, error) {
 						Filepath: filepath.Join(certFolder, file.Name()),
 						CA:       CAName,
 						Domains:  DNSName,
+						Expired:  CertIsExpired(certBytes),
 					})
 				}
 			}
@@ -357,20 +435,51 @@ func (a *AutoRenewer) renewExpiredDomains(certs []*ExpiredCerts) ([]string, erro
 		log.Printf("Renewing %s (Might take a few minutes)\n", expiredCert.Filepath)
 		fileName := filepath.Base(expiredCert.Filepath)
 		certName := fileName[:len(fileName)-len(filepath.Ext(fileName))]
+		a.notifyCertExpiry(certName, expiredCert)
 
 		// Load certificate info for ACME detail
 		certInfoFilename := fmt.Sprintf("%s/%s.json", filepath.Dir(expiredCert.Filepath), certName)
+		a.configMutex.RLock()
+		renewCA, renewCAUrl, email := a.RenewerConfig.CA, a.RenewerConfig.CAUrl, a.RenewerConfig.Email
+		a.configMutex.RUnlock()
 		certInfo, err := loadCertInfoJSON(certInfoFilename)
 		if err != nil {
-			log.Printf("Renew %s certificate error, can't get the ACME detail for cert: %v, using default ACME\n", certName, err)
-			certInfo = &CertificateInfoJSON{}
+			log.Printf("Renew %s certificate error, can't get the ACME detail for cert: %v, using auto renew CA\n", certName, err)
+			certInfo = &CertificateInfoJSON{
+				AcmeName: renewCA,
+				AcmeUrl:  renewCAUrl,
+			}
 		}
 
-		_, err = a.AcmeHandler.ObtainCert(expiredCert.Domains, certName, a.RenewerConfig.Email, certInfo.AcmeName, certInfo.AcmeUrl, certInfo.SkipTLS)
+		_, err = a.AcmeHandler.ObtainCert(expiredCert.Domains, certName, email, certInfo.AcmeName, certInfo.AcmeUrl, certInfo.SkipTLS, &CertOptions{
+			KeyType:        certInfo.KeyType,
+			MustStaple:     certInfo.MustStaple,
+			PreferredChain: certInfo.PreferredChain,
+			Challenge:      certInfo.Challenge,
+		})
 		if err != nil {
 			log.Printf("Renew %s (%s) failed: %v\n", fileName, strings.Join(expiredCert.Domains, ","), err)
+			a.Notifier.Notify(&notify.Event{
+				Source:   notify.Source_Certificate,
+				Type:     "renew_failed",
+				Key:      certName,
+				Severity: notify.Severity_Critical,
+				Title:    "Certificate renew failed for " + certName,
+				Message:  "Unable to renew certificate of " + strings.Join(expiredCert.Domains, ", ") + ": " + err.Error(),
+				Fields:   map[string]string{"domains": strings.Join(expiredCert.Domains, ","), "ca": expiredCert.CA},
+			})
 		} else {
 			log.Printf("Successfully renewed %s\n", filepath.Base(expiredCert.Filepath))
+			a.Notifier.Notify(&notify.Event{
+				Source:   notify.Source_Certificate,
+				Type:     "renewed",
+				Key:      certName,
+				Severity: notify.Severity_Info,
+				Title:    "Certificate renewed for " + certName,
+				Message:  "Certificate of " + strings.Join(expiredCert.Domains, ", ") + " has been renewed",
+				Recovery: true,
+				Fields:   map[string]string{"domains": strings.Join(expiredCert.Domains, ","), "ca": expiredCert.CA},
+			})
 			renewedCertFiles = append(renewedCertFiles, filepath.Base(expiredCert.Filepath))
 		}
 	}
@@ -378,7 +487,48 @@ func (a *AutoRenewer) renewExpiredDomains(certs []*ExpiredCerts) ([]string, erro
 	return renewedCertFiles, nil
 }
 
-// Write the current renewer config to file
+// Emit the expiry event of a certificate that is going to be renewed
+func (a *AutoRenewer) notifyCertExpiry(certName string, cert *ExpiredCerts) {
+	severity := notify.Severity_Warning
+	message := "Certificate of " + strings.Join(cert.Domains, ", ") + " is expiring soon"
+	if cert.Expired {
+		severity = notify.Severity_Critical
+		message = "Certificate of " + strings.Join(cert.Domains, ", ") + " has expired"
+	}
+
+	a.Notifier.Notify(&notify.Event{
+		Source:   notify.Source_Certificate,
+		Type:     "expiring",
+		Key:      certName,
+		Severity: severity,
+		Title:    "Certificate expiring for " + certName,
+		Message:  message,
+		Fields:   map[string]string{"domains": strings.Join(cert.Domains, ","), "ca": cert.CA},
+	})
+}
+
+// Add a certificate to the renew list, it is renewed together with the
+// other selected certificates when renew all is disabled
+func (a *AutoRenewer) AddFileToRenew(certName string) error {
+	a.configMutex.Lock()
+	defer a.configMutex.Unlock()
+	if contains(a.RenewerConfig.FilesToRenew, certName) {
+		return nil
+	}
+	a.RenewerConfig.FilesToRenew = append(a.RenewerConfig.FilesToRenew, certName)
+	return a.saveRenewConfigToFile()
+}
+
+// Get a copy of the current renewer config
+func (a *AutoRenewer) GetRenewerConfig() AutoRenewConfig {
+	a.configMutex.RLock()
+	defer a.configMutex.RUnlock()
+	config := *a.RenewerConfig
+	config.FilesToRenew = append([]string{}, a.RenewerConfig.FilesToRenew...)
+	return config
+}
+
+// Write the current renewer config to file. Must be called with the config mutex locked
 func (a *AutoRenewer) saveRenewConfigToFile() error {
 	js, _ := json.MarshalIndent(a.RenewerConfig, "", " ")
 	return os.WriteFile(a.ConfigFilePath, js, 0775)
@@ -0,0 +1,53 @@
+package acme_test
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+
+	"imuslab.com/zoraxy/mod/acme"
+)
+
+func TestAddFileToRenewConcurrent(t *testing.T) {
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "acme_conf.json")
+	renewer, err := acme.NewAutoRenewer(configFile, dir, 0, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			renewer.AddFileToRenew("cert" + strconv.Itoa(i%10))
+		}(i)
+		go func() {
+			defer wg.Done()
+			renewer.HandleLoadAutoRenewDomains(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		}()
+	}
+	wg.Wait()
+
+	if len(renewer.RenewerConfig.FilesToRenew) != 10 {
+		t.Fatalf("expected 10 files to renew, got %v", renewer.RenewerConfig.FilesToRenew)
+	}
+
+	//The saved config should contain all the files
+	content, err := os.ReadFile(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	savedConfig := acme.AutoRenewConfig{}
+	if err := json.Unmarshal(content, &savedConfig); err != nil {
+		t.Fatal(err)
+	}
+	if len(savedConfig.FilesToRenew) != 10 {
+		t.Errorf("expected 10 files to renew in config file, got %v", savedConfig.FilesToRenew)
+	}
+}
@@ -6,10 +6,15 @@ package acme
 	This script load CA defination from embedded ca.json
 */
 import (
+	"crypto/tls"
+	"crypto/x509"
 	_ "embed"
 	"encoding/json"
 	"errors"
 	"log"
+	"net"
+	"net/http"
+	"time"
 )
 
 // CA Defination, load from embeded json when startup
@@ -43,3 +48,83 @@ func loadCAApiServerFromName(caName string) (string, error) {
 	}
 	return val, nil
 }
+
+// Check if the CA name is either built-in or defined in the CA store
+func (a *ACMEHandler) IsValidCA(caName string) bool {
+	if caName == "" || IsBuiltInCA(caName) {
+		return true
+	}
+	if a.CAStore == nil {
+		return false
+	}
+	_, err := a.CAStore.Get(caName)
+	return err == nil
+}
+
+// Resolve the directory URL, EAB credentials and TLS settings of the CA to use.
+// Custom directory URLs pick up the settings of the stored CA with the same URL
+func (a *ACMEHandler) resolveCA(caName string, caUrl string, skipTLS bool) *CAConfig {
+	if caName == "custom" && caUrl != "" {
+		log.Printf("[INFO] Using Custom ACME %s for CA Directory URL\n", caUrl)
+		if a.CAStore != nil {
+			if stored, err := a.CAStore.findByDirectoryURL(caUrl); err == nil {
+				stored.SkipTLS = stored.SkipTLS || skipTLS
+				return stored
+			}
+		}
+		return &CAConfig{Name: caName, DirectoryURL: caUrl, SkipTLS: skipTLS}
+	}
+
+	caConfig := &CAConfig{Name: caName}
+	if a.CAStore != nil {
+		if stored, err := a.CAStore.Get(caName); err == nil {
+			caConfig = stored
+		}
+	}
+
+	if caConfig.DirectoryURL == "" {
+		caLinkOverwrite, err := loadCAApiServerFromName(caName)
+		if err == nil {
+			caConfig.DirectoryURL = caLinkOverwrite
+		} else {
+			// (caName == "" || caUrl == "") will use default acme
+			caConfig.DirectoryURL = a.DefaultAcmeServer
+			log.Printf("[INFO] Using Default ACME %s for CA Directory URL\n", a.DefaultAcmeServer)
+			return caConfig
+		}
+	}
+
+	caConfig.SkipTLS = caConfig.SkipTLS || skipTLS
+	log.Printf("[INFO] Using %s for CA Directory URL\n", caConfig.DirectoryURL)
+	return caConfig
+}
+
+// Create the HTTP transport for connecting to the CA with custom root certificates or TLS verification disabled
+// Ref: https://github.com/go-acme/lego/blob/6af2c756ac73a9cb401621afca722d0f4112b1b8/lego/client_config.go#L74
+func createCATransport(caConfig *CAConfig) (*http.Transport, error) {
+	tlsConfig := &tls.Config{}
+	if caConfig.SkipTLS {
+		log.Println("[INFO] Ignore TLS/SSL Verification Error for ACME Server")
+		tlsConfig.InsecureSkipVerify = true
+	} else if caConfig.RootCAs != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM([]byte(caConfig.RootCAs)) {
+			return nil, errors.New("no valid certificate found in root CAs of " + caConfig.Name)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSHandshakeTimeout:   30 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Second,
+		TLSClientConfig:       tlsConfig,
+	}, nil
+}
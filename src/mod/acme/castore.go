@@ -0,0 +1,393 @@
+package acme
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"imuslab.com/zoraxy/mod/database"
+	"imuslab.com/zoraxy/mod/utils"
+)
+
+/*
+	CAStore.go
+
+	User defined ACME certificate authorities. A CA entry either adds
+	External Account Binding (EAB) credentials to one of the built-in
+	CAs in ca.json, or defines a new CA with an arbitrary directory URL
+	and optional root certificates to trust when connecting to it
+	(e.g. an internal step-ca).
+
+	EAB HMAC keys are encrypted with AES-GCM before written to the
+	database. The encryption key is stored in a separate file that is
+	only readable by the owner
+*/
+
+type CAConfig struct {
+	Name         string //Name of the CA, selected as the CA name in obtain requests
+	DirectoryURL string //ACME directory URL, empty to use the built-in URL of this CA
+	EABKeyID     string //External account binding key ID
+	EABHmacKey   string `json:"-"` //External account binding HMAC key in base64url, only kept in memory
+	RootCAs      string //PEM encoded root certificates to trust in addition to the system pool
+	SkipTLS      bool   //Skip TLS verification of the directory (Not Recommended)
+}
+
+// CA entry written to the database
+type storedCAConfig struct {
+	CAConfig
+	EncryptedEABHmacKey string
+}
+
+// CA information returned to the UI, without the secrets
+type CAInfo struct {
+	Name         string
+	DirectoryURL string
+	BuiltIn      bool   //Listed in the embedded ca.json
+	Customized   bool   //Has user defined settings in the CA store
+	EABKeyID     string //Key ID of the EAB credentials, empty if not set
+	HasRootCAs   bool
+	SkipTLS      bool
+}
+
+type CAStore struct {
+	database  *database.Database
+	secretKey []byte
+	mutex     sync.Mutex
+}
+
+// Create a CA store. The secret key file is created if not exists
+func NewCAStore(db *database.Database, secretKeyFile string) (*CAStore, error) {
+	err := db.NewTable("acme")
+	if err != nil {
+		return nil, err
+	}
+
+	secretKey, err := loadOrCreateSecretKey(secretKeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CAStore{
+		database:  db,
+		secretKey: secretKey,
+	}, nil
+}
+
+func loadOrCreateSecretKey(filename string) ([]byte, error) {
+	key, err := os.ReadFile(filename)
+	if err == nil {
+		if len(key) != 32 {
+			return nil, errors.New("invalid acme secret key file")
+		}
+		return key, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	key = make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+	os.MkdirAll(filepath.Dir(filename), 0775)
+	err = os.WriteFile(filename, key, 0600)
+	if err != nil {
+		return nil, errors.New("failed to create acme secret key: " + err.Error())
+	}
+	return key, nil
+}
+
+func (s *CAStore) encrypt(plaintext string) (string, error) {
+	block, err := aes.NewCipher(s.secretKey)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, []byte(plaintext), nil)), nil
+}
+
+func (s *CAStore) decrypt(ciphertext string) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(ciphertext)
+	if err != nil {
+		return "", err
+	}
+	block, err := aes.NewCipher(s.secretKey)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+	if len(data) < gcm.NonceSize() {
+		return "", errors.New("malformed encrypted data")
+	}
+	plaintext, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", errors.New("unable to decrypt stored secret, is the acme secret key changed?")
+	}
+	return string(plaintext), nil
+}
+
+// Check if the CA name is listed in the embedded ca.json
+func IsBuiltInCA(caName string) bool {
+	_, ok := caDef.Production[caName]
+	return ok
+}
+
+// Validate the CA settings before saving
+func (c *CAConfig) Validate() error {
+	if strings.TrimSpace(c.Name) == "" || c.Name == "custom" {
+		return errors.New("invalid CA name")
+	}
+
+	if c.DirectoryURL == "" && !IsBuiltInCA(c.Name) {
+		return errors.New("directory URL is required for non built-in CA")
+	}
+	if c.DirectoryURL != "" {
+		u, err := url.Parse(c.DirectoryURL)
+		if err != nil || u.Scheme != "https" && u.Scheme != "http" || u.Host == "" {
+			return errors.New("invalid directory URL")
+		}
+	}
+
+	if (c.EABKeyID == "") != (c.EABHmacKey == "") {
+		return errors.New("both EAB key ID and HMAC key are required")
+	}
+	if c.EABHmacKey != "" {
+		if _, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(c.EABHmacKey, "=")); err != nil {
+			return errors.New("EAB HMAC key must be base64url encoded")
+		}
+	}
+
+	if c.RootCAs != "" {
+		if !x509.NewCertPool().AppendCertsFromPEM([]byte(c.RootCAs)) {
+			return errors.New("no valid certificate found in root CAs")
+		}
+	}
+	return nil
+}
+
+// Add or update a CA. If the HMAC key is empty and the key ID is unchanged, the stored key is kept
+func (s *CAStore) Set(config *CAConfig) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if config.EABHmacKey == "" && config.EABKeyID != "" {
+		existing, err := s.get(config.Name)
+		if err == nil && existing.EABKeyID == config.EABKeyID {
+			config.EABHmacKey = existing.EABHmacKey
+		}
+	}
+
+	if err := config.Validate(); err != nil {
+		return err
+	}
+
+	stored := storedCAConfig{CAConfig: *config}
+	stored.EABHmacKey = ""
+	if config.EABHmacKey != "" {
+		encrypted, err := s.encrypt(config.EABHmacKey)
+		if err != nil {
+			return err
+		}
+		stored.EncryptedEABHmacKey = encrypted
+	}
+
+	return s.database.Write("acme", "ca/"+config.Name, stored)
+}
+
+// Get the CA settings with decrypted EAB credentials
+func (s *CAStore) Get(caName string) (*CAConfig, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.get(caName)
+}
+
+func (s *CAStore) get(caName string) (*CAConfig, error) {
+	if !s.database.KeyExists("acme", "ca/"+caName) {
+		return nil, errors.New("CA not found")
+	}
+
+	stored := storedCAConfig{}
+	err := s.database.Read("acme", "ca/"+caName, &stored)
+	if err != nil {
+		return nil, err
+	}
+
+	config := stored.CAConfig
+	if stored.EncryptedEABHmacKey != "" {
+		config.EABHmacKey, err = s.decrypt(stored.EncryptedEABHmacKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &config, nil
+}
+
+func (s *CAStore) Remove(caName string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.database.KeyExists("acme", "ca/"+caName) {
+		return errors.New("CA not found")
+	}
+	return s.database.Delete("acme", "ca/"+caName)
+}
+
+// Get all CAs stored in the database
+func (s *CAStore) list() []*CAConfig {
+	results := []*CAConfig{}
+	entries, err := s.database.ListTable("acme")
+	if err != nil {
+		return results
+	}
+	for _, keypairs := range entries {
+		if !strings.HasPrefix(string(keypairs[0]), "ca/") {
+			continue
+		}
+		stored := storedCAConfig{}
+		if json.Unmarshal(keypairs[1], &stored) == nil {
+			config := stored.CAConfig
+			config.EABHmacKey = ""
+			results = append(results, &config)
+		}
+	}
+	return results
+}
+
+// List the built-in and user defined CAs without secrets
+func (s *CAStore) List() []*CAInfo {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	infos := map[string]*CAInfo{}
+	for name, directoryURL := range caDef.Production {
+		infos[name] = &CAInfo{
+			Name:         name,
+			DirectoryURL: directoryURL,
+			BuiltIn:      true,
+		}
+	}
+
+	for _, config := range s.list() {
+		info, ok := infos[config.Name]
+		if !ok {
+			info = &CAInfo{Name: config.Name}
+			infos[config.Name] = info
+		}
+		if config.DirectoryURL != "" {
+			info.DirectoryURL = config.DirectoryURL
+		}
+		info.Customized = true
+		info.EABKeyID = config.EABKeyID
+		info.HasRootCAs = config.RootCAs != ""
+		info.SkipTLS = config.SkipTLS
+	}
+
+	results := []*CAInfo{}
+	for _, info := range infos {
+		results = append(results, info)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].BuiltIn != results[j].BuiltIn {
+			return results[i].BuiltIn
+		}
+		return results[i].Name < results[j].Name
+	})
+	return results
+}
+
+// Find the user defined CA with the given directory URL
+func (s *CAStore) findByDirectoryURL(directoryURL string) (*CAConfig, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, config := range s.list() {
+		if config.DirectoryURL != "" && strings.TrimSuffix(config.DirectoryURL, "/") == strings.TrimSuffix(directoryURL, "/") {
+			return s.get(config.Name)
+		}
+	}
+	return nil, errors.New("CA not found")
+}
+
+// List the built-in and user defined CAs
+func (a *ACMEHandler) HandleListCA(w http.ResponseWriter, r *http.Request) {
+	results := []*CAInfo{}
+	if a.CAStore != nil {
+		results = a.CAStore.List()
+	}
+	js, _ := json.Marshal(results)
+	utils.SendJSONResponse(w, string(js))
+}
+
+// Add or update a CA. Leave eabHmac empty to keep the stored HMAC key
+func (a *ACMEHandler) HandleSetCA(w http.ResponseWriter, r *http.Request) {
+	if a.CAStore == nil {
+		utils.SendErrorResponse(w, "CA store not available")
+		return
+	}
+
+	name, err := utils.PostPara(r, "name")
+	if err != nil {
+		utils.SendErrorResponse(w, "CA name not set")
+		return
+	}
+
+	config := CAConfig{Name: strings.TrimSpace(name)}
+	config.DirectoryURL, _ = utils.PostPara(r, "url")
+	config.EABKeyID, _ = utils.PostPara(r, "eabKid")
+	config.EABHmacKey, _ = utils.PostPara(r, "eabHmac")
+	config.RootCAs, _ = utils.PostPara(r, "rootCAs")
+	config.SkipTLS, _ = utils.PostBool(r, "skipTLS")
+	if IsBuiltInCA(config.Name) {
+		//Built-in CAs always use the directory URL in ca.json
+		config.DirectoryURL = ""
+	}
+
+	err = a.CAStore.Set(&config)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+
+	utils.SendOK(w)
+}
+
+func (a *ACMEHandler) HandleRemoveCA(w http.ResponseWriter, r *http.Request) {
+	if a.CAStore == nil {
+		utils.SendErrorResponse(w, "CA store not available")
+		return
+	}
+
+	name, err := utils.PostPara(r, "name")
+	if err != nil {
+		utils.SendErrorResponse(w, "CA name not set")
+		return
+	}
+
+	err = a.CAStore.Remove(name)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+
+	utils.SendOK(w)
+}
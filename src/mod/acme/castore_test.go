@@ -0,0 +1,172 @@
+package acme_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-acme/lego/v4/registration"
+	"imuslab.com/zoraxy/mod/acme"
+	"imuslab.com/zoraxy/mod/database"
+)
+
+func TestCAStore(t *testing.T) {
+	dir := t.TempDir()
+	db, err := database.NewDatabase(filepath.Join(dir, "test.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	keyFile := filepath.Join(dir, "acme_secret.key")
+	store, err := acme.NewCAStore(db, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(keyFile); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("secret key file should be created with 0600 permission")
+	}
+
+	hmacKey := "c2VjcmV0LWhtYWMta2V5LWZvci10ZXN0aW5n"
+	err = store.Set(&acme.CAConfig{Name: "ZeroSSL", EABKeyID: "kid-1", EABHmacKey: hmacKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//HMAC key must not be written to database in plain text
+	entries, _ := db.ListTable("acme")
+	for _, keypairs := range entries {
+		if strings.Contains(string(keypairs[1]), hmacKey) {
+			t.Fatal("EAB HMAC key is stored in plain text")
+		}
+	}
+
+	//Update without HMAC key keeps the stored one
+	err = store.Set(&acme.CAConfig{Name: "ZeroSSL", EABKeyID: "kid-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := store.Get("ZeroSSL")
+	if err != nil || config.EABHmacKey != hmacKey || config.DirectoryURL != "" {
+		t.Fatalf("unexpected CA config: %+v, %v", config, err)
+	}
+
+	//Reopen the store with the same key file
+	store, err = acme.NewCAStore(db, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config, err := store.Get("ZeroSSL"); err != nil || config.EABHmacKey != hmacKey {
+		t.Errorf("failed to decrypt HMAC key after reopen: %v", err)
+	}
+
+	invalidConfigs := []*acme.CAConfig{
+		{Name: "step-ca"},
+		{Name: "custom", DirectoryURL: "https://ca.internal/acme/directory"},
+		{Name: "step-ca", DirectoryURL: "ftp://ca.internal"},
+		{Name: "step-ca", DirectoryURL: "https://ca.internal/acme/directory", EABKeyID: "kid"},
+		{Name: "step-ca", DirectoryURL: "https://ca.internal/acme/directory", EABKeyID: "kid", EABHmacKey: "not base64!"},
+		{Name: "step-ca", DirectoryURL: "https://ca.internal/acme/directory", RootCAs: "not a pem"},
+	}
+	for i, invalidConfig := range invalidConfigs {
+		if store.Set(invalidConfig) == nil {
+			t.Errorf("expected error for invalid config %d", i)
+		}
+	}
+
+	err = store.Set(&acme.CAConfig{Name: "step-ca", DirectoryURL: "https://ca.internal/acme/directory"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	foundCustom := false
+	for _, info := range store.List() {
+		if info.Name == "step-ca" {
+			foundCustom = info.Customized && !info.BuiltIn && info.DirectoryURL == "https://ca.internal/acme/directory"
+		}
+		if info.Name == "ZeroSSL" && (!info.BuiltIn || info.EABKeyID != "kid-1") {
+			t.Errorf("unexpected built-in CA info: %+v", info)
+		}
+	}
+	if !foundCustom {
+		t.Error("custom CA not found in list")
+	}
+
+	if err := store.Remove("step-ca"); err != nil {
+		t.Error(err)
+	}
+	if _, err := store.Get("step-ca"); err == nil {
+		t.Error("CA should be removed")
+	}
+}
+
+func TestAccountStore(t *testing.T) {
+	dir := t.TempDir()
+	db, err := database.NewDatabase(filepath.Join(dir, "test.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	store, err := acme.NewCAStore(db, filepath.Join(dir, "acme_secret.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	directoryURL := "https://acme-v02.api.letsencrypt.org/directory"
+	if _, err := store.LoadAccount(directoryURL, "admin@example.com"); err == nil {
+		t.Fatal("expected error for account not registered")
+	}
+
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := acme.NewACMEUser("admin@example.com", privateKey)
+	user.Registration = &registration.Resource{URI: "https://acme.example.com/acct/1"}
+	if err := store.SaveAccount(directoryURL, user); err != nil {
+		t.Fatal(err)
+	}
+
+	//Account key must not be written to database in plain text
+	entries, _ := db.ListTable("acme")
+	for _, keypairs := range entries {
+		if strings.Contains(string(keypairs[1]), "PRIVATE KEY") {
+			t.Fatal("account key is stored in plain text")
+		}
+	}
+
+	//Same account is loaded regardless of email case and trailing slash
+	loaded, err := store.LoadAccount(directoryURL+"/", "Admin@Example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	loadedKey, ok := loaded.GetPrivateKey().(*ecdsa.PrivateKey)
+	if !ok || !loadedKey.Equal(privateKey) {
+		t.Error("loaded account key does not match the saved key")
+	}
+	if loaded.GetRegistration() == nil || loaded.GetRegistration().URI != user.Registration.URI {
+		t.Errorf("unexpected registration: %+v", loaded.GetRegistration())
+	}
+
+	//Accounts are separated per CA
+	if _, err := store.LoadAccount("https://acme.zerossl.com/v2/DV90", "admin@example.com"); err == nil {
+		t.Error("account should not be shared between CAs")
+	}
+
+	accounts := store.ListAccounts()
+	if len(accounts) != 1 || accounts[0].AccountURI != user.Registration.URI {
+		t.Errorf("unexpected account list: %+v", accounts)
+	}
+
+	if err := store.RemoveAccount(directoryURL, "admin@example.com"); err != nil {
+		t.Error(err)
+	}
+	if len(store.ListAccounts()) != 0 {
+		t.Error("account should be removed")
+	}
+}
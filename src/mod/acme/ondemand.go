@@ -0,0 +1,531 @@
+package acme
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"imuslab.com/zoraxy/mod/utils"
+)
+
+/*
+	ondemand.go
+
+	On-demand TLS. When a TLS handshake arrives for a server name that
+	has no certificate, the certificate is obtained from the ACME CA
+	in the background if the domain matches one of the allowed patterns
+	or is approved by the ask URL. The handshake is held until the
+	certificate is ready or the hold timeout is reached, in which case
+	the default certificate is served.
+
+	Issuance is rate limited per hour, and domains that failed to be
+	approved or issued are not retried until the failure cache expires.
+	Ask URL checks are rate limited per minute, both in total and for
+	each client IP
+*/
+
+const (
+	onDemandMaxAskPerMinute       = 60    //Maximum number of ask URL checks per minute
+	onDemandMaxClientAskPerMinute = 10    //Maximum number of ask URL checks per minute from a single client IP
+	onDemandMaxFailures           = 10000 //Maximum number of domains in the negative cache
+)
+
+type OnDemandConfig struct {
+	Enabled         bool
+	AllowedDomains  []string //Domain patterns allowed for on-demand issuance, e.g. *.example.com
+	AskURL          string   //If set, domains not matching the patterns are approved by a 2xx response of GET <AskURL>?domain=<domain>
+	Email           string   //ACME account email
+	CA              string   //CA name, empty for default
+	CAUrl           string   //Directory URL if CA is custom
+	Challenge       string   //Challenge type, see Challenge_* constants
+	KeyType         string   //Certificate key type, see KeyType_* constants
+	HoldTimeout     int      //Seconds to hold the handshake while issuing, 0 to serve the default certificate immediately
+	MaxIssuePerHour int      //Maximum number of issuance per hour
+	FailureCacheTTL int      //Seconds to wait before retrying a failed or denied domain
+}
+
+// Failed domain in the negative cache
+type OnDemandFailure struct {
+	Domain     string
+	Reason     string
+	RetryAfter int64
+}
+
+type OnDemandIssuer struct {
+	ConfigFilePath string
+	CertFolder     string
+	AcmeHandler    *ACMEHandler
+	AutoRenewer    *AutoRenewer //Auto renewer to add the issued certificates to, can be nil
+	Config         *OnDemandConfig
+
+	pending        map[string]chan bool        //Domains being issued, closed when finished
+	failures       map[string]*OnDemandFailure //Negative cache of failed domains
+	issueTimes     []time.Time                 //Issuance start times within the last hour
+	askTimes       []time.Time                 //Ask URL check times within the last minute
+	clientAskTimes map[string][]time.Time      //Ask URL check times within the last minute, by client IP
+	lastCleanup    time.Time                   //Last time the expired failures and ask records are removed
+	askClient      *http.Client
+	mutex          sync.Mutex
+}
+
+var validDomainRegex = regexp.MustCompile(`^([a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?\.)+[a-z0-9-]{2,63}$`)
+
+// Create an on-demand issuer, the config file is created if not exists
+func NewOnDemandIssuer(config string, certFolder string, acmeHandler *ACMEHandler) (*OnDemandIssuer, error) {
+	onDemandConfig := OnDemandConfig{
+		AllowedDomains:  []string{},
+		Challenge:       Challenge_TLSALPN01,
+		HoldTimeout:     30,
+		MaxIssuePerHour: 10,
+		FailureCacheTTL: 3600,
+	}
+
+	if utils.FileExists(config) {
+		content, err := os.ReadFile(config)
+		if err != nil {
+			return nil, errors.New("failed to open acme on-demand config: " + err.Error())
+		}
+		err = json.Unmarshal(content, &onDemandConfig)
+		if err != nil {
+			return nil, errors.New("malformed acme on-demand config file: " + err.Error())
+		}
+	}
+
+	thisIssuer := OnDemandIssuer{
+		ConfigFilePath: config,
+		CertFolder:     certFolder,
+		AcmeHandler:    acmeHandler,
+		Config:         &onDemandConfig,
+		pending:        map[string]chan bool{},
+		failures:       map[string]*OnDemandFailure{},
+		issueTimes:     []time.Time{},
+		askTimes:       []time.Time{},
+		clientAskTimes: map[string][]time.Time{},
+		askClient: &http.Client{
+			Timeout: 5 * time.Second,
+		},
+	}
+
+	if !utils.FileExists(config) {
+		err := thisIssuer.saveConfigToFile()
+		if err != nil {
+			return nil, errors.New("failed to create acme on-demand config: " + err.Error())
+		}
+	}
+
+	return &thisIssuer, nil
+}
+
+func (o *OnDemandIssuer) saveConfigToFile() error {
+	js, _ := json.MarshalIndent(o.Config, "", " ")
+	os.MkdirAll(filepath.Dir(o.ConfigFilePath), 0775)
+	return os.WriteFile(o.ConfigFilePath, js, 0775)
+}
+
+// Validate the on-demand settings before saving
+func (c *OnDemandConfig) Validate() error {
+	if c.Enabled && c.Email == "" {
+		return errors.New("email is required for on-demand issuance")
+	}
+	if c.Email != "" {
+		if _, err := mail.ParseAddress(c.Email); err != nil {
+			return errors.New("invalid email")
+		}
+	}
+	for _, pattern := range c.AllowedDomains {
+		if !validDomainRegex.MatchString(strings.TrimPrefix(pattern, "*.")) {
+			return errors.New("invalid domain pattern " + pattern)
+		}
+	}
+	if c.AskURL != "" {
+		u, err := url.Parse(c.AskURL)
+		if err != nil || u.Scheme != "https" && u.Scheme != "http" || u.Host == "" {
+			return errors.New("invalid ask URL")
+		}
+	}
+	if c.Enabled && len(c.AllowedDomains) == 0 && c.AskURL == "" {
+		return errors.New("allowed domains or ask URL is required to enable on-demand issuance")
+	}
+	if !IsValidChallenge(c.Challenge) {
+		return errors.New("unsupported challenge type")
+	}
+	if !IsValidKeyType(c.KeyType) {
+		return errors.New("unsupported key type")
+	}
+	if c.HoldTimeout < 0 || c.HoldTimeout > 120 {
+		return errors.New("hold timeout must be between 0 and 120 seconds")
+	}
+	if c.MaxIssuePerHour <= 0 {
+		return errors.New("issuance rate limit must be greater than 0")
+	}
+	if c.FailureCacheTTL < 0 {
+		return errors.New("invalid failure cache TTL")
+	}
+	return nil
+}
+
+// Check if the domain matches one of the allowed patterns. Wildcard
+// patterns match subdomains of any depth but not the domain itself
+func matchDomainPatterns(domain string, patterns []string) bool {
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+		if strings.HasPrefix(pattern, "*.") {
+			if strings.HasSuffix(domain, pattern[1:]) {
+				return true
+			}
+		} else if domain == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// Check if the domain is allowed by the patterns or the ask URL
+func (o *OnDemandIssuer) isDomainAllowed(domain string, config OnDemandConfig) (bool, string) {
+	if matchDomainPatterns(domain, config.AllowedDomains) {
+		return true, ""
+	}
+	if config.AskURL == "" {
+		return false, "domain not allowed"
+	}
+
+	askURL, err := url.Parse(config.AskURL)
+	if err != nil {
+		return false, "invalid ask URL"
+	}
+	query := askURL.Query()
+	query.Set("domain", domain)
+	askURL.RawQuery = query.Encode()
+
+	resp, err := o.askClient.Get(askURL.String())
+	if err != nil {
+		return false, "ask URL request failed: " + err.Error()
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return false, "denied by ask URL with status code " + strconv.Itoa(resp.StatusCode)
+	}
+	return true, ""
+}
+
+// Check if a usable certificate of the domain exists. Expired or expiring
+// certificates are treated as missing so they will be issued again
+func (o *OnDemandIssuer) certExists(domain string) bool {
+	if !utils.FileExists(filepath.Join(o.CertFolder, domain+".key")) {
+		return false
+	}
+	certBytes, err := os.ReadFile(filepath.Join(o.CertFolder, domain+".crt"))
+	if err != nil {
+		return false
+	}
+	return !CertExpireSoon(certBytes)
+}
+
+// Add the domain to the negative cache. Must be called with the mutex locked
+func (o *OnDemandIssuer) addFailure(domain string, reason string, ttl int) {
+	if _, ok := o.failures[domain]; !ok && len(o.failures) >= onDemandMaxFailures {
+		//Negative cache is full, the domain will be checked again on next handshake
+		return
+	}
+	o.failures[domain] = &OnDemandFailure{
+		Domain:     domain,
+		Reason:     reason,
+		RetryAfter: time.Now().Add(time.Duration(ttl) * time.Second).Unix(),
+	}
+}
+
+// Remove the expired failures and ask records, at most once per minute.
+// Must be called with the mutex locked
+func (o *OnDemandIssuer) removeExpiredEntries(now time.Time) {
+	if now.Sub(o.lastCleanup) < time.Minute {
+		return
+	}
+	o.lastCleanup = now
+	for domain, failure := range o.failures {
+		if now.Unix() >= failure.RetryAfter {
+			delete(o.failures, domain)
+		}
+	}
+	for clientIP, askTimes := range o.clientAskTimes {
+		if len(filterRecentTimes(askTimes, now, time.Minute)) == 0 {
+			delete(o.clientAskTimes, clientIP)
+		}
+	}
+}
+
+// Check the ask URL rate limits and record the check if allowed.
+// Must be called with the mutex locked
+func (o *OnDemandIssuer) allowAskCheck(clientIP string, now time.Time) bool {
+	o.askTimes = filterRecentTimes(o.askTimes, now, time.Minute)
+	clientAskTimes := filterRecentTimes(o.clientAskTimes[clientIP], now, time.Minute)
+	if len(o.askTimes) >= onDemandMaxAskPerMinute || len(clientAskTimes) >= onDemandMaxClientAskPerMinute {
+		o.clientAskTimes[clientIP] = clientAskTimes
+		return false
+	}
+	o.askTimes = append(o.askTimes, now)
+	o.clientAskTimes[clientIP] = append(clientAskTimes, now)
+	return true
+}
+
+// Keep the times that are within the given period before now
+func filterRecentTimes(times []time.Time, now time.Time, period time.Duration) []time.Time {
+	recentTimes := []time.Time{}
+	for _, t := range times {
+		if now.Sub(t) < period {
+			recentTimes = append(recentTimes, t)
+		}
+	}
+	return recentTimes
+}
+
+// Get the IP address of the client, without the port number
+func getClientIP(clientAddr net.Addr) string {
+	if clientAddr == nil {
+		return ""
+	}
+	if tcpAddr, ok := clientAddr.(*net.TCPAddr); ok {
+		return tcpAddr.IP.String()
+	}
+	host, _, err := net.SplitHostPort(clientAddr.String())
+	if err != nil {
+		return clientAddr.String()
+	}
+	return host
+}
+
+// IssueOnDemand obtains the certificate of the server name if allowed. It returns
+// true if the certificate is ready in the cert folder before the hold timeout.
+// The client address is used for rate limiting the ask URL checks, can be nil
+func (o *OnDemandIssuer) IssueOnDemand(serverName string, clientAddr net.Addr) bool {
+	domain := strings.ToLower(strings.TrimSuffix(serverName, "."))
+	if net.ParseIP(domain) != nil || !validDomainRegex.MatchString(domain) {
+		return false
+	}
+
+	o.mutex.Lock()
+	config := *o.Config
+	if !config.Enabled {
+		o.mutex.Unlock()
+		return false
+	}
+	now := time.Now()
+	o.removeExpiredEntries(now)
+	if done, ok := o.pending[domain]; ok {
+		//Issuance already running, wait for it
+		o.mutex.Unlock()
+		return o.waitForIssuance(domain, done, config.HoldTimeout)
+	}
+	if failure, ok := o.failures[domain]; ok {
+		if time.Now().Unix() < failure.RetryAfter {
+			o.mutex.Unlock()
+			return false
+		}
+		delete(o.failures, domain)
+	}
+	if !matchDomainPatterns(domain, config.AllowedDomains) && config.AskURL != "" && !o.allowAskCheck(getClientIP(clientAddr), now) {
+		//Too many ask URL checks, not cached as the domain is not checked
+		o.mutex.Unlock()
+		return false
+	}
+	o.mutex.Unlock()
+
+	allowed, reason := o.isDomainAllowed(domain, config)
+
+	o.mutex.Lock()
+	if !allowed {
+		o.addFailure(domain, reason, config.FailureCacheTTL)
+		o.mutex.Unlock()
+		return false
+	}
+	if done, ok := o.pending[domain]; ok {
+		o.mutex.Unlock()
+		return o.waitForIssuance(domain, done, config.HoldTimeout)
+	}
+	if o.certExists(domain) {
+		//Issued while checking with the ask URL
+		o.mutex.Unlock()
+		return true
+	}
+
+	//Check the issuance rate limit
+	now = time.Now()
+	o.issueTimes = filterRecentTimes(o.issueTimes, now, time.Hour)
+	if len(o.issueTimes) >= config.MaxIssuePerHour {
+		o.mutex.Unlock()
+		log.Println("[ACME] On-demand issuance rate limit reached, skipping " + domain)
+		return false
+	}
+	o.issueTimes = append(o.issueTimes, now)
+	done := make(chan bool)
+	o.pending[domain] = done
+	o.mutex.Unlock()
+
+	go o.issue(domain, config, done)
+	return o.waitForIssuance(domain, done, config.HoldTimeout)
+}
+
+func (o *OnDemandIssuer) waitForIssuance(domain string, done chan bool, holdTimeout int) bool {
+	if holdTimeout <= 0 {
+		return false
+	}
+	select {
+	case <-done:
+		return o.certExists(domain)
+	case <-time.After(time.Duration(holdTimeout) * time.Second):
+		return false
+	}
+}
+
+func (o *OnDemandIssuer) issue(domain string, config OnDemandConfig, done chan bool) {
+	log.Println("[ACME] Obtaining on-demand certificate for " + domain)
+	_, err := o.AcmeHandler.ObtainCert([]string{domain}, domain, config.Email, config.CA, config.CAUrl, false, &CertOptions{
+		KeyType:   config.KeyType,
+		Challenge: config.Challenge,
+	})
+
+	o.mutex.Lock()
+	if err != nil {
+		log.Println("[ACME] On-demand certificate for " + domain + " failed: " + err.Error())
+		o.addFailure(domain, err.Error(), config.FailureCacheTTL)
+	} else {
+		log.Println("[ACME] On-demand certificate for " + domain + " obtained")
+	}
+	if err == nil && o.AutoRenewer != nil {
+		//Make sure the certificate is renewed before it expires
+		o.AutoRenewer.AddFileToRenew(domain)
+	}
+	delete(o.pending, domain)
+	o.mutex.Unlock()
+	close(done)
+}
+
+// Get or set the on-demand issuance settings
+func (o *OnDemandIssuer) HandleConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		o.mutex.Lock()
+		js, _ := json.Marshal(o.Config)
+		o.mutex.Unlock()
+		utils.SendJSONResponse(w, string(js))
+		return
+	}
+
+	newConfig := OnDemandConfig{AllowedDomains: []string{}}
+	newConfig.Enabled, _ = utils.PostBool(r, "enabled")
+	allowedDomains, _ := utils.PostPara(r, "allowedDomains")
+	for _, pattern := range strings.Split(allowedDomains, ",") {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if pattern != "" {
+			newConfig.AllowedDomains = append(newConfig.AllowedDomains, pattern)
+		}
+	}
+	newConfig.AskURL, _ = utils.PostPara(r, "askURL")
+	newConfig.Email, _ = utils.PostPara(r, "email")
+	newConfig.CA, _ = utils.PostPara(r, "ca")
+	if newConfig.CA == "custom" {
+		newConfig.CAUrl, _ = utils.PostPara(r, "caURL")
+	}
+	if newConfig.CA != "" && newConfig.CA != "custom" && !o.AcmeHandler.IsValidCA(newConfig.CA) {
+		utils.SendErrorResponse(w, "CA "+jsonEscape(newConfig.CA)+" is not supported")
+		return
+	}
+	newConfig.Challenge, _ = utils.PostPara(r, "challenge")
+	newConfig.KeyType, _ = utils.PostPara(r, "keyType")
+
+	var err error
+	intParas := map[string]*int{
+		"holdTimeout":     &newConfig.HoldTimeout,
+		"maxIssuePerHour": &newConfig.MaxIssuePerHour,
+		"failureCacheTTL": &newConfig.FailureCacheTTL,
+	}
+	for key, target := range intParas {
+		value, err := utils.PostPara(r, key)
+		if err != nil {
+			utils.SendErrorResponse(w, key+" not set")
+			return
+		}
+		*target, err = strconv.Atoi(value)
+		if err != nil {
+			utils.SendErrorResponse(w, "invalid "+key)
+			return
+		}
+	}
+
+	err = newConfig.Validate()
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+
+	o.mutex.Lock()
+	o.Config = &newConfig
+	//Settings changed, allow the failed domains to be retried
+	o.failures = map[string]*OnDemandFailure{}
+	err = o.saveConfigToFile()
+	o.mutex.Unlock()
+	if err != nil {
+		utils.SendErrorResponse(w, "failed to save config: "+err.Error())
+		return
+	}
+
+	utils.SendOK(w)
+}
+
+// List the domains being issued and the domains in the negative cache
+func (o *OnDemandIssuer) HandleStatus(w http.ResponseWriter, r *http.Request) {
+	o.mutex.Lock()
+	now := time.Now()
+	status := struct {
+		Pending          []string
+		Failed           []*OnDemandFailure
+		IssuedInLastHour int
+	}{
+		Pending: []string{},
+		Failed:  []*OnDemandFailure{},
+	}
+	for domain := range o.pending {
+		status.Pending = append(status.Pending, domain)
+	}
+	for _, failure := range o.failures {
+		if now.Unix() < failure.RetryAfter {
+			status.Failed = append(status.Failed, failure)
+		}
+	}
+	for _, issueTime := range o.issueTimes {
+		if now.Sub(issueTime) < time.Hour {
+			status.IssuedInLastHour++
+		}
+	}
+	o.mutex.Unlock()
+
+	sort.Strings(status.Pending)
+	sort.Slice(status.Failed, func(i, j int) bool {
+		return status.Failed[i].Domain < status.Failed[j].Domain
+	})
+	js, _ := json.Marshal(status)
+	utils.SendJSONResponse(w, string(js))
+}
+
+// Remove a domain from the negative cache, or clear the whole cache if domain is not set
+func (o *OnDemandIssuer) HandleClearFailure(w http.ResponseWriter, r *http.Request) {
+	domain, _ := utils.PostPara(r, "domain")
+	o.mutex.Lock()
+	if domain == "" {
+		o.failures = map[string]*OnDemandFailure{}
+	} else {
+		delete(o.failures, strings.ToLower(domain))
+	}
+	o.mutex.Unlock()
+	utils.SendOK(w)
+}
@@ -0,0 +1,201 @@
+package acme_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"imuslab.com/zoraxy/mod/acme"
+)
+
+func TestOnDemandIssuer(t *testing.T) {
+	var askCount, directoryCount int32
+	askServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&askCount, 1)
+		if r.URL.Query().Get("domain") != "customer.com" {
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer askServer.Close()
+
+	//CA that is always unavailable, so every issuance fails
+	caServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&directoryCount, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer caServer.Close()
+
+	dir := t.TempDir()
+	issuer, err := acme.NewOnDemandIssuer(filepath.Join(dir, "ondemand.json"), dir, acme.NewACME(caServer.URL, "0", nil, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//Disabled by default
+	if issuer.IssueOnDemand("a.allowed.com", nil) || atomic.LoadInt32(&directoryCount) != 0 {
+		t.Fatal("on-demand issuance should be disabled by default")
+	}
+
+	issuer.Config = &acme.OnDemandConfig{
+		Enabled:         true,
+		AllowedDomains:  []string{"*.allowed.com"},
+		AskURL:          askServer.URL,
+		Email:           "admin@example.com",
+		Challenge:       acme.Challenge_HTTP01,
+		HoldTimeout:     5,
+		MaxIssuePerHour: 1,
+		FailureCacheTTL: 3600,
+	}
+	if err := issuer.Config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	//Domains denied by the ask URL are cached
+	for i := 0; i < 2; i++ {
+		if issuer.IssueOnDemand("denied.com", nil) {
+			t.Error("denied domain should not be issued")
+		}
+	}
+	if atomic.LoadInt32(&askCount) != 1 {
+		t.Errorf("expected 1 ask request, got %d", askCount)
+	}
+
+	//IP addresses and invalid names are never issued
+	if issuer.IssueOnDemand("127.0.0.1", nil) || issuer.IssueOnDemand("bad_name.com", nil) {
+		t.Error("invalid server names should not be issued")
+	}
+
+	//Failed issuance is cached
+	for i := 0; i < 2; i++ {
+		if issuer.IssueOnDemand("a.allowed.com", nil) {
+			t.Error("issuance should fail with unavailable CA")
+		}
+	}
+	if atomic.LoadInt32(&directoryCount) != 1 {
+		t.Errorf("expected 1 issuance attempt, got %d", directoryCount)
+	}
+
+	//Approved domain is blocked by the rate limit
+	if issuer.IssueOnDemand("customer.com", nil) || atomic.LoadInt32(&directoryCount) != 1 {
+		t.Error("issuance should be rate limited")
+	}
+	if atomic.LoadInt32(&askCount) != 2 {
+		t.Errorf("expected approved domain to be checked with ask URL, got %d ask requests", askCount)
+	}
+}
+
+func TestOnDemandAskRateLimit(t *testing.T) {
+	var askCount int32
+	askServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&askCount, 1)
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer askServer.Close()
+
+	dir := t.TempDir()
+	issuer, err := acme.NewOnDemandIssuer(filepath.Join(dir, "ondemand.json"), dir, acme.NewACME("https://127.0.0.1:1/directory", "0", nil, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer.Config = &acme.OnDemandConfig{
+		Enabled:         true,
+		AllowedDomains:  []string{},
+		AskURL:          askServer.URL,
+		Email:           "admin@example.com",
+		Challenge:       acme.Challenge_HTTP01,
+		MaxIssuePerHour: 10,
+		FailureCacheTTL: 3600,
+	}
+
+	//Each client can only trigger a limited number of ask URL checks
+	client := &net.TCPAddr{IP: net.ParseIP("203.0.113.1"), Port: 50000}
+	for i := 0; i < 20; i++ {
+		issuer.IssueOnDemand("client1-"+strconv.Itoa(i)+".com", client)
+	}
+	if atomic.LoadInt32(&askCount) != 10 {
+		t.Errorf("expected 10 ask requests from a single client, got %d", askCount)
+	}
+
+	//The total number of ask URL checks is also limited
+	for c := 2; c <= 10; c++ {
+		client := &net.TCPAddr{IP: net.ParseIP("203.0.113." + strconv.Itoa(c)), Port: 50000}
+		for i := 0; i < 10; i++ {
+			issuer.IssueOnDemand("client"+strconv.Itoa(c)+"-"+strconv.Itoa(i)+".com", client)
+		}
+	}
+	if atomic.LoadInt32(&askCount) != 60 {
+		t.Errorf("expected 60 ask requests in total, got %d", askCount)
+	}
+}
+
+// Write a self signed certificate of the domain that expires at notAfter
+func writeTestCert(t *testing.T, dir string, domain string, notAfter time.Time) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: domain},
+		DNSNames:     []string{domain},
+		NotBefore:    notAfter.Add(-90 * 24 * time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+	os.WriteFile(filepath.Join(dir, domain+".crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	os.WriteFile(filepath.Join(dir, domain+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+}
+
+func TestOnDemandReissueExpired(t *testing.T) {
+	var directoryCount int32
+	caServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&directoryCount, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer caServer.Close()
+
+	dir := t.TempDir()
+	issuer, err := acme.NewOnDemandIssuer(filepath.Join(dir, "ondemand.json"), dir, acme.NewACME(caServer.URL, "0", nil, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer.Config = &acme.OnDemandConfig{
+		Enabled:         true,
+		AllowedDomains:  []string{"*.allowed.com"},
+		Email:           "admin@example.com",
+		Challenge:       acme.Challenge_HTTP01,
+		HoldTimeout:     5,
+		MaxIssuePerHour: 10,
+		FailureCacheTTL: 3600,
+	}
+
+	//Valid certificates are used as is
+	writeTestCert(t, dir, "valid.allowed.com", time.Now().Add(60*24*time.Hour))
+	if !issuer.IssueOnDemand("valid.allowed.com", nil) || atomic.LoadInt32(&directoryCount) != 0 {
+		t.Error("valid certificate should be served without issuance")
+	}
+
+	//Expired and expiring certificates are issued again
+	writeTestCert(t, dir, "expired.allowed.com", time.Now().Add(-time.Hour))
+	writeTestCert(t, dir, "expiring.allowed.com", time.Now().Add(24*time.Hour))
+	if issuer.IssueOnDemand("expired.allowed.com", nil) || issuer.IssueOnDemand("expiring.allowed.com", nil) {
+		t.Error("issuance should fail with unavailable CA")
+	}
+	if atomic.LoadInt32(&directoryCount) != 2 {
+		t.Errorf("expected 2 issuance attempts, got %d", directoryCount)
+	}
+}
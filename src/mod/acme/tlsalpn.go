@@ -0,0 +1,53 @@
+package acme
+
+import (
+	"crypto/tls"
+
+	"github.com/go-acme/lego/v4/challenge/tlsalpn01"
+)
+
+/*
+	TLSALPN.go
+
+	TLS-ALPN-01 challenge provider. Instead of starting a temporary
+	listener, the challenge certificates are handed over to the main
+	TLS listener of the reverse proxy, which answers acme-tls/1
+	handshakes with them
+*/
+
+// Supported ACME challenge types
+const (
+	Challenge_HTTP01    = "http-01"
+	Challenge_TLSALPN01 = "tls-alpn-01"
+)
+
+// Store of the challenge certificates served by the main TLS listener
+type ChallengeCertStore interface {
+	SetChallengeCert(domain string, cert *tls.Certificate)
+	RemoveChallengeCert(domain string)
+}
+
+type tlsALPNProvider struct {
+	store ChallengeCertStore
+}
+
+// Present the challenge certificate of the domain on the TLS listener
+func (p *tlsALPNProvider) Present(domain, token, keyAuth string) error {
+	cert, err := tlsalpn01.ChallengeCert(domain, keyAuth)
+	if err != nil {
+		return err
+	}
+	p.store.SetChallengeCert(domain, cert)
+	return nil
+}
+
+// Remove the challenge certificate after validation
+func (p *tlsALPNProvider) CleanUp(domain, token, keyAuth string) error {
+	p.store.RemoveChallengeCert(domain)
+	return nil
+}
+
+// Check if the challenge type is supported. Empty challenge type use HTTP-01
+func IsValidChallenge(challengeType string) bool {
+	return challengeType == "" || challengeType == Challenge_HTTP01 || challengeType == Challenge_TLSALPN01
+}
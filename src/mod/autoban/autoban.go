@@ -0,0 +1,346 @@
+package autoban
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"imuslab.com/zoraxy/mod/database"
+	"imuslab.com/zoraxy/mod/geodb"
+)
+
+/*
+	Autoban.go
+
+	Fail2ban-style behaviour tracker. Events (like auth failures) are
+	counted per client IP over a sliding window. When a client exceed
+	the threshold of that event type, its IP address will be added
+	to the geodb blacklist until the ban expires
+*/
+
+const (
+	Event_AuthFailure = "auth" //Basic auth failures
+	Event_ClientError = "4xx"  //Requests that ends up in 4xx status code
+	Event_WafHit      = "waf"  //Requests that matches WAF rules
+)
+
+const defaultSweepInterval = 30 * time.Second
+
+type Threshold struct {
+	Enabled     bool  //If this event type will trigger auto ban
+	MaxEvents   int   //Max number of events allowed within the window
+	Window      int64 //Sliding window size in seconds
+	BanDuration int64 //Ban duration in seconds
+}
+
+type Ban struct {
+	IpAddr    string //Banned IP address
+	EventType string //The event type that trigger the ban
+	Reason    string //Human readable reason of this ban
+	BannedAt  int64  //Unix timestamp of the ban
+	ExpireAt  int64  //Unix timestamp of the ban expires
+}
+
+type Options struct {
+	Database      *database.Database //Database for storing thresholds and active bans
+	GeodbStore    *geodb.Store       //Geodb store for writing the blacklist
+	SweepInterval time.Duration      //Interval for removing expired bans, set to 0 for default (30s)
+}
+
+type Tracker struct {
+	Options    *Options
+	thresholds map[string]*Threshold
+	events     map[string][]time.Time //Event timestamps, in eventType/ip as key
+	bans       map[string]*Ban        //Active bans, in ip as key
+	mutex      sync.Mutex
+	stopChan   chan bool
+}
+
+// Default thresholds of each event types
+func defaultThresholds() map[string]*Threshold {
+	return map[string]*Threshold{
+		Event_AuthFailure: {
+			Enabled:     true,
+			MaxEvents:   5,
+			Window:      60,
+			BanDuration: 600,
+		},
+		Event_ClientError: {
+			Enabled:     false,
+			MaxEvents:   100,
+			Window:      60,
+			BanDuration: 600,
+		},
+		Event_WafHit: {
+			Enabled:     true,
+			MaxEvents:   10,
+			Window:      60,
+			BanDuration: 3600,
+		},
+	}
+}
+
+// Create a new behaviour tracker and restore the active bans from database
+func NewTracker(options *Options) (*Tracker, error) {
+	if options.GeodbStore == nil {
+		return nil, errors.New("geodb store cannot be nil")
+	}
+
+	if options.SweepInterval <= 0 {
+		options.SweepInterval = defaultSweepInterval
+	}
+
+	thisTracker := Tracker{
+		Options:    options,
+		thresholds: defaultThresholds(),
+		events:     map[string][]time.Time{},
+		bans:       map[string]*Ban{},
+		stopChan:   make(chan bool),
+	}
+
+	if options.Database != nil {
+		err := options.Database.NewTable("autoban")
+		if err != nil {
+			return nil, err
+		}
+
+		//Restore thresholds and active bans
+		entries, _ := options.Database.ListTable("autoban")
+		for _, keypairs := range entries {
+			key := string(keypairs[0])
+			if strings.HasPrefix(key, "threshold/") {
+				eventType := strings.TrimPrefix(key, "threshold/")
+				threshold := Threshold{}
+				if json.Unmarshal(keypairs[1], &threshold) == nil && thisTracker.thresholds[eventType] != nil {
+					thisTracker.thresholds[eventType] = &threshold
+				}
+			} else if strings.HasPrefix(key, "ban/") {
+				ban := Ban{}
+				if json.Unmarshal(keypairs[1], &ban) == nil {
+					thisTracker.bans[ban.IpAddr] = &ban
+				}
+			}
+		}
+	}
+
+	go thisTracker.sweep()
+	return &thisTracker, nil
+}
+
+// Check if the given event type is supported
+func IsValidEventType(eventType string) bool {
+	return eventType == Event_AuthFailure || eventType == Event_ClientError || eventType == Event_WafHit
+}
+
+// Record an event from the given client IP. The IP will be banned
+// if it exceed the threshold of this event type
+func (t *Tracker) RecordEvent(ipAddr string, eventType string) {
+	if ipAddr == "" || isExcludedAddr(ipAddr) {
+		return
+	}
+
+	t.mutex.Lock()
+	threshold, ok := t.thresholds[eventType]
+	if !ok || !threshold.Enabled || threshold.MaxEvents <= 0 {
+		t.mutex.Unlock()
+		return
+	}
+
+	if _, banned := t.bans[ipAddr]; banned {
+		t.mutex.Unlock()
+		return
+	}
+
+	//Drop the events that fall outside the sliding window
+	now := time.Now()
+	windowStart := now.Add(-time.Duration(threshold.Window) * time.Second)
+	key := eventType + "/" + ipAddr
+	events := []time.Time{}
+	for _, eventTime := range t.events[key] {
+		if eventTime.After(windowStart) {
+			events = append(events, eventTime)
+		}
+	}
+	events = append(events, now)
+
+	if len(events) < threshold.MaxEvents {
+		t.events[key] = events
+		t.mutex.Unlock()
+		return
+	}
+
+	//Threshold exceeded
+	delete(t.events, key)
+	reason := fmt.Sprintf("%d %s events within %d seconds", len(events), eventType, threshold.Window)
+	banDuration := threshold.BanDuration
+	t.mutex.Unlock()
+
+	t.Ban(ipAddr, eventType, reason, banDuration)
+}
+
+// Ban an IP address for the given duration (in seconds)
+func (t *Tracker) Ban(ipAddr string, eventType string, reason string, duration int64) error {
+	if t.Options.GeodbStore.IsIPBlacklisted(ipAddr) {
+		//Already blacklisted, maybe by user manually. Do not touch it
+		return errors.New("ip address already blacklisted")
+	}
+
+	now := time.Now().Unix()
+	ban := Ban{
+		IpAddr:    ipAddr,
+		EventType: eventType,
+		Reason:    reason,
+		BannedAt:  now,
+		ExpireAt:  now + duration,
+	}
+
+	t.mutex.Lock()
+	t.bans[ipAddr] = &ban
+	t.mutex.Unlock()
+
+	//Also stored as an expiring blacklist entry, so the ban is shown with its reason
+	//in the access list and lifted by geodb even if the tracker is not running
+	t.Options.GeodbStore.AddIPToBlackListWithEntry(ipAddr, &geodb.AccessEntry{
+		Comment:  reason,
+		Source:   geodb.EntrySource_Auto,
+		ExpireAt: ban.ExpireAt,
+	})
+	if t.Options.Database != nil {
+		t.Options.Database.Write("autoban", "ban/"+ipAddr, ban)
+	}
+
+	log.Println("[Autoban] Banned " + ipAddr + " for " + fmt.Sprint(duration) + " seconds: " + reason)
+	return nil
+}
+
+// Remove a ban created by the tracker
+func (t *Tracker) Unban(ipAddr string) error {
+	t.mutex.Lock()
+	_, ok := t.bans[ipAddr]
+	if !ok {
+		t.mutex.Unlock()
+		return errors.New("ip address is not banned by autoban")
+	}
+	delete(t.bans, ipAddr)
+	t.mutex.Unlock()
+
+	t.Options.GeodbStore.RemoveIPFromBlackList(ipAddr)
+	if t.Options.Database != nil {
+		t.Options.Database.Delete("autoban", "ban/"+ipAddr)
+	}
+	return nil
+}
+
+// Check if an IP address is currently banned by the tracker
+func (t *Tracker) IsBanned(ipAddr string) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	_, ok := t.bans[ipAddr]
+	return ok
+}
+
+// List all active bans
+func (t *Tracker) ListBans() []*Ban {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	results := []*Ban{}
+	for _, ban := range t.bans {
+		thisBan := *ban
+		results = append(results, &thisBan)
+	}
+	return results
+}
+
+// Get a copy of the thresholds of all event types
+func (t *Tracker) GetThresholds() map[string]Threshold {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	results := map[string]Threshold{}
+	for eventType, threshold := range t.thresholds {
+		results[eventType] = *threshold
+	}
+	return results
+}
+
+// Update the threshold of an event type
+func (t *Tracker) SetThreshold(eventType string, threshold *Threshold) error {
+	if !IsValidEventType(eventType) {
+		return errors.New("invalid event type")
+	}
+
+	if threshold.MaxEvents <= 0 || threshold.Window <= 0 || threshold.BanDuration <= 0 {
+		return errors.New("max events, window and ban duration must be positive")
+	}
+
+	t.mutex.Lock()
+	t.thresholds[eventType] = threshold
+	t.mutex.Unlock()
+
+	if t.Options.Database != nil {
+		return t.Options.Database.Write("autoban", "threshold/"+eventType, threshold)
+	}
+	return nil
+}
+
+// Remove expired bans and stale event records
+func (t *Tracker) sweep() {
+	ticker := time.NewTicker(t.Options.SweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.stopChan:
+			return
+		case <-ticker.C:
+			t.removeExpiredBans()
+			t.removeStaleEvents()
+		}
+	}
+}
+
+func (t *Tracker) removeExpiredBans() {
+	now := time.Now().Unix()
+	expiredIps := []string{}
+	t.mutex.Lock()
+	for ipAddr, ban := range t.bans {
+		if ban.ExpireAt <= now {
+			expiredIps = append(expiredIps, ipAddr)
+		}
+	}
+	t.mutex.Unlock()
+
+	for _, ipAddr := range expiredIps {
+		t.Unban(ipAddr)
+		log.Println("[Autoban] Ban on " + ipAddr + " expired")
+	}
+}
+
+func (t *Tracker) removeStaleEvents() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for key, events := range t.events {
+		eventType := strings.SplitN(key, "/", 2)[0]
+		threshold, ok := t.thresholds[eventType]
+		if !ok || len(events) == 0 || time.Since(events[len(events)-1]) > time.Duration(threshold.Window)*time.Second {
+			delete(t.events, key)
+		}
+	}
+}
+
+// Stop the tracker background worker
+func (t *Tracker) Close() {
+	t.stopChan <- true
+}
+
+// Loopback addresses are never banned so the admin won't lock themselves out
+func isExcludedAddr(ipAddr string) bool {
+	ip := net.ParseIP(ipAddr)
+	if ip == nil {
+		return true
+	}
+	return ip.IsLoopback()
+}
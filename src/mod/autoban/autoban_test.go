@@ -0,0 +1,112 @@
+package autoban_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"imuslab.com/zoraxy/mod/autoban"
+	"imuslab.com/zoraxy/mod/database"
+	"imuslab.com/zoraxy/mod/geodb"
+)
+
+func newTestTracker(t *testing.T) (*autoban.Tracker, *geodb.Store) {
+	db, err := database.NewDatabase(filepath.Join(t.TempDir(), "test.db"), false)
+	if err != nil {
+		t.Fatalf("Unable to create database: %v", err)
+	}
+	t.Cleanup(db.Close)
+
+	store, err := geodb.NewGeoDb(db, &geodb.StoreOptions{
+		AllowSlowIpv4LookUp: true,
+		AllowSloeIpv6Lookup: true,
+	})
+	if err != nil {
+		t.Fatalf("Unable to create geodb store: %v", err)
+	}
+
+	tracker, err := autoban.NewTracker(&autoban.Options{
+		Database:   db,
+		GeodbStore: store,
+	})
+	if err != nil {
+		t.Fatalf("Unable to create tracker: %v", err)
+	}
+	t.Cleanup(tracker.Close)
+	return tracker, store
+}
+
+func TestBanAfterThreshold(t *testing.T) {
+	tracker, store := newTestTracker(t)
+	err := tracker.SetThreshold(autoban.Event_AuthFailure, &autoban.Threshold{
+		Enabled:     true,
+		MaxEvents:   3,
+		Window:      60,
+		BanDuration: 600,
+	})
+	if err != nil {
+		t.Fatalf("Unable to set threshold: %v", err)
+	}
+
+	ipAddr := "203.0.113.10"
+	tracker.RecordEvent(ipAddr, autoban.Event_AuthFailure)
+	tracker.RecordEvent(ipAddr, autoban.Event_AuthFailure)
+	if tracker.IsBanned(ipAddr) {
+		t.Fatalf("IP should not be banned before reaching threshold")
+	}
+
+	tracker.RecordEvent(ipAddr, autoban.Event_AuthFailure)
+	if !tracker.IsBanned(ipAddr) {
+		t.Fatalf("IP should be banned after reaching threshold")
+	}
+
+	if !store.IsIPBlacklisted(ipAddr) {
+		t.Errorf("Banned IP should be added to blacklist")
+	}
+
+	bans := tracker.ListBans()
+	if len(bans) != 1 || bans[0].EventType != autoban.Event_AuthFailure || bans[0].ExpireAt-bans[0].BannedAt != 600 {
+		t.Errorf("Unexpected ban list: %+v", bans)
+	}
+}
+
+func TestUnban(t *testing.T) {
+	tracker, store := newTestTracker(t)
+	ipAddr := "203.0.113.20"
+	err := tracker.Ban(ipAddr, autoban.Event_WafHit, "test", 600)
+	if err != nil {
+		t.Fatalf("Unable to ban ip: %v", err)
+	}
+
+	err = tracker.Unban(ipAddr)
+	if err != nil {
+		t.Fatalf("Unable to unban ip: %v", err)
+	}
+
+	if tracker.IsBanned(ipAddr) || store.IsIPBlacklisted(ipAddr) {
+		t.Errorf("IP should be removed from blacklist after unban")
+	}
+}
+
+func TestDisabledEventTypeIgnored(t *testing.T) {
+	tracker, _ := newTestTracker(t)
+	ipAddr := "203.0.113.30"
+	for i := 0; i < 500; i++ {
+		//4xx event type is disabled by default
+		tracker.RecordEvent(ipAddr, autoban.Event_ClientError)
+	}
+
+	if tracker.IsBanned(ipAddr) {
+		t.Errorf("Disabled event type should not trigger ban")
+	}
+}
+
+func TestLoopbackNeverBanned(t *testing.T) {
+	tracker, _ := newTestTracker(t)
+	for i := 0; i < 50; i++ {
+		tracker.RecordEvent("127.0.0.1", autoban.Event_AuthFailure)
+	}
+
+	if tracker.IsBanned("127.0.0.1") {
+		t.Errorf("Loopback address should never be banned")
+	}
+}
@@ -0,0 +1,129 @@
+package autoban
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"imuslab.com/zoraxy/mod/utils"
+)
+
+/*
+	Handler.go
+
+	Handlers for the autoban management APIs
+*/
+
+type BanStatus struct {
+	Ban
+	RemainingTTL int64 //Remaining ban time in seconds
+}
+
+// List all the active bans with their remaining TTL
+func (t *Tracker) HandleListBans(w http.ResponseWriter, r *http.Request) {
+	now := time.Now().Unix()
+	results := []*BanStatus{}
+	for _, ban := range t.ListBans() {
+		remaining := ban.ExpireAt - now
+		if remaining < 0 {
+			remaining = 0
+		}
+		results = append(results, &BanStatus{
+			Ban:          *ban,
+			RemainingTTL: remaining,
+		})
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].BannedAt > results[j].BannedAt
+	})
+
+	js, _ := json.Marshal(results)
+	utils.SendJSONResponse(w, string(js))
+}
+
+func (t *Tracker) HandleUnban(w http.ResponseWriter, r *http.Request) {
+	ipAddr, err := utils.PostPara(r, "ip")
+	if err != nil {
+		utils.SendErrorResponse(w, "invalid ip given")
+		return
+	}
+
+	err = t.Unban(ipAddr)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+
+	utils.SendOK(w)
+}
+
+func (t *Tracker) HandleListThresholds(w http.ResponseWriter, r *http.Request) {
+	js, _ := json.Marshal(t.GetThresholds())
+	utils.SendJSONResponse(w, string(js))
+}
+
+func (t *Tracker) HandleUpdateThreshold(w http.ResponseWriter, r *http.Request) {
+	eventType, err := utils.PostPara(r, "type")
+	if err != nil || !IsValidEventType(eventType) {
+		utils.SendErrorResponse(w, "invalid event type given")
+		return
+	}
+
+	enabled, err := utils.PostBool(r, "enabled")
+	if err != nil {
+		utils.SendErrorResponse(w, "invalid enabled state given")
+		return
+	}
+
+	maxEvents, err := utils.PostPara(r, "maxevents")
+	if err != nil {
+		utils.SendErrorResponse(w, "invalid max events given")
+		return
+	}
+
+	maxEventsInt, err := strconv.Atoi(maxEvents)
+	if err != nil {
+		utils.SendErrorResponse(w, "invalid max events given")
+		return
+	}
+
+	window, err := utils.PostPara(r, "window")
+	if err != nil {
+		utils.SendErrorResponse(w, "invalid window given")
+		return
+	}
+
+	windowInt, err := utils.StringToInt64(window)
+	if err != nil {
+		utils.SendErrorResponse(w, "invalid window given")
+		return
+	}
+
+	duration, err := utils.PostPara(r, "duration")
+	if err != nil {
+		utils.SendErrorResponse(w, "invalid ban duration given")
+		return
+	}
+
+	durationInt, err := utils.StringToInt64(duration)
+	if err != nil {
+		utils.SendErrorResponse(w, "invalid ban duration given")
+		return
+	}
+
+	err = t.SetThreshold(eventType, &Threshold{
+		Enabled:     enabled,
+		MaxEvents:   maxEventsInt,
+		Window:      windowInt,
+		BanDuration: durationInt,
+	})
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+
+	utils.SendOK(w)
+}
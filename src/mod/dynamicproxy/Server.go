@@ -22,6 +22,7 @@ import (
 	- Blacklist
 	- Whitelist
 	- Redirectable
+	- Web Application Firewall (per endpoint)
 	- Subdomain Routing
 	- Vitrual Directory Routing
 */
@@ -32,6 +33,13 @@ var (
 )
 
 func (h *ProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.Parent.Option.AccessLogger != nil || h.Parent.Option.MetricsCollector != nil || h.Parent.Option.StatisticCollector != nil || h.Parent.Option.LiveStream != nil {
+		//Record the request and response for access log, metrics and statistics
+		rw, lr := h.startAccessLog(w, r)
+		defer h.finishAccessLog(rw, lr)
+		w, r = rw, lr
+	}
+
 	/*
 		Special Routing Rules, bypass most of the limitations
 	*/
@@ -84,6 +92,11 @@ func (h *ProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		//This might be a subdomain. See if there are any subdomain proxy router for this
 		sep := h.Parent.getSubdomainProxyEndpointFromHostname(domainOnly)
 		if sep != nil {
+			setAccessLogEndpoint(r, sep)
+			sep.setHSTSHeader(w, r)
+			if h.handleWafRouting(w, r, sep) {
+				return
+			}
 			if sep.RequireBasicAuth {
 				err := h.handleBasicAuthRouting(w, r, sep)
 				if err != nil {
@@ -102,6 +115,10 @@ func (h *ProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	proxyingPath := strings.TrimSpace(r.RequestURI)
 	targetProxyEndpoint := h.Parent.getTargetProxyEndpointFromRequestURI(proxyingPath)
 	if targetProxyEndpoint != nil {
+		setAccessLogEndpoint(r, targetProxyEndpoint)
+		if h.handleWafRouting(w, r, targetProxyEndpoint) {
+			return
+		}
 		if targetProxyEndpoint.RequireBasicAuth {
 			if err := h.handleBasicAuthRouting(w, r, targetProxyEndpoint); err != nil {
 				return
@@ -132,6 +149,7 @@ Once entered this routing segment, the root routing options will take over
 for the routing logic.
 */
 func (h *ProxyHandler) handleRootRouting(w http.ResponseWriter, r *http.Request) {
+	setAccessLogEndpoint(r, h.Parent.Root)
 	domainOnly := r.Host
 	if strings.Contains(r.Host, ":") {
 		hostPath := strings.Split(r.Host, ":")
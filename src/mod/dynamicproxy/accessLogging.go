@@ -0,0 +1,254 @@
+package dynamicproxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"imuslab.com/zoraxy/mod/accesslog"
+	"imuslab.com/zoraxy/mod/geodb"
+)
+
+/*
+	accessLogging.go
+
+	This script wraps the request and response writer of each request
+	to collect the information required by the access log, e.g. the
+	real status code, bytes transfered and upstream latency.
+	The same records are also used for the request metrics.
+	Each request is tagged with a request ID that is forwarded to
+	the upstream via the X-Request-ID header
+*/
+
+type accessLogContextKey struct{}
+
+type accessLogState struct {
+	entry         accesslog.Entry
+	startTime     time.Time
+	endpoint      *ProxyEndpoint //Matched proxy endpoint, nil if not matched
+	upstreamStart time.Time      //Time when the request is forwarded to upstream
+	recorder      *responseRecorder
+	bytesIn       int64
+}
+
+// Response writer that records the status code, bytes written and time to first byte
+type responseRecorder struct {
+	http.ResponseWriter
+	statusCode    int
+	bytesWritten  int64
+	headerWritten time.Time
+}
+
+func (rr *responseRecorder) WriteHeader(statusCode int) {
+	if rr.statusCode == 0 {
+		rr.statusCode = statusCode
+		rr.headerWritten = time.Now()
+	}
+	rr.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (rr *responseRecorder) Write(b []byte) (int, error) {
+	if rr.statusCode == 0 {
+		rr.WriteHeader(http.StatusOK)
+	}
+	n, err := rr.ResponseWriter.Write(b)
+	rr.bytesWritten += int64(n)
+	return n, err
+}
+
+func (rr *responseRecorder) Flush() {
+	if flusher, ok := rr.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// CloseNotify is used by the proxy core to cancel upstream requests
+func (rr *responseRecorder) CloseNotify() <-chan bool {
+	if notifier, ok := rr.ResponseWriter.(http.CloseNotifier); ok {
+		return notifier.CloseNotify()
+	}
+	return make(chan bool)
+}
+
+// Hijack is required by the websocket proxy
+func (rr *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := rr.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer does not support hijacking")
+	}
+	if rr.statusCode == 0 {
+		rr.statusCode = http.StatusSwitchingProtocols
+		rr.headerWritten = time.Now()
+	}
+	return hijacker.Hijack()
+}
+
+// Request body wrapper that count the bytes read
+type countingReadCloser struct {
+	io.ReadCloser
+	counter *int64
+}
+
+func (c *countingReadCloser) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	atomic.AddInt64(c.counter, int64(n))
+	return n, err
+}
+
+// Generate a new request ID, or reuse the one given by the downstream proxy
+func getRequestID(r *http.Request) string {
+	requestID := r.Header.Get("X-Request-ID")
+	if isValidRequestID(requestID) {
+		return requestID
+	}
+
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Check if the request ID only contains [A-Za-z0-9._-], so it is safe to be logged
+func isValidRequestID(requestID string) bool {
+	if requestID == "" || len(requestID) > 128 {
+		return false
+	}
+
+	for _, c := range requestID {
+		if !(c >= 'a' && c <= 'z') && !(c >= 'A' && c <= 'Z') && !(c >= '0' && c <= '9') &&
+			c != '.' && c != '_' && c != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+// Wrap the request and response writer for access logging
+func (h *ProxyHandler) startAccessLog(w http.ResponseWriter, r *http.Request) (*responseRecorder, *http.Request) {
+	requestID := getRequestID(r)
+	r.Header.Set("X-Request-ID", requestID)
+	w.Header().Set("X-Request-ID", requestID)
+
+	state := accessLogState{
+		startTime: time.Now(),
+		entry: accesslog.Entry{
+			RequestID: requestID,
+			ClientIP:  geodb.GetRequesterIP(r),
+			Host:      r.Host,
+			Method:    r.Method,
+			URI:       r.RequestURI,
+			Protocol:  r.Proto,
+			Referer:   r.Referer(),
+			UserAgent: r.UserAgent(),
+		},
+	}
+
+	if r.TLS != nil {
+		state.entry.TLSVersion = accesslog.TLSVersionName(r.TLS.Version)
+	}
+
+	if r.Body != nil && r.Body != http.NoBody {
+		r.Body = &countingReadCloser{ReadCloser: r.Body, counter: &state.bytesIn}
+	}
+
+	state.recorder = &responseRecorder{ResponseWriter: w}
+	r = r.WithContext(context.WithValue(r.Context(), accessLogContextKey{}, &state))
+	return state.recorder, r
+}
+
+// Write the access log entry and metrics of a finished request
+func (h *ProxyHandler) finishAccessLog(rw *responseRecorder, r *http.Request) {
+	state := getAccessLogState(r)
+	if state == nil {
+		return
+	}
+
+	entry := state.entry
+	entry.Timestamp = state.startTime
+	entry.StatusCode = rw.statusCode
+	if entry.StatusCode == 0 {
+		//Nothing written, net/http will reply with 200
+		entry.StatusCode = http.StatusOK
+	}
+	entry.BytesIn = atomic.LoadInt64(&state.bytesIn)
+	entry.BytesOut = rw.bytesWritten
+	duration := time.Since(state.startTime)
+	entry.DurationMs = float64(duration.Microseconds()) / 1000
+	if !state.upstreamStart.IsZero() && rw.headerWritten.After(state.upstreamStart) {
+		entry.UpstreamLatencyMs = float64(rw.headerWritten.Sub(state.upstreamStart).Microseconds()) / 1000
+	}
+
+	format := accesslog.Format_Default
+	if state.endpoint != nil {
+		entry.Endpoint = state.endpoint.RootOrMatchingDomain
+		format = state.endpoint.AccessLogFormat
+	}
+
+	if h.Parent.Option.MetricsCollector != nil {
+		endpointName := entry.Endpoint
+		if endpointName == "" {
+			endpointName = "unmatched"
+		}
+		h.Parent.Option.MetricsCollector.ObserveRequest(endpointName, entry.StatusCode, duration, entry.BytesIn, entry.BytesOut)
+	}
+
+	if h.Parent.Option.AccessLogger != nil {
+		h.Parent.Option.AccessLogger.Log(&entry, format)
+	}
+}
+
+func getAccessLogState(r *http.Request) *accessLogState {
+	state, _ := r.Context().Value(accessLogContextKey{}).(*accessLogState)
+	return state
+}
+
+// Set the matched proxy endpoint of this request for access logging
+func setAccessLogEndpoint(r *http.Request, endpoint *ProxyEndpoint) {
+	if state := getAccessLogState(r); state != nil {
+		state.endpoint = endpoint
+	}
+}
+
+// Mark the request as being forwarded to the upstream
+func setAccessLogUpstream(r *http.Request, upstream string) {
+	if state := getAccessLogState(r); state != nil {
+		state.entry.Upstream = upstream
+		state.upstreamStart = time.Now()
+	}
+}
+
+// Get the matched endpoint, time elapsed and the status code written to
+// client so far of this request. Status code is 0 if nothing is written yet
+func getRequestOutcome(r *http.Request) (string, time.Duration, int) {
+	state := getAccessLogState(r)
+	if state == nil {
+		return "", 0, 0
+	}
+
+	endpoint := ""
+	if state.endpoint != nil {
+		endpoint = state.endpoint.RootOrMatchingDomain
+	}
+	return endpoint, time.Since(state.startTime), state.recorder.statusCode
+}
+
+// Get the host requested by the client, as r.Host is rewritten before proxying
+func getRequestOriginalHost(r *http.Request) string {
+	if state := getAccessLogState(r); state != nil {
+		return state.entry.Host
+	}
+	return r.Host
+}
+
+// Set the forward type of this request for access logging
+func setAccessLogForwardType(r *http.Request, forwardType string) {
+	if state := getAccessLogState(r); state != nil {
+		state.entry.ForwardType = forwardType
+	}
+}
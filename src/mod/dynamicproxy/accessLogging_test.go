@@ -0,0 +1,38 @@
+package dynamicproxy_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequestIDSanitized(t *testing.T) {
+	var upstreamRequestID string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamRequestID = r.Header.Get("X-Request-ID")
+	}))
+	defer upstream.Close()
+	handler, _ := newAutobanTestHandler(t, upstream.URL)
+
+	tests := map[string]bool{
+		"req-2026.10_19":              true,
+		"abc\" status=200 forged=\"1": false,
+		"abc\nGET /admin 200":         false,
+		"":                            false,
+	}
+	for requestID, kept := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Host = "app.example.com"
+		r.Header.Set("X-Request-ID", requestID)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		responseID := w.Header().Get("X-Request-ID")
+		if responseID == "" || responseID != upstreamRequestID {
+			t.Errorf("expected the same request ID sent to upstream and client, got %q and %q", upstreamRequestID, responseID)
+		}
+		if (responseID == requestID) != kept {
+			t.Errorf("unexpected request ID %q for given ID %q", responseID, requestID)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package dynamicproxy_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"imuslab.com/zoraxy/mod/auth"
+	"imuslab.com/zoraxy/mod/autoban"
+	"imuslab.com/zoraxy/mod/database"
+	"imuslab.com/zoraxy/mod/dynamicproxy"
+	"imuslab.com/zoraxy/mod/dynamicproxy/redirection"
+	"imuslab.com/zoraxy/mod/geodb"
+	"imuslab.com/zoraxy/mod/livestream"
+)
+
+// Create a proxy handler that forward app.example.com and secure.example.com (basic auth) to upstream
+func newAutobanTestHandler(t *testing.T, upstream string) (http.Handler, *autoban.Tracker) {
+	db, err := database.NewDatabase(filepath.Join(t.TempDir(), "test.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(db.Close)
+	store, err := geodb.NewGeoDb(db, &geodb.StoreOptions{AllowSlowIpv4LookUp: true, AllowSloeIpv6Lookup: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracker, err := autoban.NewTracker(&autoban.Options{Database: db, GeodbStore: store})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(tracker.Close)
+	for _, eventType := range []string{autoban.Event_ClientError, autoban.Event_AuthFailure} {
+		tracker.SetThreshold(eventType, &autoban.Threshold{Enabled: true, MaxEvents: 3, Window: 60, BanDuration: 600})
+	}
+	redirectTable, err := redirection.NewRuleTable(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	router, err := dynamicproxy.NewDynamicProxy(dynamicproxy.RouterOption{
+		HostUUID:          "test",
+		GeodbStore:        store,
+		RedirectRuleTable: redirectTable,
+		AutobanTracker:    tracker,
+		LiveStream:        livestream.NewHub(&livestream.Options{}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstreamHost := strings.TrimPrefix(upstream, "http://")
+	router.AddSubdomainRoutingService(&dynamicproxy.SubdOptions{MatchingDomain: "app.example.com", Domain: upstreamHost})
+	router.AddSubdomainRoutingService(&dynamicproxy.SubdOptions{
+		MatchingDomain:       "secure.example.com",
+		Domain:               upstreamHost,
+		RequireBasicAuth:     true,
+		BasicAuthCredentials: []*dynamicproxy.BasicAuthCredentials{{Username: "admin", PasswordHash: auth.Hash("password")}},
+	})
+	return &dynamicproxy.ProxyHandler{Parent: router}, tracker
+}
+
+func TestAutobanUpstreamClientErrors(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer upstream.Close()
+	handler, tracker := newAutobanTestHandler(t, upstream.URL)
+
+	//Probe scans answered with 404 by upstream are counted
+	for i := 0; i < 3; i++ {
+		r := httptest.NewRequest("GET", "/wp-admin/"+string(rune('a'+i)), nil)
+		r.Host = "app.example.com"
+		r.RemoteAddr = "203.0.113.10:1234"
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+	}
+	bans := tracker.ListBans()
+	if len(bans) != 1 || bans[0].EventType != autoban.Event_ClientError {
+		t.Fatalf("upstream 4xx responses not counted toward auto ban: %+v", bans)
+	}
+}
+
+func TestAutobanAuthFailureCountedOnce(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+	handler, tracker := newAutobanTestHandler(t, upstream.URL)
+	tracker.SetThreshold(autoban.Event_ClientError, &autoban.Threshold{Enabled: true, MaxEvents: 1, Window: 60, BanDuration: 600})
+
+	//Auth failures are only counted as auth failure, which is below its threshold
+	for i := 0; i < 2; i++ {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Host = "secure.example.com"
+		r.RemoteAddr = "203.0.113.20:1234"
+		r.SetBasicAuth("admin", "wrong")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != http.StatusUnauthorized {
+			t.Fatalf("expected 401, got %d", w.Code)
+		}
+	}
+	if tracker.IsBanned("203.0.113.20") {
+		t.Fatal("auth failure counted more than once")
+	}
+}
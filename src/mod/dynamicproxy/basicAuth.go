@@ -6,6 +6,7 @@ import (
 	"strings"
 
 	"imuslab.com/zoraxy/mod/auth"
+	"imuslab.com/zoraxy/mod/autoban"
 )
 
 /*
@@ -49,6 +50,7 @@ func (h *ProxyHandler) handleBasicAuthRouting(w http.ResponseWriter, r *http.Req
 
 	if !matchingFound {
 		h.logRequest(r, false, 401, proxyType, pe.Domain)
+		h.recordAutobanEvent(r, autoban.Event_AuthFailure)
 		w.Header().Set("WWW-Authenticate", `Basic realm="Restricted"`)
 		w.WriteHeader(401)
 		return errors.New("unauthorized")
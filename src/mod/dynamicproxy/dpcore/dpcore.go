@@ -11,6 +11,8 @@ import (
 	"strings"
 	"sync"
 	"time"
+
+	"imuslab.com/zoraxy/mod/tracing"
 )
 
 var onExitFlushLoop func()
@@ -54,6 +56,10 @@ type ReverseProxy struct {
 	//
 	Prepender string
 
+	//Tracer is an optional tracer that creates a span for each
+	//proxied request and propagate the trace context to upstream
+	Tracer *tracing.Tracer
+
 	Verbal bool
 }
 
@@ -315,16 +321,31 @@ func (p *ReverseProxy) ProxyHTTP(rw http.ResponseWriter, req *http.Request, rrr
 	// Add X-Forwarded-For Header.
 	addXForwardedForHeader(outreq)
 
+	// Start the span of this request and forward the trace context to upstream
+	span := p.startSpan(req, rrr)
+	defer span.End()
+	if span != nil {
+		tracing.Inject(outreq.Header, span.Context)
+	}
+
+	upstreamStart := time.Now()
 	res, err := transport.RoundTrip(outreq)
 	if err != nil {
 		if p.Verbal {
 			p.logf("http: proxy error: %v", err)
 		}
 
+		span.SetStatus(tracing.StatusCode_Error, err.Error())
 		//rw.WriteHeader(http.StatusBadGateway)
 		return err
 	}
 
+	span.SetAttribute("zoraxy.upstream_latency_ms", float64(time.Since(upstreamStart).Microseconds())/1000)
+	span.SetAttribute("http.response.status_code", res.StatusCode)
+	if res.StatusCode >= 500 {
+		span.SetStatus(tracing.StatusCode_Error, res.Status)
+	}
+
 	// Remove hop-by-hop headers listed in the "Connection" header of the response, Remove hop-by-hop headers.
 	removeHeaders(res.Header)
 
@@ -334,6 +355,7 @@ func (p *ReverseProxy) ProxyHTTP(rw http.ResponseWriter, req *http.Request, rrr
 				p.logf("http: proxy error: %v", err)
 			}
 
+			span.SetStatus(tracing.StatusCode_Error, err.Error())
 			//rw.WriteHeader(http.StatusBadGateway)
 			return err
 		}
@@ -365,6 +387,11 @@ func (p *ReverseProxy) ProxyHTTP(rw http.ResponseWriter, req *http.Request, rrr
 		res.Header.Set("Location", locationRewrite)
 	}
 
+	// HSTS header set by the proxy endpoint takes precedence over the upstream one
+	if rw.Header().Get("Strict-Transport-Security") != "" {
+		res.Header.Del("Strict-Transport-Security")
+	}
+
 	// Copy header from response to client.
 	copyHeader(rw.Header(), res.Header)
 
@@ -395,6 +422,36 @@ func (p *ReverseProxy) ProxyHTTP(rw http.ResponseWriter, req *http.Request, rrr
 	return nil
 }
 
+// Start a span for the proxied request, return nil if tracing is disabled
+func (p *ReverseProxy) startSpan(req *http.Request, rrr *ResponseRewriteRuleSet) *tracing.Span {
+	if p.Tracer == nil {
+		return nil
+	}
+
+	routing := "host"
+	if rrr.PathPrefix != "" {
+		routing = "vdir"
+	}
+
+	span := p.Tracer.StartRequestSpan(req.Method+" "+routing, req)
+	span.SetAttribute("http.request.method", req.Method)
+	span.SetAttribute("server.address", rrr.OriginalHost)
+	span.SetAttribute("url.path", req.URL.Path)
+	span.SetAttribute("network.protocol.version", req.Proto)
+	span.SetAttribute("user_agent.original", req.UserAgent())
+	if clientIP, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		span.SetAttribute("client.address", clientIP)
+	}
+	if requestID := req.Header.Get("X-Request-ID"); requestID != "" {
+		span.SetAttribute("zoraxy.request_id", requestID)
+	}
+	span.SetAttribute("zoraxy.routing", routing)
+	span.SetAttribute("zoraxy.path_prefix", rrr.PathPrefix)
+	span.SetAttribute("zoraxy.upstream", rrr.ProxyDomain)
+	span.SetAttribute("zoraxy.upstream_tls", rrr.UseTLS)
+	return span
+}
+
 func (p *ReverseProxy) ProxyHTTPS(rw http.ResponseWriter, req *http.Request) error {
 	hij, ok := rw.(http.Hijacker)
 	if !ok {
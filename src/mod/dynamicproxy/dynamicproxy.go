@@ -6,6 +6,7 @@ import (
 	"encoding/json"
 	"errors"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
 	"strconv"
@@ -89,19 +90,27 @@ func (router *Router) StartProxyService() error {
 	if router.Option.ForceTLSLatest {
 		minVersion = tls.VersionTLS12
 	}
+	//TLS policy profiles and per host overrides are applied in GetConfigForClient
+	router.Option.TlsManager.SetDefaultMinVersion(uint16(minVersion))
 	config := &tls.Config{
-		GetCertificate: router.Option.TlsManager.GetCert,
-		MinVersion:     uint16(minVersion),
+		GetCertificate:     router.Option.TlsManager.GetCert,
+		GetConfigForClient: router.Option.TlsManager.GetConfigForClient,
+		MinVersion:         uint16(minVersion),
 	}
 
 	if router.Option.UseTls {
 		//Serve with TLS mode
-		ln, err := tls.Listen("tcp", ":"+strconv.Itoa(router.Option.Port), config)
+		rawListener, err := net.Listen("tcp", ":"+strconv.Itoa(router.Option.Port))
 		if err != nil {
 			log.Println(err)
 			router.Running = false
 			return err
 		}
+		if router.Option.SNIRouter != nil {
+			//Connections matching a passthrough route are not terminated here
+			rawListener = router.Option.SNIRouter.Listener(rawListener)
+		}
+		ln := tls.NewListener(rawListener, config)
 		router.tlsListener = ln
 		router.server = &http.Server{Addr: ":" + strconv.Itoa(router.Option.Port), Handler: router.mux}
 		router.Running = true
@@ -110,18 +119,10 @@ func (router *Router) StartProxyService() error {
 			//Add a 80 to 443 redirector
 			httpServer := &http.Server{
 				Addr: ":80",
-				Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-					protocol := "https://"
-					if router.Option.Port == 443 {
-						http.Redirect(w, r, protocol+r.Host+r.RequestURI, http.StatusTemporaryRedirect)
-					} else {
-						http.Redirect(w, r, protocol+r.Host+":"+strconv.Itoa(router.Option.Port)+r.RequestURI, http.StatusTemporaryRedirect)
-					}
-
-				}),
-				ReadTimeout:  3 * time.Second,
-				WriteTimeout: 3 * time.Second,
-				IdleTimeout:  120 * time.Second,
+				//Redirect mode follows the endpoint settings, see httpsRedirect.go
+				Handler:           http.HandlerFunc(router.handleHttpToHttpsRedirect),
+				ReadHeaderTimeout: 10 * time.Second,
+				IdleTimeout:       120 * time.Second,
 			}
 
 			log.Println("Starting HTTP-to-HTTPS redirector (port 80)")
@@ -260,6 +261,7 @@ func (router *Router) AddVirtualDirectoryProxyService(options *VdirOptions) erro
 	}
 
 	proxy := dpcore.NewDynamicProxyCore(path, options.RootName, options.SkipCertValidations)
+	proxy.Tracer = router.Option.Tracer
 
 	endpointObject := ProxyEndpoint{
 		ProxyType:               ProxyType_Vdir,
@@ -270,6 +272,8 @@ func (router *Router) AddVirtualDirectoryProxyService(options *VdirOptions) erro
 		RequireBasicAuth:        options.RequireBasicAuth,
 		BasicAuthCredentials:    options.BasicAuthCredentials,
 		BasicAuthExceptionRules: options.BasicAuthExceptionRules,
+		WafMode:                 options.WafMode,
+		AccessLogFormat:         options.AccessLogFormat,
 		Proxy:                   proxy,
 	}
 
@@ -328,6 +332,7 @@ func (router *Router) SetRootProxy(options *RootOptions) error {
 	}
 
 	proxy := dpcore.NewDynamicProxyCore(path, "", options.SkipCertValidations)
+	proxy.Tracer = router.Option.Tracer
 
 	rootEndpoint := ProxyEndpoint{
 		ProxyType:               ProxyType_Vdir,
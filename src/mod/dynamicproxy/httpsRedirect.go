@@ -0,0 +1,124 @@
+package dynamicproxy
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+/*
+	HttpsRedirect.go
+
+	Per endpoint HTTP to HTTPS redirection and HSTS policy.
+	The port 80 listener started by ForceHttpsRedirect serves
+	special routing rules (e.g. ACME HTTP-01 challenge) and
+	endpoints with redirection disabled over plain HTTP, all
+	other hosts are redirected with the endpoint redirect mode
+*/
+
+const (
+	HttpsRedirect_Default   = ""     //307 Temporary Redirect, same as the global redirector
+	HttpsRedirect_None      = "none" //Serve over plain HTTP without redirection
+	HttpsRedirect_Permanent = "301"  //301 Moved Permanently
+	HttpsRedirect_Preserve  = "308"  //308 Permanent Redirect, keeps the request method and body
+)
+
+// Minimum max-age required by the HSTS preload list
+const hstsPreloadMinMaxAge = 31536000
+
+type HSTSPolicy struct {
+	MaxAge            int  //max-age in seconds
+	IncludeSubDomains bool //Apply the policy to all subdomains
+	Preload           bool //Allow the domain to be included in browser preload lists
+}
+
+// Check if the given https redirect mode is valid
+func IsValidHttpsRedirectMode(mode string) bool {
+	switch mode {
+	case HttpsRedirect_Default, HttpsRedirect_None, HttpsRedirect_Permanent, HttpsRedirect_Preserve:
+		return true
+	}
+	return false
+}
+
+// Validate the HSTS policy, preload requires a max-age of
+// at least one year and includeSubDomains
+func (p *HSTSPolicy) Validate() error {
+	if p.MaxAge <= 0 {
+		return errors.New("HSTS max-age must be greater than 0")
+	}
+	if p.Preload && (p.MaxAge < hstsPreloadMinMaxAge || !p.IncludeSubDomains) {
+		return errors.New("HSTS preload requires includeSubDomains and a max-age of at least " + strconv.Itoa(hstsPreloadMinMaxAge) + " seconds")
+	}
+	return nil
+}
+
+// Get the Strict-Transport-Security header value of the policy
+func (p *HSTSPolicy) HeaderValue() string {
+	value := "max-age=" + strconv.Itoa(p.MaxAge)
+	if p.IncludeSubDomains {
+		value += "; includeSubDomains"
+	}
+	if p.Preload {
+		value += "; preload"
+	}
+	return value
+}
+
+// Get the status code used to redirect plain HTTP requests to this endpoint.
+// Return 0 if the endpoint should be served over plain HTTP
+func (ep *ProxyEndpoint) httpsRedirectStatusCode() int {
+	switch ep.HttpsRedirect {
+	case HttpsRedirect_None:
+		return 0
+	case HttpsRedirect_Permanent:
+		return http.StatusMovedPermanently
+	case HttpsRedirect_Preserve:
+		return http.StatusPermanentRedirect
+	}
+	return http.StatusTemporaryRedirect
+}
+
+// Set the HSTS header of the endpoint on responses served over TLS
+func (ep *ProxyEndpoint) setHSTSHeader(w http.ResponseWriter, r *http.Request) {
+	if r.TLS == nil || ep.HSTS == nil || ep.HSTS.MaxAge <= 0 {
+		return
+	}
+	w.Header().Set("Strict-Transport-Security", ep.HSTS.HeaderValue())
+}
+
+// Handler of the port 80 listener when https redirect is enabled
+func (router *Router) handleHttpToHttpsRedirect(w http.ResponseWriter, r *http.Request) {
+	//Special routing rules like ACME challenge are always served over plain HTTP
+	if router.GetMatchingRoutingRule(r) != nil {
+		router.mux.ServeHTTP(w, r)
+		return
+	}
+
+	hostname := strings.TrimSuffix(strings.TrimPrefix(r.Host, "["), "]")
+	if host, _, err := net.SplitHostPort(r.Host); err == nil {
+		hostname = host
+	}
+
+	statusCode := http.StatusTemporaryRedirect
+	if sep := router.getSubdomainProxyEndpointFromHostname(hostname); sep != nil {
+		statusCode = sep.httpsRedirectStatusCode()
+	}
+	if statusCode == 0 {
+		//Redirection disabled on this endpoint
+		router.mux.ServeHTTP(w, r)
+		return
+	}
+
+	target := "https://" + hostname
+	if strings.Contains(hostname, ":") {
+		//IPv6 literal
+		target = "https://[" + hostname + "]"
+	}
+	if router.Option.Port != 443 {
+		target += ":" + strconv.Itoa(router.Option.Port)
+	}
+	http.Redirect(w, r, target+r.URL.RequestURI(), statusCode)
+}
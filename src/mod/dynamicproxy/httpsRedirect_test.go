@@ -0,0 +1,41 @@
+package dynamicproxy_test
+
+import (
+	"testing"
+
+	"imuslab.com/zoraxy/mod/dynamicproxy"
+)
+
+func TestHSTSPolicy(t *testing.T) {
+	tests := []struct {
+		policy   dynamicproxy.HSTSPolicy
+		valid    bool
+		expected string
+	}{
+		{dynamicproxy.HSTSPolicy{MaxAge: 300}, true, "max-age=300"},
+		{dynamicproxy.HSTSPolicy{MaxAge: 31536000, IncludeSubDomains: true}, true, "max-age=31536000; includeSubDomains"},
+		{dynamicproxy.HSTSPolicy{MaxAge: 63072000, IncludeSubDomains: true, Preload: true}, true, "max-age=63072000; includeSubDomains; preload"},
+		{dynamicproxy.HSTSPolicy{MaxAge: 0}, false, ""},
+		{dynamicproxy.HSTSPolicy{MaxAge: 86400, IncludeSubDomains: true, Preload: true}, false, ""},
+		{dynamicproxy.HSTSPolicy{MaxAge: 31536000, Preload: true}, false, ""},
+	}
+	for _, test := range tests {
+		err := test.policy.Validate()
+		if (err == nil) != test.valid {
+			t.Errorf("Validate(%+v) = %v, expected valid: %v", test.policy, err, test.valid)
+			continue
+		}
+		if test.valid && test.policy.HeaderValue() != test.expected {
+			t.Errorf("HeaderValue(%+v) = %q, expected %q", test.policy, test.policy.HeaderValue(), test.expected)
+		}
+	}
+
+	for _, mode := range []string{dynamicproxy.HttpsRedirect_Default, dynamicproxy.HttpsRedirect_None, dynamicproxy.HttpsRedirect_Permanent, dynamicproxy.HttpsRedirect_Preserve} {
+		if !dynamicproxy.IsValidHttpsRedirectMode(mode) {
+			t.Errorf("redirect mode %q rejected", mode)
+		}
+	}
+	if dynamicproxy.IsValidHttpsRedirectMode("302") {
+		t.Error("unsupported redirect mode accepted")
+	}
+}
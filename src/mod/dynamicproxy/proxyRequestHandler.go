@@ -7,10 +7,14 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
+	"time"
 
+	"imuslab.com/zoraxy/mod/autoban"
 	"imuslab.com/zoraxy/mod/dynamicproxy/dpcore"
 	"imuslab.com/zoraxy/mod/geodb"
+	"imuslab.com/zoraxy/mod/livestream"
 	"imuslab.com/zoraxy/mod/statistic"
 	"imuslab.com/zoraxy/mod/websocketproxy"
 )
@@ -77,6 +81,7 @@ func (h *ProxyHandler) subdomainRequest(w http.ResponseWriter, r *http.Request,
 			u, _ = url.Parse(fmt.Sprintf("wss://%s%s", wsRedirectionEndpoint, requestURL))
 		}
 		h.logRequest(r, true, 101, "subdomain-websocket", target.Domain)
+		setAccessLogUpstream(r, u.Host)
 		wspHandler := websocketproxy.NewProxy(u, target.SkipCertValidations)
 		wspHandler.ServeHTTP(w, r)
 		return
@@ -90,6 +95,7 @@ func (h *ProxyHandler) subdomainRequest(w http.ResponseWriter, r *http.Request,
 		r.URL, _ = url.Parse(originalHostHeader)
 	}
 
+	setAccessLogUpstream(r, target.Domain)
 	err := target.Proxy.ServeHTTP(w, r, &dpcore.ResponseRewriteRuleSet{
 		ProxyDomain:  target.Domain,
 		OriginalHost: originalHostHeader,
@@ -99,6 +105,7 @@ func (h *ProxyHandler) subdomainRequest(w http.ResponseWriter, r *http.Request,
 
 	var dnsError *net.DNSError
 	if err != nil {
+		h.recordUpstreamError(target)
 		if errors.As(err, &dnsError) {
 			http.ServeFile(w, r, "./web/hosterror.html")
 			log.Println(err.Error())
@@ -108,6 +115,7 @@ func (h *ProxyHandler) subdomainRequest(w http.ResponseWriter, r *http.Request,
 			log.Println(err.Error())
 			h.logRequest(r, false, 521, "subdomain-http", target.Domain)
 		}
+		return
 	}
 
 	h.logRequest(r, true, 200, "subdomain-http", target.Domain)
@@ -132,6 +140,7 @@ func (h *ProxyHandler) proxyRequest(w http.ResponseWriter, r *http.Request, targ
 			u, _ = url.Parse(fmt.Sprintf("wss://%s%s", wsRedirectionEndpoint, r.URL.String()))
 		}
 		h.logRequest(r, true, 101, "vdir-websocket", target.Domain)
+		setAccessLogUpstream(r, u.Host)
 		wspHandler := websocketproxy.NewProxy(u, target.SkipCertValidations)
 		wspHandler.ServeHTTP(w, r)
 		return
@@ -145,6 +154,7 @@ func (h *ProxyHandler) proxyRequest(w http.ResponseWriter, r *http.Request, targ
 		r.URL, _ = url.Parse(originalHostHeader)
 	}
 
+	setAccessLogUpstream(r, target.Domain)
 	err := target.Proxy.ServeHTTP(w, r, &dpcore.ResponseRewriteRuleSet{
 		ProxyDomain:  target.Domain,
 		OriginalHost: originalHostHeader,
@@ -154,6 +164,7 @@ func (h *ProxyHandler) proxyRequest(w http.ResponseWriter, r *http.Request, targ
 
 	var dnsError *net.DNSError
 	if err != nil {
+		h.recordUpstreamError(target)
 		if errors.As(err, &dnsError) {
 			http.ServeFile(w, r, "./web/hosterror.html")
 			log.Println(err.Error())
@@ -163,17 +174,46 @@ func (h *ProxyHandler) proxyRequest(w http.ResponseWriter, r *http.Request, targ
 			log.Println(err.Error())
 			h.logRequest(r, false, 521, "vdir-http", target.Domain)
 		}
+		return
 	}
 	h.logRequest(r, true, 200, "vdir-http", target.Domain)
 
 }
 
 func (h *ProxyHandler) logRequest(r *http.Request, succ bool, statusCode int, forwardType string, target string) {
+	setAccessLogForwardType(r, forwardType)
+
+	endpoint, latency, writtenStatusCode := getRequestOutcome(r)
+	if succ && writtenStatusCode != 0 {
+		//Use the status code responded by upstream for proxied requests
+		statusCode = writtenStatusCode
+	}
+
+	if statusCode >= 400 && statusCode < 500 && !isAutobanRecordedForwardType(forwardType) {
+		//Client errors are counted toward auto ban, including those responded by upstream
+		h.recordAutobanEvent(r, autoban.Event_ClientError)
+	}
+
+	if h.Parent.Option.LiveStream.HasSubscribers() {
+		h.publishLiveEvent(r, succ, statusCode, forwardType, target, endpoint, latency)
+	}
+
 	if h.Parent.Option.StatisticCollector != nil {
 		go func() {
+			countryCode := ""
+			requestASN := ""
+			countryInfo := h.Parent.Option.GeodbStore.GetRequesterCountryInfo(r)
+			if countryInfo != nil {
+				countryCode = countryInfo.CountryIsoCode
+				if countryInfo.ASN > 0 {
+					requestASN = strings.TrimSpace("AS" + strconv.Itoa(int(countryInfo.ASN)) + " " + countryInfo.ASOrganization)
+				}
+			}
+
 			requestInfo := statistic.RequestInfo{
 				IpAddr:                        geodb.GetRequesterIP(r),
-				RequestOriginalCountryISOCode: h.Parent.Option.GeodbStore.GetRequesterCountryISOCode(r),
+				RequestOriginalCountryISOCode: countryCode,
+				RequestASN:                    requestASN,
 				Succ:                          succ,
 				StatusCode:                    statusCode,
 				ForwardType:                   forwardType,
@@ -181,8 +221,62 @@ func (h *ProxyHandler) logRequest(r *http.Request, succ bool, statusCode int, fo
 				UserAgent:                     r.UserAgent(),
 				RequestURL:                    r.Host + r.RequestURI,
 				Target:                        target,
+				Endpoint:                      endpoint,
+				Latency:                       latency,
 			}
 			h.Parent.Option.StatisticCollector.RecordRequest(requestInfo)
 		}()
 	}
 }
+
+// Publish the routing result of this request to the live stream viewers
+func (h *ProxyHandler) publishLiveEvent(r *http.Request, succ bool, statusCode int, forwardType string, target string, endpoint string, latency time.Duration) {
+	event := livestream.Event{
+		RequestID:   r.Header.Get("X-Request-ID"),
+		Method:      r.Method,
+		Host:        getRequestOriginalHost(r),
+		Path:        r.RequestURI,
+		StatusCode:  statusCode,
+		Succ:        succ,
+		ForwardType: forwardType,
+		Endpoint:    endpoint,
+		Target:      target,
+		LatencyMs:   float64(latency.Microseconds()) / 1000,
+		ClientIP:    geodb.GetRequesterIP(r),
+	}
+
+	if h.Parent.Option.GeodbStore != nil {
+		countryInfo := h.Parent.Option.GeodbStore.GetRequesterCountryInfo(r)
+		if countryInfo != nil {
+			event.Country = countryInfo.CountryIsoCode
+		}
+	}
+
+	h.Parent.Option.LiveStream.Publish(&event)
+}
+
+// Record a failed connection to the upstream of the given endpoint
+func (h *ProxyHandler) recordUpstreamError(target *ProxyEndpoint) {
+	if h.Parent.Option.MetricsCollector == nil {
+		return
+	}
+	h.Parent.Option.MetricsCollector.RecordUpstreamError(target.RootOrMatchingDomain)
+}
+
+// Check if requests of the forward type are rejected by access control, or already
+// recorded their own autoban event (WAF hits and basic auth failures)
+func isAutobanRecordedForwardType(forwardType string) bool {
+	switch forwardType {
+	case "blacklist", "whitelist", "waf-block", "vdir-auth", "subd-auth":
+		return true
+	}
+	return false
+}
+
+// Record an abusive behaviour event of the requesting client to the autoban tracker
+func (h *ProxyHandler) recordAutobanEvent(r *http.Request, eventType string) {
+	if h.Parent.Option.AutobanTracker == nil {
+		return
+	}
+	h.Parent.Option.AutobanTracker.RecordEvent(geodb.GetRequesterIP(r), eventType)
+}
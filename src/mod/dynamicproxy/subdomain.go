@@ -33,6 +33,7 @@ func (router *Router) AddSubdomainRoutingService(options *SubdOptions) error {
 	}
 
 	proxy := dpcore.NewDynamicProxyCore(path, "", options.SkipCertValidations)
+	proxy.Tracer = router.Option.Tracer
 
 	router.SubdomainEndpoint.Store(options.MatchingDomain, &ProxyEndpoint{
 		RootOrMatchingDomain:    options.MatchingDomain,
@@ -43,6 +44,11 @@ func (router *Router) AddSubdomainRoutingService(options *SubdOptions) error {
 		RequireBasicAuth:        options.RequireBasicAuth,
 		BasicAuthCredentials:    options.BasicAuthCredentials,
 		BasicAuthExceptionRules: options.BasicAuthExceptionRules,
+		WafMode:                 options.WafMode,
+		AccessLogFormat:         options.AccessLogFormat,
+		AutoCert:                options.AutoCert,
+		HttpsRedirect:           options.HttpsRedirect,
+		HSTS:                    options.HSTS,
 	})
 
 	log.Printf("Adding Subdomain Rule: %s to %s\n", options.MatchingDomain, domain)
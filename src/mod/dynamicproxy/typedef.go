@@ -5,11 +5,18 @@ import (
 	"net/http"
 	"sync"
 
+	"imuslab.com/zoraxy/mod/accesslog"
+	"imuslab.com/zoraxy/mod/autoban"
 	"imuslab.com/zoraxy/mod/dynamicproxy/dpcore"
 	"imuslab.com/zoraxy/mod/dynamicproxy/redirection"
+	"imuslab.com/zoraxy/mod/dynamicproxy/waf"
 	"imuslab.com/zoraxy/mod/geodb"
+	"imuslab.com/zoraxy/mod/livestream"
+	"imuslab.com/zoraxy/mod/metrics"
+	"imuslab.com/zoraxy/mod/sniproxy"
 	"imuslab.com/zoraxy/mod/statistic"
 	"imuslab.com/zoraxy/mod/tlscert"
+	"imuslab.com/zoraxy/mod/tracing"
 )
 
 const (
@@ -31,6 +38,13 @@ type RouterOption struct {
 	RedirectRuleTable  *redirection.RuleTable
 	GeodbStore         *geodb.Store //GeoIP blacklist and whitelist
 	StatisticCollector *statistic.Collector
+	WafEngine          *waf.RuleEngine    //Web application firewall rule engine
+	AutobanTracker     *autoban.Tracker   //Behaviour tracker for auto banning abusive clients
+	AccessLogger       *accesslog.Logger  //Access logger, set to nil to disable access log
+	MetricsCollector   *metrics.Collector //Prometheus metrics collector, set to nil to disable request metrics
+	Tracer             *tracing.Tracer    //Distributed tracing exporter, set to nil to disable tracing
+	LiveStream         *livestream.Hub    //Live request stream for admin viewers, set to nil to disable
+	SNIRouter          *sniproxy.Manager  //TLS passthrough routing on the TLS listener, set to nil to disable
 }
 
 type Router struct {
@@ -77,6 +91,11 @@ type ProxyEndpoint struct {
 	RequireBasicAuth        bool                      //Set to true to request basic auth before proxy
 	BasicAuthCredentials    []*BasicAuthCredentials   `json:"-"` //Basic auth credentials
 	BasicAuthExceptionRules []*BasicAuthExceptionRule //Path to exclude in a basic auth enabled proxy target
+	WafMode                 string                    //WAF mode of this endpoint, see waf.Mode_* definations
+	AccessLogFormat         string                    //Access log format of this endpoint, see accesslog.Format_* definations
+	AutoCert                bool                      //Obtain and renew the certificate of the matching domain automatically
+	HttpsRedirect           string                    //HTTP to HTTPS redirect mode of this endpoint, see HttpsRedirect_* definations
+	HSTS                    *HSTSPolicy               //HSTS policy of this endpoint, nil for disabled
 	Proxy                   *dpcore.ReverseProxy      `json:"-"`
 
 	parent *Router
@@ -111,6 +130,8 @@ type VdirOptions struct {
 	RequireBasicAuth        bool
 	BasicAuthCredentials    []*BasicAuthCredentials
 	BasicAuthExceptionRules []*BasicAuthExceptionRule
+	WafMode                 string
+	AccessLogFormat         string
 }
 
 type SubdOptions struct {
@@ -122,4 +143,9 @@ type SubdOptions struct {
 	RequireBasicAuth        bool
 	BasicAuthCredentials    []*BasicAuthCredentials
 	BasicAuthExceptionRules []*BasicAuthExceptionRule
+	WafMode                 string
+	AccessLogFormat         string
+	AutoCert                bool
+	HttpsRedirect           string
+	HSTS                    *HSTSPolicy
 }
@@ -0,0 +1,107 @@
+package waf
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"imuslab.com/zoraxy/mod/utils"
+)
+
+/*
+	Handler.go
+
+	Handlers for the WAF rule management APIs
+*/
+
+func (e *RuleEngine) HandleListRules(w http.ResponseWriter, r *http.Request) {
+	js, _ := json.Marshal(e.ListRules())
+	utils.SendJSONResponse(w, string(js))
+}
+
+func (e *RuleEngine) HandleAddRule(w http.ResponseWriter, r *http.Request) {
+	ruleID, err := utils.PostPara(r, "id")
+	if err != nil {
+		utils.SendErrorResponse(w, "invalid rule id given")
+		return
+	}
+
+	pattern, err := utils.PostPara(r, "pattern")
+	if err != nil {
+		utils.SendErrorResponse(w, "invalid pattern given")
+		return
+	}
+
+	targets, err := utils.PostPara(r, "targets")
+	if err != nil {
+		utils.SendErrorResponse(w, "invalid targets given")
+		return
+	}
+
+	description, _ := utils.PostPara(r, "description")
+	category, _ := utils.PostPara(r, "category")
+	if category == "" {
+		category = "custom"
+	}
+
+	ruleTargets := []string{}
+	for _, target := range strings.Split(targets, ",") {
+		target = strings.TrimSpace(target)
+		if target != "" {
+			ruleTargets = append(ruleTargets, target)
+		}
+	}
+
+	err = e.AddRule(&Rule{
+		ID:          strings.TrimSpace(ruleID),
+		Description: description,
+		Category:    category,
+		Targets:     ruleTargets,
+		Pattern:     pattern,
+		Enabled:     true,
+	})
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+
+	utils.SendOK(w)
+}
+
+func (e *RuleEngine) HandleRemoveRule(w http.ResponseWriter, r *http.Request) {
+	ruleID, err := utils.PostPara(r, "id")
+	if err != nil {
+		utils.SendErrorResponse(w, "invalid rule id given")
+		return
+	}
+
+	err = e.RemoveRule(ruleID)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+
+	utils.SendOK(w)
+}
+
+func (e *RuleEngine) HandleToggleRule(w http.ResponseWriter, r *http.Request) {
+	ruleID, err := utils.PostPara(r, "id")
+	if err != nil {
+		utils.SendErrorResponse(w, "invalid rule id given")
+		return
+	}
+
+	enabled, err := utils.PostBool(r, "enabled")
+	if err != nil {
+		utils.SendErrorResponse(w, "invalid enabled state given")
+		return
+	}
+
+	err = e.SetRuleEnabled(ruleID, enabled)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+
+	utils.SendOK(w)
+}
@@ -0,0 +1,407 @@
+package waf
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	"imuslab.com/zoraxy/mod/database"
+	"imuslab.com/zoraxy/mod/utils"
+)
+
+/*
+	WAF.go
+
+	Lightweight web application firewall for the dynamic proxy.
+	Incoming requests are evaluated against a set of regex / signature
+	rules on their method, URI, headers, query arguments and (bounded) body.
+	The proxy endpoint decide if a match is only logged (detect)
+	or the request is blocked (block)
+*/
+
+const (
+	Mode_Off    = ""       //WAF disabled on this endpoint
+	Mode_Detect = "detect" //Log matches but let the request through
+	Mode_Block  = "block"  //Log matches and reject the request
+)
+
+// Inspection targets of a rule
+const (
+	Target_Method  = "METHOD"  //Request method
+	Target_URI     = "URI"     //Decoded request URI (path + query)
+	Target_Path    = "PATH"    //Decoded request path
+	Target_Args    = "ARGS"    //Query argument names and values
+	Target_Headers = "HEADERS" //All request header values
+	Target_Body    = "BODY"    //Request body, up to MaxBodyInspectSize
+	//Use HEADER:<name> to inspect a single header, e.g. HEADER:User-Agent
+	targetHeaderPrefix = "HEADER:"
+)
+
+const defaultMaxBodyInspectSize = 64 * 1024 //64KB
+
+//go:embed default_rules.json
+var defaultRulesJson []byte
+
+type Rule struct {
+	ID          string   //Unique ID of the rule, e.g. 942100
+	Description string   //Human readable description of the rule
+	Category    string   //Category of the rule, e.g. sqli, xss
+	Targets     []string //What to inspect, see Target_* definations
+	Pattern     string   //Regex pattern to match
+	Enabled     bool     //If this rule is enabled
+	BuiltIn     bool     //If this rule comes with the starter rule set
+
+	compiled *regexp.Regexp
+}
+
+type Match struct {
+	RuleID   string //ID of the matching rule
+	Category string //Category of the matching rule
+	Target   string //The target that trigger the rule
+}
+
+type Options struct {
+	Database           *database.Database //Database for storing built-in rules states
+	ConfigFolder       string             //Folder to store custom rules
+	MaxBodyInspectSize int64              //Max size of body to inspect, set to 0 for default (64KB)
+}
+
+type RuleEngine struct {
+	Options *Options
+	rules   []*Rule
+	mutex   sync.RWMutex
+}
+
+// Create a new WAF rule engine and load the starter rules + custom rules from file
+func NewRuleEngine(options *Options) (*RuleEngine, error) {
+	if options.MaxBodyInspectSize <= 0 {
+		options.MaxBodyInspectSize = defaultMaxBodyInspectSize
+	}
+
+	if !utils.FileExists(options.ConfigFolder) {
+		os.MkdirAll(options.ConfigFolder, 0775)
+	}
+
+	if options.Database != nil {
+		options.Database.NewTable("waf")
+	}
+
+	thisEngine := RuleEngine{
+		Options: options,
+		rules:   []*Rule{},
+	}
+
+	//Load the starter rules
+	builtInRules := []*Rule{}
+	err := json.Unmarshal(defaultRulesJson, &builtInRules)
+	if err != nil {
+		return nil, errors.New("unable to parse built-in waf rules: " + err.Error())
+	}
+	for _, rule := range builtInRules {
+		rule.BuiltIn = true
+		rule.Enabled = true
+		if options.Database != nil && options.Database.KeyExists("waf", "builtin/"+rule.ID) {
+			options.Database.Read("waf", "builtin/"+rule.ID, &rule.Enabled)
+		}
+		if err := rule.compile(); err != nil {
+			log.Println("[WAF] Unable to compile built-in rule " + rule.ID + ": " + err.Error())
+			continue
+		}
+		thisEngine.rules = append(thisEngine.rules, rule)
+	}
+
+	//Load the custom rules
+	files, _ := filepath.Glob(filepath.Join(options.ConfigFolder, "*.json"))
+	for _, file := range files {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			continue
+		}
+
+		thisRule := Rule{}
+		err = json.Unmarshal(content, &thisRule)
+		if err != nil {
+			log.Println("[WAF] Unable to load custom rule " + filepath.Base(file) + ": " + err.Error())
+			continue
+		}
+		thisRule.BuiltIn = false
+		if err := thisRule.compile(); err != nil {
+			log.Println("[WAF] Unable to compile custom rule " + thisRule.ID + ": " + err.Error())
+			continue
+		}
+		thisEngine.rules = append(thisEngine.rules, &thisRule)
+	}
+
+	return &thisEngine, nil
+}
+
+// Compile the rule pattern and validate its targets
+func (rule *Rule) compile() error {
+	if rule.ID == "" {
+		return errors.New("rule id cannot be empty")
+	}
+
+	if len(rule.Targets) == 0 {
+		return errors.New("rule must have at least one target")
+	}
+
+	for _, target := range rule.Targets {
+		if !isValidTarget(target) {
+			return errors.New("invalid rule target: " + target)
+		}
+	}
+
+	compiled, err := regexp.Compile(rule.Pattern)
+	if err != nil {
+		return err
+	}
+	rule.compiled = compiled
+	return nil
+}
+
+func isValidTarget(target string) bool {
+	switch target {
+	case Target_Method, Target_URI, Target_Path, Target_Args, Target_Headers, Target_Body:
+		return true
+	}
+
+	return strings.HasPrefix(target, targetHeaderPrefix) && len(target) > len(targetHeaderPrefix)
+}
+
+// Check if the given mode string is valid
+func IsValidMode(mode string) bool {
+	return mode == Mode_Off || mode == Mode_Detect || mode == Mode_Block
+}
+
+// List all the rules loaded in this engine. The returned rules are copies
+// so they can be read while the rules are being enabled or disabled
+func (e *RuleEngine) ListRules() []*Rule {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	results := []*Rule{}
+	for _, rule := range e.rules {
+		thisRule := *rule
+		results = append(results, &thisRule)
+	}
+	return results
+}
+
+// Get a rule by its ID, return nil if not found
+func (e *RuleEngine) GetRuleByID(ruleID string) *Rule {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	for _, rule := range e.rules {
+		if rule.ID == ruleID {
+			return rule
+		}
+	}
+	return nil
+}
+
+// Add a custom rule to the engine and save it to file
+func (e *RuleEngine) AddRule(rule *Rule) error {
+	if e.GetRuleByID(rule.ID) != nil {
+		return errors.New("rule with same id already exists")
+	}
+
+	rule.BuiltIn = false
+	err := rule.compile()
+	if err != nil {
+		return err
+	}
+
+	e.mutex.Lock()
+	e.rules = append(e.rules, rule)
+	e.mutex.Unlock()
+
+	return e.saveRuleToFile(rule)
+}
+
+// Remove a custom rule from the engine. Built-in rules can only be disabled
+func (e *RuleEngine) RemoveRule(ruleID string) error {
+	targetRule := e.GetRuleByID(ruleID)
+	if targetRule == nil {
+		return errors.New("rule not found")
+	}
+
+	if targetRule.BuiltIn {
+		return errors.New("built-in rules cannot be removed. Disable it instead")
+	}
+
+	e.mutex.Lock()
+	newRules := []*Rule{}
+	for _, rule := range e.rules {
+		if rule.ID != ruleID {
+			newRules = append(newRules, rule)
+		}
+	}
+	e.rules = newRules
+	e.mutex.Unlock()
+
+	return os.Remove(e.getRuleFilepath(ruleID))
+}
+
+// Enable or disable a rule by its ID
+func (e *RuleEngine) SetRuleEnabled(ruleID string, enabled bool) error {
+	targetRule := e.GetRuleByID(ruleID)
+	if targetRule == nil {
+		return errors.New("rule not found")
+	}
+
+	e.mutex.Lock()
+	targetRule.Enabled = enabled
+	updatedRule := *targetRule
+	e.mutex.Unlock()
+
+	if updatedRule.BuiltIn {
+		if e.Options.Database == nil {
+			return nil
+		}
+		return e.Options.Database.Write("waf", "builtin/"+ruleID, enabled)
+	}
+
+	return e.saveRuleToFile(&updatedRule)
+}
+
+func (e *RuleEngine) getRuleFilepath(ruleID string) string {
+	filename := strings.NewReplacer("/", "-", "\\", "-", ".", "_").Replace(ruleID)
+	return filepath.Join(e.Options.ConfigFolder, filename+".json")
+}
+
+func (e *RuleEngine) saveRuleToFile(rule *Rule) error {
+	js, _ := json.MarshalIndent(rule, "", " ")
+	return os.WriteFile(e.getRuleFilepath(rule.ID), js, 0775)
+}
+
+/*
+	Request Inspection
+*/
+
+// Inspect the request against all enabled rules and return the matches.
+// Request body will be restored after inspection so it can be proxied as usual
+func (e *RuleEngine) Inspect(r *http.Request) []*Match {
+	//Copy the enabled rules so the lock is not held while reading the body from client
+	e.mutex.RLock()
+	enabledRules := []Rule{}
+	for _, rule := range e.rules {
+		if rule.Enabled && rule.compiled != nil {
+			enabledRules = append(enabledRules, *rule)
+		}
+	}
+	e.mutex.RUnlock()
+
+	matches := []*Match{}
+	var bodyContent *string = nil
+	for _, rule := range enabledRules {
+		for _, target := range rule.Targets {
+			if target == Target_Body && bodyContent == nil {
+				//Only read the body when there is a rule that need it
+				content := e.readRequestBody(r)
+				bodyContent = &content
+			}
+
+			if rule.matchTarget(r, target, bodyContent) {
+				matches = append(matches, &Match{
+					RuleID:   rule.ID,
+					Category: rule.Category,
+					Target:   target,
+				})
+				break
+			}
+		}
+	}
+
+	return matches
+}
+
+func (rule *Rule) matchTarget(r *http.Request, target string, body *string) bool {
+	switch target {
+	case Target_Method:
+		return rule.compiled.MatchString(r.Method)
+	case Target_URI:
+		return rule.compiled.MatchString(decodeString(r.RequestURI))
+	case Target_Path:
+		return rule.compiled.MatchString(decodeString(r.URL.Path))
+	case Target_Args:
+		for key, values := range r.URL.Query() {
+			if rule.compiled.MatchString(key) {
+				return true
+			}
+			for _, value := range values {
+				if rule.compiled.MatchString(value) {
+					return true
+				}
+			}
+		}
+	case Target_Headers:
+		for _, values := range r.Header {
+			for _, value := range values {
+				if rule.compiled.MatchString(value) {
+					return true
+				}
+			}
+		}
+	case Target_Body:
+		if body != nil && *body != "" {
+			return rule.compiled.MatchString(*body) || rule.compiled.MatchString(decodeString(*body))
+		}
+	default:
+		if strings.HasPrefix(target, targetHeaderPrefix) {
+			headerName := strings.TrimPrefix(target, targetHeaderPrefix)
+			for _, value := range r.Header.Values(headerName) {
+				if rule.compiled.MatchString(value) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// Read the first MaxBodyInspectSize bytes of the request body and restore
+// the body so the upstream still receive the full request
+func (e *RuleEngine) readRequestBody(r *http.Request) string {
+	if r.Body == nil || r.Body == http.NoBody {
+		return ""
+	}
+
+	buf, err := io.ReadAll(io.LimitReader(r.Body, e.Options.MaxBodyInspectSize))
+	//Restore the consumed bytes even if the read failed halfway
+	r.Body = &restoredBody{
+		Reader: io.MultiReader(bytes.NewReader(buf), r.Body),
+		closer: r.Body,
+	}
+	if err != nil {
+		return ""
+	}
+	return string(buf)
+}
+
+type restoredBody struct {
+	io.Reader
+	closer io.Closer
+}
+
+func (b *restoredBody) Close() error {
+	return b.closer.Close()
+}
+
+// Decode url encoded string so encoded payloads are also matched.
+// Return the original string if it cannot be decoded
+func decodeString(s string) string {
+	decoded, err := url.QueryUnescape(s)
+	if err != nil {
+		return s
+	}
+	return decoded
+}
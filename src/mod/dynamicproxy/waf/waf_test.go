@@ -0,0 +1,134 @@
+package waf_test
+
+import (
+	"errors"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"imuslab.com/zoraxy/mod/dynamicproxy/waf"
+)
+
+func newTestEngine(t *testing.T) *waf.RuleEngine {
+	engine, err := waf.NewRuleEngine(&waf.Options{
+		ConfigFolder: t.TempDir(),
+	})
+	if err != nil {
+		t.Fatalf("Unable to create rule engine: %v", err)
+	}
+	return engine
+}
+
+func TestStarterRulesMatch(t *testing.T) {
+	engine := newTestEngine(t)
+
+	tests := []struct {
+		uri       string
+		userAgent string
+		category  string
+	}{
+		{"/search?q=1%27%20UNION%20SELECT%20password%20FROM%20users", "", "sqli"},
+		{"/login?user=admin%27%20or%20%271%27%3D%271", "", "sqli"},
+		{"/comment?text=%3Cscript%3Ealert(1)%3C/script%3E", "", "xss"},
+		{"/download?file=../../etc/passwd", "", "traversal"},
+		{"/index.html", "sqlmap/1.7.2#stable (https://sqlmap.org)", "scanner"},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", test.uri, nil)
+		if test.userAgent != "" {
+			r.Header.Set("User-Agent", test.userAgent)
+		}
+
+		matches := engine.Inspect(r)
+		found := false
+		for _, match := range matches {
+			if match.Category == test.category {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("Expected %s match for %s, got %d matches", test.category, test.uri, len(matches))
+		}
+	}
+}
+
+func TestCleanRequestNotMatched(t *testing.T) {
+	engine := newTestEngine(t)
+	r := httptest.NewRequest("GET", "/blog/2023/09/hello-world?page=2&sort=asc", nil)
+	r.Header.Set("User-Agent", "Mozilla/5.0 (X11; Linux x86_64) Firefox/117.0")
+	matches := engine.Inspect(r)
+	if len(matches) != 0 {
+		t.Errorf("Expected no match for clean request, got rule %s", matches[0].RuleID)
+	}
+}
+
+func TestBodyInspectionRestoresBody(t *testing.T) {
+	engine := newTestEngine(t)
+	payload := "name=test&comment=<script>alert(1)</script>"
+	r := httptest.NewRequest("POST", "/submit", strings.NewReader(payload))
+
+	matches := engine.Inspect(r)
+	if len(matches) == 0 {
+		t.Errorf("Expected body payload to be matched")
+	}
+
+	restored, _ := io.ReadAll(r.Body)
+	if string(restored) != payload {
+		t.Errorf("Expected body to be restored, got %s", string(restored))
+	}
+}
+
+func TestBodyReadErrorRestoresBody(t *testing.T) {
+	engine := newTestEngine(t)
+	readErr := errors.New("connection reset")
+	r := httptest.NewRequest("POST", "/submit", io.MultiReader(strings.NewReader("partial"), iotest.ErrReader(readErr)))
+
+	engine.Inspect(r)
+	restored, err := io.ReadAll(r.Body)
+	if string(restored) != "partial" || err != readErr {
+		t.Errorf("Expected consumed bytes and read error to be restored, got %q, %v", string(restored), err)
+	}
+}
+
+func TestDisableRule(t *testing.T) {
+	engine := newTestEngine(t)
+	err := engine.SetRuleEnabled("scanner-001", false)
+	if err != nil {
+		t.Fatalf("Unable to disable rule: %v", err)
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("User-Agent", "Nikto/2.1.6")
+	for _, match := range engine.Inspect(r) {
+		if match.RuleID == "scanner-001" {
+			t.Errorf("Disabled rule should not be matched")
+		}
+	}
+}
+
+func TestSlowBodyDoesNotBlockInspection(t *testing.T) {
+	engine := newTestEngine(t)
+
+	//Client that never finish sending the body
+	bodyReader, bodyWriter := io.Pipe()
+	defer bodyWriter.Close()
+	go engine.Inspect(httptest.NewRequest("POST", "/submit", bodyReader))
+	time.Sleep(100 * time.Millisecond)
+
+	done := make(chan bool)
+	go func() {
+		engine.SetRuleEnabled("scanner-001", false)
+		engine.Inspect(httptest.NewRequest("GET", "/", nil))
+		done <- true
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("inspection blocked by a slow request body")
+	}
+}
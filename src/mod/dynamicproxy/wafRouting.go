@@ -0,0 +1,62 @@
+package dynamicproxy
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"imuslab.com/zoraxy/mod/autoban"
+	"imuslab.com/zoraxy/mod/dynamicproxy/waf"
+	"imuslab.com/zoraxy/mod/geodb"
+)
+
+/*
+	WafRouting.go
+
+	This file handles the web application firewall checking
+	on proxy endpoints that has WafMode set. The root endpoint
+	has no WAF settings, requests falling through to root are
+	not inspected
+*/
+
+// Handle WAF routing logic. Return true if the request is blocked by the WAF
+// if the return value is false, you can continue process the response writer
+func (h *ProxyHandler) handleWafRouting(w http.ResponseWriter, r *http.Request, pe *ProxyEndpoint) bool {
+	if pe.WafMode == waf.Mode_Off || h.Parent.Option.WafEngine == nil {
+		return false
+	}
+
+	matches := h.Parent.Option.WafEngine.Inspect(r)
+	if len(matches) == 0 {
+		return false
+	}
+
+	matchedRuleIDs := []string{}
+	for _, match := range matches {
+		matchedRuleIDs = append(matchedRuleIDs, match.RuleID)
+	}
+
+	clientIpAddr := geodb.GetRequesterIP(r)
+	log.Println("[WAF] Request from " + clientIpAddr + " to " + r.Host + r.RequestURI + " matched rules: " + strings.Join(matchedRuleIDs, ", ") + " (" + pe.WafMode + ")")
+	if h.Parent.Option.StatisticCollector != nil {
+		h.Parent.Option.StatisticCollector.RecordWafMatches(matchedRuleIDs)
+	}
+	h.recordAutobanEvent(r, autoban.Event_WafHit)
+
+	if pe.WafMode != waf.Mode_Block {
+		//Detect only. Let the request through
+		return false
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusForbidden)
+	template, err := os.ReadFile("./web/forbidden.html")
+	if err != nil {
+		w.Write([]byte("403 - Forbidden"))
+	} else {
+		w.Write(template)
+	}
+	h.logRequest(r, false, 403, "waf-block", pe.Domain)
+	return true
+}
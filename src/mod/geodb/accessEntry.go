@@ -0,0 +1,148 @@
+package geodb
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+)
+
+/*
+	AccessEntry.go
+
+	This script handles the metadata of blacklist and whitelist entries.
+	Each entry records why, when and by whom it is added, and
+	can optionally expire after a given time
+*/
+
+const (
+	EntrySource_Manual = "manual" //Added by user via the web UI or API
+	EntrySource_Auto   = "auto"   //Added automatically, e.g. by autoban
+	EntrySource_Import = "import" //Added from imported lists
+)
+
+const entrySweepInterval = 1 * time.Minute
+
+type AccessEntry struct {
+	Key       string //The IP, CIDR or country code of this entry
+	Comment   string //Reason or note for this entry
+	CreatedAt int64  //Unix timestamp of creation
+	Source    string //Who added this entry, see EntrySource_* definations
+	ExpireAt  int64  //Unix timestamp of expiry, 0 for never expire
+}
+
+// Return true if this entry has expired
+func (e *AccessEntry) IsExpired() bool {
+	return e.ExpireAt > 0 && e.ExpireAt <= time.Now().Unix()
+}
+
+// Fill in the default values of a new entry
+func newAccessEntry(key string, entry *AccessEntry) *AccessEntry {
+	thisEntry := AccessEntry{}
+	if entry != nil {
+		thisEntry = *entry
+	}
+	thisEntry.Key = key
+	if thisEntry.CreatedAt == 0 {
+		thisEntry.CreatedAt = time.Now().Unix()
+	}
+	if thisEntry.Source == "" {
+		thisEntry.Source = EntrySource_Manual
+	}
+	return &thisEntry
+}
+
+// Parse the stored value of an entry. Entries created by older
+// versions only store "true" and are treated as manual entries
+func parseAccessEntry(key string, value []byte) *AccessEntry {
+	thisEntry := AccessEntry{}
+	err := json.Unmarshal(value, &thisEntry)
+	if err != nil {
+		//Legacy entry
+		thisEntry = AccessEntry{}
+	}
+	thisEntry.Key = key
+	if thisEntry.Source == "" {
+		thisEntry.Source = EntrySource_Manual
+	}
+	return &thisEntry
+}
+
+func (s *Store) writeEntry(tableName string, key string, entry *AccessEntry) {
+	s.sysdb.Write(tableName, key, newAccessEntry(key, entry))
+	s.invalidateIpList(tableName)
+}
+
+// Check if a key exists in the given table and is not expired
+func (s *Store) isEntryActive(tableName string, key string) bool {
+	if !s.sysdb.KeyExists(tableName, key) {
+		return false
+	}
+
+	thisEntry := AccessEntry{}
+	s.sysdb.Read(tableName, key, &thisEntry)
+	return !thisEntry.IsExpired()
+}
+
+// List all the non-expired entries in the given table
+func (s *Store) listEntries(tableName string) []*AccessEntry {
+	results := []*AccessEntry{}
+	entries, err := s.sysdb.ListTable(tableName)
+	if err != nil {
+		return results
+	}
+
+	for _, keypairs := range entries {
+		thisEntry := parseAccessEntry(string(keypairs[0]), keypairs[1])
+		if thisEntry.IsExpired() {
+			continue
+		}
+		results = append(results, thisEntry)
+	}
+	return results
+}
+
+func entryKeys(entries []*AccessEntry) []string {
+	results := []string{}
+	for _, entry := range entries {
+		results = append(results, entry.Key)
+	}
+	return results
+}
+
+// Start the background sweeper that remove expired entries, refresh ip feeds
+// and reload updated geoip databases
+func (s *Store) startEntrySweeper() {
+	ticker := time.NewTicker(entrySweepInterval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.sweeperStop:
+				return
+			case <-ticker.C:
+				s.RemoveExpiredEntries()
+				s.refreshDueIpFeeds()
+				s.reloadGeoDatabasesIfChanged()
+			}
+		}
+	}()
+}
+
+// Remove all the expired entries from blacklist and whitelist
+func (s *Store) RemoveExpiredEntries() {
+	for _, tableName := range []string{"blacklist-cn", "blacklist-ip", "whitelist-cn", "whitelist-ip"} {
+		entries, err := s.sysdb.ListTable(tableName)
+		if err != nil {
+			continue
+		}
+
+		for _, keypairs := range entries {
+			thisEntry := parseAccessEntry(string(keypairs[0]), keypairs[1])
+			if thisEntry.IsExpired() {
+				s.sysdb.Delete(tableName, thisEntry.Key)
+				s.invalidateIpList(tableName)
+				log.Println("[Geodb] Expired entry " + thisEntry.Key + " removed from " + tableName)
+			}
+		}
+	}
+}
@@ -11,8 +11,13 @@ import "strings"
 //Geo Blacklist
 
 func (s *Store) AddCountryCodeToBlackList(countryCode string) {
+	s.AddCountryCodeToBlackListWithEntry(countryCode, nil)
+}
+
+// Add a country code to blacklist with metadata, e.g. comment and expiry
+func (s *Store) AddCountryCodeToBlackListWithEntry(countryCode string, entry *AccessEntry) {
 	countryCode = strings.ToLower(countryCode)
-	s.sysdb.Write("blacklist-cn", countryCode, true)
+	s.writeEntry("blacklist-cn", countryCode, entry)
 }
 
 func (s *Store) RemoveCountryCodeFromBlackList(countryCode string) {
@@ -22,70 +27,53 @@ func (s *Store) RemoveCountryCodeFromBlackList(countryCode string) {
 
 func (s *Store) IsCountryCodeBlacklisted(countryCode string) bool {
 	countryCode = strings.ToLower(countryCode)
-	var isBlacklisted bool = false
-	s.sysdb.Read("blacklist-cn", countryCode, &isBlacklisted)
-	return isBlacklisted
+	return s.isEntryActive("blacklist-cn", countryCode)
 }
 
 func (s *Store) GetAllBlacklistedCountryCode() []string {
-	bannedCountryCodes := []string{}
-	entries, err := s.sysdb.ListTable("blacklist-cn")
-	if err != nil {
-		return bannedCountryCodes
-	}
-	for _, keypairs := range entries {
-		ip := string(keypairs[0])
-		bannedCountryCodes = append(bannedCountryCodes, ip)
-	}
+	return entryKeys(s.GetAllBlacklistedCountryCodeEntries())
+}
 
-	return bannedCountryCodes
+// Get all blacklisted country codes with their metadata
+func (s *Store) GetAllBlacklistedCountryCodeEntries() []*AccessEntry {
+	return s.listEntries("blacklist-cn")
 }
 
 //IP Blacklsits
 
 func (s *Store) AddIPToBlackList(ipAddr string) {
-	s.sysdb.Write("blacklist-ip", ipAddr, true)
+	s.AddIPToBlackListWithEntry(ipAddr, nil)
+}
+
+// Add an IP or IP range to blacklist with metadata, e.g. comment and expiry
+func (s *Store) AddIPToBlackListWithEntry(ipAddr string, entry *AccessEntry) {
+	s.writeEntry("blacklist-ip", ipAddr, entry)
 }
 
 func (s *Store) RemoveIPFromBlackList(ipAddr string) {
 	s.sysdb.Delete("blacklist-ip", ipAddr)
+	s.invalidateIpList("blacklist-ip")
 }
 
 func (s *Store) GetAllBlacklistedIp() []string {
-	bannedIps := []string{}
-	entries, err := s.sysdb.ListTable("blacklist-ip")
-	if err != nil {
-		return bannedIps
-	}
-
-	for _, keypairs := range entries {
-		ip := string(keypairs[0])
-		bannedIps = append(bannedIps, ip)
-	}
+	return entryKeys(s.GetAllBlacklistedIpEntries())
+}
 
-	return bannedIps
+// Get all blacklisted IP or IP ranges with their metadata
+func (s *Store) GetAllBlacklistedIpEntries() []*AccessEntry {
+	return s.listEntries("blacklist-ip")
 }
 
 func (s *Store) IsIPBlacklisted(ipAddr string) bool {
-	var isBlacklisted bool = false
-	s.sysdb.Read("blacklist-ip", ipAddr, &isBlacklisted)
-	if isBlacklisted {
+	if s.isEntryActive("blacklist-ip", ipAddr) {
 		return true
 	}
 
-	//Check for IP wildcard and CIRD rules
-	AllBlacklistedIps := s.GetAllBlacklistedIp()
-	for _, blacklistRule := range AllBlacklistedIps {
-		wildcardMatch := MatchIpWildcard(ipAddr, blacklistRule)
-		if wildcardMatch {
-			return true
-		}
-
-		cidrMatch := MatchIpCIDR(ipAddr, blacklistRule)
-		if cidrMatch {
-			return true
-		}
+	//Check for IP wildcard, CIDR and range rules
+	if s.matchIpList("blacklist-ip", ipAddr) {
+		return true
 	}
 
-	return false
+	//Check for imported blocklist feeds
+	return s.matchIpFeeds(IpFeedTarget_Blacklist, ipAddr)
 }
@@ -0,0 +1,316 @@
+package geodb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"imuslab.com/zoraxy/mod/utils"
+)
+
+/*
+	feeds.go
+
+	This script handles IP blocklist / allowlist feeds. A feed is a named
+	list of IP, CIDR or range rules in FireHOL netset or plain text format
+	that is loaded from a local file or URL and refreshed on schedule.
+	The feed content is cached in the feed folder so it is available
+	on startup even if the source is offline
+*/
+
+const (
+	IpFeedTarget_Blacklist = "blacklist"
+	IpFeedTarget_Whitelist = "whitelist"
+)
+
+const (
+	defaultFeedFolder = "./conf/feeds"
+	maxFeedSize       = 64 * 1024 * 1024 //64MB
+)
+
+var validFeedName = regexp.MustCompile(`^[a-zA-Z0-9_\-]+$`)
+
+type IpFeed struct {
+	Name            string //Name of this feed, used as key
+	Source          string //Local file path or http(s) URL, empty for imported static lists
+	Target          string //Apply to blacklist or whitelist, see IpFeedTarget_* definations
+	RefreshInterval int64  //Refresh interval in seconds, 0 for never refresh
+	LastUpdated     int64  //Unix timestamp of last successful update
+	EntryCount      int    //Number of valid entries in last update
+	InvalidCount    int    //Number of invalid lines skipped in last update
+	LastError       string //Error of last update, if any
+
+	set *ipRangeSet
+}
+
+// Load all the saved ip feeds from their cached content
+func (s *Store) loadIpFeeds() {
+	entries, err := s.sysdb.ListTable("ipfeeds")
+	if err != nil {
+		return
+	}
+
+	for _, keypairs := range entries {
+		thisFeed := IpFeed{}
+		if json.Unmarshal(keypairs[1], &thisFeed) != nil {
+			continue
+		}
+
+		content, err := os.ReadFile(s.getFeedCachePath(thisFeed.Name))
+		if err == nil {
+			thisFeed.set, _, _ = parseIpFeed(content)
+		} else if thisFeed.Source != "" {
+			//No cache. Force a refresh on next tick
+			thisFeed.LastUpdated = 0
+		}
+
+		s.feedMutex.Lock()
+		s.feeds[thisFeed.Name] = &thisFeed
+		s.feedMutex.Unlock()
+	}
+}
+
+func (s *Store) getFeedCachePath(name string) string {
+	return filepath.Join(s.option.FeedFolder, name+".netset")
+}
+
+// Parse feed content in netset / plain CIDR text format. Return the range set,
+// number of valid and invalid entries
+func parseIpFeed(content []byte) (*ipRangeSet, int, int) {
+	rules := []string{}
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+
+		//Remove inline comments and trailing columns
+		if idx := strings.IndexAny(line, "#;"); idx >= 0 {
+			line = strings.TrimSpace(line[:idx])
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		rules = append(rules, fields[0])
+	}
+
+	set, unparsed := newIpRangeSet(rules)
+	return set, len(rules) - len(unparsed), len(unparsed)
+}
+
+// Read the content of a feed source from local file or URL
+func fetchIpFeedSource(source string) ([]byte, error) {
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		client := http.Client{
+			Timeout: 60 * time.Second,
+		}
+		resp, err := client.Get(source)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return nil, errors.New("feed source returned status " + resp.Status)
+		}
+
+		//Read one more byte to tell if the feed is over the limit, as a truncated feed must not be applied
+		content, err := io.ReadAll(io.LimitReader(resp.Body, maxFeedSize+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(content) > maxFeedSize {
+			return nil, errors.New("feed source is larger than the size limit of " + strconv.Itoa(maxFeedSize/1024/1024) + "MB")
+		}
+		return content, nil
+	}
+
+	if !utils.FileExists(source) {
+		return nil, errors.New("feed source file not found")
+	}
+	return os.ReadFile(source)
+}
+
+// Add a new ip feed and load it from its source
+func (s *Store) AddIpFeed(name string, source string, target string, refreshInterval int64) error {
+	if !validFeedName.MatchString(name) {
+		return errors.New("feed name can only contain letters, numbers, dash and underscore")
+	}
+
+	if target != IpFeedTarget_Blacklist && target != IpFeedTarget_Whitelist {
+		return errors.New("invalid feed target")
+	}
+
+	if source == "" {
+		return errors.New("feed source cannot be empty")
+	}
+
+	if refreshInterval < 0 {
+		return errors.New("invalid refresh interval")
+	}
+
+	if s.GetIpFeed(name) != nil {
+		return errors.New("feed with same name already exists")
+	}
+
+	thisFeed := IpFeed{
+		Name:            name,
+		Source:          source,
+		Target:          target,
+		RefreshInterval: refreshInterval,
+	}
+
+	content, err := fetchIpFeedSource(source)
+	if err != nil {
+		return err
+	}
+
+	return s.updateIpFeed(&thisFeed, content)
+}
+
+// Import a static ip list from the given content, e.g. uploaded netset file
+func (s *Store) ImportIpFeed(name string, target string, content []byte) error {
+	if !validFeedName.MatchString(name) {
+		return errors.New("feed name can only contain letters, numbers, dash and underscore")
+	}
+
+	if target != IpFeedTarget_Blacklist && target != IpFeedTarget_Whitelist {
+		return errors.New("invalid feed target")
+	}
+
+	thisFeed := s.GetIpFeed(name)
+	if thisFeed == nil {
+		thisFeed = &IpFeed{
+			Name:   name,
+			Target: target,
+		}
+	} else if thisFeed.Source != "" {
+		return errors.New("feed with same name already exists and is loaded from " + thisFeed.Source)
+	}
+
+	return s.updateIpFeed(thisFeed, content)
+}
+
+// Refresh a feed from its source
+func (s *Store) RefreshIpFeed(name string) error {
+	thisFeed := s.GetIpFeed(name)
+	if thisFeed == nil {
+		return errors.New("feed not found")
+	}
+
+	if thisFeed.Source == "" {
+		return errors.New("imported feed has no source to refresh from")
+	}
+
+	content, err := fetchIpFeedSource(thisFeed.Source)
+	if err != nil {
+		s.feedMutex.Lock()
+		thisFeed.LastError = err.Error()
+		feedCopy := *thisFeed
+		s.feedMutex.Unlock()
+		s.sysdb.Write("ipfeeds", thisFeed.Name, feedCopy)
+		return err
+	}
+
+	return s.updateIpFeed(thisFeed, content)
+}
+
+func (s *Store) updateIpFeed(thisFeed *IpFeed, content []byte) error {
+	set, validCount, invalidCount := parseIpFeed(content)
+	if validCount == 0 && invalidCount > 0 {
+		return errors.New("feed does not contain any valid ip or cidr entries")
+	}
+
+	os.MkdirAll(s.option.FeedFolder, 0775)
+	err := os.WriteFile(s.getFeedCachePath(thisFeed.Name), content, 0775)
+	if err != nil {
+		return err
+	}
+
+	s.feedMutex.Lock()
+	thisFeed.set = set
+	thisFeed.EntryCount = validCount
+	thisFeed.InvalidCount = invalidCount
+	thisFeed.LastUpdated = time.Now().Unix()
+	thisFeed.LastError = ""
+	s.feeds[thisFeed.Name] = thisFeed
+	feedCopy := *thisFeed
+	s.feedMutex.Unlock()
+
+	log.Printf("[Geodb] IP feed %s loaded with %d entries (%d invalid)", thisFeed.Name, validCount, invalidCount)
+	return s.sysdb.Write("ipfeeds", thisFeed.Name, feedCopy)
+}
+
+// Remove an ip feed and its cached content
+func (s *Store) RemoveIpFeed(name string) error {
+	if s.GetIpFeed(name) == nil {
+		return errors.New("feed not found")
+	}
+
+	s.feedMutex.Lock()
+	delete(s.feeds, name)
+	s.feedMutex.Unlock()
+
+	os.Remove(s.getFeedCachePath(name))
+	return s.sysdb.Delete("ipfeeds", name)
+}
+
+// Get a feed by name, return nil if not found
+func (s *Store) GetIpFeed(name string) *IpFeed {
+	s.feedMutex.RLock()
+	defer s.feedMutex.RUnlock()
+	return s.feeds[name]
+}
+
+// List all the ip feeds
+func (s *Store) ListIpFeeds() []*IpFeed {
+	s.feedMutex.RLock()
+	defer s.feedMutex.RUnlock()
+	results := []*IpFeed{}
+	for _, thisFeed := range s.feeds {
+		feedCopy := *thisFeed
+		results = append(results, &feedCopy)
+	}
+	return results
+}
+
+// Check if the ip address is in any feeds of the given target
+func (s *Store) matchIpFeeds(target string, ipAddr string) bool {
+	s.feedMutex.RLock()
+	defer s.feedMutex.RUnlock()
+	for _, thisFeed := range s.feeds {
+		if thisFeed.Target == target && thisFeed.set.Contains(ipAddr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Refresh the feeds that reached their refresh interval
+func (s *Store) refreshDueIpFeeds() {
+	now := time.Now().Unix()
+	for _, thisFeed := range s.ListIpFeeds() {
+		if thisFeed.Source == "" || thisFeed.RefreshInterval <= 0 {
+			continue
+		}
+
+		if now-thisFeed.LastUpdated >= thisFeed.RefreshInterval {
+			err := s.RefreshIpFeed(thisFeed.Name)
+			if err != nil {
+				log.Println("[Geodb] Unable to refresh IP feed " + thisFeed.Name + ": " + err.Error())
+			}
+		}
+	}
+}
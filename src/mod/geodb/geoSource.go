@@ -0,0 +1,140 @@
+package geodb
+
+import (
+	"errors"
+	"log"
+	"os"
+	"time"
+)
+
+/*
+	geoSource.go
+
+	This script handles the loadable MMDB country and ASN databases.
+	Loaded databases are held in an immutable geoSource and swapped
+	atomically, so databases can be updated on disk and reloaded
+	without restarting or blocking ongoing lookups.
+	If no country database is loaded, the embedded csv dataset is used
+*/
+
+type geoSource struct {
+	countryDb        *mmdbReader //Country database, nil for using embedded dataset
+	countryDbModTime time.Time
+	asnDb            *mmdbReader //ASN database, nil if not loaded
+	asnDbModTime     time.Time
+}
+
+type GeoDatabaseStatus struct {
+	CountrySource       string //Path of the loaded country database, or "embedded"
+	CountryDatabaseType string //Database type in mmdb metadata
+	CountryBuildEpoch   uint64 //Build time of the country database
+	AsnSource           string //Path of the loaded ASN database, empty if not loaded
+	AsnDatabaseType     string
+	AsnBuildEpoch       uint64
+}
+
+func (s *Store) getGeoSource() *geoSource {
+	source, ok := s.geoSource.Load().(*geoSource)
+	if !ok {
+		return &geoSource{}
+	}
+	return source
+}
+
+// Load a mmdb file if it exists. Return nil reader if the path is not set or file not exists
+func loadMmdbIfExists(filename string) (*mmdbReader, time.Time, error) {
+	if filename == "" {
+		return nil, time.Time{}, nil
+	}
+
+	fileInfo, err := os.Stat(filename)
+	if err != nil {
+		return nil, time.Time{}, nil
+	}
+
+	reader, err := openMmdb(filename)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	return reader, fileInfo.ModTime(), nil
+}
+
+// Reload the country and ASN databases from disk and swap them in.
+// If a database failed to load, the previous one is kept
+func (s *Store) ReloadGeoDatabases() error {
+	current := s.getGeoSource()
+	newSource := *current
+	var loadErr error
+
+	countryDb, modTime, err := loadMmdbIfExists(s.option.CountryDatabase)
+	if err != nil {
+		log.Println("[Geodb] Unable to load country database: " + err.Error())
+		loadErr = errors.New("unable to load country database: " + err.Error())
+	} else {
+		newSource.countryDb = countryDb
+		newSource.countryDbModTime = modTime
+		if countryDb != nil {
+			log.Println("[Geodb] Country database loaded from " + s.option.CountryDatabase + " (" + countryDb.metadata.DatabaseType + ")")
+		}
+	}
+
+	asnDb, modTime, err := loadMmdbIfExists(s.option.AsnDatabase)
+	if err != nil {
+		log.Println("[Geodb] Unable to load ASN database: " + err.Error())
+		loadErr = errors.New("unable to load ASN database: " + err.Error())
+	} else {
+		newSource.asnDb = asnDb
+		newSource.asnDbModTime = modTime
+		if asnDb != nil {
+			log.Println("[Geodb] ASN database loaded from " + s.option.AsnDatabase + " (" + asnDb.metadata.DatabaseType + ")")
+		}
+	}
+
+	s.geoSource.Store(&newSource)
+	return loadErr
+}
+
+// Reload the databases if any of the files on disk has been changed
+func (s *Store) reloadGeoDatabasesIfChanged() {
+	current := s.getGeoSource()
+	if fileChanged(s.option.CountryDatabase, current.countryDb != nil, current.countryDbModTime) ||
+		fileChanged(s.option.AsnDatabase, current.asnDb != nil, current.asnDbModTime) {
+		s.ReloadGeoDatabases()
+	}
+}
+
+func fileChanged(filename string, loaded bool, loadedModTime time.Time) bool {
+	if filename == "" {
+		return false
+	}
+
+	fileInfo, err := os.Stat(filename)
+	if err != nil {
+		//File removed
+		return loaded
+	}
+
+	return !loaded || !fileInfo.ModTime().Equal(loadedModTime)
+}
+
+// Get the status of the currently loaded geoip databases
+func (s *Store) GetGeoDatabaseStatus() *GeoDatabaseStatus {
+	current := s.getGeoSource()
+	status := GeoDatabaseStatus{
+		CountrySource: "embedded",
+	}
+
+	if current.countryDb != nil {
+		status.CountrySource = s.option.CountryDatabase
+		status.CountryDatabaseType = current.countryDb.metadata.DatabaseType
+		status.CountryBuildEpoch = current.countryDb.metadata.BuildEpoch
+	}
+
+	if current.asnDb != nil {
+		status.AsnSource = s.option.AsnDatabase
+		status.AsnDatabaseType = current.asnDb.metadata.DatabaseType
+		status.AsnBuildEpoch = current.asnDb.metadata.BuildEpoch
+	}
+
+	return &status
+}
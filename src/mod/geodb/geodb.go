@@ -5,6 +5,9 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
 
 	"imuslab.com/zoraxy/mod/database"
 )
@@ -18,23 +21,35 @@ var geoipv6 []byte //Geodb dataset for ipv6
 type Store struct {
 	BlacklistEnabled bool
 	WhitelistEnabled bool
-	geodb            [][]string //Parsed geodb list
-	geodbIpv6        [][]string //Parsed geodb list for ipv6
+	ipv4Index        *geoRangeIndex //Compact range index of the embedded ipv4 dataset
+	ipv6Index        *geoRangeIndex //Compact range index of the embedded ipv6 dataset
 	geotrie          *trie
 	geotrieIpv6      *trie
+	geoSource        atomic.Value //*geoSource, loaded mmdb databases
 	//geoipCache sync.Map
-	sysdb  *database.Database
-	option *StoreOptions
+	sysdb       *database.Database
+	option      *StoreOptions
+	sweeperStop chan bool
+	ipListCache sync.Map //Compiled blacklist and whitelist ip rules
+	ipListGen   uint64   //Bumped on every invalidation, guarded by ipListMutex
+	ipListMutex sync.Mutex
+	feeds       map[string]*IpFeed //Loaded ip blocklist / allowlist feeds
+	feedMutex   sync.RWMutex
 }
 
 type StoreOptions struct {
-	AllowSlowIpv4LookUp bool
-	AllowSloeIpv6Lookup bool
+	AllowSlowIpv4LookUp bool   //Use the compact range index instead of trie for ipv4
+	AllowSloeIpv6Lookup bool   //Use the compact range index instead of trie for ipv6
+	FeedFolder          string //Folder for caching ip feeds, default to ./conf/feeds
+	CountryDatabase     string //Path to the country mmdb, fallback to embedded dataset if not exists
+	AsnDatabase         string //Path to the ASN mmdb, ASN lookup is disabled if not exists
 }
 
 type CountryInfo struct {
 	CountryIsoCode string
 	ContinetCode   string
+	ASN            uint   //Autonomous system number, 0 if unknown
+	ASOrganization string //Organization of the autonomous system
 }
 
 func NewGeoDb(sysdb *database.Database, option *StoreOptions) (*Store, error) {
@@ -76,6 +91,11 @@ func NewGeoDb(sysdb *database.Database, option *StoreOptions) (*Store, error) {
 			return nil, err
 		}
 
+		err = sysdb.NewTable("ipfeeds")
+		if err != nil {
+			return nil, err
+		}
+
 		sysdb.Read("blackwhitelist", "blacklistEnabled", &blacklistEnabled)
 		sysdb.Read("blackwhitelist", "whitelistEnabled", &whitelistEnabled)
 	} else {
@@ -83,25 +103,49 @@ func NewGeoDb(sysdb *database.Database, option *StoreOptions) (*Store, error) {
 	}
 
 	var ipv4Trie *trie
+	var ipv4Index *geoRangeIndex
 	if !option.AllowSlowIpv4LookUp {
 		ipv4Trie = constrctTrieTree(parsedGeoData)
+	} else {
+		ipv4Index = newGeoRangeIndex(parsedGeoData)
 	}
 
 	var ipv6Trie *trie
+	var ipv6Index *geoRangeIndex
 	if !option.AllowSloeIpv6Lookup {
 		ipv6Trie = constrctTrieTree(parsedGeoDataIpv6)
+	} else {
+		ipv6Index = newGeoRangeIndex(parsedGeoDataIpv6)
 	}
 
-	return &Store{
+	thisStore := Store{
 		BlacklistEnabled: blacklistEnabled,
 		WhitelistEnabled: whitelistEnabled,
-		geodb:            parsedGeoData,
+		ipv4Index:        ipv4Index,
 		geotrie:          ipv4Trie,
-		geodbIpv6:        parsedGeoDataIpv6,
+		ipv6Index:        ipv6Index,
 		geotrieIpv6:      ipv6Trie,
 		sysdb:            sysdb,
 		option:           option,
-	}, nil
+		sweeperStop:      make(chan bool),
+		feeds:            map[string]*IpFeed{},
+	}
+
+	if option.FeedFolder == "" {
+		option.FeedFolder = defaultFeedFolder
+	}
+
+	//Load the mmdb databases if exists
+	thisStore.ReloadGeoDatabases()
+
+	if sysdb != nil {
+		thisStore.loadIpFeeds()
+
+		//Remove expired blacklist and whitelist entries in background
+		thisStore.startEntrySweeper()
+	}
+
+	return &thisStore, nil
 }
 
 func (s *Store) ToggleBlacklist(enabled bool) {
@@ -115,16 +159,48 @@ func (s *Store) ToggleWhitelist(enabled bool) {
 }
 
 func (s *Store) ResolveCountryCodeFromIP(ipstring string) (*CountryInfo, error) {
-	cc := s.search(ipstring)
-	return &CountryInfo{
-		CountryIsoCode: cc,
-		ContinetCode:   "",
-	}, nil
+	if strings.Contains(ipstring, ",") {
+		//This is a CF proxied request. We only need the front part
+		//Example 219.71.102.145, 172.71.139.178
+		ipstring = strings.TrimSpace(strings.Split(ipstring, ",")[0])
+	}
+
+	info := CountryInfo{}
+	if net.ParseIP(ipstring) == nil {
+		//Not a valid IP address (e.g. [::1]:8080). Resolve to no country
+		return &info, nil
+	}
+
+	source := s.getGeoSource()
+	if source.countryDb != nil {
+		record, err := source.countryDb.lookup(ipstring)
+		if err != nil {
+			return nil, err
+		}
+		info.CountryIsoCode = mmdbString(record, "country", "iso_code")
+		if info.CountryIsoCode == "" {
+			info.CountryIsoCode = mmdbString(record, "registered_country", "iso_code")
+		}
+		info.ContinetCode = mmdbString(record, "continent", "code")
+	} else {
+		info.CountryIsoCode = s.search(ipstring)
+	}
+
+	if source.asnDb != nil {
+		record, err := source.asnDb.lookup(ipstring)
+		if err == nil && record != nil {
+			info.ASN = uint(toUint64(record["autonomous_system_number"]))
+			info.ASOrganization = mmdbString(record, "autonomous_system_organization")
+		}
+	}
 
+	return &info, nil
 }
 
 func (s *Store) Close() {
-
+	if s.sysdb != nil {
+		s.sweeperStop <- true
+	}
 }
 
 /*
@@ -143,11 +219,7 @@ func (s *Store) IsBlacklisted(ipAddr string) bool {
 	}
 
 	countryCode, err := s.ResolveCountryCodeFromIP(ipAddr)
-	if err != nil {
-		return false
-	}
-
-	if s.IsCountryCodeBlacklisted(countryCode.CountryIsoCode) {
+	if err == nil && s.IsCountryCodeBlacklisted(countryCode.CountryIsoCode) {
 		return true
 	}
 
@@ -162,8 +234,9 @@ func (s *Store) IsBlacklisted(ipAddr string) bool {
 IsWhitelisted check if a given IP address is in the current
 server's white list.
 
-Note that the Whitelist default result is true even
-when encountered error
+Note that the Whitelist default result is true only
+when the requester IP cannot be found. IP addresses that
+cannot be resolved are denied
 */
 func (s *Store) IsWhitelisted(ipAddr string) bool {
 	if !s.WhitelistEnabled {
@@ -178,7 +251,7 @@ func (s *Store) IsWhitelisted(ipAddr string) bool {
 
 	countryCode, err := s.ResolveCountryCodeFromIP(ipAddr)
 	if err != nil {
-		return true
+		return false
 	}
 
 	if s.IsCountryCodeWhitelisted(countryCode.CountryIsoCode) {
@@ -203,12 +276,33 @@ func (s *Store) AllowIpAccess(ipaddr string) bool {
 }
 
 func (s *Store) AllowConnectionAccess(conn net.Conn) bool {
-	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+	return s.AllowAddrAccess(conn.RemoteAddr())
+}
+
+// Check access of a TCP or UDP remote address. Other address types are allowed
+func (s *Store) AllowAddrAccess(addr net.Addr) bool {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return s.AllowIpAccess(addr.IP.String())
+	case *net.UDPAddr:
 		return s.AllowIpAccess(addr.IP.String())
 	}
 	return true
 }
 
+// Get the country and ASN info of the requester, return nil if not resolvable
+func (s *Store) GetRequesterCountryInfo(r *http.Request) *CountryInfo {
+	ipAddr := GetRequesterIP(r)
+	if ipAddr == "" {
+		return nil
+	}
+	info, err := s.ResolveCountryCodeFromIP(ipAddr)
+	if err != nil {
+		return nil
+	}
+	return info
+}
+
 func (s *Store) GetRequesterCountryISOCode(r *http.Request) string {
 	ipAddr := GetRequesterIP(r)
 	if ipAddr == "" {
@@ -1,8 +1,12 @@
 package geodb_test
 
 import (
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
+	"imuslab.com/zoraxy/mod/database"
 	"imuslab.com/zoraxy/mod/geodb"
 )
 
@@ -42,8 +46,8 @@ func TestTrieConstruct(t *testing.T) {
 func TestResolveCountryCodeFromIP(t *testing.T) {
 	// Create a new store
 	store, err := geodb.NewGeoDb(nil, &geodb.StoreOptions{
-		false,
-		false,
+		AllowSlowIpv4LookUp: false,
+		AllowSloeIpv6Lookup: false,
 	})
 	if err != nil {
 		t.Errorf("error creating store: %v", err)
@@ -74,3 +78,356 @@ func TestResolveCountryCodeFromIP(t *testing.T) {
 		t.Errorf("expected country code %s, but got %s for IP %s", expected, info.CountryIsoCode, ip)
 	}
 }
+
+func TestExpiringAccessEntries(t *testing.T) {
+	db, err := database.NewDatabase(filepath.Join(t.TempDir(), "test.db"), false)
+	if err != nil {
+		t.Fatalf("error creating database: %v", err)
+	}
+	defer db.Close()
+
+	store, err := geodb.NewGeoDb(db, &geodb.StoreOptions{
+		AllowSlowIpv4LookUp: true,
+		AllowSloeIpv6Lookup: true,
+		FeedFolder:          t.TempDir(),
+	})
+	if err != nil {
+		t.Fatalf("error creating store: %v", err)
+	}
+	defer store.Close()
+
+	//Legacy entries only store true as value
+	db.Write("blacklist-ip", "192.0.2.1", true)
+	store.AddIPToBlackListWithEntry("192.0.2.2", &geodb.AccessEntry{
+		Comment: "test entry",
+	})
+	store.AddIPToBlackListWithEntry("192.0.2.3", &geodb.AccessEntry{
+		Source:   geodb.EntrySource_Auto,
+		ExpireAt: time.Now().Unix() - 1,
+	})
+
+	if !store.IsIPBlacklisted("192.0.2.1") || !store.IsIPBlacklisted("192.0.2.2") {
+		t.Errorf("expected legacy and annotated entries to be blacklisted")
+	}
+
+	if store.IsIPBlacklisted("192.0.2.3") {
+		t.Errorf("expected expired entry to be ignored")
+	}
+
+	entries := store.GetAllBlacklistedIpEntries()
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 active entries, got %d", len(entries))
+	}
+
+	for _, entry := range entries {
+		if entry.Source != geodb.EntrySource_Manual {
+			t.Errorf("expected entry %s to be manual, got %s", entry.Key, entry.Source)
+		}
+		if entry.Key == "192.0.2.2" && (entry.Comment != "test entry" || entry.CreatedAt == 0) {
+			t.Errorf("unexpected metadata for entry %s: %+v", entry.Key, entry)
+		}
+	}
+
+	store.RemoveExpiredEntries()
+	if db.KeyExists("blacklist-ip", "192.0.2.3") {
+		t.Errorf("expected expired entry to be removed by sweeper")
+	}
+}
+
+func TestIpFeedImport(t *testing.T) {
+	db, err := database.NewDatabase(filepath.Join(t.TempDir(), "test.db"), false)
+	if err != nil {
+		t.Fatalf("error creating database: %v", err)
+	}
+	defer db.Close()
+
+	store, err := geodb.NewGeoDb(db, &geodb.StoreOptions{
+		AllowSlowIpv4LookUp: true,
+		AllowSloeIpv6Lookup: true,
+		FeedFolder:          t.TempDir(),
+	})
+	if err != nil {
+		t.Fatalf("error creating store: %v", err)
+	}
+	defer store.Close()
+
+	netset := []byte(`#
+# firehol_level1 sample
+#
+1.10.16.0/20
+2.56.192.0/22 # inline comment
+203.0.113.7
+10.0.0.1-10.0.0.20
+2001:db8::/32
+not-an-ip
+`)
+	err = store.ImportIpFeed("firehol", geodb.IpFeedTarget_Blacklist, netset)
+	if err != nil {
+		t.Fatalf("error importing feed: %v", err)
+	}
+
+	feed := store.GetIpFeed("firehol")
+	if feed == nil || feed.EntryCount != 5 || feed.InvalidCount != 1 {
+		t.Fatalf("unexpected feed stats: %+v", feed)
+	}
+
+	tests := map[string]bool{
+		"1.10.20.5":    true,
+		"1.10.32.0":    false,
+		"2.56.195.255": true,
+		"203.0.113.7":  true,
+		"203.0.113.8":  false,
+		"10.0.0.20":    true,
+		"10.0.0.21":    false,
+		"2001:db8::1":  true,
+		"2001:db9::1":  false,
+	}
+	for ip, expected := range tests {
+		if store.IsIPBlacklisted(ip) != expected {
+			t.Errorf("expected blacklisted state of %s to be %v", ip, expected)
+		}
+	}
+
+	if store.IsIPWhitelisted("203.0.113.7") {
+		t.Errorf("blacklist feed should not affect whitelist")
+	}
+
+	err = store.RemoveIpFeed("firehol")
+	if err != nil {
+		t.Fatalf("error removing feed: %v", err)
+	}
+	if store.IsIPBlacklisted("203.0.113.7") {
+		t.Errorf("expected removed feed to be no longer matched")
+	}
+}
+
+func TestManualCidrRules(t *testing.T) {
+	db, err := database.NewDatabase(filepath.Join(t.TempDir(), "test.db"), false)
+	if err != nil {
+		t.Fatalf("error creating database: %v", err)
+	}
+	defer db.Close()
+
+	store, err := geodb.NewGeoDb(db, &geodb.StoreOptions{
+		AllowSlowIpv4LookUp: true,
+		AllowSloeIpv6Lookup: true,
+		FeedFolder:          t.TempDir(),
+	})
+	if err != nil {
+		t.Fatalf("error creating store: %v", err)
+	}
+	defer store.Close()
+
+	store.AddIPToBlackList("172.164.*.*")
+	store.AddIPToBlackList("192.168.0.0/24")
+	store.AddIPToBlackList("10.*.5.*")
+
+	tests := map[string]bool{
+		"172.164.20.1":  true,
+		"172.165.0.1":   false,
+		"192.168.0.200": true,
+		"192.168.1.1":   false,
+		"10.1.5.9":      true,
+		"10.1.6.9":      false,
+	}
+	for ip, expected := range tests {
+		if store.IsIPBlacklisted(ip) != expected {
+			t.Errorf("expected blacklisted state of %s to be %v", ip, expected)
+		}
+	}
+
+	store.RemoveIPFromBlackList("192.168.0.0/24")
+	if store.IsIPBlacklisted("192.168.0.200") {
+		t.Errorf("expected removed rule to be no longer matched")
+	}
+}
+
+// Build a minimal IPv4 mmdb that maps firstOctet.0.0.0/8 to the given record
+func buildTestMmdb(firstOctet byte, databaseType string, record map[string]interface{}) []byte {
+	encodeSize := func(dataType byte, size int) []byte {
+		if size >= 29 {
+			return []byte{dataType<<5 | 29, byte(size - 29)}
+		}
+		return []byte{dataType<<5 | byte(size)}
+	}
+
+	var encode func(value interface{}) []byte
+	encode = func(value interface{}) []byte {
+		switch v := value.(type) {
+		case string:
+			return append(encodeSize(2, len(v)), []byte(v)...)
+		case uint32:
+			return []byte{6<<5 | 4, byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v)}
+		case map[string]interface{}:
+			result := encodeSize(7, len(v))
+			for key, item := range v {
+				result = append(result, encode(key)...)
+				result = append(result, encode(item)...)
+			}
+			return result
+		}
+		return nil
+	}
+
+	//One node per bit of the first octet, 24 bits record size
+	nodeCount := uint32(8)
+	dataPointer := nodeCount + 16
+	buffer := []byte{}
+	for i := uint32(0); i < nodeCount; i++ {
+		matched := i + 1
+		if i == nodeCount-1 {
+			matched = dataPointer
+		}
+		left, right := nodeCount, nodeCount
+		if (firstOctet>>(7-i))&1 == 0 {
+			left = matched
+		} else {
+			right = matched
+		}
+		buffer = append(buffer, byte(left>>16), byte(left>>8), byte(left), byte(right>>16), byte(right>>8), byte(right))
+	}
+
+	buffer = append(buffer, make([]byte, 16)...)
+	buffer = append(buffer, encode(record)...)
+	buffer = append(buffer, []byte("\xab\xcd\xefMaxMind.com")...)
+	buffer = append(buffer, encode(map[string]interface{}{
+		"node_count":    nodeCount,
+		"record_size":   uint32(24),
+		"ip_version":    uint32(4),
+		"database_type": databaseType,
+		"build_epoch":   uint32(1700000000),
+	})...)
+	return buffer
+}
+
+func TestMmdbHotSwap(t *testing.T) {
+	dbFolder := t.TempDir()
+	countryDbPath := filepath.Join(dbFolder, "country.mmdb")
+	asnDbPath := filepath.Join(dbFolder, "asn.mmdb")
+
+	err := os.WriteFile(countryDbPath, buildTestMmdb(1, "GeoLite2-Country", map[string]interface{}{
+		"continent": map[string]interface{}{"code": "OC"},
+		"country":   map[string]interface{}{"iso_code": "AU"},
+	}), 0775)
+	if err != nil {
+		t.Fatalf("error writing country database: %v", err)
+	}
+
+	err = os.WriteFile(asnDbPath, buildTestMmdb(1, "GeoLite2-ASN", map[string]interface{}{
+		"autonomous_system_number":       uint32(13335),
+		"autonomous_system_organization": "CLOUDFLARENET",
+	}), 0775)
+	if err != nil {
+		t.Fatalf("error writing asn database: %v", err)
+	}
+
+	store, err := geodb.NewGeoDb(nil, &geodb.StoreOptions{
+		AllowSlowIpv4LookUp: true,
+		AllowSloeIpv6Lookup: true,
+		CountryDatabase:     countryDbPath,
+		AsnDatabase:         asnDbPath,
+	})
+	if err != nil {
+		t.Fatalf("error creating store: %v", err)
+	}
+
+	info, err := store.ResolveCountryCodeFromIP("1.1.1.1")
+	if err != nil {
+		t.Fatalf("error resolving ip: %v", err)
+	}
+	if info.CountryIsoCode != "AU" || info.ContinetCode != "OC" || info.ASN != 13335 || info.ASOrganization != "CLOUDFLARENET" {
+		t.Errorf("unexpected lookup result: %+v", info)
+	}
+
+	info, err = store.ResolveCountryCodeFromIP("2.1.1.1")
+	if err != nil {
+		t.Fatalf("error resolving ip: %v", err)
+	}
+	if info.CountryIsoCode != "" || info.ASN != 0 {
+		t.Errorf("expected no result for ip outside database, got %+v", info)
+	}
+
+	status := store.GetGeoDatabaseStatus()
+	if status.CountrySource != countryDbPath || status.CountryDatabaseType != "GeoLite2-Country" || status.AsnSource != asnDbPath {
+		t.Errorf("unexpected database status: %+v", status)
+	}
+
+	//Replace the country database and reload
+	err = os.WriteFile(countryDbPath, buildTestMmdb(1, "GeoLite2-Country", map[string]interface{}{
+		"country": map[string]interface{}{"iso_code": "JP"},
+	}), 0775)
+	if err != nil {
+		t.Fatalf("error writing country database: %v", err)
+	}
+
+	err = store.ReloadGeoDatabases()
+	if err != nil {
+		t.Fatalf("error reloading databases: %v", err)
+	}
+
+	info, _ = store.ResolveCountryCodeFromIP("1.1.1.1")
+	if info.CountryIsoCode != "JP" || info.ASN != 13335 {
+		t.Errorf("expected reloaded database to be used, got %+v", info)
+	}
+
+	//A broken database should not replace the loaded one
+	err = os.WriteFile(countryDbPath, []byte("not a mmdb"), 0775)
+	if err != nil {
+		t.Fatalf("error writing country database: %v", err)
+	}
+	if store.ReloadGeoDatabases() == nil {
+		t.Errorf("expected error when reloading invalid database")
+	}
+
+	info, _ = store.ResolveCountryCodeFromIP("1.1.1.1")
+	if info.CountryIsoCode != "JP" {
+		t.Errorf("expected previous database to be kept, got %+v", info)
+	}
+}
+
+func TestWhitelistDeniesInvalidIP(t *testing.T) {
+	dbFolder := t.TempDir()
+	countryDbPath := filepath.Join(dbFolder, "country.mmdb")
+	err := os.WriteFile(countryDbPath, buildTestMmdb(1, "GeoLite2-Country", map[string]interface{}{
+		"country": map[string]interface{}{"iso_code": "AU"},
+	}), 0775)
+	if err != nil {
+		t.Fatalf("error writing country database: %v", err)
+	}
+
+	db, err := database.NewDatabase(filepath.Join(dbFolder, "test.db"), false)
+	if err != nil {
+		t.Fatalf("error creating database: %v", err)
+	}
+	defer db.Close()
+
+	store, err := geodb.NewGeoDb(db, &geodb.StoreOptions{
+		AllowSlowIpv4LookUp: true,
+		AllowSloeIpv6Lookup: true,
+		CountryDatabase:     countryDbPath,
+	})
+	if err != nil {
+		t.Fatalf("error creating store: %v", err)
+	}
+	defer store.Close()
+
+	store.ToggleWhitelist(true)
+	store.AddCountryCodeToWhitelist("au")
+
+	tests := map[string]bool{
+		"1.1.1.1":                    true,
+		"2.1.1.1":                    false,
+		"not-an-ip":                  false,
+		"[2001:db8::1]:443, 1.1.1.1": false,
+		"[2001:db8::1]:443":          false,
+	}
+	for ip, expected := range tests {
+		info, err := store.ResolveCountryCodeFromIP(ip)
+		if err != nil || info == nil {
+			t.Errorf("expected %s to resolve without error, got %v", ip, err)
+		}
+		if store.IsWhitelisted(ip) != expected {
+			t.Errorf("expected whitelisted state of %s to be %v", ip, expected)
+		}
+	}
+}
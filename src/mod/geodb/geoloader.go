@@ -4,16 +4,10 @@ import (
 	"bytes"
 	"encoding/csv"
 	"io"
-	"strings"
 )
 
+// Search the country code from the embedded dataset
 func (s *Store) search(ip string) string {
-	if strings.Contains(ip, ",") {
-		//This is a CF proxied request. We only need the front part
-		//Example 219.71.102.145, 172.71.139.178
-		ip = strings.Split(ip, ",")[0]
-		ip = strings.TrimSpace(ip)
-	}
 	//See if there are cached country code for this ip
 	/*
 		ccc, ok := s.geoipCache.Load(ip)
@@ -26,13 +20,13 @@ func (s *Store) search(ip string) string {
 	cc := ""
 	if IsIPv6(ip) {
 		if s.geotrieIpv6 == nil {
-			cc = s.slowSearchIpv6(ip)
+			cc = s.ipv6Index.search(ip)
 		} else {
 			cc = s.geotrieIpv6.search(ip)
 		}
 	} else {
 		if s.geotrie == nil {
-			cc = s.slowSearchIpv4(ip)
+			cc = s.ipv4Index.search(ip)
 		} else {
 			cc = s.geotrie.search(ip)
 		}
@@ -0,0 +1,263 @@
+package geodb
+
+import (
+	"bytes"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+	ipset.go
+
+	This script implement a compact IP range set for matching
+	large amount of IP / CIDR rules. All rules are converted into
+	sorted and merged [start, end] ranges in 16 bytes form so
+	a lookup only takes a binary search
+*/
+
+type ipRange struct {
+	start [16]byte
+	end   [16]byte
+}
+
+type ipRangeSet struct {
+	ranges []ipRange
+}
+
+// Build a new ip range set from the given rules. Rules that cannot be
+// converted into a range (e.g. 172.*.1.*) are returned as unparsed
+func newIpRangeSet(rules []string) (*ipRangeSet, []string) {
+	ranges := []ipRange{}
+	unparsed := []string{}
+	for _, rule := range rules {
+		thisRange, ok := parseIpRule(rule)
+		if !ok {
+			unparsed = append(unparsed, rule)
+			continue
+		}
+		ranges = append(ranges, thisRange)
+	}
+
+	sort.Slice(ranges, func(i, j int) bool {
+		return bytes.Compare(ranges[i].start[:], ranges[j].start[:]) < 0
+	})
+
+	//Merge overlapping or adjacent ranges
+	merged := []ipRange{}
+	for _, thisRange := range ranges {
+		if len(merged) > 0 {
+			last := &merged[len(merged)-1]
+			next := nextIpBytes(last.end)
+			if bytes.Compare(thisRange.start[:], next[:]) <= 0 || bytes.Compare(thisRange.start[:], last.end[:]) <= 0 {
+				if bytes.Compare(thisRange.end[:], last.end[:]) > 0 {
+					last.end = thisRange.end
+				}
+				continue
+			}
+		}
+		merged = append(merged, thisRange)
+	}
+
+	return &ipRangeSet{
+		ranges: merged,
+	}, unparsed
+}
+
+// Check if the given ip address is inside this set
+func (s *ipRangeSet) Contains(ipAddr string) bool {
+	ip := net.ParseIP(ipAddr)
+	if ip == nil || s == nil || len(s.ranges) == 0 {
+		return false
+	}
+
+	var target [16]byte
+	copy(target[:], ip.To16())
+
+	//Find the first range that ends after the target
+	idx := sort.Search(len(s.ranges), func(i int) bool {
+		return bytes.Compare(s.ranges[i].end[:], target[:]) >= 0
+	})
+
+	if idx >= len(s.ranges) {
+		return false
+	}
+
+	return bytes.Compare(s.ranges[idx].start[:], target[:]) <= 0
+}
+
+// Return the number of merged ranges in this set
+func (s *ipRangeSet) Len() int {
+	if s == nil {
+		return 0
+	}
+	return len(s.ranges)
+}
+
+// Parse a single IP, CIDR, trailing wildcard (e.g. 172.164.*.*)
+// or range (e.g. 10.0.0.1-10.0.0.20) rule into ip range
+func parseIpRule(rule string) (ipRange, bool) {
+	rule = strings.TrimSpace(rule)
+	if strings.Contains(rule, "/") {
+		_, ipnet, err := net.ParseCIDR(rule)
+		if err != nil {
+			return ipRange{}, false
+		}
+
+		start := make(net.IP, len(ipnet.IP))
+		end := make(net.IP, len(ipnet.IP))
+		for i := range ipnet.IP {
+			start[i] = ipnet.IP[i] & ipnet.Mask[i]
+			end[i] = ipnet.IP[i] | ^ipnet.Mask[i]
+		}
+		return toIpRange(start, end), true
+	}
+
+	if strings.Contains(rule, "-") {
+		parts := strings.SplitN(rule, "-", 2)
+		start := net.ParseIP(strings.TrimSpace(parts[0]))
+		end := net.ParseIP(strings.TrimSpace(parts[1]))
+		if start == nil || end == nil || (start.To4() == nil) != (end.To4() == nil) {
+			return ipRange{}, false
+		}
+		thisRange := toIpRange(start, end)
+		if bytes.Compare(thisRange.start[:], thisRange.end[:]) > 0 {
+			return ipRange{}, false
+		}
+		return thisRange, true
+	}
+
+	if strings.Contains(rule, "*") {
+		octets := strings.Split(rule, ".")
+		if len(octets) != 4 {
+			return ipRange{}, false
+		}
+
+		start := net.IPv4(0, 0, 0, 0).To4()
+		end := net.IPv4(0, 0, 0, 0).To4()
+		wildcardStarted := false
+		for i, octet := range octets {
+			if octet == "*" {
+				wildcardStarted = true
+				start[i] = 0
+				end[i] = 255
+				continue
+			}
+
+			if wildcardStarted {
+				//Wildcard in middle, cannot be represented as a single range
+				return ipRange{}, false
+			}
+
+			value, err := strconv.Atoi(octet)
+			if err != nil || value < 0 || value > 255 {
+				return ipRange{}, false
+			}
+			start[i] = byte(value)
+			end[i] = byte(value)
+		}
+		return toIpRange(start, end), true
+	}
+
+	ip := net.ParseIP(rule)
+	if ip == nil {
+		return ipRange{}, false
+	}
+	return toIpRange(ip, ip), true
+}
+
+func toIpRange(start net.IP, end net.IP) ipRange {
+	thisRange := ipRange{}
+	copy(thisRange.start[:], start.To16())
+	copy(thisRange.end[:], end.To16())
+	return thisRange
+}
+
+// Return the ip address right after the given one, wrap around on overflow
+func nextIpBytes(ip [16]byte) [16]byte {
+	for i := len(ip) - 1; i >= 0; i-- {
+		ip[i]++
+		if ip[i] != 0 {
+			break
+		}
+	}
+	return ip
+}
+
+/*
+	Compiled IP lists
+
+	Blacklist and whitelist IP rules are compiled into ip range set
+	and cached until the list is modified or an entry expires
+*/
+
+type compiledIpList struct {
+	set      *ipRangeSet
+	unparsed []string //Rules that require linear matching
+	expireAt int64    //Earliest expiry of entries in this list, 0 if none
+}
+
+func (s *Store) getCompiledIpList(tableName string) *compiledIpList {
+	if cached, ok := s.ipListCache.Load(tableName); ok {
+		compiled := cached.(*compiledIpList)
+		if compiled.expireAt == 0 || compiled.expireAt > time.Now().Unix() {
+			return compiled
+		}
+	}
+
+	//Remember the generation so a rebuild racing with invalidation
+	//will not overwrite the cache with the stale result
+	s.ipListMutex.Lock()
+	generation := s.ipListGen
+	s.ipListMutex.Unlock()
+
+	entries := s.listEntries(tableName)
+	rules := []string{}
+	var earliestExpiry int64 = 0
+	for _, entry := range entries {
+		rules = append(rules, entry.Key)
+		if entry.ExpireAt > 0 && (earliestExpiry == 0 || entry.ExpireAt < earliestExpiry) {
+			earliestExpiry = entry.ExpireAt
+		}
+	}
+
+	set, unparsed := newIpRangeSet(rules)
+	compiled := &compiledIpList{
+		set:      set,
+		unparsed: unparsed,
+		expireAt: earliestExpiry,
+	}
+	s.ipListMutex.Lock()
+	if s.ipListGen == generation {
+		s.ipListCache.Store(tableName, compiled)
+	}
+	s.ipListMutex.Unlock()
+	return compiled
+}
+
+// Remove the compiled list cache so it will be rebuilt on next lookup
+func (s *Store) invalidateIpList(tableName string) {
+	s.ipListMutex.Lock()
+	s.ipListGen++
+	s.ipListCache.Delete(tableName)
+	s.ipListMutex.Unlock()
+}
+
+// Check if the ip address matches any rules in the given ip list table
+func (s *Store) matchIpList(tableName string, ipAddr string) bool {
+	compiled := s.getCompiledIpList(tableName)
+	if compiled.set.Contains(ipAddr) {
+		return true
+	}
+
+	//Fallback to linear matching for rules that are not ranges
+	for _, rule := range compiled.unparsed {
+		if MatchIpWildcard(ipAddr, rule) || MatchIpCIDR(ipAddr, rule) {
+			return true
+		}
+	}
+
+	return false
+}
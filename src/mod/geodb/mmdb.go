@@ -0,0 +1,411 @@
+package geodb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"net"
+	"os"
+)
+
+/*
+	mmdb.go
+
+	A minimal reader for MaxMind DB (MMDB) files, the format used by
+	MaxMind GeoLite2 / GeoIP2 and DB-IP databases. Only the features
+	required for country and ASN lookup are implemented.
+
+	Format specification: https://maxmind.github.io/MaxMind-DB/
+*/
+
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+const mmdbDataSectionSeparatorSize = 16
+
+type mmdbMetadata struct {
+	NodeCount    uint
+	RecordSize   uint
+	IPVersion    uint
+	DatabaseType string
+	BuildEpoch   uint64
+}
+
+type mmdbReader struct {
+	buffer      []byte //The whole database file
+	metadata    mmdbMetadata
+	dataSection []byte //The data section of the database
+	ipv4Start   uint   //Node to start for IPv4 lookups in IPv6 trees
+}
+
+// Open and parse a mmdb file
+func openMmdb(filename string) (*mmdbReader, error) {
+	buffer, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return newMmdbReader(buffer)
+}
+
+func newMmdbReader(buffer []byte) (*mmdbReader, error) {
+	markerIndex := bytes.LastIndex(buffer, mmdbMetadataMarker)
+	if markerIndex < 0 {
+		return nil, errors.New("invalid mmdb file: metadata not found")
+	}
+
+	metadataStart := markerIndex + len(mmdbMetadataMarker)
+	metadataDecoder := mmdbDecoder{buffer: buffer[metadataStart:]}
+	rawMetadata, _, err := metadataDecoder.decode(0)
+	if err != nil {
+		return nil, errors.New("invalid mmdb metadata: " + err.Error())
+	}
+
+	metadataMap, ok := rawMetadata.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("invalid mmdb metadata")
+	}
+
+	metadata := mmdbMetadata{
+		NodeCount:  uint(toUint64(metadataMap["node_count"])),
+		RecordSize: uint(toUint64(metadataMap["record_size"])),
+		IPVersion:  uint(toUint64(metadataMap["ip_version"])),
+		BuildEpoch: toUint64(metadataMap["build_epoch"]),
+	}
+	metadata.DatabaseType, _ = metadataMap["database_type"].(string)
+
+	if metadata.RecordSize != 24 && metadata.RecordSize != 28 && metadata.RecordSize != 32 {
+		return nil, errors.New("unsupported mmdb record size")
+	}
+
+	if metadata.IPVersion != 4 && metadata.IPVersion != 6 {
+		return nil, errors.New("unsupported mmdb ip version")
+	}
+
+	searchTreeSize := metadata.NodeCount * metadata.RecordSize / 4
+	dataSectionStart := searchTreeSize + mmdbDataSectionSeparatorSize
+	if dataSectionStart > uint(markerIndex) {
+		return nil, errors.New("invalid mmdb file: search tree out of range")
+	}
+
+	reader := mmdbReader{
+		buffer:      buffer,
+		metadata:    metadata,
+		dataSection: buffer[dataSectionStart:markerIndex],
+	}
+
+	//Find the IPv4 subtree (::/96) in IPv6 databases
+	if metadata.IPVersion == 6 {
+		node := uint(0)
+		for i := 0; i < 96 && node < metadata.NodeCount; i++ {
+			node, err = reader.readNode(node, 0)
+			if err != nil {
+				return nil, err
+			}
+		}
+		reader.ipv4Start = node
+	}
+
+	return &reader, nil
+}
+
+// Read the left (0) or right (1) record of a node
+func (r *mmdbReader) readNode(node uint, bit uint) (uint, error) {
+	nodeSize := r.metadata.RecordSize / 4
+	offset := node * nodeSize
+	if offset+nodeSize > uint(len(r.buffer)) {
+		return 0, errors.New("invalid mmdb node")
+	}
+	b := r.buffer[offset : offset+nodeSize]
+
+	switch r.metadata.RecordSize {
+	case 24:
+		if bit == 0 {
+			return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2]), nil
+		}
+		return uint(b[3])<<16 | uint(b[4])<<8 | uint(b[5]), nil
+	case 28:
+		if bit == 0 {
+			return uint(b[3]&0xF0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2]), nil
+		}
+		return uint(b[3]&0x0F)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6]), nil
+	default:
+		if bit == 0 {
+			return uint(binary.BigEndian.Uint32(b[0:4])), nil
+		}
+		return uint(binary.BigEndian.Uint32(b[4:8])), nil
+	}
+}
+
+// Lookup the record of an ip address, return nil if not found
+func (r *mmdbReader) lookup(ipAddr string) (map[string]interface{}, error) {
+	ip := net.ParseIP(ipAddr)
+	if ip == nil {
+		return nil, errors.New("invalid ip address")
+	}
+
+	node := uint(0)
+	if ipv4 := ip.To4(); ipv4 != nil {
+		ip = ipv4
+		if r.metadata.IPVersion == 6 {
+			node = r.ipv4Start
+		}
+	} else if r.metadata.IPVersion == 4 {
+		//IPv6 address in IPv4 only database
+		return nil, nil
+	}
+
+	bitCount := uint(len(ip) * 8)
+	for i := uint(0); i < bitCount && node < r.metadata.NodeCount; i++ {
+		bit := uint(ip[i/8]>>(7-(i%8))) & 1
+		next, err := r.readNode(node, bit)
+		if err != nil {
+			return nil, err
+		}
+		node = next
+	}
+
+	if node == r.metadata.NodeCount {
+		//Not found
+		return nil, nil
+	}
+
+	if node < r.metadata.NodeCount {
+		return nil, errors.New("invalid mmdb search tree")
+	}
+
+	offset := node - r.metadata.NodeCount - mmdbDataSectionSeparatorSize
+	decoder := mmdbDecoder{buffer: r.dataSection}
+	value, _, err := decoder.decode(offset)
+	if err != nil {
+		return nil, err
+	}
+
+	record, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("invalid mmdb record")
+	}
+	return record, nil
+}
+
+/*
+	Data section decoder
+*/
+
+const (
+	mmdbType_Extended  = 0
+	mmdbType_Pointer   = 1
+	mmdbType_String    = 2
+	mmdbType_Double    = 3
+	mmdbType_Bytes     = 4
+	mmdbType_Uint16    = 5
+	mmdbType_Uint32    = 6
+	mmdbType_Map       = 7
+	mmdbType_Int32     = 8
+	mmdbType_Uint64    = 9
+	mmdbType_Uint128   = 10
+	mmdbType_Array     = 11
+	mmdbType_Container = 12
+	mmdbType_EndMarker = 13
+	mmdbType_Boolean   = 14
+	mmdbType_Float     = 15
+)
+
+const mmdbMaxDecodeDepth = 32
+
+var errMmdbOutOfRange = errors.New("invalid mmdb data: offset out of range")
+
+type mmdbDecoder struct {
+	buffer []byte
+	depth  int
+}
+
+// Decode the value at offset, return the value and the offset after it
+func (d *mmdbDecoder) decode(offset uint) (interface{}, uint, error) {
+	d.depth++
+	defer func() { d.depth-- }()
+	if d.depth > mmdbMaxDecodeDepth {
+		return nil, 0, errors.New("invalid mmdb data: max depth exceeded")
+	}
+
+	if offset >= uint(len(d.buffer)) {
+		return nil, 0, errMmdbOutOfRange
+	}
+
+	ctrl := d.buffer[offset]
+	offset++
+	dataType := uint(ctrl >> 5)
+
+	if dataType == mmdbType_Pointer {
+		pointer, newOffset, err := d.decodePointer(ctrl, offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		value, _, err := d.decode(pointer)
+		return value, newOffset, err
+	}
+
+	if dataType == mmdbType_Extended {
+		if offset >= uint(len(d.buffer)) {
+			return nil, 0, errMmdbOutOfRange
+		}
+		dataType = 7 + uint(d.buffer[offset])
+		offset++
+	}
+
+	size, offset, err := d.decodeSize(ctrl, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	switch dataType {
+	case mmdbType_Map:
+		result := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			var key, value interface{}
+			key, offset, err = d.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			value, offset, err = d.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			keyString, ok := key.(string)
+			if !ok {
+				return nil, 0, errors.New("invalid mmdb data: map key is not string")
+			}
+			result[keyString] = value
+		}
+		return result, offset, nil
+	case mmdbType_Array:
+		result := make([]interface{}, 0, size)
+		for i := uint(0); i < size; i++ {
+			var value interface{}
+			value, offset, err = d.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			result = append(result, value)
+		}
+		return result, offset, nil
+	case mmdbType_Boolean:
+		return size != 0, offset, nil
+	}
+
+	if offset+size > uint(len(d.buffer)) {
+		return nil, 0, errMmdbOutOfRange
+	}
+	payload := d.buffer[offset : offset+size]
+	newOffset := offset + size
+
+	switch dataType {
+	case mmdbType_String:
+		return string(payload), newOffset, nil
+	case mmdbType_Bytes:
+		return append([]byte{}, payload...), newOffset, nil
+	case mmdbType_Double:
+		if size != 8 {
+			return nil, 0, errors.New("invalid mmdb data: bad double size")
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(payload)), newOffset, nil
+	case mmdbType_Float:
+		if size != 4 {
+			return nil, 0, errors.New("invalid mmdb data: bad float size")
+		}
+		return math.Float32frombits(binary.BigEndian.Uint32(payload)), newOffset, nil
+	case mmdbType_Uint16, mmdbType_Uint32, mmdbType_Uint64:
+		if size > 8 {
+			return nil, 0, errors.New("invalid mmdb data: bad integer size")
+		}
+		return decodeMmdbUint(payload), newOffset, nil
+	case mmdbType_Int32:
+		if size > 4 {
+			return nil, 0, errors.New("invalid mmdb data: bad integer size")
+		}
+		return int32(uint32(decodeMmdbUint(payload))), newOffset, nil
+	case mmdbType_Uint128:
+		//Not used by country or ASN databases, keep the raw bytes
+		return append([]byte{}, payload...), newOffset, nil
+	}
+
+	return nil, 0, errors.New("invalid mmdb data: unknown data type")
+}
+
+func (d *mmdbDecoder) decodePointer(ctrl byte, offset uint) (uint, uint, error) {
+	pointerSize := uint((ctrl>>3)&0x3) + 1
+	if offset+pointerSize > uint(len(d.buffer)) {
+		return 0, 0, errMmdbOutOfRange
+	}
+
+	b := d.buffer[offset : offset+pointerSize]
+	vvv := uint(ctrl & 0x7)
+	var pointer uint
+	switch pointerSize {
+	case 1:
+		pointer = vvv<<8 | uint(b[0])
+	case 2:
+		pointer = (vvv<<16 | uint(b[0])<<8 | uint(b[1])) + 2048
+	case 3:
+		pointer = (vvv<<24 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])) + 526336
+	default:
+		pointer = uint(binary.BigEndian.Uint32(b))
+	}
+	return pointer, offset + pointerSize, nil
+}
+
+func (d *mmdbDecoder) decodeSize(ctrl byte, offset uint) (uint, uint, error) {
+	size := uint(ctrl & 0x1f)
+	if size < 29 {
+		return size, offset, nil
+	}
+
+	extraBytes := size - 28
+	if offset+extraBytes > uint(len(d.buffer)) {
+		return 0, 0, errMmdbOutOfRange
+	}
+	b := d.buffer[offset : offset+extraBytes]
+	switch size {
+	case 29:
+		size = 29 + uint(b[0])
+	case 30:
+		size = 285 + (uint(b[0])<<8 | uint(b[1]))
+	default:
+		size = 65821 + (uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2]))
+	}
+	return size, offset + extraBytes, nil
+}
+
+func decodeMmdbUint(payload []byte) uint64 {
+	var value uint64
+	for _, b := range payload {
+		value = value<<8 | uint64(b)
+	}
+	return value
+}
+
+// Convert decoded numeric value to uint64
+func toUint64(value interface{}) uint64 {
+	switch v := value.(type) {
+	case uint64:
+		return v
+	case int32:
+		return uint64(v)
+	case float64:
+		return uint64(v)
+	}
+	return 0
+}
+
+// Get a nested string field from a decoded record, e.g. country -> iso_code
+func mmdbString(record map[string]interface{}, keys ...string) string {
+	var current interface{} = record
+	for _, key := range keys {
+		currentMap, ok := current.(map[string]interface{})
+		if !ok {
+			return ""
+		}
+		current = currentMap[key]
+	}
+	value, _ := current.(string)
+	return value
+}
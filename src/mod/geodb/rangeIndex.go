@@ -0,0 +1,100 @@
+package geodb
+
+import (
+	"bytes"
+	"net"
+	"sort"
+)
+
+/*
+	rangeIndex.go
+
+	Compact in-memory index for the embedded geoip csv. Each row
+	(ip start, ip end, country code) is stored as fixed size range
+	with a country code index, and lookup is done by binary search.
+	This takes a few MB of memory instead of the 1GB required by the trie
+*/
+
+type geoRangeIndex struct {
+	ranges       []ipRange
+	countryIndex []uint16 //Index into countryCodes for each range
+	countryCodes []string //Unique country codes
+}
+
+// Build the range index from the parsed csv records
+func newGeoRangeIndex(records [][]string) *geoRangeIndex {
+	index := geoRangeIndex{
+		ranges:       make([]ipRange, 0, len(records)),
+		countryIndex: make([]uint16, 0, len(records)),
+		countryCodes: []string{},
+	}
+
+	ccLookup := map[string]uint16{}
+	for _, record := range records {
+		if len(record) < 3 {
+			continue
+		}
+
+		start := net.ParseIP(record[0])
+		end := net.ParseIP(record[1])
+		if start == nil || end == nil {
+			continue
+		}
+
+		cc := record[2]
+		ccIdx, ok := ccLookup[cc]
+		if !ok {
+			ccIdx = uint16(len(index.countryCodes))
+			index.countryCodes = append(index.countryCodes, cc)
+			ccLookup[cc] = ccIdx
+		}
+
+		index.ranges = append(index.ranges, toIpRange(start, end))
+		index.countryIndex = append(index.countryIndex, ccIdx)
+	}
+
+	if !sort.IsSorted(&index) {
+		sort.Sort(&index)
+	}
+
+	return &index
+}
+
+// Search the country code of the given ip address
+func (g *geoRangeIndex) search(ipAddr string) string {
+	if g == nil || isReservedIP(ipAddr) {
+		return ""
+	}
+
+	ip := net.ParseIP(ipAddr)
+	if ip == nil {
+		return ""
+	}
+
+	var target [16]byte
+	copy(target[:], ip.To16())
+
+	idx := sort.Search(len(g.ranges), func(i int) bool {
+		return bytes.Compare(g.ranges[i].end[:], target[:]) >= 0
+	})
+
+	if idx >= len(g.ranges) || bytes.Compare(g.ranges[idx].start[:], target[:]) > 0 {
+		return ""
+	}
+
+	return g.countryCodes[g.countryIndex[idx]]
+}
+
+// sort.Interface implementations
+func (g *geoRangeIndex) Len() int {
+	return len(g.ranges)
+}
+
+func (g *geoRangeIndex) Less(i, j int) bool {
+	return bytes.Compare(g.ranges[i].start[:], g.ranges[j].start[:]) < 0
+}
+
+func (g *geoRangeIndex) Swap(i, j int) {
+	g.ranges[i], g.ranges[j] = g.ranges[j], g.ranges[i]
+	g.countryIndex[i], g.countryIndex[j] = g.countryIndex[j], g.countryIndex[i]
+}
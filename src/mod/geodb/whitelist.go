@@ -11,8 +11,13 @@ import "strings"
 //Geo Whitelist
 
 func (s *Store) AddCountryCodeToWhitelist(countryCode string) {
+	s.AddCountryCodeToWhitelistWithEntry(countryCode, nil)
+}
+
+// Add a country code to whitelist with metadata, e.g. comment and expiry
+func (s *Store) AddCountryCodeToWhitelistWithEntry(countryCode string, entry *AccessEntry) {
 	countryCode = strings.ToLower(countryCode)
-	s.sysdb.Write("whitelist-cn", countryCode, true)
+	s.writeEntry("whitelist-cn", countryCode, entry)
 }
 
 func (s *Store) RemoveCountryCodeFromWhitelist(countryCode string) {
@@ -22,70 +27,53 @@ func (s *Store) RemoveCountryCodeFromWhitelist(countryCode string) {
 
 func (s *Store) IsCountryCodeWhitelisted(countryCode string) bool {
 	countryCode = strings.ToLower(countryCode)
-	var isWhitelisted bool = false
-	s.sysdb.Read("whitelist-cn", countryCode, &isWhitelisted)
-	return isWhitelisted
+	return s.isEntryActive("whitelist-cn", countryCode)
 }
 
 func (s *Store) GetAllWhitelistedCountryCode() []string {
-	whitelistedCountryCode := []string{}
-	entries, err := s.sysdb.ListTable("whitelist-cn")
-	if err != nil {
-		return whitelistedCountryCode
-	}
-	for _, keypairs := range entries {
-		ip := string(keypairs[0])
-		whitelistedCountryCode = append(whitelistedCountryCode, ip)
-	}
+	return entryKeys(s.GetAllWhitelistedCountryCodeEntries())
+}
 
-	return whitelistedCountryCode
+// Get all whitelisted country codes with their metadata
+func (s *Store) GetAllWhitelistedCountryCodeEntries() []*AccessEntry {
+	return s.listEntries("whitelist-cn")
 }
 
 //IP Whitelist
 
 func (s *Store) AddIPToWhiteList(ipAddr string) {
-	s.sysdb.Write("whitelist-ip", ipAddr, true)
+	s.AddIPToWhiteListWithEntry(ipAddr, nil)
+}
+
+// Add an IP or IP range to whitelist with metadata, e.g. comment and expiry
+func (s *Store) AddIPToWhiteListWithEntry(ipAddr string, entry *AccessEntry) {
+	s.writeEntry("whitelist-ip", ipAddr, entry)
 }
 
 func (s *Store) RemoveIPFromWhiteList(ipAddr string) {
 	s.sysdb.Delete("whitelist-ip", ipAddr)
+	s.invalidateIpList("whitelist-ip")
 }
 
 func (s *Store) IsIPWhitelisted(ipAddr string) bool {
-	var isWhitelisted bool = false
-	s.sysdb.Read("whitelist-ip", ipAddr, &isWhitelisted)
-	if isWhitelisted {
+	if s.isEntryActive("whitelist-ip", ipAddr) {
 		return true
 	}
 
-	//Check for IP wildcard and CIRD rules
-	AllWhitelistedIps := s.GetAllWhitelistedIp()
-	for _, whitelistRules := range AllWhitelistedIps {
-		wildcardMatch := MatchIpWildcard(ipAddr, whitelistRules)
-		if wildcardMatch {
-			return true
-		}
-
-		cidrMatch := MatchIpCIDR(ipAddr, whitelistRules)
-		if cidrMatch {
-			return true
-		}
+	//Check for IP wildcard, CIDR and range rules
+	if s.matchIpList("whitelist-ip", ipAddr) {
+		return true
 	}
 
-	return false
+	//Check for imported allowlist feeds
+	return s.matchIpFeeds(IpFeedTarget_Whitelist, ipAddr)
 }
 
 func (s *Store) GetAllWhitelistedIp() []string {
-	whitelistedIp := []string{}
-	entries, err := s.sysdb.ListTable("whitelist-ip")
-	if err != nil {
-		return whitelistedIp
-	}
-
-	for _, keypairs := range entries {
-		ip := string(keypairs[0])
-		whitelistedIp = append(whitelistedIp, ip)
-	}
+	return entryKeys(s.GetAllWhitelistedIpEntries())
+}
 
-	return whitelistedIp
+// Get all whitelisted IP or IP ranges with their metadata
+func (s *Store) GetAllWhitelistedIpEntries() []*AccessEntry {
+	return s.listEntries("whitelist-ip")
 }
@@ -0,0 +1,157 @@
+package livestream
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"imuslab.com/zoraxy/mod/utils"
+)
+
+/*
+	handler.go
+
+	Stream the events to viewers over WebSocket or Server-Sent Events.
+	Filters are given as GET parameters, e.g.
+	/api/stream/ws?host=example.com&status=5xx
+*/
+
+const (
+	pingInterval = 30 * time.Second
+	writeTimeout = 10 * time.Second
+)
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 4096,
+}
+
+// Notice sent to viewers when events are dropped due to slow connection
+type droppedNotice struct {
+	Dropped uint64 `json:"dropped"`
+}
+
+// Parse the stream filter from request parameters
+func GetFilterFromRequest(r *http.Request) *Filter {
+	filter := Filter{}
+	filter.Host, _ = utils.GetPara(r, "host")
+	filter.Endpoint, _ = utils.GetPara(r, "endpoint")
+	filter.ClientIP, _ = utils.GetPara(r, "ip")
+	filter.Country, _ = utils.GetPara(r, "country")
+	filter.ForwardType, _ = utils.GetPara(r, "forwardtype")
+	filter.StatusClass, _ = utils.GetPara(r, "status")
+	filter.Keyword, _ = utils.GetPara(r, "keyword")
+	errorOnly, _ := utils.GetPara(r, "erroronly")
+	filter.ErrorOnly, _ = strconv.ParseBool(errorOnly)
+	return &filter
+}
+
+// Stream the events over WebSocket
+func (h *Hub) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
+	subscriber := h.Subscribe(GetFilterFromRequest(r))
+	if subscriber == nil {
+		http.Error(w, "503 - Too many live stream viewers", http.StatusServiceUnavailable)
+		return
+	}
+	defer h.Unsubscribe(subscriber)
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	//Read loop to handle control frames and detect disconnection
+	clientGone := make(chan bool)
+	go func() {
+		defer close(clientGone)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	pingTicker := time.NewTicker(pingInterval)
+	defer pingTicker.Stop()
+	for {
+		select {
+		case event, ok := <-subscriber.Events():
+			if !ok {
+				return
+			}
+			if dropped := subscriber.TakeDropped(); dropped > 0 {
+				conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+				if err := conn.WriteJSON(droppedNotice{Dropped: dropped}); err != nil {
+					return
+				}
+			}
+			conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			if err := conn.WriteJSON(event); err != nil {
+				return
+			}
+		case <-pingTicker.C:
+			err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeTimeout))
+			if err != nil {
+				return
+			}
+		case <-clientGone:
+			return
+		}
+	}
+}
+
+// Stream the events over Server-Sent Events
+func (h *Hub) HandleSSE(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "500 - Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	subscriber := h.Subscribe(GetFilterFromRequest(r))
+	if subscriber == nil {
+		http.Error(w, "503 - Too many live stream viewers", http.StatusServiceUnavailable)
+		return
+	}
+	defer h.Unsubscribe(subscriber)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	pingTicker := time.NewTicker(pingInterval)
+	defer pingTicker.Stop()
+	for {
+		select {
+		case event, ok := <-subscriber.Events():
+			if !ok {
+				return
+			}
+			if dropped := subscriber.TakeDropped(); dropped > 0 {
+				js, _ := json.Marshal(droppedNotice{Dropped: dropped})
+				w.Write([]byte("event: dropped\ndata: " + string(js) + "\n\n"))
+			}
+			js, _ := json.Marshal(event)
+			_, err := w.Write([]byte("event: request\ndata: " + string(js) + "\n\n"))
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-pingTicker.C:
+			//Comment line to keep the connection alive through proxies
+			_, err := w.Write([]byte(": ping\n\n"))
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package livestream
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+	Live Stream
+
+	This module publish the routing result of each request to the
+	admin UI viewers over WebSocket or Server-Sent Events as it happens.
+	Each viewer has its own bounded queue. When a viewer cannot keep up,
+	events are dropped for that viewer instead of blocking the proxy
+*/
+
+// Routing result of a request
+type Event struct {
+	Time        int64   `json:"time"` //Unix timestamp in milliseconds
+	RequestID   string  `json:"request_id,omitempty"`
+	Method      string  `json:"method"`
+	Host        string  `json:"host"`
+	Path        string  `json:"path"`
+	StatusCode  int     `json:"status"`
+	Succ        bool    `json:"succ"`
+	ForwardType string  `json:"forward_type"`
+	Endpoint    string  `json:"endpoint,omitempty"`
+	Target      string  `json:"target,omitempty"`
+	LatencyMs   float64 `json:"latency_ms"`
+	ClientIP    string  `json:"client_ip"`
+	Country     string  `json:"country,omitempty"`
+}
+
+// Server side filter of a viewer, empty fields match everything
+type Filter struct {
+	Host        string //Match if the host contains this value
+	Endpoint    string
+	ClientIP    string
+	Country     string
+	ForwardType string
+	StatusClass string //e.g. 5xx
+	ErrorOnly   bool   //Only publish requests that are not succeeded
+	Keyword     string //Match if the path contains this value
+}
+
+type Options struct {
+	QueueSize      int //Number of events buffered for each viewer, default 256
+	MaxSubscribers int //Max number of concurrent viewers, default 16
+}
+
+type Subscriber struct {
+	dropped uint64 //Keep 64 bit fields on top for atomic alignment
+
+	Filter    *Filter
+	events    chan *Event
+	closeOnce sync.Once
+}
+
+type Hub struct {
+	subscriberCount int32
+	Option          *Options
+	subscribers     map[*Subscriber]bool
+	mutex           sync.RWMutex
+}
+
+// Create a new live stream hub
+func NewHub(option *Options) *Hub {
+	if option.QueueSize <= 0 {
+		option.QueueSize = 256
+	}
+	if option.MaxSubscribers <= 0 {
+		option.MaxSubscribers = 16
+	}
+
+	return &Hub{
+		Option:      option,
+		subscribers: map[*Subscriber]bool{},
+	}
+}
+
+// Check if there is any viewer, so the caller can skip building events
+func (h *Hub) HasSubscribers() bool {
+	return h != nil && atomic.LoadInt32(&h.subscriberCount) > 0
+}
+
+// Subscribe to the events that match the filter, return nil if the hub is full
+func (h *Hub) Subscribe(filter *Filter) *Subscriber {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if len(h.subscribers) >= h.Option.MaxSubscribers {
+		return nil
+	}
+
+	subscriber := Subscriber{
+		Filter: filter,
+		events: make(chan *Event, h.Option.QueueSize),
+	}
+	h.subscribers[&subscriber] = true
+	atomic.StoreInt32(&h.subscriberCount, int32(len(h.subscribers)))
+	return &subscriber
+}
+
+// Remove a subscriber from the hub
+func (h *Hub) Unsubscribe(subscriber *Subscriber) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if _, ok := h.subscribers[subscriber]; !ok {
+		return
+	}
+	delete(h.subscribers, subscriber)
+	atomic.StoreInt32(&h.subscriberCount, int32(len(h.subscribers)))
+	subscriber.closeOnce.Do(func() {
+		close(subscriber.events)
+	})
+}
+
+// Publish an event to all the matching subscribers without blocking
+func (h *Hub) Publish(event *Event) {
+	if !h.HasSubscribers() {
+		return
+	}
+
+	if event.Time == 0 {
+		event.Time = time.Now().UnixNano() / int64(time.Millisecond)
+	}
+
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	for subscriber := range h.subscribers {
+		if !subscriber.Filter.Match(event) {
+			continue
+		}
+		select {
+		case subscriber.events <- event:
+		default:
+			//Viewer too slow, drop the event for this viewer
+			atomic.AddUint64(&subscriber.dropped, 1)
+		}
+	}
+}
+
+// Get the event channel of the subscriber, closed when unsubscribed
+func (s *Subscriber) Events() <-chan *Event {
+	return s.events
+}
+
+// Get and reset the number of events dropped for this subscriber
+func (s *Subscriber) TakeDropped() uint64 {
+	return atomic.SwapUint64(&s.dropped, 0)
+}
+
+// Check if the event match this filter
+func (f *Filter) Match(event *Event) bool {
+	if f == nil {
+		return true
+	}
+	if f.Host != "" && !strings.Contains(strings.ToLower(event.Host), strings.ToLower(f.Host)) {
+		return false
+	}
+	if f.Endpoint != "" && event.Endpoint != f.Endpoint {
+		return false
+	}
+	if f.ClientIP != "" && event.ClientIP != f.ClientIP {
+		return false
+	}
+	if f.Country != "" && !strings.EqualFold(event.Country, f.Country) {
+		return false
+	}
+	if f.ForwardType != "" && event.ForwardType != f.ForwardType {
+		return false
+	}
+	if f.StatusClass != "" && (len(f.StatusClass) != 3 || event.StatusCode/100 != int(f.StatusClass[0]-'0')) {
+		return false
+	}
+	if f.ErrorOnly && event.Succ {
+		return false
+	}
+	if f.Keyword != "" && !strings.Contains(event.Path, f.Keyword) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,98 @@
+package livestream_test
+
+import (
+	"testing"
+	"time"
+
+	"imuslab.com/zoraxy/mod/livestream"
+)
+
+func TestFilterMatch(t *testing.T) {
+	event := &livestream.Event{
+		Host:        "Blog.Example.com",
+		Path:        "/wp-admin/login.php",
+		StatusCode:  502,
+		Succ:        false,
+		ForwardType: "subdomain-http",
+		ClientIP:    "192.168.1.10",
+		Country:     "JP",
+	}
+
+	tests := []struct {
+		filter livestream.Filter
+		match  bool
+	}{
+		{livestream.Filter{}, true},
+		{livestream.Filter{Host: "example.com"}, true},
+		{livestream.Filter{Host: "other.com"}, false},
+		{livestream.Filter{Country: "jp", StatusClass: "5xx"}, true},
+		{livestream.Filter{StatusClass: "4xx"}, false},
+		{livestream.Filter{StatusClass: "5"}, false},
+		{livestream.Filter{ErrorOnly: true, Keyword: "wp-admin"}, true},
+		{livestream.Filter{ClientIP: "192.168.1.11"}, false},
+		{livestream.Filter{ForwardType: "vdir-http"}, false},
+	}
+
+	for i, test := range tests {
+		if test.filter.Match(event) != test.match {
+			t.Errorf("test %d: expected match to be %v for filter %+v", i, test.match, test.filter)
+		}
+	}
+}
+
+func TestSlowSubscriberDoNotBlock(t *testing.T) {
+	hub := livestream.NewHub(&livestream.Options{
+		QueueSize:      4,
+		MaxSubscribers: 2,
+	})
+
+	if hub.HasSubscribers() {
+		t.Fatal("new hub should have no subscribers")
+	}
+
+	slow := hub.Subscribe(nil)
+	filtered := hub.Subscribe(&livestream.Filter{StatusClass: "5xx"})
+	if slow == nil || filtered == nil {
+		t.Fatal("failed to subscribe")
+	}
+	if hub.Subscribe(nil) != nil {
+		t.Error("expected subscribe to fail when the hub is full")
+	}
+
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 100; i++ {
+			hub.Publish(&livestream.Event{StatusCode: 200})
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("publish blocked by slow subscriber")
+	}
+
+	if len(slow.Events()) != 4 {
+		t.Errorf("expected 4 buffered events, got %d", len(slow.Events()))
+	}
+	if dropped := slow.TakeDropped(); dropped != 96 {
+		t.Errorf("expected 96 dropped events, got %d", dropped)
+	}
+	if slow.TakeDropped() != 0 {
+		t.Error("dropped counter should be reset after taken")
+	}
+	if len(filtered.Events()) != 0 {
+		t.Error("filtered subscriber should not receive unmatched events")
+	}
+
+	hub.Unsubscribe(slow)
+	hub.Unsubscribe(slow)
+	for range slow.Events() {
+		//Drain until the channel is closed
+	}
+	hub.Unsubscribe(filtered)
+	if hub.HasSubscribers() {
+		t.Error("expected no subscribers after unsubscribe")
+	}
+}
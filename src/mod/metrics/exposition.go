@@ -0,0 +1,104 @@
+package metrics
+
+import (
+	"bytes"
+	"math"
+	"strconv"
+	"strings"
+)
+
+/*
+	exposition.go
+
+	Minimal writer for the Prometheus text exposition format (v0.0.4)
+*/
+
+const (
+	Type_Counter   = "counter"
+	Type_Gauge     = "gauge"
+	Type_Histogram = "histogram"
+)
+
+// Writer for metric families in text exposition format
+type Writer struct {
+	buffer   bytes.Buffer
+	declared map[string]bool
+}
+
+func newWriter() *Writer {
+	return &Writer{
+		declared: map[string]bool{},
+	}
+}
+
+// Declare a metric family with its help text and type. Each family is
+// only declared once even if called multiple times
+func (w *Writer) Declare(name string, help string, metricType string) {
+	if w.declared[name] {
+		return
+	}
+	w.declared[name] = true
+	w.buffer.WriteString("# HELP " + name + " " + escapeHelp(help) + "\n")
+	w.buffer.WriteString("# TYPE " + name + " " + metricType + "\n")
+}
+
+// Write a sample. Labels are given as name value pairs,
+// e.g. WriteSample("requests_total", 10, "endpoint", "a.com")
+func (w *Writer) WriteSample(name string, value float64, labels ...string) {
+	w.buffer.WriteString(name)
+	if len(labels) >= 2 {
+		w.buffer.WriteString("{")
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				w.buffer.WriteString(",")
+			}
+			w.buffer.WriteString(labels[i])
+			w.buffer.WriteString("=\"")
+			w.buffer.WriteString(escapeLabelValue(labels[i+1]))
+			w.buffer.WriteString("\"")
+		}
+		w.buffer.WriteString("}")
+	}
+	w.buffer.WriteString(" ")
+	w.buffer.WriteString(formatValue(value))
+	w.buffer.WriteString("\n")
+}
+
+// Declare and write a single gauge value
+func (w *Writer) Gauge(name string, help string, value float64, labels ...string) {
+	w.Declare(name, help, Type_Gauge)
+	w.WriteSample(name, value, labels...)
+}
+
+// Declare and write a single counter value
+func (w *Writer) Counter(name string, help string, value float64, labels ...string) {
+	w.Declare(name, help, Type_Counter)
+	w.WriteSample(name, value, labels...)
+}
+
+func (w *Writer) Bytes() []byte {
+	return w.buffer.Bytes()
+}
+
+func formatValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func escapeHelp(help string) string {
+	help = strings.ReplaceAll(help, "\\", "\\\\")
+	return strings.ReplaceAll(help, "\n", "\\n")
+}
+
+func escapeLabelValue(value string) string {
+	value = strings.ReplaceAll(value, "\\", "\\\\")
+	value = strings.ReplaceAll(value, "\"", "\\\"")
+	return strings.ReplaceAll(value, "\n", "\\n")
+}
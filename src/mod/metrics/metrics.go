@@ -0,0 +1,241 @@
+package metrics
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+	Metrics
+
+	This module collects the request metrics of the reverse proxy and
+	exports them together with metrics from other modules in the
+	Prometheus text exposition format, so they can be scraped by
+	Prometheus compatible monitoring systems
+*/
+
+// Default latency histogram buckets in seconds
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Source write metrics of other modules into the exposition on each scrape
+type Source func(w *Writer)
+
+type Options struct {
+	Namespace   string    //Prefix of the metric names, default to zoraxy
+	BearerToken string    //Token required to scrape the metrics, leave empty to disable
+	Buckets     []float64 //Latency histogram buckets in seconds
+}
+
+type requestSeriesKey struct {
+	endpoint    string
+	statusClass string
+}
+
+type requestSeries struct {
+	count   uint64
+	sum     float64
+	buckets []uint64 //Non-cumulative count of each bucket, last one for +Inf
+}
+
+type endpointCounters struct {
+	bytesIn        int64
+	bytesOut       int64
+	upstreamErrors uint64
+}
+
+type Collector struct {
+	Option *Options
+
+	requests  map[requestSeriesKey]*requestSeries
+	endpoints map[string]*endpointCounters
+	sources   []Source
+	startTime time.Time
+	mutex     sync.RWMutex
+}
+
+// Create a new metrics collector
+func NewCollector(option *Options) *Collector {
+	if option.Namespace == "" {
+		option.Namespace = "zoraxy"
+	}
+
+	if len(option.Buckets) == 0 {
+		option.Buckets = DefaultBuckets
+	}
+	sort.Float64s(option.Buckets)
+
+	return &Collector{
+		Option:    option,
+		requests:  map[requestSeriesKey]*requestSeries{},
+		endpoints: map[string]*endpointCounters{},
+		sources:   []Source{},
+		startTime: time.Now(),
+	}
+}
+
+// Add a source that write metrics of other modules on each scrape
+func (c *Collector) AddSource(source Source) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.sources = append(c.sources, source)
+}
+
+// Get the status class of a status code, e.g. 2xx
+func StatusClass(statusCode int) string {
+	if statusCode < 100 || statusCode > 599 {
+		return "unknown"
+	}
+	return strconv.Itoa(statusCode/100) + "xx"
+}
+
+func (c *Collector) getEndpointCounters(endpoint string) *endpointCounters {
+	counters, ok := c.endpoints[endpoint]
+	if !ok {
+		counters = &endpointCounters{}
+		c.endpoints[endpoint] = counters
+	}
+	return counters
+}
+
+// Record a finished request of a proxy endpoint
+func (c *Collector) ObserveRequest(endpoint string, statusCode int, duration time.Duration, bytesIn int64, bytesOut int64) {
+	key := requestSeriesKey{
+		endpoint:    endpoint,
+		statusClass: StatusClass(statusCode),
+	}
+	seconds := duration.Seconds()
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	series, ok := c.requests[key]
+	if !ok {
+		series = &requestSeries{
+			buckets: make([]uint64, len(c.Option.Buckets)+1),
+		}
+		c.requests[key] = series
+	}
+
+	series.count++
+	series.sum += seconds
+	bucketIndex := sort.SearchFloat64s(c.Option.Buckets, seconds)
+	series.buckets[bucketIndex]++
+
+	counters := c.getEndpointCounters(endpoint)
+	counters.bytesIn += bytesIn
+	counters.bytesOut += bytesOut
+}
+
+// Record an error when connecting to the upstream of a proxy endpoint
+func (c *Collector) RecordUpstreamError(endpoint string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.getEndpointCounters(endpoint).upstreamErrors++
+}
+
+// Render all the metrics in text exposition format
+func (c *Collector) Render() []byte {
+	w := newWriter()
+	c.writeRequestMetrics(w)
+	c.writeRuntimeMetrics(w)
+
+	c.mutex.RLock()
+	sources := c.sources
+	c.mutex.RUnlock()
+	for _, source := range sources {
+		source(w)
+	}
+	return w.Bytes()
+}
+
+func (c *Collector) writeRequestMetrics(w *Writer) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	ns := c.Option.Namespace
+
+	keys := make([]requestSeriesKey, 0, len(c.requests))
+	for key := range c.requests {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].endpoint != keys[j].endpoint {
+			return keys[i].endpoint < keys[j].endpoint
+		}
+		return keys[i].statusClass < keys[j].statusClass
+	})
+
+	w.Declare(ns+"_http_requests_total", "Total number of proxied requests by endpoint and status class", Type_Counter)
+	for _, key := range keys {
+		w.WriteSample(ns+"_http_requests_total", float64(c.requests[key].count), "endpoint", key.endpoint, "status_class", key.statusClass)
+	}
+
+	histogramName := ns + "_http_request_duration_seconds"
+	w.Declare(histogramName, "Latency of proxied requests by endpoint and status class", Type_Histogram)
+	for _, key := range keys {
+		series := c.requests[key]
+		cumulative := uint64(0)
+		for i, upperBound := range c.Option.Buckets {
+			cumulative += series.buckets[i]
+			w.WriteSample(histogramName+"_bucket", float64(cumulative), "endpoint", key.endpoint, "status_class", key.statusClass, "le", formatValue(upperBound))
+		}
+		w.WriteSample(histogramName+"_bucket", float64(series.count), "endpoint", key.endpoint, "status_class", key.statusClass, "le", "+Inf")
+		w.WriteSample(histogramName+"_sum", series.sum, "endpoint", key.endpoint, "status_class", key.statusClass)
+		w.WriteSample(histogramName+"_count", float64(series.count), "endpoint", key.endpoint, "status_class", key.statusClass)
+	}
+
+	endpoints := make([]string, 0, len(c.endpoints))
+	for endpoint := range c.endpoints {
+		endpoints = append(endpoints, endpoint)
+	}
+	sort.Strings(endpoints)
+
+	w.Declare(ns+"_http_request_bytes_total", "Total bytes received from clients by endpoint", Type_Counter)
+	for _, endpoint := range endpoints {
+		w.WriteSample(ns+"_http_request_bytes_total", float64(c.endpoints[endpoint].bytesIn), "endpoint", endpoint)
+	}
+
+	w.Declare(ns+"_http_response_bytes_total", "Total bytes sent to clients by endpoint", Type_Counter)
+	for _, endpoint := range endpoints {
+		w.WriteSample(ns+"_http_response_bytes_total", float64(c.endpoints[endpoint].bytesOut), "endpoint", endpoint)
+	}
+
+	w.Declare(ns+"_upstream_errors_total", "Total number of failed connections to upstream by endpoint", Type_Counter)
+	for _, endpoint := range endpoints {
+		w.WriteSample(ns+"_upstream_errors_total", float64(c.endpoints[endpoint].upstreamErrors), "endpoint", endpoint)
+	}
+}
+
+func (c *Collector) writeRuntimeMetrics(w *Writer) {
+	memStats := runtime.MemStats{}
+	runtime.ReadMemStats(&memStats)
+
+	w.Gauge("go_goroutines", "Number of goroutines that currently exist", float64(runtime.NumGoroutine()))
+	w.Gauge("go_memstats_alloc_bytes", "Number of bytes allocated and still in use", float64(memStats.Alloc))
+	w.Counter("go_memstats_alloc_bytes_total", "Total number of bytes allocated, even if freed", float64(memStats.TotalAlloc))
+	w.Gauge("go_memstats_sys_bytes", "Number of bytes obtained from system", float64(memStats.Sys))
+	w.Gauge("go_memstats_heap_inuse_bytes", "Number of heap bytes that are in use", float64(memStats.HeapInuse))
+	w.Gauge("go_memstats_heap_objects", "Number of allocated objects", float64(memStats.HeapObjects))
+	w.Counter("go_gc_cycles_total", "Number of completed GC cycles", float64(memStats.NumGC))
+	w.Counter("go_gc_pause_seconds_total", "Total time spent in GC stop-the-world pauses", float64(memStats.PauseTotalNs)/1e9)
+	w.Gauge("go_memstats_last_gc_time_seconds", "Unix time of the last garbage collection", float64(memStats.LastGC)/1e9)
+	w.Gauge("process_start_time_seconds", "Start time of the process since unix epoch in seconds", float64(c.startTime.Unix()))
+}
+
+// Serve the metrics in text exposition format
+func (c *Collector) HandleMetrics(w http.ResponseWriter, r *http.Request) {
+	if c.Option.BearerToken != "" {
+		expected := []byte("Bearer " + c.Option.BearerToken)
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "401 - Unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(c.Render())
+}
@@ -0,0 +1,72 @@
+package metrics_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"imuslab.com/zoraxy/mod/metrics"
+)
+
+func TestRequestMetrics(t *testing.T) {
+	collector := metrics.NewCollector(&metrics.Options{
+		Buckets: []float64{0.1, 1},
+	})
+
+	collector.ObserveRequest("a.example.com", 200, 50*time.Millisecond, 100, 2000)
+	collector.ObserveRequest("a.example.com", 204, 500*time.Millisecond, 0, 0)
+	collector.ObserveRequest("a.example.com", 502, 2*time.Second, 10, 20)
+	collector.RecordUpstreamError("a.example.com")
+	collector.AddSource(func(w *metrics.Writer) {
+		w.Gauge("custom_value", "A custom value with \"quoted\" label", 42, "name", "with \"quote\"")
+	})
+
+	output := string(collector.Render())
+	expectedLines := []string{
+		`zoraxy_http_requests_total{endpoint="a.example.com",status_class="2xx"} 2`,
+		`zoraxy_http_requests_total{endpoint="a.example.com",status_class="5xx"} 1`,
+		`zoraxy_http_request_duration_seconds_bucket{endpoint="a.example.com",status_class="2xx",le="0.1"} 1`,
+		`zoraxy_http_request_duration_seconds_bucket{endpoint="a.example.com",status_class="2xx",le="1"} 2`,
+		`zoraxy_http_request_duration_seconds_bucket{endpoint="a.example.com",status_class="5xx",le="1"} 0`,
+		`zoraxy_http_request_duration_seconds_bucket{endpoint="a.example.com",status_class="5xx",le="+Inf"} 1`,
+		`zoraxy_http_request_duration_seconds_count{endpoint="a.example.com",status_class="2xx"} 2`,
+		`zoraxy_http_request_bytes_total{endpoint="a.example.com"} 110`,
+		`zoraxy_http_response_bytes_total{endpoint="a.example.com"} 2020`,
+		`zoraxy_upstream_errors_total{endpoint="a.example.com"} 1`,
+		`# TYPE zoraxy_http_request_duration_seconds histogram`,
+		`# TYPE go_goroutines gauge`,
+		`custom_value{name="with \"quote\""} 42`,
+	}
+
+	for _, line := range expectedLines {
+		if !strings.Contains(output, line+"\n") {
+			t.Errorf("expected line not found in output: %s", line)
+		}
+	}
+
+	if strings.Count(output, "# TYPE zoraxy_http_requests_total") != 1 {
+		t.Errorf("metric family should only be declared once")
+	}
+}
+
+func TestMetricsBearerToken(t *testing.T) {
+	collector := metrics.NewCollector(&metrics.Options{
+		BearerToken: "secret",
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	rec := httptest.NewRecorder()
+	collector.HandleMetrics(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 without token, got %d", rec.Code)
+	}
+
+	req.Header.Set("Authorization", "Bearer secret")
+	rec = httptest.NewRecorder()
+	collector.HandleMetrics(rec, req)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "go_goroutines") {
+		t.Errorf("expected metrics with valid token, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,235 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"html"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+/*
+	Channels.go
+
+	Delivery channels of the notifications. Supported types are
+	email (via the system SMTP settings), generic webhook with
+	customizable JSON body template, ntfy and Gotify push services
+*/
+
+const (
+	Channel_Email   = "email"
+	Channel_Webhook = "webhook"
+	Channel_Ntfy    = "ntfy"
+	Channel_Gotify  = "gotify"
+)
+
+const deliveryTimeout = 10 * time.Second
+
+var httpClient = &http.Client{Timeout: deliveryTimeout}
+
+type Channel struct {
+	ID       string
+	Name     string
+	Type     string            //email, webhook, ntfy or gotify
+	URL      string            //Webhook URL, ntfy topic URL or Gotify server URL
+	To       string            //Recipient address of email channel
+	Token    string            //Access token of ntfy or Gotify
+	Template string            //Body template of webhook, the event in JSON is sent if empty
+	Headers  map[string]string //Extra headers of webhook
+}
+
+// Data passed to the webhook templates
+type templateData struct {
+	*Event
+	Recovery bool
+}
+
+var templateFuncs = template.FuncMap{
+	//Escape a value for embedding into JSON string, e.g. "{{json .Message}}"
+	"json": func(v interface{}) string {
+		js, _ := json.Marshal(v)
+		return string(js)
+	},
+	"upper": strings.ToUpper,
+	"time": func(unix int64) string {
+		return time.Unix(unix, 0).Format(time.RFC3339)
+	},
+}
+
+// Check if the channel settings are valid
+func (c *Channel) Validate() error {
+	switch c.Type {
+	case Channel_Email:
+		if _, err := mail.ParseAddress(c.To); err != nil {
+			return errors.New("invalid recipient address")
+		}
+	case Channel_Webhook, Channel_Ntfy, Channel_Gotify:
+		u, err := url.Parse(c.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.New("invalid channel url")
+		}
+		if c.Type == Channel_Webhook && c.Template != "" {
+			if _, err := template.New("webhook").Funcs(templateFuncs).Parse(c.Template); err != nil {
+				return errors.New("invalid webhook template: " + err.Error())
+			}
+		}
+	default:
+		return errors.New("unsupported channel type: " + c.Type)
+	}
+	return nil
+}
+
+// Get the title of the notification, with a prefix for recovery notifications
+func notificationTitle(event *Event, recovery bool) string {
+	if recovery {
+		return "[Resolved] " + event.Title
+	}
+	return "[" + strings.ToUpper(event.Severity) + "] " + event.Title
+}
+
+// Send a notification of the event to the channel
+func (m *Manager) send(channel *Channel, event *Event, recovery bool) error {
+	switch channel.Type {
+	case Channel_Email:
+		return m.sendEmail(channel, event, recovery)
+	case Channel_Webhook:
+		return sendWebhook(channel, event, recovery)
+	case Channel_Ntfy:
+		return sendNtfy(channel, event, recovery)
+	case Channel_Gotify:
+		return sendGotify(channel, event, recovery)
+	}
+	return errors.New("unsupported channel type: " + channel.Type)
+}
+
+func (m *Manager) sendEmail(channel *Channel, event *Event, recovery bool) error {
+	if m.Options.GetEmailSender == nil {
+		return errors.New("email sender not set")
+	}
+	sender := m.Options.GetEmailSender()
+	if sender == nil || sender.Hostname == "" || sender.SenderAddr == "" {
+		return errors.New("SMTP is not configured")
+	}
+
+	content := html.EscapeString(event.Message)
+	content = strings.ReplaceAll(content, "\n", "<br>")
+	content += "<br><br>Source: " + html.EscapeString(event.Source) +
+		"<br>Time: " + time.Unix(event.Time, 0).Format(time.RFC1123) +
+		"<br><br>This is an automated notification sent by Zoraxy. DO NOT REPLY TO THIS EMAIL."
+	return sender.SendEmail(channel.To, notificationTitle(event, recovery)+" | Zoraxy", content)
+}
+
+func sendWebhook(channel *Channel, event *Event, recovery bool) error {
+	var body []byte
+	if channel.Template == "" {
+		body, _ = json.Marshal(templateData{Event: event, Recovery: recovery || event.Recovery})
+	} else {
+		tmpl, err := template.New("webhook").Funcs(templateFuncs).Parse(channel.Template)
+		if err != nil {
+			return err
+		}
+		var buf bytes.Buffer
+		err = tmpl.Execute(&buf, templateData{Event: event, Recovery: recovery || event.Recovery})
+		if err != nil {
+			return err
+		}
+		body = buf.Bytes()
+	}
+
+	req, err := http.NewRequest("POST", channel.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range channel.Headers {
+		req.Header.Set(key, value)
+	}
+	return doRequest(req)
+}
+
+// Push to ntfy topic, see https://docs.ntfy.sh/publish/
+func sendNtfy(channel *Channel, event *Event, recovery bool) error {
+	req, err := http.NewRequest("POST", channel.URL, strings.NewReader(event.Message))
+	if err != nil {
+		return err
+	}
+
+	priority := "default"
+	tags := "information_source"
+	if recovery {
+		tags = "white_check_mark"
+	} else if event.Severity == Severity_Critical {
+		priority = "urgent"
+		tags = "rotating_light"
+	} else if event.Severity == Severity_Warning {
+		priority = "high"
+		tags = "warning"
+	}
+
+	req.Header.Set("Title", notificationTitle(event, recovery))
+	req.Header.Set("Priority", priority)
+	req.Header.Set("Tags", tags)
+	if channel.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+channel.Token)
+	}
+	return doRequest(req)
+}
+
+// Push to Gotify server, see https://gotify.net/docs/pushmsg
+func sendGotify(channel *Channel, event *Event, recovery bool) error {
+	priority := 2
+	if !recovery && event.Severity == Severity_Critical {
+		priority = 8
+	} else if !recovery && event.Severity == Severity_Warning {
+		priority = 5
+	}
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"title":    notificationTitle(event, recovery),
+		"message":  event.Message,
+		"priority": priority,
+	})
+
+	req, err := http.NewRequest("POST", strings.TrimSuffix(channel.URL, "/")+"/message", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Gotify-Key", channel.Token)
+	return doRequest(req)
+}
+
+func doRequest(req *http.Request) error {
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.New("remote server responded with status code " + strconv.Itoa(resp.StatusCode))
+	}
+	return nil
+}
+
+// Send a test notification to the channel
+func (m *Manager) SendTestNotification(channel *Channel) error {
+	return m.send(channel, &Event{
+		Source:   "test",
+		Type:     "test",
+		Severity: Severity_Info,
+		Title:    "Test notification",
+		Message:  "This is a test notification sent by Zoraxy.",
+		Time:     time.Now().Unix(),
+		Fields:   map[string]string{},
+	}, false)
+}
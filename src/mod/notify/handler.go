@@ -0,0 +1,236 @@
+package notify
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+	"imuslab.com/zoraxy/mod/utils"
+)
+
+/*
+	Handler.go
+
+	Handlers for the notification channels and rules management APIs
+*/
+
+// Parse a list given in JSON array or comma seperated format
+func parseListPara(value string) []string {
+	results := []string{}
+	if strings.HasPrefix(strings.TrimSpace(value), "[") {
+		json.Unmarshal([]byte(value), &results)
+		return results
+	}
+	for _, v := range strings.Split(value, ",") {
+		v = strings.TrimSpace(v)
+		if v != "" {
+			results = append(results, v)
+		}
+	}
+	return results
+}
+
+func (m *Manager) HandleListChannels(w http.ResponseWriter, r *http.Request) {
+	channels := m.ListChannels()
+	sort.Slice(channels, func(i, j int) bool {
+		return channels[i].Name < channels[j].Name
+	})
+	js, _ := json.Marshal(channels)
+	utils.SendJSONResponse(w, string(js))
+}
+
+// Add a new channel, or update the existing one if id is given
+func (m *Manager) HandleSetChannel(w http.ResponseWriter, r *http.Request) {
+	channelID, err := utils.PostPara(r, "id")
+	if err != nil {
+		channelID = uuid.New().String()
+	}
+
+	name, err := utils.PostPara(r, "name")
+	if err != nil {
+		utils.SendErrorResponse(w, "channel name not set")
+		return
+	}
+
+	channelType, err := utils.PostPara(r, "type")
+	if err != nil {
+		utils.SendErrorResponse(w, "channel type not set")
+		return
+	}
+
+	channel := Channel{
+		ID:      channelID,
+		Name:    name,
+		Type:    channelType,
+		Headers: map[string]string{},
+	}
+	channel.URL, _ = utils.PostPara(r, "url")
+	channel.To, _ = utils.PostPara(r, "to")
+	channel.Token, _ = utils.PostPara(r, "token")
+	channel.Template, _ = utils.PostPara(r, "template")
+
+	headers, err := utils.PostPara(r, "headers")
+	if err == nil && strings.TrimSpace(headers) != "" {
+		err = json.Unmarshal([]byte(headers), &channel.Headers)
+		if err != nil {
+			utils.SendErrorResponse(w, "invalid headers given")
+			return
+		}
+	}
+
+	err = m.SetChannel(&channel)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+
+	js, _ := json.Marshal(channel.ID)
+	utils.SendJSONResponse(w, string(js))
+}
+
+func (m *Manager) HandleRemoveChannel(w http.ResponseWriter, r *http.Request) {
+	channelID, err := utils.PostPara(r, "id")
+	if err != nil {
+		utils.SendErrorResponse(w, "invalid channel id given")
+		return
+	}
+
+	for _, rule := range m.ListRules() {
+		if utils.StringInArray(rule.Channels, channelID) {
+			utils.SendErrorResponse(w, "channel is used by rule "+rule.Name)
+			return
+		}
+	}
+
+	err = m.RemoveChannel(channelID)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+
+	utils.SendOK(w)
+}
+
+// Send a test notification to the given channel
+func (m *Manager) HandleTestChannel(w http.ResponseWriter, r *http.Request) {
+	channelID, err := utils.PostPara(r, "id")
+	if err != nil {
+		utils.SendErrorResponse(w, "invalid channel id given")
+		return
+	}
+
+	channel, err := m.GetChannel(channelID)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+
+	err = m.SendTestNotification(channel)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+
+	utils.SendOK(w)
+}
+
+func (m *Manager) HandleListRules(w http.ResponseWriter, r *http.Request) {
+	rules := m.ListRules()
+	sort.Slice(rules, func(i, j int) bool {
+		return rules[i].Name < rules[j].Name
+	})
+	js, _ := json.Marshal(rules)
+	utils.SendJSONResponse(w, string(js))
+}
+
+// Add a new rule, or update the existing one if id is given
+func (m *Manager) HandleSetRule(w http.ResponseWriter, r *http.Request) {
+	ruleID, err := utils.PostPara(r, "id")
+	if err != nil {
+		ruleID = uuid.New().String()
+	}
+
+	name, err := utils.PostPara(r, "name")
+	if err != nil {
+		utils.SendErrorResponse(w, "rule name not set")
+		return
+	}
+
+	channels, err := utils.PostPara(r, "channels")
+	if err != nil || len(parseListPara(channels)) == 0 {
+		utils.SendErrorResponse(w, "rule must have at least one channel")
+		return
+	}
+
+	rule := Rule{
+		ID:       ruleID,
+		Name:     name,
+		Enabled:  true,
+		Sources:  []string{},
+		Types:    []string{},
+		Channels: parseListPara(channels),
+	}
+
+	if enabled, err := utils.PostBool(r, "enabled"); err == nil {
+		rule.Enabled = enabled
+	}
+	if sources, err := utils.PostPara(r, "sources"); err == nil {
+		rule.Sources = parseListPara(sources)
+	}
+	if types, err := utils.PostPara(r, "types"); err == nil {
+		rule.Types = parseListPara(types)
+	}
+	rule.MinSeverity, _ = utils.PostPara(r, "severity")
+	if throttle, err := utils.PostPara(r, "throttle"); err == nil {
+		rule.Throttle, err = strconv.ParseInt(throttle, 10, 64)
+		if err != nil {
+			utils.SendErrorResponse(w, "invalid throttle given")
+			return
+		}
+	}
+	rule.Dedup, _ = utils.PostBool(r, "dedup")
+	rule.NotifyRecovery, _ = utils.PostBool(r, "recovery")
+
+	err = m.SetRule(&rule)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+
+	js, _ := json.Marshal(rule.ID)
+	utils.SendJSONResponse(w, string(js))
+}
+
+func (m *Manager) HandleRemoveRule(w http.ResponseWriter, r *http.Request) {
+	ruleID, err := utils.PostPara(r, "id")
+	if err != nil {
+		utils.SendErrorResponse(w, "invalid rule id given")
+		return
+	}
+
+	err = m.RemoveRule(ruleID)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+
+	utils.SendOK(w)
+}
+
+// List the active alerts, latest first
+func (m *Manager) HandleListAlerts(w http.ResponseWriter, r *http.Request) {
+	alerts := m.ListActiveAlerts()
+	sort.Slice(alerts, func(i, j int) bool {
+		return alerts[i].Event.Time > alerts[j].Event.Time
+	})
+	js, _ := json.Marshal(alerts)
+	utils.SendJSONResponse(w, string(js))
+}
+
+func (m *Manager) HandleDeliveryHistory(w http.ResponseWriter, r *http.Request) {
+	js, _ := json.Marshal(m.GetHistory())
+	utils.SendJSONResponse(w, string(js))
+}
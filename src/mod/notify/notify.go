@@ -0,0 +1,460 @@
+package notify
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"imuslab.com/zoraxy/mod/database"
+	"imuslab.com/zoraxy/mod/email"
+	"imuslab.com/zoraxy/mod/utils"
+)
+
+/*
+	Notify.go
+
+	Alerting engine of Zoraxy. Modules emit events (e.g. uptime target
+	offline, certificate renew failed) to the manager, which match them
+	against the user defined rules and deliver the alerts to the
+	channels of the matching rules.
+
+	An alert is identified by the source, type and key of its event.
+	Repeated events of an active alert can be deduplicated, and the
+	notifications of the same alert are throttled per rule. A recovery
+	event with the same source and key resolves the active alerts and
+	optionally sends a recovery notification
+*/
+
+const (
+	Source_Uptime      = "uptime"
+	Source_Certificate = "certificate"
+	Source_Proxy       = "proxy"
+	Source_Traffic     = "traffic"
+)
+
+const (
+	Severity_Info     = "info"
+	Severity_Warning  = "warning"
+	Severity_Critical = "critical"
+)
+
+const maxHistoryRecords = 100
+
+type Event struct {
+	Source   string            //Module that emit this event, e.g. uptime
+	Type     string            //Type of the event, e.g. offline
+	Key      string            //Subject of the event, e.g. the uptime target ID
+	Severity string            //info, warning or critical
+	Title    string            //Short summary of the event
+	Message  string            //Human readable details of the event
+	Recovery bool              //This event resolve the active alerts with the same source and key
+	Time     int64             //Unix timestamp of the event
+	Fields   map[string]string //Extra information, accessible from webhook templates
+}
+
+type Rule struct {
+	ID             string
+	Name           string
+	Enabled        bool
+	Sources        []string //Event sources to match, empty to match all sources
+	Types          []string //Event types to match, empty to match all types
+	MinSeverity    string   //Lowest severity to match
+	Channels       []string //ID of the channels to deliver the alerts
+	Throttle       int64    //Min interval in seconds between notifications of the same alert
+	Dedup          bool     //Suppress repeated events while the alert is still active
+	NotifyRecovery bool     //Send a notification when the alert is resolved
+}
+
+// State of an active alert under a rule
+type Alert struct {
+	RuleID     string
+	Event      *Event //The latest event of this alert
+	FiredAt    int64  //Unix timestamp of the first event
+	Count      int    //Number of events received while active
+	Notified   bool   //At least one notification is sent for this alert
+	Suppressed int    //Number of notifications suppressed by dedup or throttle
+}
+
+// Result of a notification delivery
+type DeliveryRecord struct {
+	Time     int64
+	RuleID   string
+	Channel  string
+	Title    string
+	Recovery bool
+	Error    string //Empty if delivered
+}
+
+type Options struct {
+	Database       *database.Database   //Database for storing channels and rules
+	GetEmailSender func() *email.Sender //Get the current SMTP sender for email channels
+	QueueSize      int                  //Number of pending events, default 256
+}
+
+type Manager struct {
+	Options  *Options
+	channels map[string]*Channel
+	rules    map[string]*Rule
+	alerts   map[string]*Alert //Active alerts, in rule ID / alert ID as key
+	lastSent map[string]int64  //Last notification time of alerts, kept after resolved for throttling
+	history  []*DeliveryRecord
+	mutex    sync.Mutex
+	queue    chan *Event
+	stopChan chan bool
+}
+
+// Create a new notification manager and restore the channels and rules from database
+func NewManager(options *Options) (*Manager, error) {
+	if options.QueueSize <= 0 {
+		options.QueueSize = 256
+	}
+
+	thisManager := Manager{
+		Options:  options,
+		channels: map[string]*Channel{},
+		rules:    map[string]*Rule{},
+		alerts:   map[string]*Alert{},
+		lastSent: map[string]int64{},
+		history:  []*DeliveryRecord{},
+		queue:    make(chan *Event, options.QueueSize),
+		stopChan: make(chan bool),
+	}
+
+	if options.Database != nil {
+		err := options.Database.NewTable("notify")
+		if err != nil {
+			return nil, err
+		}
+
+		entries, _ := options.Database.ListTable("notify")
+		for _, keypairs := range entries {
+			key := string(keypairs[0])
+			if strings.HasPrefix(key, "channel/") {
+				channel := Channel{}
+				if json.Unmarshal(keypairs[1], &channel) == nil {
+					thisManager.channels[channel.ID] = &channel
+				}
+			} else if strings.HasPrefix(key, "rule/") {
+				rule := Rule{}
+				if json.Unmarshal(keypairs[1], &rule) == nil {
+					thisManager.rules[rule.ID] = &rule
+				}
+			}
+		}
+	}
+
+	go thisManager.worker()
+	return &thisManager, nil
+}
+
+// Emit an event to the manager. This never block, events are dropped if the queue is full
+func (m *Manager) Notify(event *Event) {
+	if m == nil {
+		return
+	}
+
+	if event.Time == 0 {
+		event.Time = time.Now().Unix()
+	}
+	if event.Severity == "" {
+		event.Severity = Severity_Info
+	}
+
+	select {
+	case m.queue <- event:
+	default:
+		log.Println("[Notify] Event queue full. Dropping event: " + event.Title)
+	}
+}
+
+func (m *Manager) worker() {
+	for {
+		select {
+		case event := <-m.queue:
+			m.processEvent(event)
+		case <-m.stopChan:
+			return
+		}
+	}
+}
+
+// Delivery job created while processing an event
+type pendingDelivery struct {
+	rule     *Rule
+	event    *Event
+	recovery bool
+}
+
+// Match the event against the rules and deliver the notifications
+func (m *Manager) processEvent(event *Event) {
+	now := time.Now().Unix()
+	alertID := event.Source + "/" + event.Type + "/" + event.Key
+	deliveries := []*pendingDelivery{}
+
+	m.mutex.Lock()
+	for _, rule := range m.rules {
+		if !rule.Enabled {
+			continue
+		}
+
+		if event.Recovery {
+			//Resolve all active alerts of the same subject under this rule
+			resolvedNotified := false
+			for stateKey, alert := range m.alerts {
+				if alert.RuleID != rule.ID || alert.Event.Source != event.Source || alert.Event.Key != event.Key {
+					continue
+				}
+				delete(m.alerts, stateKey)
+				resolvedNotified = resolvedNotified || alert.Notified
+			}
+			if rule.NotifyRecovery && resolvedNotified {
+				deliveries = append(deliveries, &pendingDelivery{rule: rule, event: event, recovery: true})
+			}
+
+			//Recovery events are also delivered to rules explicitly subscribed to their type
+			if len(rule.Types) > 0 && rule.Match(event) {
+				deliveries = append(deliveries, &pendingDelivery{rule: rule, event: event})
+			}
+			continue
+		}
+
+		if !rule.Match(event) {
+			continue
+		}
+
+		stateKey := rule.ID + "/" + alertID
+		alert, active := m.alerts[stateKey]
+		if !active {
+			alert = &Alert{
+				RuleID:  rule.ID,
+				FiredAt: event.Time,
+			}
+			m.alerts[stateKey] = alert
+		}
+		alert.Event = event
+		alert.Count++
+
+		if active && rule.Dedup {
+			alert.Suppressed++
+			continue
+		}
+
+		if lastSent, ok := m.lastSent[stateKey]; ok && rule.Throttle > 0 && now-lastSent < rule.Throttle {
+			alert.Suppressed++
+			continue
+		}
+
+		m.lastSent[stateKey] = now
+		alert.Notified = true
+		deliveries = append(deliveries, &pendingDelivery{rule: rule, event: event})
+	}
+	m.mutex.Unlock()
+
+	for _, delivery := range deliveries {
+		m.deliver(delivery)
+	}
+}
+
+// Send the notification to all channels of the rule
+func (m *Manager) deliver(delivery *pendingDelivery) {
+	for _, channelID := range delivery.rule.Channels {
+		m.mutex.Lock()
+		channel, ok := m.channels[channelID]
+		m.mutex.Unlock()
+		if !ok {
+			continue
+		}
+
+		record := DeliveryRecord{
+			Time:     time.Now().Unix(),
+			RuleID:   delivery.rule.ID,
+			Channel:  channel.Name,
+			Title:    delivery.event.Title,
+			Recovery: delivery.recovery,
+		}
+
+		err := m.send(channel, delivery.event, delivery.recovery)
+		if err != nil {
+			log.Println("[Notify] Unable to deliver notification via " + channel.Name + ": " + err.Error())
+			record.Error = err.Error()
+		}
+
+		m.mutex.Lock()
+		m.history = append(m.history, &record)
+		if len(m.history) > maxHistoryRecords {
+			m.history = m.history[len(m.history)-maxHistoryRecords:]
+		}
+		m.mutex.Unlock()
+	}
+}
+
+// Get the rank of a severity for comparison
+func severityRank(severity string) int {
+	switch severity {
+	case Severity_Warning:
+		return 1
+	case Severity_Critical:
+		return 2
+	}
+	return 0
+}
+
+// Check if the given severity is valid
+func IsValidSeverity(severity string) bool {
+	return severity == Severity_Info || severity == Severity_Warning || severity == Severity_Critical
+}
+
+// Check if the event match the sources, types and severity of this rule
+func (r *Rule) Match(event *Event) bool {
+	if len(r.Sources) > 0 && !utils.StringInArray(r.Sources, event.Source) {
+		return false
+	}
+	if len(r.Types) > 0 && !utils.StringInArray(r.Types, event.Type) {
+		return false
+	}
+	return severityRank(event.Severity) >= severityRank(r.MinSeverity)
+}
+
+// Add or update a channel
+func (m *Manager) SetChannel(channel *Channel) error {
+	if channel.ID == "" {
+		return errors.New("channel ID cannot be empty")
+	}
+	if err := channel.Validate(); err != nil {
+		return err
+	}
+
+	m.mutex.Lock()
+	m.channels[channel.ID] = channel
+	m.mutex.Unlock()
+	if m.Options.Database != nil {
+		return m.Options.Database.Write("notify", "channel/"+channel.ID, channel)
+	}
+	return nil
+}
+
+func (m *Manager) RemoveChannel(channelID string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, ok := m.channels[channelID]; !ok {
+		return errors.New("channel not exists")
+	}
+	delete(m.channels, channelID)
+	if m.Options.Database != nil {
+		return m.Options.Database.Delete("notify", "channel/"+channelID)
+	}
+	return nil
+}
+
+func (m *Manager) GetChannel(channelID string) (*Channel, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	channel, ok := m.channels[channelID]
+	if !ok {
+		return nil, errors.New("channel not exists")
+	}
+	return channel, nil
+}
+
+func (m *Manager) ListChannels() []*Channel {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	results := []*Channel{}
+	for _, channel := range m.channels {
+		results = append(results, channel)
+	}
+	return results
+}
+
+// Add or update a rule. Active alerts of the previous version are kept
+func (m *Manager) SetRule(rule *Rule) error {
+	if rule.ID == "" {
+		return errors.New("rule ID cannot be empty")
+	}
+	if rule.MinSeverity == "" {
+		rule.MinSeverity = Severity_Info
+	}
+	if !IsValidSeverity(rule.MinSeverity) {
+		return errors.New("invalid severity: " + rule.MinSeverity)
+	}
+	if rule.Throttle < 0 {
+		return errors.New("throttle cannot be negative")
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, channelID := range rule.Channels {
+		if _, ok := m.channels[channelID]; !ok {
+			return errors.New("channel not exists: " + channelID)
+		}
+	}
+	m.rules[rule.ID] = rule
+	if m.Options.Database != nil {
+		return m.Options.Database.Write("notify", "rule/"+rule.ID, rule)
+	}
+	return nil
+}
+
+// Remove a rule and its active alerts
+func (m *Manager) RemoveRule(ruleID string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, ok := m.rules[ruleID]; !ok {
+		return errors.New("rule not exists")
+	}
+	delete(m.rules, ruleID)
+	for stateKey, alert := range m.alerts {
+		if alert.RuleID == ruleID {
+			delete(m.alerts, stateKey)
+			delete(m.lastSent, stateKey)
+		}
+	}
+	if m.Options.Database != nil {
+		return m.Options.Database.Delete("notify", "rule/"+ruleID)
+	}
+	return nil
+}
+
+func (m *Manager) ListRules() []*Rule {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	results := []*Rule{}
+	for _, rule := range m.rules {
+		results = append(results, rule)
+	}
+	return results
+}
+
+// List the active alerts of all rules
+func (m *Manager) ListActiveAlerts() []*Alert {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	results := []*Alert{}
+	for _, alert := range m.alerts {
+		thisAlert := *alert
+		results = append(results, &thisAlert)
+	}
+	return results
+}
+
+// Get the recent delivery records, latest first
+func (m *Manager) GetHistory() []*DeliveryRecord {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	results := make([]*DeliveryRecord, 0, len(m.history))
+	for i := len(m.history) - 1; i >= 0; i-- {
+		results = append(results, m.history[i])
+	}
+	return results
+}
+
+// Stop the event worker
+func (m *Manager) Close() {
+	if m == nil {
+		return
+	}
+	m.stopChan <- true
+}
@@ -0,0 +1,196 @@
+package notify_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"imuslab.com/zoraxy/mod/notify"
+)
+
+// Webhook receiver that record the received bodies
+type webhookReceiver struct {
+	bodies []string
+	mutex  sync.Mutex
+}
+
+func (wr *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	wr.mutex.Lock()
+	wr.bodies = append(wr.bodies, string(body))
+	wr.mutex.Unlock()
+}
+
+func (wr *webhookReceiver) waitFor(t *testing.T, count int) []string {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		wr.mutex.Lock()
+		n := len(wr.bodies)
+		wr.mutex.Unlock()
+		if n >= count {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	//Give the manager a chance to deliver unexpected notifications
+	time.Sleep(100 * time.Millisecond)
+	wr.mutex.Lock()
+	defer wr.mutex.Unlock()
+	return append([]string{}, wr.bodies...)
+}
+
+func TestDedupAndRecovery(t *testing.T) {
+	receiver := &webhookReceiver{}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	manager, err := notify.NewManager(&notify.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer manager.Close()
+
+	err = manager.SetChannel(&notify.Channel{
+		ID:       "hook",
+		Name:     "Test Hook",
+		Type:     notify.Channel_Webhook,
+		URL:      server.URL,
+		Template: `{"text":{{json .Title}},"recovery":{{.Recovery}}}`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = manager.SetRule(&notify.Rule{
+		ID:             "uptime",
+		Name:           "Uptime alerts",
+		Enabled:        true,
+		Sources:        []string{notify.Source_Uptime},
+		MinSeverity:    notify.Severity_Warning,
+		Channels:       []string{"hook"},
+		Dedup:          true,
+		NotifyRecovery: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	offline := func() *notify.Event {
+		return &notify.Event{Source: notify.Source_Uptime, Type: "offline", Key: "a", Severity: notify.Severity_Critical, Title: "a \"offline\""}
+	}
+	manager.Notify(offline())
+	manager.Notify(offline())
+	manager.Notify(&notify.Event{Source: notify.Source_Uptime, Type: "slow", Key: "b", Severity: notify.Severity_Info, Title: "below severity"})
+	manager.Notify(&notify.Event{Source: notify.Source_Traffic, Type: "spike", Key: "a", Severity: notify.Severity_Critical, Title: "other source"})
+
+	bodies := receiver.waitFor(t, 1)
+	if len(bodies) != 1 {
+		t.Fatalf("expected 1 notification after dedup, got %d: %v", len(bodies), bodies)
+	}
+
+	payload := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(bodies[0]), &payload); err != nil {
+		t.Fatalf("template rendered invalid JSON %q: %v", bodies[0], err)
+	}
+	if payload["text"] != "a \"offline\"" || payload["recovery"] != false {
+		t.Errorf("unexpected payload: %v", payload)
+	}
+
+	alerts := manager.ListActiveAlerts()
+	if len(alerts) != 1 || alerts[0].Count != 2 || alerts[0].Suppressed != 1 {
+		t.Errorf("unexpected active alerts: %+v", alerts)
+	}
+
+	manager.Notify(&notify.Event{Source: notify.Source_Uptime, Type: "online", Key: "a", Title: "a online", Recovery: true})
+	bodies = receiver.waitFor(t, 2)
+	if len(bodies) != 2 || bodies[1] != `{"text":"a online","recovery":true}` {
+		t.Fatalf("expected recovery notification, got %v", bodies)
+	}
+	if len(manager.ListActiveAlerts()) != 0 {
+		t.Error("alert should be resolved after recovery")
+	}
+
+	//Recovery without active alert should not notify
+	manager.Notify(&notify.Event{Source: notify.Source_Uptime, Type: "online", Key: "a", Title: "a online", Recovery: true})
+	bodies = receiver.waitFor(t, 2)
+	if len(bodies) != 2 {
+		t.Errorf("unexpected notification for recovery without alert: %v", bodies)
+	}
+}
+
+func TestThrottle(t *testing.T) {
+	receiver := &webhookReceiver{}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	manager, _ := notify.NewManager(&notify.Options{})
+	defer manager.Close()
+	manager.SetChannel(&notify.Channel{ID: "hook", Name: "Test Hook", Type: notify.Channel_Webhook, URL: server.URL})
+	err := manager.SetRule(&notify.Rule{
+		ID:       "all",
+		Name:     "All",
+		Enabled:  true,
+		Channels: []string{"hook"},
+		Throttle: 3600,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		manager.Notify(&notify.Event{Source: notify.Source_Proxy, Type: "stopped", Key: "main", Title: "stopped"})
+		manager.Notify(&notify.Event{Source: notify.Source_Proxy, Type: "started", Key: "main", Title: "started", Recovery: true})
+	}
+
+	//Flapping alert is only notified once within the throttle window
+	bodies := receiver.waitFor(t, 1)
+	if len(bodies) != 1 {
+		t.Fatalf("expected 1 notification within throttle window, got %d: %v", len(bodies), bodies)
+	}
+
+	history := manager.GetHistory()
+	if len(history) != 1 || history[0].Error != "" {
+		t.Errorf("unexpected delivery history: %+v", history)
+	}
+
+	if manager.SetRule(&notify.Rule{ID: "bad", Name: "Bad", Channels: []string{"missing"}}) == nil {
+		t.Error("expected error for rule with unknown channel")
+	}
+}
+
+func TestTrafficAnomaly(t *testing.T) {
+	monitor := notify.NewTrafficMonitor(nil, nil, &notify.TrafficOptions{
+		MinRequests:   10,
+		WarmupSamples: 3,
+	})
+
+	for i := 0; i < 3; i++ {
+		if events := monitor.Evaluate(100, 1); len(events) != 0 {
+			t.Fatalf("unexpected events during warmup: %+v", events[0])
+		}
+	}
+
+	events := monitor.Evaluate(1000, 600)
+	if len(events) != 2 || events[0].Type != notify.Traffic_Spike || events[1].Type != notify.Traffic_ErrorRate || events[1].Severity != notify.Severity_Critical {
+		t.Fatalf("expected spike and error rate events, got %d", len(events))
+	}
+
+	if events := monitor.Evaluate(1000, 600); len(events) != 0 {
+		t.Errorf("expected no repeated events while anomaly is active, got %d", len(events))
+	}
+
+	events = monitor.Evaluate(150, 0)
+	if len(events) != 2 || !events[0].Recovery || !events[1].Recovery {
+		t.Fatalf("expected recovery events, got %d", len(events))
+	}
+
+	events = monitor.Evaluate(0, 0)
+	if len(events) != 1 || events[0].Type != notify.Traffic_Drop {
+		t.Errorf("expected traffic drop event, got %d", len(events))
+	}
+}
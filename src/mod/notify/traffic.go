@@ -0,0 +1,179 @@
+package notify
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+	Traffic.go
+
+	Traffic anomaly detector. The request counters are sampled at a
+	fixed interval and compared against a moving average baseline.
+	Sudden spikes, drops and high error rates are emitted as events
+	of the traffic source
+*/
+
+const (
+	Traffic_Spike     = "spike"
+	Traffic_Drop      = "drop"
+	Traffic_ErrorRate = "error_rate"
+)
+
+// Get the current total and error request counters. Counters may reset (e.g. on a new day)
+type TrafficSource func() (total int64, errors int64)
+
+type TrafficOptions struct {
+	Interval           time.Duration //Sampling interval, default 1 minute
+	SpikeRatio         float64       //Alert when requests exceed or drop below baseline by this ratio, default 3
+	MinRequests        int64         //Min requests of baseline or sample to be evaluated, default 100
+	ErrorRateThreshold float64       //Alert when error ratio exceed this value, default 0.5
+	WarmupSamples      int           //Number of samples to build the baseline before alerting, default 10
+}
+
+type TrafficMonitor struct {
+	Options  *TrafficOptions
+	manager  *Manager
+	source   TrafficSource
+	baseline float64 //Moving average of requests per interval
+	samples  int
+	active   map[string]bool //Anomaly types that are currently firing
+	mutex    sync.Mutex
+	stopChan chan bool
+}
+
+// Create a traffic monitor. Call Start to begin sampling the source
+func NewTrafficMonitor(manager *Manager, source TrafficSource, options *TrafficOptions) *TrafficMonitor {
+	if options.Interval <= 0 {
+		options.Interval = time.Minute
+	}
+	if options.SpikeRatio <= 1 {
+		options.SpikeRatio = 3
+	}
+	if options.MinRequests <= 0 {
+		options.MinRequests = 100
+	}
+	if options.ErrorRateThreshold <= 0 || options.ErrorRateThreshold > 1 {
+		options.ErrorRateThreshold = 0.5
+	}
+	if options.WarmupSamples <= 0 {
+		options.WarmupSamples = 10
+	}
+
+	return &TrafficMonitor{
+		Options: options,
+		manager: manager,
+		source:  source,
+		active:  map[string]bool{},
+	}
+}
+
+// Start sampling the traffic source in background
+func (t *TrafficMonitor) Start() {
+	t.stopChan = make(chan bool)
+	go func() {
+		ticker := time.NewTicker(t.Options.Interval)
+		defer ticker.Stop()
+		lastTotal, lastErrors := t.source()
+		for {
+			select {
+			case <-ticker.C:
+				total, errors := t.source()
+				if total < lastTotal || errors < lastErrors {
+					//Counter reset, skip this sample
+					lastTotal, lastErrors = total, errors
+					continue
+				}
+				for _, event := range t.Evaluate(total-lastTotal, errors-lastErrors) {
+					t.manager.Notify(event)
+				}
+				lastTotal, lastErrors = total, errors
+			case <-t.stopChan:
+				return
+			}
+		}
+	}()
+}
+
+// Evaluate the requests and errors of one interval and return the anomaly events
+func (t *TrafficMonitor) Evaluate(requests int64, errors int64) []*Event {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	events := []*Event{}
+	baseline := t.baseline
+	warmedUp := t.samples >= t.Options.WarmupSamples
+	interval := t.Options.Interval.String()
+
+	//Update the baseline with exponential moving average
+	if t.samples == 0 {
+		t.baseline = float64(requests)
+	} else {
+		t.baseline = t.baseline*0.9 + float64(requests)*0.1
+	}
+	t.samples++
+
+	if warmedUp {
+		spike := requests >= t.Options.MinRequests && float64(requests) > baseline*t.Options.SpikeRatio
+		events = t.updateState(events, Traffic_Spike, spike, Severity_Warning,
+			"Traffic spike detected", "Traffic spike resolved",
+			strconv.FormatInt(requests, 10)+" requests in the last "+interval+", baseline is "+strconv.FormatFloat(baseline, 'f', 0, 64),
+			requests, errors)
+
+		drop := baseline >= float64(t.Options.MinRequests) && float64(requests) < baseline/t.Options.SpikeRatio
+		events = t.updateState(events, Traffic_Drop, drop, Severity_Warning,
+			"Traffic drop detected", "Traffic drop resolved",
+			"Only "+strconv.FormatInt(requests, 10)+" requests in the last "+interval+", baseline is "+strconv.FormatFloat(baseline, 'f', 0, 64),
+			requests, errors)
+	}
+
+	errorRate := 0.0
+	if requests > 0 {
+		errorRate = float64(errors) / float64(requests)
+	}
+	highErrorRate := requests >= t.Options.MinRequests && errorRate >= t.Options.ErrorRateThreshold
+	events = t.updateState(events, Traffic_ErrorRate, highErrorRate, Severity_Critical,
+		"High error rate detected", "Error rate back to normal",
+		strconv.FormatFloat(errorRate*100, 'f', 1, 64)+"% of "+strconv.FormatInt(requests, 10)+" requests failed in the last "+interval,
+		requests, errors)
+
+	return events
+}
+
+// Append the firing or recovery event if the anomaly state changed
+func (t *TrafficMonitor) updateState(events []*Event, anomalyType string, firing bool, severity string, title string, resolvedTitle string, message string, requests int64, errors int64) []*Event {
+	if firing == t.active[anomalyType] {
+		return events
+	}
+	t.active[anomalyType] = firing
+
+	event := Event{
+		Source:   Source_Traffic,
+		Type:     anomalyType,
+		Key:      anomalyType,
+		Severity: severity,
+		Title:    title,
+		Message:  message,
+		Recovery: !firing,
+		Time:     time.Now().Unix(),
+		Fields: map[string]string{
+			"requests": strconv.FormatInt(requests, 10),
+			"errors":   strconv.FormatInt(errors, 10),
+		},
+	}
+	if !firing {
+		event.Severity = Severity_Info
+		event.Title = resolvedTitle
+		event.Message = strconv.FormatInt(requests, 10) + " requests with " + strconv.FormatInt(errors, 10) + " errors in the last " + t.Options.Interval.String()
+	}
+	return append(events, &event)
+}
+
+// Stop sampling the traffic source
+func (t *TrafficMonitor) Close() {
+	if t.stopChan != nil {
+		t.stopChan <- true
+		t.stopChan = nil
+	}
+}
@@ -0,0 +1,797 @@
+package pki
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	jose "github.com/go-jose/go-jose/v3"
+)
+
+/*
+	ACMEServer.go
+
+	Embedded ACME server (RFC 8555) backed by the private CA, so
+	internal tools can request certificates for the managed domains
+	with any ACME client. Only the HTTP-01 challenge is supported.
+	Accounts are persisted in the database, orders and authorizations
+	are kept in memory until they expire
+*/
+
+const (
+	acmeOrderLifetime  = 24 * time.Hour
+	acmeNonceLifetime  = time.Hour
+	acmeMaxNonces      = 10000
+	acmeMaxRequestSize = 64 * 1024
+)
+
+type acmeProblem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+	Status int    `json:"status"`
+}
+
+type acmeIdentifier struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+// Account entry written to the database
+type acmeAccount struct {
+	ID      string
+	Key     json.RawMessage //Public key in JWK format
+	Contact []string
+	Created int64
+}
+
+type acmeOrder struct {
+	ID          string
+	AccountID   string
+	Status      string
+	Expires     time.Time
+	Identifiers []acmeIdentifier
+	AuthzIDs    []string
+	CertID      string
+	Error       *acmeProblem
+}
+
+type acmeAuthz struct {
+	ID              string
+	AccountID       string
+	Identifier      acmeIdentifier
+	Status          string
+	Expires         time.Time
+	Token           string
+	ChallengeStatus string
+	Validated       time.Time
+	Error           *acmeProblem
+}
+
+type acmeServer struct {
+	manager  *Manager
+	nonces   map[string]time.Time
+	orders   map[string]*acmeOrder
+	authzs   map[string]*acmeAuthz
+	certs    map[string][]byte //Issued certificate chains in PEM, keyed by cert ID
+	client   *http.Client
+	mutex    sync.Mutex
+	basePath string
+}
+
+// Verified content of a JWS request
+type acmeRequest struct {
+	URL       string
+	Payload   []byte
+	AccountID string
+	JWK       *jose.JSONWebKey
+}
+
+func newACMEServer(manager *Manager) *acmeServer {
+	return &acmeServer{
+		manager: manager,
+		nonces:  map[string]time.Time{},
+		orders:  map[string]*acmeOrder{},
+		authzs:  map[string]*acmeAuthz{},
+		certs:   map[string][]byte{},
+		client: &http.Client{
+			Timeout: 10 * time.Second,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				if len(via) >= 10 {
+					return errors.New("too many redirects")
+				}
+				return nil
+			},
+		},
+	}
+}
+
+func randomID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func newProblem(problemType string, detail string, status int) *acmeProblem {
+	return &acmeProblem{
+		Type:   "urn:ietf:params:acme:error:" + problemType,
+		Detail: detail,
+		Status: status,
+	}
+}
+
+// Get the base URL of the ACME server from the request
+func (s *acmeServer) baseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + s.basePath
+}
+
+func (s *acmeServer) newNonce() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(s.nonces) >= acmeMaxNonces {
+		for nonce, issued := range s.nonces {
+			if time.Since(issued) > acmeNonceLifetime || len(s.nonces) >= acmeMaxNonces {
+				delete(s.nonces, nonce)
+			}
+		}
+	}
+	nonce := randomID()
+	s.nonces[nonce] = time.Now()
+	return nonce
+}
+
+// Consume the nonce, return false if it was not issued or already used
+func (s *acmeServer) useNonce(nonce string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	issued, ok := s.nonces[nonce]
+	if !ok {
+		return false
+	}
+	delete(s.nonces, nonce)
+	return time.Since(issued) < acmeNonceLifetime
+}
+
+func (s *acmeServer) writeHeaders(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Replay-Nonce", s.newNonce())
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Add("Link", "<"+s.baseURL(r)+"/directory>;rel=\"index\"")
+}
+
+func (s *acmeServer) sendProblem(w http.ResponseWriter, r *http.Request, problem *acmeProblem) {
+	s.writeHeaders(w, r)
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(problem.Status)
+	json.NewEncoder(w).Encode(problem)
+}
+
+func (s *acmeServer) sendJSON(w http.ResponseWriter, r *http.Request, status int, location string, body interface{}) {
+	s.writeHeaders(w, r)
+	if location != "" {
+		w.Header().Set("Location", location)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// ServeHTTP handles the ACME API under the base path
+func (s *acmeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, s.basePath)
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	resource := segments[0]
+	id := ""
+	if len(segments) > 1 {
+		id = segments[1]
+	}
+
+	switch resource {
+	case "directory":
+		s.handleDirectory(w, r)
+		return
+	case "new-nonce":
+		s.writeHeaders(w, r)
+		if r.Method == http.MethodGet {
+			w.WriteHeader(http.StatusNoContent)
+		}
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		s.sendProblem(w, r, newProblem("malformed", "method not allowed", http.StatusMethodNotAllowed))
+		return
+	}
+
+	request, problem := s.verifyRequest(r, resource == "new-account")
+	if problem != nil {
+		s.sendProblem(w, r, problem)
+		return
+	}
+
+	switch resource {
+	case "new-account":
+		s.handleNewAccount(w, r, request)
+	case "account":
+		s.handleAccount(w, r, request, id)
+	case "new-order":
+		s.handleNewOrder(w, r, request)
+	case "order":
+		s.handleGetOrder(w, r, request, id)
+	case "authz":
+		s.handleGetAuthz(w, r, request, id)
+	case "challenge":
+		s.handleChallenge(w, r, request, id)
+	case "finalize":
+		s.handleFinalize(w, r, request, id)
+	case "cert":
+		s.handleGetCert(w, r, request, id)
+	default:
+		s.sendProblem(w, r, newProblem("malformed", "resource not found", http.StatusNotFound))
+	}
+}
+
+func (s *acmeServer) handleDirectory(w http.ResponseWriter, r *http.Request) {
+	base := s.baseURL(r)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"newNonce":   base + "/new-nonce",
+		"newAccount": base + "/new-account",
+		"newOrder":   base + "/new-order",
+		"meta": map[string]interface{}{
+			"website": "https://zoraxy.arozos.com",
+		},
+	})
+}
+
+// Verify the JWS signature, nonce and URL of the request. New account requests
+// are signed with the embedded JWK, other requests with the account URL as kid.
+// Some clients look up their existing account with the kid, which is accepted too
+func (s *acmeServer) verifyRequest(r *http.Request, allowJWK bool) (*acmeRequest, *acmeProblem) {
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, acmeMaxRequestSize))
+	if err != nil {
+		return nil, newProblem("malformed", "unable to read request", http.StatusBadRequest)
+	}
+
+	jws, err := jose.ParseSigned(string(body))
+	if err != nil || len(jws.Signatures) != 1 {
+		return nil, newProblem("malformed", "invalid JWS", http.StatusBadRequest)
+	}
+	header := jws.Signatures[0].Protected
+
+	if !s.useNonce(header.Nonce) {
+		return nil, newProblem("badNonce", "invalid or expired nonce", http.StatusBadRequest)
+	}
+
+	requestURL, _ := header.ExtraHeaders["url"].(string)
+	expectedURL := s.baseURL(r) + strings.TrimPrefix(r.URL.Path, s.basePath)
+	if requestURL != expectedURL {
+		return nil, newProblem("unauthorized", "JWS url does not match the request url", http.StatusUnauthorized)
+	}
+
+	request := acmeRequest{URL: requestURL}
+	var verifyKey interface{}
+	if header.JSONWebKey != nil && header.KeyID != "" {
+		return nil, newProblem("malformed", "jwk and kid are mutually exclusive", http.StatusBadRequest)
+	}
+	if header.JSONWebKey != nil {
+		if !allowJWK {
+			return nil, newProblem("malformed", "request must be signed with the account kid", http.StatusBadRequest)
+		}
+		request.JWK = header.JSONWebKey
+		verifyKey = header.JSONWebKey
+	} else {
+		if header.KeyID == "" {
+			return nil, newProblem("malformed", "request must be signed with the account kid", http.StatusBadRequest)
+		}
+		accountID := strings.TrimPrefix(header.KeyID, s.baseURL(r)+"/account/")
+		account, err := s.loadAccount(accountID)
+		if err != nil {
+			return nil, newProblem("accountDoesNotExist", "account not found", http.StatusBadRequest)
+		}
+		key := jose.JSONWebKey{}
+		if err := key.UnmarshalJSON(account.Key); err != nil {
+			return nil, newProblem("serverInternal", "invalid stored account key", http.StatusInternalServerError)
+		}
+		request.AccountID = account.ID
+		request.JWK = &key
+		verifyKey = &key
+	}
+
+	payload, err := jws.Verify(verifyKey)
+	if err != nil {
+		return nil, newProblem("malformed", "JWS signature verification failed", http.StatusBadRequest)
+	}
+	request.Payload = payload
+	return &request, nil
+}
+
+func jwkThumbprint(key *jose.JSONWebKey) (string, error) {
+	thumbprint, err := key.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(thumbprint), nil
+}
+
+func (s *acmeServer) loadAccount(id string) (*acmeAccount, error) {
+	db := s.manager.Option.Database
+	if db == nil || id == "" || !db.KeyExists("pki", "account/"+id) {
+		return nil, errors.New("account not found")
+	}
+	account := acmeAccount{}
+	err := db.Read("pki", "account/"+id, &account)
+	return &account, err
+}
+
+func (s *acmeServer) accountResponse(r *http.Request, account *acmeAccount) map[string]interface{} {
+	return map[string]interface{}{
+		"status":  "valid",
+		"contact": account.Contact,
+		"orders":  s.baseURL(r) + "/account/" + account.ID + "/orders",
+	}
+}
+
+func (s *acmeServer) handleNewAccount(w http.ResponseWriter, r *http.Request, request *acmeRequest) {
+	payload := struct {
+		Contact              []string `json:"contact"`
+		TermsOfServiceAgreed bool     `json:"termsOfServiceAgreed"`
+		OnlyReturnExisting   bool     `json:"onlyReturnExisting"`
+	}{}
+	if err := json.Unmarshal(request.Payload, &payload); err != nil {
+		s.sendProblem(w, r, newProblem("malformed", "invalid account payload", http.StatusBadRequest))
+		return
+	}
+
+	accountID, err := jwkThumbprint(request.JWK)
+	if err != nil {
+		s.sendProblem(w, r, newProblem("badPublicKey", "unsupported account key", http.StatusBadRequest))
+		return
+	}
+	location := s.baseURL(r) + "/account/" + accountID
+
+	if existing, err := s.loadAccount(accountID); err == nil {
+		s.sendJSON(w, r, http.StatusOK, location, s.accountResponse(r, existing))
+		return
+	}
+	if payload.OnlyReturnExisting {
+		s.sendProblem(w, r, newProblem("accountDoesNotExist", "account not found", http.StatusBadRequest))
+		return
+	}
+
+	keyJSON, err := request.JWK.Public().MarshalJSON()
+	if err != nil {
+		s.sendProblem(w, r, newProblem("badPublicKey", "unsupported account key", http.StatusBadRequest))
+		return
+	}
+	account := acmeAccount{
+		ID:      accountID,
+		Key:     keyJSON,
+		Contact: payload.Contact,
+		Created: time.Now().Unix(),
+	}
+	if account.Contact == nil {
+		account.Contact = []string{}
+	}
+	err = s.manager.Option.Database.Write("pki", "account/"+accountID, account)
+	if err != nil {
+		s.sendProblem(w, r, newProblem("serverInternal", "unable to save account", http.StatusInternalServerError))
+		return
+	}
+	s.sendJSON(w, r, http.StatusCreated, location, s.accountResponse(r, &account))
+}
+
+func (s *acmeServer) handleAccount(w http.ResponseWriter, r *http.Request, request *acmeRequest, id string) {
+	if id != request.AccountID {
+		s.sendProblem(w, r, newProblem("unauthorized", "account does not match the request signer", http.StatusUnauthorized))
+		return
+	}
+	if strings.HasSuffix(r.URL.Path, "/orders") {
+		s.mutex.Lock()
+		orderURLs := []string{}
+		for _, order := range s.orders {
+			if order.AccountID == id {
+				orderURLs = append(orderURLs, s.baseURL(r)+"/order/"+order.ID)
+			}
+		}
+		s.mutex.Unlock()
+		sort.Strings(orderURLs)
+		s.sendJSON(w, r, http.StatusOK, "", map[string]interface{}{"orders": orderURLs})
+		return
+	}
+
+	account, err := s.loadAccount(id)
+	if err != nil {
+		s.sendProblem(w, r, newProblem("accountDoesNotExist", "account not found", http.StatusBadRequest))
+		return
+	}
+	s.sendJSON(w, r, http.StatusOK, "", s.accountResponse(r, account))
+}
+
+// Remove expired orders and authorizations. Must be called with the mutex locked
+func (s *acmeServer) cleanUpExpired() {
+	now := time.Now()
+	for id, order := range s.orders {
+		if now.After(order.Expires) {
+			delete(s.certs, order.CertID)
+			delete(s.orders, id)
+		}
+	}
+	for id, authz := range s.authzs {
+		if now.After(authz.Expires) {
+			delete(s.authzs, id)
+		}
+	}
+}
+
+func (s *acmeServer) orderResponse(r *http.Request, order *acmeOrder) map[string]interface{} {
+	base := s.baseURL(r)
+	authzURLs := []string{}
+	for _, authzID := range order.AuthzIDs {
+		authzURLs = append(authzURLs, base+"/authz/"+authzID)
+	}
+	response := map[string]interface{}{
+		"status":         order.Status,
+		"expires":        order.Expires.UTC().Format(time.RFC3339),
+		"identifiers":    order.Identifiers,
+		"authorizations": authzURLs,
+		"finalize":       base + "/finalize/" + order.ID,
+	}
+	if order.CertID != "" {
+		response["certificate"] = base + "/cert/" + order.CertID
+	}
+	if order.Error != nil {
+		response["error"] = order.Error
+	}
+	return response
+}
+
+func (s *acmeServer) handleNewOrder(w http.ResponseWriter, r *http.Request, request *acmeRequest) {
+	payload := struct {
+		Identifiers []acmeIdentifier `json:"identifiers"`
+	}{}
+	if err := json.Unmarshal(request.Payload, &payload); err != nil || len(payload.Identifiers) == 0 {
+		s.sendProblem(w, r, newProblem("malformed", "invalid order payload", http.StatusBadRequest))
+		return
+	}
+
+	for i, identifier := range payload.Identifiers {
+		if identifier.Type != "dns" {
+			s.sendProblem(w, r, newProblem("unsupportedIdentifier", "only dns identifiers are supported", http.StatusBadRequest))
+			return
+		}
+		payload.Identifiers[i].Value = strings.ToLower(identifier.Value)
+		if strings.Contains(identifier.Value, "*") || !s.manager.ManagesDomain(identifier.Value) {
+			s.sendProblem(w, r, newProblem("rejectedIdentifier", identifier.Value+" is not managed by this CA", http.StatusBadRequest))
+			return
+		}
+	}
+
+	expires := time.Now().Add(acmeOrderLifetime)
+	order := acmeOrder{
+		ID:          randomID(),
+		AccountID:   request.AccountID,
+		Status:      "pending",
+		Expires:     expires,
+		Identifiers: payload.Identifiers,
+		AuthzIDs:    []string{},
+	}
+
+	s.mutex.Lock()
+	s.cleanUpExpired()
+	for _, identifier := range payload.Identifiers {
+		authz := acmeAuthz{
+			ID:              randomID(),
+			AccountID:       request.AccountID,
+			Identifier:      identifier,
+			Status:          "pending",
+			Expires:         expires,
+			Token:           randomID(),
+			ChallengeStatus: "pending",
+		}
+		s.authzs[authz.ID] = &authz
+		order.AuthzIDs = append(order.AuthzIDs, authz.ID)
+	}
+	s.orders[order.ID] = &order
+	response := s.orderResponse(r, &order)
+	s.mutex.Unlock()
+
+	s.sendJSON(w, r, http.StatusCreated, s.baseURL(r)+"/order/"+order.ID, response)
+}
+
+// Get the order of the account, must be called with the mutex locked
+func (s *acmeServer) getOrder(id string, accountID string) (*acmeOrder, *acmeProblem) {
+	order, ok := s.orders[id]
+	if !ok || order.AccountID != accountID {
+		return nil, newProblem("malformed", "order not found", http.StatusNotFound)
+	}
+	if time.Now().After(order.Expires) {
+		return nil, newProblem("malformed", "order expired", http.StatusNotFound)
+	}
+	return order, nil
+}
+
+func (s *acmeServer) handleGetOrder(w http.ResponseWriter, r *http.Request, request *acmeRequest, id string) {
+	s.mutex.Lock()
+	order, problem := s.getOrder(id, request.AccountID)
+	if problem != nil {
+		s.mutex.Unlock()
+		s.sendProblem(w, r, problem)
+		return
+	}
+	response := s.orderResponse(r, order)
+	s.mutex.Unlock()
+	s.sendJSON(w, r, http.StatusOK, "", response)
+}
+
+func (s *acmeServer) challengeResponse(r *http.Request, authz *acmeAuthz) map[string]interface{} {
+	challenge := map[string]interface{}{
+		"type":   "http-01",
+		"url":    s.baseURL(r) + "/challenge/" + authz.ID,
+		"token":  authz.Token,
+		"status": authz.ChallengeStatus,
+	}
+	if !authz.Validated.IsZero() {
+		challenge["validated"] = authz.Validated.UTC().Format(time.RFC3339)
+	}
+	if authz.Error != nil {
+		challenge["error"] = authz.Error
+	}
+	return challenge
+}
+
+func (s *acmeServer) authzResponse(r *http.Request, authz *acmeAuthz) map[string]interface{} {
+	return map[string]interface{}{
+		"status":     authz.Status,
+		"expires":    authz.Expires.UTC().Format(time.RFC3339),
+		"identifier": authz.Identifier,
+		"challenges": []interface{}{s.challengeResponse(r, authz)},
+	}
+}
+
+// Get the authorization of the account, must be called with the mutex locked
+func (s *acmeServer) getAuthz(id string, accountID string) (*acmeAuthz, *acmeProblem) {
+	authz, ok := s.authzs[id]
+	if !ok || authz.AccountID != accountID {
+		return nil, newProblem("malformed", "authorization not found", http.StatusNotFound)
+	}
+	return authz, nil
+}
+
+func (s *acmeServer) handleGetAuthz(w http.ResponseWriter, r *http.Request, request *acmeRequest, id string) {
+	s.mutex.Lock()
+	authz, problem := s.getAuthz(id, request.AccountID)
+	if problem != nil {
+		s.mutex.Unlock()
+		s.sendProblem(w, r, problem)
+		return
+	}
+	response := s.authzResponse(r, authz)
+	s.mutex.Unlock()
+	s.sendJSON(w, r, http.StatusOK, "", response)
+}
+
+// Fetch the HTTP-01 key authorization from the domain
+func (s *acmeServer) validateHTTP01(domain string, token string, keyAuthorization string) error {
+	host := domain
+	if s.manager.Option.ChallengePort != 80 {
+		host = domain + ":" + strconv.Itoa(s.manager.Option.ChallengePort)
+	}
+	resp, err := s.client.Get("http://" + host + "/.well-known/acme-challenge/" + token)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("unexpected status code " + strconv.Itoa(resp.StatusCode))
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(string(body)) != keyAuthorization {
+		return errors.New("key authorization mismatch")
+	}
+	return nil
+}
+
+// Update the order status from its authorizations, must be called with the mutex locked
+func (s *acmeServer) updateOrderStatus(order *acmeOrder) {
+	if order.Status != "pending" {
+		return
+	}
+	allValid := true
+	for _, authzID := range order.AuthzIDs {
+		authz, ok := s.authzs[authzID]
+		if !ok || authz.Status == "invalid" {
+			order.Status = "invalid"
+			order.Error = newProblem("unauthorized", "authorization failed", http.StatusForbidden)
+			return
+		}
+		if authz.Status != "valid" {
+			allValid = false
+		}
+	}
+	if allValid {
+		order.Status = "ready"
+	}
+}
+
+func (s *acmeServer) handleChallenge(w http.ResponseWriter, r *http.Request, request *acmeRequest, id string) {
+	s.mutex.Lock()
+	authz, problem := s.getAuthz(id, request.AccountID)
+	if problem != nil {
+		s.mutex.Unlock()
+		s.sendProblem(w, r, problem)
+		return
+	}
+
+	//POST-as-GET returns the challenge without triggering validation
+	if len(request.Payload) == 0 || authz.ChallengeStatus != "pending" {
+		response := s.challengeResponse(r, authz)
+		s.mutex.Unlock()
+		s.sendJSON(w, r, http.StatusOK, "", response)
+		return
+	}
+	authz.ChallengeStatus = "processing"
+	domain := authz.Identifier.Value
+	token := authz.Token
+	s.mutex.Unlock()
+
+	thumbprint, err := jwkThumbprint(request.JWK)
+	if err == nil {
+		err = s.validateHTTP01(domain, token, token+"."+thumbprint)
+	}
+
+	s.mutex.Lock()
+	if err != nil {
+		authz.ChallengeStatus = "invalid"
+		authz.Status = "invalid"
+		authz.Error = newProblem("connection", "HTTP-01 validation of "+domain+" failed: "+err.Error(), http.StatusForbidden)
+	} else {
+		authz.ChallengeStatus = "valid"
+		authz.Status = "valid"
+		authz.Validated = time.Now()
+	}
+	for _, order := range s.orders {
+		for _, authzID := range order.AuthzIDs {
+			if authzID == authz.ID {
+				s.updateOrderStatus(order)
+			}
+		}
+	}
+	response := s.challengeResponse(r, authz)
+	s.mutex.Unlock()
+
+	w.Header().Add("Link", "<"+s.baseURL(r)+"/authz/"+id+">;rel=\"up\"")
+	s.sendJSON(w, r, http.StatusOK, "", response)
+}
+
+func (s *acmeServer) handleFinalize(w http.ResponseWriter, r *http.Request, request *acmeRequest, id string) {
+	payload := struct {
+		CSR string `json:"csr"`
+	}{}
+	if err := json.Unmarshal(request.Payload, &payload); err != nil {
+		s.sendProblem(w, r, newProblem("malformed", "invalid finalize payload", http.StatusBadRequest))
+		return
+	}
+	csrDER, err := base64.RawURLEncoding.DecodeString(payload.CSR)
+	if err != nil {
+		s.sendProblem(w, r, newProblem("badCSR", "invalid CSR encoding", http.StatusBadRequest))
+		return
+	}
+	csr, err := x509.ParseCertificateRequest(csrDER)
+	if err != nil || csr.CheckSignature() != nil {
+		s.sendProblem(w, r, newProblem("badCSR", "invalid CSR", http.StatusBadRequest))
+		return
+	}
+
+	//The CSR must request exactly the identifiers of the order
+	requested := map[string]bool{}
+	for _, name := range csr.DNSNames {
+		requested[strings.ToLower(name)] = true
+	}
+	if csr.Subject.CommonName != "" {
+		requested[strings.ToLower(csr.Subject.CommonName)] = true
+	}
+
+	s.mutex.Lock()
+	order, problem := s.getOrder(id, request.AccountID)
+	if problem == nil && order.Status != "ready" {
+		problem = newProblem("orderNotReady", "order is not ready for finalization", http.StatusForbidden)
+	}
+	domains := []string{}
+	if problem == nil {
+		for _, identifier := range order.Identifiers {
+			domains = append(domains, identifier.Value)
+		}
+		if len(requested) != len(domains) || len(csr.IPAddresses) > 0 || len(csr.EmailAddresses) > 0 || len(csr.URIs) > 0 {
+			problem = newProblem("badCSR", "CSR names do not match the order identifiers", http.StatusBadRequest)
+		}
+		for _, domain := range domains {
+			if !requested[domain] {
+				problem = newProblem("badCSR", "CSR names do not match the order identifiers", http.StatusBadRequest)
+			}
+		}
+	}
+	if problem != nil {
+		s.mutex.Unlock()
+		s.sendProblem(w, r, problem)
+		return
+	}
+	//Move to processing before signing so concurrent finalize requests are rejected
+	order.Status = "processing"
+	s.mutex.Unlock()
+
+	chain, err := s.manager.signLeaf(domains, csr.PublicKey, s.manager.leafLifetime())
+	if err != nil {
+		problem := newProblem("serverInternal", "unable to sign certificate: "+err.Error(), http.StatusInternalServerError)
+		s.mutex.Lock()
+		order.Status = "invalid"
+		order.Error = problem
+		s.mutex.Unlock()
+		s.sendProblem(w, r, problem)
+		return
+	}
+	chainPEM := []byte{}
+	for _, der := range chain {
+		chainPEM = append(chainPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+
+	s.mutex.Lock()
+	order.CertID = randomID()
+	order.Status = "valid"
+	s.certs[order.CertID] = chainPEM
+	response := s.orderResponse(r, order)
+	s.mutex.Unlock()
+
+	s.sendJSON(w, r, http.StatusOK, s.baseURL(r)+"/order/"+order.ID, response)
+}
+
+func (s *acmeServer) handleGetCert(w http.ResponseWriter, r *http.Request, request *acmeRequest, id string) {
+	s.mutex.Lock()
+	var chainPEM []byte
+	for _, order := range s.orders {
+		if order.CertID == id && order.AccountID == request.AccountID {
+			chainPEM = s.certs[id]
+		}
+	}
+	s.mutex.Unlock()
+
+	if chainPEM == nil {
+		s.sendProblem(w, r, newProblem("malformed", "certificate not found", http.StatusNotFound))
+		return
+	}
+	s.writeHeaders(w, r)
+	w.Header().Set("Content-Type", "application/pem-certificate-chain")
+	w.Write(chainPEM)
+}
+
+// Serve the embedded ACME server if enabled. The base path is the path the handler is mounted on
+func (m *Manager) HandleACMEServer(basePath string) http.HandlerFunc {
+	m.acme.basePath = strings.TrimSuffix(basePath, "/")
+	return func(w http.ResponseWriter, r *http.Request) {
+		m.mutex.RLock()
+		enabled := m.Config.ACMEServer
+		m.mutex.RUnlock()
+		if !enabled {
+			http.NotFound(w, r)
+			return
+		}
+		m.acme.ServeHTTP(w, r)
+	}
+}
@@ -0,0 +1,120 @@
+package pki
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"imuslab.com/zoraxy/mod/utils"
+)
+
+/*
+	Handler.go
+
+	API handlers of the private CA
+*/
+
+// Get the private CA settings and the root / intermediate CA information
+func (m *Manager) HandleStatus(w http.ResponseWriter, r *http.Request) {
+	m.mutex.RLock()
+	status := struct {
+		Config       *Config
+		Root         *CAInfo
+		Intermediate *CAInfo
+	}{
+		Config:       m.Config,
+		Root:         getCAInfo(m.rootCert),
+		Intermediate: getCAInfo(m.intermediateCert),
+	}
+	js, _ := json.Marshal(status)
+	m.mutex.RUnlock()
+	utils.SendJSONResponse(w, string(js))
+}
+
+// Update the private CA settings
+func (m *Manager) HandleSetConfig(w http.ResponseWriter, r *http.Request) {
+	newConfig := Config{Domains: []string{}}
+	newConfig.Enabled, _ = utils.PostBool(r, "enabled")
+	newConfig.ACMEServer, _ = utils.PostBool(r, "acmeServer")
+	domains, _ := utils.PostPara(r, "domains")
+	for _, pattern := range strings.Split(domains, ",") {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if pattern != "" {
+			newConfig.Domains = append(newConfig.Domains, pattern)
+		}
+	}
+
+	lifetime, err := utils.PostPara(r, "leafLifetime")
+	if err != nil {
+		utils.SendErrorResponse(w, "leafLifetime not set")
+		return
+	}
+	newConfig.LeafLifetime, err = strconv.Atoi(lifetime)
+	if err != nil {
+		utils.SendErrorResponse(w, "invalid leafLifetime given")
+		return
+	}
+
+	err = m.SetConfig(&newConfig)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+	if m.ConfigChanged != nil {
+		go m.ConfigChanged()
+	}
+	utils.SendOK(w)
+}
+
+// Download the root CA certificate in PEM (default) or DER format
+func (m *Manager) HandleExportRoot(w http.ResponseWriter, r *http.Request) {
+	format, _ := utils.GetPara(r, "format")
+	if format == "der" {
+		w.Header().Set("Content-Type", "application/pkix-cert")
+		w.Header().Set("Content-Disposition", "attachment; filename=\"zoraxy-root-ca.cer\"")
+		w.Write(m.RootDER())
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	w.Header().Set("Content-Disposition", "attachment; filename=\"zoraxy-root-ca.crt\"")
+	w.Write(m.RootPEM())
+}
+
+// Issue a certificate from the private CA to the cert store
+func (m *Manager) HandleIssue(w http.ResponseWriter, r *http.Request) {
+	domains, err := utils.PostPara(r, "domains")
+	if err != nil {
+		utils.SendErrorResponse(w, "domains not set")
+		return
+	}
+
+	domainList := []string{}
+	for _, domain := range strings.Split(domains, ",") {
+		domain = strings.ToLower(strings.TrimSpace(domain))
+		if domain == "" {
+			continue
+		}
+		if !m.ManagesDomain(domain) {
+			utils.SendErrorResponse(w, domain+" is not managed by the private CA")
+			return
+		}
+		domainList = append(domainList, domain)
+	}
+	if len(domainList) == 0 {
+		utils.SendErrorResponse(w, "domains not set")
+		return
+	}
+
+	name, _ := utils.PostPara(r, "name")
+	if name == "" {
+		name = domainList[0]
+	}
+
+	err = m.IssueToStore(name, domainList)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+	utils.SendOK(w)
+}
@@ -0,0 +1,524 @@
+package pki
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"log"
+	"math/big"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"imuslab.com/zoraxy/mod/database"
+	"imuslab.com/zoraxy/mod/utils"
+)
+
+/*
+	PKI.go
+
+	Built-in private certificate authority for LAN services.
+	A root CA and an intermediate CA are generated on first start
+	and kept in the PKI store folder. Leaf certificates for the
+	managed domains are signed by the intermediate with a short
+	lifetime and rotated before they expire.
+*/
+
+const (
+	rootLifetime         = 10 * 365 * 24 * time.Hour
+	intermediateLifetime = 5 * 365 * 24 * time.Hour
+	intermediateRenewal  = 30 * 24 * time.Hour //Regenerate the intermediate CA if it expires within this period
+	rotateCheckInterval  = time.Hour
+)
+
+type Config struct {
+	Enabled      bool     //Issue certificates from the private CA for the managed domains
+	Domains      []string //Domain patterns managed by the private CA, e.g. *.lan or nas.home.arpa
+	LeafLifetime int      //Lifetime of leaf certificates in hours
+	ACMEServer   bool     //Serve the embedded ACME server for internal tools
+}
+
+type Options struct {
+	Database      *database.Database
+	StorePath     string //Folder to store the CA certificates and keys
+	CertStore     string //Folder to write issued leaf certificates, shared with tlscert
+	CommonName    string //Common name prefix of the generated CAs
+	ChallengePort int    //Port to connect for ACME HTTP-01 validation, default 80
+}
+
+type Manager struct {
+	Config        *Config
+	Option        *Options
+	ConfigChanged func() //Called after the settings are updated from the UI, can be nil
+
+	rootCert         *x509.Certificate
+	rootKey          crypto.Signer
+	intermediateCert *x509.Certificate
+	intermediateKey  crypto.Signer
+	acme             *acmeServer
+	rotateStop       chan bool
+	mutex            sync.RWMutex
+}
+
+// CA information returned to the UI
+type CAInfo struct {
+	Subject     string
+	NotBefore   int64
+	NotAfter    int64
+	Fingerprint string //SHA-256 fingerprint of the certificate
+}
+
+var domainPatternRegex = regexp.MustCompile(`^(\*\.)?([a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?\.)*[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// Create a private CA manager. The root and intermediate CAs are generated if not exists
+func NewManager(option *Options) (*Manager, error) {
+	if option.CommonName == "" {
+		option.CommonName = "Zoraxy Private CA"
+	}
+	if option.ChallengePort == 0 {
+		option.ChallengePort = 80
+	}
+
+	err := os.MkdirAll(option.StorePath, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	config := Config{
+		Domains:      []string{},
+		LeafLifetime: 7 * 24,
+	}
+	if option.Database != nil {
+		option.Database.NewTable("pki")
+		if option.Database.KeyExists("pki", "config") {
+			option.Database.Read("pki", "config", &config)
+		}
+	}
+
+	thisManager := Manager{
+		Config: &config,
+		Option: option,
+	}
+
+	err = thisManager.loadOrCreateCA()
+	if err != nil {
+		return nil, err
+	}
+
+	thisManager.acme = newACMEServer(&thisManager)
+	return &thisManager, nil
+}
+
+func (m *Manager) loadOrCreateCA() error {
+	rootCertFile := filepath.Join(m.Option.StorePath, "root.crt")
+	rootKeyFile := filepath.Join(m.Option.StorePath, "root.key")
+	if !utils.FileExists(rootCertFile) || !utils.FileExists(rootKeyFile) {
+		log.Println("[PKI] Generating private root CA")
+		cert, key, err := createCACertificate(m.Option.CommonName+" Root", rootLifetime, 1, nil, nil)
+		if err != nil {
+			return err
+		}
+		err = writeCertAndKey(rootCertFile, rootKeyFile, [][]byte{cert.Raw}, key)
+		if err != nil {
+			return err
+		}
+	}
+
+	rootCert, rootKey, err := loadCertAndKey(rootCertFile, rootKeyFile)
+	if err != nil {
+		return errors.New("unable to load private root CA: " + err.Error())
+	}
+	m.rootCert = rootCert
+	m.rootKey = rootKey
+
+	return m.loadOrCreateIntermediate(false)
+}
+
+// Load the intermediate CA, or sign a new one with the root if missing, expiring or forced
+func (m *Manager) loadOrCreateIntermediate(force bool) error {
+	certFile := filepath.Join(m.Option.StorePath, "intermediate.crt")
+	keyFile := filepath.Join(m.Option.StorePath, "intermediate.key")
+
+	if !force && utils.FileExists(certFile) && utils.FileExists(keyFile) {
+		cert, key, err := loadCertAndKey(certFile, keyFile)
+		if err == nil && time.Until(cert.NotAfter) > intermediateRenewal && cert.CheckSignatureFrom(m.rootCert) == nil {
+			m.intermediateCert = cert
+			m.intermediateKey = key
+			return nil
+		}
+	}
+
+	log.Println("[PKI] Generating private intermediate CA")
+	cert, key, err := createCACertificate(m.Option.CommonName+" Intermediate", intermediateLifetime, 0, m.rootCert, m.rootKey)
+	if err != nil {
+		return err
+	}
+	err = writeCertAndKey(certFile, keyFile, [][]byte{cert.Raw}, key)
+	if err != nil {
+		return err
+	}
+	m.intermediateCert = cert
+	m.intermediateKey = key
+	return nil
+}
+
+func randomSerialNumber() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+// Create a CA certificate. The certificate is self signed if parent is nil
+func createCACertificate(commonName string, lifetime time.Duration, maxPathLen int, parent *x509.Certificate, parentKey crypto.Signer) (*x509.Certificate, crypto.Signer, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := randomSerialNumber()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: commonName, Organization: []string{"Zoraxy"}},
+		NotBefore:             time.Now().Add(-5 * time.Minute),
+		NotAfter:              time.Now().Add(lifetime),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLen:            maxPathLen,
+		MaxPathLenZero:        maxPathLen == 0,
+	}
+
+	if parent == nil {
+		parent = template
+		parentKey = key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, key.Public(), parentKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	return cert, key, err
+}
+
+func writeCertAndKey(certFile string, keyFile string, certs [][]byte, key crypto.Signer) error {
+	certPEM := []byte{}
+	for _, der := range certs {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(certFile, certPEM, 0644)
+}
+
+func loadCertAndKey(certFile string, keyFile string) (*x509.Certificate, crypto.Signer, error) {
+	certPEM, err := os.ReadFile(certFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return nil, nil, errors.New("invalid certificate file")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keyPEM, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	block, _ = pem.Decode(keyPEM)
+	if block == nil {
+		return nil, nil, errors.New("invalid key file")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, nil, errors.New("unsupported key type")
+	}
+	return cert, signer, nil
+}
+
+// Validate the private CA settings before saving
+func (c *Config) Validate() error {
+	for _, pattern := range c.Domains {
+		if !domainPatternRegex.MatchString(pattern) {
+			return errors.New("invalid domain pattern " + pattern)
+		}
+	}
+	if c.LeafLifetime < 1 || c.LeafLifetime > 90*24 {
+		return errors.New("leaf certificate lifetime must be between 1 hour and 90 days")
+	}
+	return nil
+}
+
+// Update the private CA settings
+func (m *Manager) SetConfig(config *Config) error {
+	err := config.Validate()
+	if err != nil {
+		return err
+	}
+
+	m.mutex.Lock()
+	m.Config = config
+	m.mutex.Unlock()
+
+	if m.Option.Database != nil {
+		return m.Option.Database.Write("pki", "config", config)
+	}
+	return nil
+}
+
+func (m *Manager) leafLifetime() time.Duration {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return time.Duration(m.Config.LeafLifetime) * time.Hour
+}
+
+// Check if the private CA is enabled and the domain matches one of the managed patterns
+func (m *Manager) ManagesDomain(domain string) bool {
+	if m == nil {
+		return false
+	}
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.Config.Enabled && m.matchDomain(domain)
+}
+
+// Check if the domain matches the managed patterns. Wildcard patterns
+// match subdomains of any depth. Must be called with the mutex locked
+func (m *Manager) matchDomain(domain string) bool {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	for _, pattern := range m.Config.Domains {
+		if strings.HasPrefix(pattern, "*.") {
+			if strings.HasSuffix(domain, pattern[1:]) {
+				return true
+			}
+		} else if domain == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// Sign a leaf certificate for the public key. The returned chain contains the leaf and the intermediate
+func (m *Manager) signLeaf(domains []string, publicKey crypto.PublicKey, lifetime time.Duration) ([][]byte, error) {
+	if len(domains) == 0 {
+		return nil, errors.New("no domain given")
+	}
+	serial, err := randomSerialNumber()
+	if err != nil {
+		return nil, err
+	}
+
+	keyUsage := x509.KeyUsageDigitalSignature
+	if _, ok := publicKey.(*rsa.PublicKey); ok {
+		keyUsage |= x509.KeyUsageKeyEncipherment
+	}
+
+	m.mutex.RLock()
+	issuer := m.intermediateCert
+	issuerKey := m.intermediateKey
+	m.mutex.RUnlock()
+
+	notAfter := time.Now().Add(lifetime)
+	if notAfter.After(issuer.NotAfter) {
+		notAfter = issuer.NotAfter
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: domains[0]},
+		DNSNames:              domains,
+		NotBefore:             time.Now().Add(-5 * time.Minute),
+		NotAfter:              notAfter,
+		KeyUsage:              keyUsage,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, issuer, publicKey, issuerKey)
+	if err != nil {
+		return nil, err
+	}
+	return [][]byte{der, issuer.Raw}, nil
+}
+
+// Issue a certificate for the domains and write it to the cert store as <name>.crt and <name>.key
+func (m *Manager) IssueToStore(name string, domains []string) error {
+	if strings.ContainsAny(name, "/\\") || strings.Contains(name, "..") || name == "" {
+		return errors.New("invalid certificate name")
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	chain, err := m.signLeaf(domains, key.Public(), m.leafLifetime())
+	if err != nil {
+		return err
+	}
+
+	os.MkdirAll(m.Option.CertStore, 0775)
+	err = writeCertAndKey(filepath.Join(m.Option.CertStore, name+".crt"), filepath.Join(m.Option.CertStore, name+".key"), chain, key)
+	if err != nil {
+		return err
+	}
+	log.Println("[PKI] Issued private certificate for " + strings.Join(domains, ", "))
+	return nil
+}
+
+// Parse the certificates in a PEM encoded chain
+func parsePEMChain(certPEM []byte) []*x509.Certificate {
+	certs := []*x509.Certificate{}
+	for {
+		var block *pem.Block
+		block, certPEM = pem.Decode(certPEM)
+		if block == nil {
+			return certs
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err == nil {
+			certs = append(certs, cert)
+		}
+	}
+}
+
+// Check if the PEM encoded certificate chain is issued by this private CA,
+// including certificates signed by previous intermediates of the same root
+func (m *Manager) IsIssuedByCA(certPEM []byte) bool {
+	if m == nil {
+		return false
+	}
+	chain := parsePEMChain(certPEM)
+	if len(chain) == 0 {
+		return false
+	}
+
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	leaf := chain[0]
+	if leaf.CheckSignatureFrom(m.intermediateCert) == nil {
+		return true
+	}
+	return len(chain) > 1 && chain[1].CheckSignatureFrom(m.rootCert) == nil && leaf.CheckSignatureFrom(chain[1]) == nil
+}
+
+// Renew the intermediate CA and the leaf certificates in the cert store that are
+// issued by this CA and passed two third of their lifetime
+func (m *Manager) RotateCertificates() []string {
+	m.mutex.Lock()
+	if time.Until(m.intermediateCert.NotAfter) < intermediateRenewal {
+		err := m.loadOrCreateIntermediate(true)
+		if err != nil {
+			log.Println("[PKI] Unable to renew intermediate CA: " + err.Error())
+		}
+	}
+	m.mutex.Unlock()
+
+	rotated := []string{}
+	files, err := os.ReadDir(m.Option.CertStore)
+	if err != nil {
+		return rotated
+	}
+	for _, file := range files {
+		if file.IsDir() || filepath.Ext(file.Name()) != ".crt" {
+			continue
+		}
+		certPEM, err := os.ReadFile(filepath.Join(m.Option.CertStore, file.Name()))
+		if err != nil || !m.IsIssuedByCA(certPEM) {
+			continue
+		}
+		cert := parsePEMChain(certPEM)[0]
+
+		//Keep certificates with more than one third of lifetime left that are signed by the current intermediate
+		m.mutex.RLock()
+		signedByCurrent := cert.CheckSignatureFrom(m.intermediateCert) == nil
+		m.mutex.RUnlock()
+		if signedByCurrent && time.Until(cert.NotAfter) > cert.NotAfter.Sub(cert.NotBefore)/3 {
+			continue
+		}
+
+		name := strings.TrimSuffix(file.Name(), ".crt")
+		err = m.IssueToStore(name, cert.DNSNames)
+		if err != nil {
+			log.Println("[PKI] Unable to rotate certificate " + name + ": " + err.Error())
+			continue
+		}
+		rotated = append(rotated, name)
+	}
+	return rotated
+}
+
+// Start the certificate rotation ticker
+func (m *Manager) StartRotation() {
+	m.rotateStop = make(chan bool)
+	ticker := time.NewTicker(rotateCheckInterval)
+	go func() {
+		m.RotateCertificates()
+		for {
+			select {
+			case <-m.rotateStop:
+				ticker.Stop()
+				return
+			case <-ticker.C:
+				m.RotateCertificates()
+			}
+		}
+	}()
+}
+
+func (m *Manager) Close() {
+	if m.rotateStop != nil {
+		close(m.rotateStop)
+		m.rotateStop = nil
+	}
+}
+
+// Get the root CA certificate in PEM format for client trust installation
+func (m *Manager) RootPEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: m.RootDER()})
+}
+
+// Get the root CA certificate in DER format
+func (m *Manager) RootDER() []byte {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.rootCert.Raw
+}
+
+func getCAInfo(cert *x509.Certificate) *CAInfo {
+	fingerprint := sha256.Sum256(cert.Raw)
+	return &CAInfo{
+		Subject:     cert.Subject.CommonName,
+		NotBefore:   cert.NotBefore.Unix(),
+		NotAfter:    cert.NotAfter.Unix(),
+		Fingerprint: strings.ToUpper(hex.EncodeToString(fingerprint[:])),
+	}
+}
@@ -0,0 +1,216 @@
+package pki_test
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/go-acme/lego/v4/certificate"
+	"github.com/go-acme/lego/v4/challenge/http01"
+	"github.com/go-acme/lego/v4/lego"
+	"github.com/go-acme/lego/v4/registration"
+	"imuslab.com/zoraxy/mod/database"
+	"imuslab.com/zoraxy/mod/pki"
+)
+
+type testUser struct {
+	registration *registration.Resource
+	key          crypto.PrivateKey
+}
+
+func (u *testUser) GetEmail() string                        { return "admin@example.com" }
+func (u *testUser) GetRegistration() *registration.Resource { return u.registration }
+func (u *testUser) GetPrivateKey() crypto.PrivateKey        { return u.key }
+
+func newTestManager(t *testing.T, challengePort int) *pki.Manager {
+	dir := t.TempDir()
+	db, err := database.NewDatabase(filepath.Join(dir, "test.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	manager, err := pki.NewManager(&pki.Options{
+		Database:      db,
+		StorePath:     filepath.Join(dir, "pki"),
+		CertStore:     filepath.Join(dir, "certs"),
+		ChallengePort: challengePort,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return manager
+}
+
+// Verify the chain in the PEM file up to the root of the manager
+func verifyChain(t *testing.T, manager *pki.Manager, chainPEM []byte, domain string) *x509.Certificate {
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(manager.RootPEM()) {
+		t.Fatal("unable to parse root PEM")
+	}
+	certs := []*x509.Certificate{}
+	for block, rest := pem.Decode(chainPEM); block != nil; block, rest = pem.Decode(rest) {
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) != 2 {
+		t.Fatalf("expected leaf and intermediate in chain, got %d certificates", len(certs))
+	}
+	intermediates := x509.NewCertPool()
+	intermediates.AddCert(certs[1])
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		DNSName:       domain,
+		Roots:         roots,
+		Intermediates: intermediates,
+	})
+	if err != nil {
+		t.Fatalf("certificate chain does not verify: %v", err)
+	}
+	return certs[0]
+}
+
+func TestIssueAndRotate(t *testing.T) {
+	manager := newTestManager(t, 0)
+	if manager.ManagesDomain("nas.lan") {
+		t.Fatal("private CA should be disabled by default")
+	}
+
+	err := manager.SetConfig(&pki.Config{Enabled: true, Domains: []string{"*.bad domain"}, LeafLifetime: 24})
+	if err == nil {
+		t.Fatal("invalid domain pattern accepted")
+	}
+	err = manager.SetConfig(&pki.Config{Enabled: true, Domains: []string{"*.lan"}, LeafLifetime: 24})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !manager.ManagesDomain("nas.lan") || !manager.ManagesDomain("a.b.lan") || manager.ManagesDomain("example.com") {
+		t.Fatal("domain matching is incorrect")
+	}
+
+	err = manager.IssueToStore("nas.lan", []string{"nas.lan"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM, err := os.ReadFile(filepath.Join(manager.Option.CertStore, "nas.lan.crt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf := verifyChain(t, manager, certPEM, "nas.lan")
+	if !manager.IsIssuedByCA(certPEM) {
+		t.Fatal("issued certificate not recognized as private CA certificate")
+	}
+	if leaf.NotAfter.Sub(leaf.NotBefore).Hours() > 25 {
+		t.Fatal("leaf lifetime setting not applied")
+	}
+
+	//Fresh certificates are not rotated
+	if rotated := manager.RotateCertificates(); len(rotated) != 0 {
+		t.Fatalf("unexpected rotation: %v", rotated)
+	}
+
+	//Certificates signed by other CAs are not managed
+	otherManager := newTestManager(t, 0)
+	otherManager.SetConfig(&pki.Config{Enabled: true, Domains: []string{"*.lan"}, LeafLifetime: 24})
+	otherManager.IssueToStore("other.lan", []string{"other.lan"})
+	otherPEM, _ := os.ReadFile(filepath.Join(otherManager.Option.CertStore, "other.lan.crt"))
+	if manager.IsIssuedByCA(otherPEM) {
+		t.Fatal("certificate of another CA recognized as issued")
+	}
+
+	//The root is exported in DER format
+	root, err := x509.ParseCertificate(manager.RootDER())
+	if err != nil || !root.IsCA {
+		t.Fatal("invalid root certificate export")
+	}
+
+	//CA is reloaded from the store
+	reloaded, err := pki.NewManager(manager.Option)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(reloaded.RootDER()) != string(manager.RootDER()) || !reloaded.IsIssuedByCA(certPEM) {
+		t.Fatal("CA not reloaded from store")
+	}
+	if !reloaded.ManagesDomain("nas.lan") {
+		t.Fatal("config not reloaded from database")
+	}
+}
+
+func TestEmbeddedACMEServer(t *testing.T) {
+	//Reserve a port for the lego HTTP-01 challenge server
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	challengePort := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	manager := newTestManager(t, challengePort)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/pki/acme/", manager.HandleACMEServer("/pki/acme"))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	//Disabled by default
+	resp, err := http.Get(server.URL + "/pki/acme/directory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatal("ACME server should be disabled by default")
+	}
+
+	err = manager.SetConfig(&pki.Config{Enabled: true, Domains: []string{"localhost"}, LeafLifetime: 24, ACMEServer: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	user := &testUser{key: key}
+	config := lego.NewConfig(user)
+	config.CADirURL = server.URL + "/pki/acme/directory"
+	client, err := lego.NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.Challenge.SetHTTP01Provider(http01.NewProviderServer("127.0.0.1", strconv.Itoa(challengePort)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	user.registration, err = client.Registration.Register(registration.RegisterOptions{TermsOfServiceAgreed: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//Existing account is returned for the same key
+	_, err = client.Registration.ResolveAccountByKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//Domains not managed by the CA are rejected
+	_, err = client.Certificate.Obtain(certificate.ObtainRequest{Domains: []string{"example.com"}, Bundle: true})
+	if err == nil {
+		t.Fatal("certificate issued for unmanaged domain")
+	}
+
+	certs, err := client.Certificate.Obtain(certificate.ObtainRequest{Domains: []string{"localhost"}, Bundle: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyChain(t, manager, certs.Certificate, "localhost")
+}
@@ -0,0 +1,89 @@
+package sniproxy
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"imuslab.com/zoraxy/mod/utils"
+)
+
+/*
+	Handler.go
+	Handlers for managing the SNI passthrough routes
+*/
+
+func (m *Manager) HandleAddRoute(w http.ResponseWriter, r *http.Request) {
+	hostname, err := utils.PostPara(r, "hostname")
+	if err != nil {
+		utils.SendErrorResponse(w, "hostname cannot be empty")
+		return
+	}
+
+	upstream, err := utils.PostPara(r, "upstream")
+	if err != nil {
+		utils.SendErrorResponse(w, "upstream cannot be empty")
+		return
+	}
+
+	routeUUID, err := m.AddRoute(hostname, upstream)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+
+	js, _ := json.Marshal(routeUUID)
+	utils.SendJSONResponse(w, string(js))
+}
+
+func (m *Manager) HandleEditRoute(w http.ResponseWriter, r *http.Request) {
+	routeUUID, err := utils.PostPara(r, "uuid")
+	if err != nil {
+		utils.SendErrorResponse(w, "route UUID cannot be empty")
+		return
+	}
+
+	route, err := m.GetRouteByUUID(routeUUID)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+
+	newHostname, _ := utils.PostPara(r, "hostname")
+	newUpstream, _ := utils.PostPara(r, "upstream")
+	enabled, err := utils.PostBool(r, "enabled")
+	if err != nil {
+		//Keep the current state if not given
+		m.routesMutex.RLock()
+		enabled = route.Enabled
+		m.routesMutex.RUnlock()
+	}
+
+	err = m.EditRoute(routeUUID, newHostname, newUpstream, enabled)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+
+	utils.SendOK(w)
+}
+
+func (m *Manager) HandleListRoutes(w http.ResponseWriter, r *http.Request) {
+	js, _ := json.Marshal(m.ListRoutes())
+	utils.SendJSONResponse(w, string(js))
+}
+
+func (m *Manager) HandleRemoveRoute(w http.ResponseWriter, r *http.Request) {
+	routeUUID, err := utils.PostPara(r, "uuid")
+	if err != nil {
+		utils.SendErrorResponse(w, "invalid uuid given")
+		return
+	}
+
+	err = m.RemoveRoute(routeUUID)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+
+	utils.SendOK(w)
+}
@@ -0,0 +1,212 @@
+package sniproxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"imuslab.com/zoraxy/mod/utils"
+)
+
+/*
+	Listener.go
+
+	Listener wrapper that peeks the TLS ClientHello of
+	incoming connections. Connections with a matching
+	route are piped to the upstream, others are replayed
+	to the wrapped TLS listener with the peeked bytes
+*/
+
+// Timeout for the client to send the ClientHello
+const clientHelloTimeout = 10 * time.Second
+
+// Conn that replays the peeked bytes before reading from the connection
+type peekedConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// Half close the underlying TCP connection
+func (c *peekedConn) CloseWrite() error {
+	if tcpConn, ok := c.Conn.(*net.TCPConn); ok {
+		return tcpConn.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+// Conn that only allows reading, used to parse the ClientHello
+// with the TLS stack without answering the client
+type readOnlyConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c *readOnlyConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func (c *readOnlyConn) Write(b []byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
+
+var errClientHelloPeeked = errors.New("client hello peeked")
+
+// Read the server name from the ClientHello of the connection. The returned
+// conn replays the consumed bytes and must be used in place of conn
+func PeekServerName(conn net.Conn) (string, net.Conn, error) {
+	peeked := new(bytes.Buffer)
+	serverName := ""
+	err := tls.Server(&readOnlyConn{Conn: conn, reader: io.TeeReader(conn, peeked)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = hello.ServerName
+			return nil, errClientHelloPeeked
+		},
+	}).Handshake()
+
+	replayConn := &peekedConn{Conn: conn, reader: io.MultiReader(peeked, conn)}
+	if !errors.Is(err, errClientHelloPeeked) {
+		//Not a TLS handshake or the client hello is malformed
+		return "", replayConn, err
+	}
+	return serverName, replayConn, nil
+}
+
+type passthroughListener struct {
+	net.Listener
+	manager *Manager
+
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+	acceptErr error
+}
+
+// Wrap a raw TCP listener with SNI passthrough routing. The returned listener
+// only yields connections that are not routed, wrap it with tls.NewListener
+// to terminate TLS for them
+func (m *Manager) Listener(inner net.Listener) net.Listener {
+	l := &passthroughListener{
+		Listener: inner,
+		manager:  m,
+		conns:    make(chan net.Conn),
+		done:     make(chan struct{}),
+	}
+	go l.acceptLoop()
+	return l
+}
+
+func (l *passthroughListener) acceptLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				time.Sleep(50 * time.Millisecond)
+				continue
+			}
+			l.closeOnce.Do(func() {
+				l.acceptErr = err
+				l.Listener.Close()
+				close(l.done)
+			})
+			return
+		}
+		go l.handleConn(conn)
+	}
+}
+
+// Route the connection to upstream if the server name matches, or pass it to the TLS listener
+func (l *passthroughListener) handleConn(conn net.Conn) {
+	if !l.manager.hasEnabledRoutes() {
+		l.deliver(conn)
+		return
+	}
+
+	conn.SetReadDeadline(time.Now().Add(clientHelloTimeout))
+	serverName, replayConn, err := PeekServerName(conn)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		//Let the TLS listener handle the error, e.g. plain HTTP request to HTTPS port
+		l.deliver(replayConn)
+		return
+	}
+
+	route, upstream := l.manager.matchRoute(serverName)
+	if route == nil {
+		l.deliver(replayConn)
+		return
+	}
+
+	if !l.manager.Options.AccessControlHandler(conn.RemoteAddr()) {
+		log.Printf("[SNI Proxy] Connection from %s to %s rejected by access control policy\n", conn.RemoteAddr().String(), serverName)
+		conn.Close()
+		return
+	}
+
+	target, err := net.DialTimeout("tcp", upstream, l.manager.dialTimeout())
+	if err != nil {
+		log.Printf("[SNI Proxy] Unable to connect upstream %s of %s: %s\n", upstream, serverName, err.Error())
+		conn.Close()
+		return
+	}
+	forward(replayConn, target, route)
+}
+
+// Pass the connection to Accept, close it if the listener is closed
+func (l *passthroughListener) deliver(conn net.Conn) {
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+func (l *passthroughListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		if l.acceptErr != nil {
+			return nil, l.acceptErr
+		}
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *passthroughListener) Close() error {
+	err := net.ErrClosed
+	l.closeOnce.Do(func() {
+		err = l.Listener.Close()
+		close(l.done)
+	})
+	return err
+}
+
+// Pipe the client and upstream connections until both sides are closed
+func forward(client net.Conn, upstream net.Conn, route *Route) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	pipe := func(dst net.Conn, src net.Conn, accumulator *int64) {
+		io.Copy(&utils.AccumulatedWriter{Writer: dst, Accumulator: accumulator}, src)
+		//Half close to let the other direction finish
+		if closeWriter, ok := dst.(interface{ CloseWrite() error }); ok {
+			closeWriter.CloseWrite()
+		} else {
+			dst.Close()
+		}
+		wg.Done()
+	}
+	go pipe(upstream, client, &route.aTobAccumulatedByteTransfer)
+	go pipe(client, upstream, &route.bToaAccumulatedByteTransfer)
+	wg.Wait()
+	client.Close()
+	upstream.Close()
+}
@@ -0,0 +1,274 @@
+package sniproxy
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"imuslab.com/zoraxy/mod/database"
+)
+
+/*
+	SNI Proxy
+
+	Route TLS connections by the server name in the
+	ClientHello to raw TCP upstreams without decrypting,
+	for services that terminate TLS themselves. Connections
+	without a matching route fall through to the TLS
+	listener of the reverse proxy on the same port
+*/
+
+type Route struct {
+	aTobAccumulatedByteTransfer int64 //Accumulated byte transfer from client to upstream, keep first for 64 bit alignment
+	bToaAccumulatedByteTransfer int64 //Accumulated byte transfer from upstream to client
+
+	UUID     string //A UUIDv4 representing this route
+	Hostname string //Server name to match, exact hostname or wildcard (*.example.com)
+	Upstream string //Upstream address in host:port format
+	Enabled  bool   //If the route is active
+}
+
+// Snapshot of a route with its transfer statistics
+type RouteStatus struct {
+	UUID                 string
+	Hostname             string
+	Upstream             string
+	Enabled              bool
+	AToBTransferredBytes int64 //Bytes sent from client to upstream
+	BToATransferredBytes int64 //Bytes sent from upstream to client
+}
+
+type Options struct {
+	Database             *database.Database
+	DialTimeout          int                 //Timeout for connecting to upstream in sec, default 10
+	AccessControlHandler func(net.Addr) bool //Check if the remote address is allowed
+}
+
+type Manager struct {
+	Options *Options
+	Routes  []*Route
+
+	routesMutex sync.RWMutex
+}
+
+func NewSNIProxy(options *Options) *Manager {
+	options.Database.NewTable("sniproxy")
+
+	//Load routes from db
+	previousRoutes := []*Route{}
+	if options.Database.KeyExists("sniproxy", "routes") {
+		options.Database.Read("sniproxy", "routes", &previousRoutes)
+	}
+
+	if options.DialTimeout <= 0 {
+		options.DialTimeout = 10
+	}
+
+	//Check if the AccessControlHandler is empty. If yes, set it to always allow access
+	if options.AccessControlHandler == nil {
+		options.AccessControlHandler = func(addr net.Addr) bool {
+			return true
+		}
+	}
+
+	return &Manager{
+		Options: options,
+		Routes:  previousRoutes,
+	}
+}
+
+// Normalize a hostname or wildcard for matching
+func normalizeHostname(hostname string) string {
+	return strings.ToLower(strings.TrimSuffix(strings.TrimSpace(hostname), "."))
+}
+
+// Validate the hostname and upstream of a route
+func validateRoute(hostname string, upstream string) error {
+	if hostname == "" || strings.ContainsAny(hostname, " /:") {
+		return errors.New("invalid hostname")
+	}
+	if strings.Contains(hostname, "*") && (!strings.HasPrefix(hostname, "*.") || strings.Count(hostname, "*") > 1) {
+		return errors.New("wildcard hostname must be in *.example.com format")
+	}
+	host, port, err := net.SplitHostPort(upstream)
+	if err != nil || host == "" || port == "" {
+		return errors.New("upstream must be in host:port format")
+	}
+	return nil
+}
+
+// Add a new passthrough route, return the route UUID
+func (m *Manager) AddRoute(hostname string, upstream string) (string, error) {
+	hostname = normalizeHostname(hostname)
+	err := validateRoute(hostname, upstream)
+	if err != nil {
+		return "", err
+	}
+
+	m.routesMutex.Lock()
+	defer m.routesMutex.Unlock()
+	for _, route := range m.Routes {
+		if route.Hostname == hostname {
+			return "", errors.New("route for " + hostname + " already exists")
+		}
+	}
+	route := Route{
+		UUID:     uuid.New().String(),
+		Hostname: hostname,
+		Upstream: upstream,
+		Enabled:  true,
+	}
+	m.Routes = append(m.Routes, &route)
+	m.saveRoutes()
+	return route.UUID, nil
+}
+
+// Get a route by UUID
+func (m *Manager) GetRouteByUUID(routeUUID string) (*Route, error) {
+	m.routesMutex.RLock()
+	defer m.routesMutex.RUnlock()
+	for _, route := range m.Routes {
+		if route.UUID == routeUUID {
+			return route, nil
+		}
+	}
+	return nil, errors.New("route not found")
+}
+
+// Edit a route by UUID, leave empty for unchange fields
+func (m *Manager) EditRoute(routeUUID string, newHostname string, newUpstream string, enabled bool) error {
+	m.routesMutex.Lock()
+	defer m.routesMutex.Unlock()
+	var target *Route
+	for _, route := range m.Routes {
+		if route.UUID == routeUUID {
+			target = route
+		}
+	}
+	if target == nil {
+		return errors.New("route not found")
+	}
+
+	hostname := target.Hostname
+	if newHostname != "" {
+		hostname = normalizeHostname(newHostname)
+	}
+	upstream := target.Upstream
+	if newUpstream != "" {
+		upstream = newUpstream
+	}
+	err := validateRoute(hostname, upstream)
+	if err != nil {
+		return err
+	}
+	for _, route := range m.Routes {
+		if route != target && route.Hostname == hostname {
+			return errors.New("route for " + hostname + " already exists")
+		}
+	}
+
+	target.Hostname = hostname
+	target.Upstream = upstream
+	target.Enabled = enabled
+	m.saveRoutes()
+	return nil
+}
+
+// Remove a route by UUID
+func (m *Manager) RemoveRoute(routeUUID string) error {
+	m.routesMutex.Lock()
+	defer m.routesMutex.Unlock()
+	for i, route := range m.Routes {
+		if route.UUID == routeUUID {
+			m.Routes = append(m.Routes[:i], m.Routes[i+1:]...)
+			m.saveRoutes()
+			return nil
+		}
+	}
+	return errors.New("route not found")
+}
+
+// List the routes with their transfer statistics
+func (m *Manager) ListRoutes() []*RouteStatus {
+	m.routesMutex.RLock()
+	defer m.routesMutex.RUnlock()
+	results := []*RouteStatus{}
+	for _, route := range m.Routes {
+		aTob, bToa := route.GetTransferredBytes()
+		results = append(results, &RouteStatus{
+			UUID:                 route.UUID,
+			Hostname:             route.Hostname,
+			Upstream:             route.Upstream,
+			Enabled:              route.Enabled,
+			AToBTransferredBytes: aTob,
+			BToATransferredBytes: bToa,
+		})
+	}
+	return results
+}
+
+// Get the enabled route of the server name, exact hostnames are preferred over wildcards
+func (m *Manager) MatchRoute(serverName string) *Route {
+	route, _ := m.matchRoute(serverName)
+	return route
+}
+
+// Get the matching route and its upstream, which is read under lock as routes can be edited at runtime
+func (m *Manager) matchRoute(serverName string) (*Route, string) {
+	serverName = normalizeHostname(serverName)
+	if serverName == "" {
+		return nil, ""
+	}
+	wildcard := ""
+	if dot := strings.Index(serverName, "."); dot > 0 {
+		wildcard = "*" + serverName[dot:]
+	}
+
+	m.routesMutex.RLock()
+	defer m.routesMutex.RUnlock()
+	var wildcardMatch *Route
+	for _, route := range m.Routes {
+		if !route.Enabled {
+			continue
+		}
+		if route.Hostname == serverName {
+			return route, route.Upstream
+		}
+		if route.Hostname == wildcard {
+			wildcardMatch = route
+		}
+	}
+	if wildcardMatch == nil {
+		return nil, ""
+	}
+	return wildcardMatch, wildcardMatch.Upstream
+}
+
+// Check if there are any enabled routes
+func (m *Manager) hasEnabledRoutes() bool {
+	m.routesMutex.RLock()
+	defer m.routesMutex.RUnlock()
+	for _, route := range m.Routes {
+		if route.Enabled {
+			return true
+		}
+	}
+	return false
+}
+
+// Get the accumulated bytes transfered from client to upstream and from upstream to client
+func (r *Route) GetTransferredBytes() (int64, int64) {
+	return atomic.LoadInt64(&r.aTobAccumulatedByteTransfer), atomic.LoadInt64(&r.bToaAccumulatedByteTransfer)
+}
+
+func (m *Manager) saveRoutes() {
+	m.Options.Database.Write("sniproxy", "routes", m.Routes)
+}
+
+func (m *Manager) dialTimeout() time.Duration {
+	return time.Duration(m.Options.DialTimeout) * time.Second
+}
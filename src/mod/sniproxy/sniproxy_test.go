@@ -0,0 +1,134 @@
+package sniproxy_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"imuslab.com/zoraxy/mod/database"
+	"imuslab.com/zoraxy/mod/sniproxy"
+)
+
+// Create a self signed certificate for the common name
+func testCertificate(t *testing.T, commonName string) tls.Certificate {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// Serve TLS on the listener, reply the common name of the certificate to each connection
+func serveTLS(ln net.Listener, reply string) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			buf := make([]byte, 4)
+			if _, err := io.ReadFull(conn, buf); err == nil {
+				conn.Write([]byte(reply))
+			}
+		}()
+	}
+}
+
+func TestSNIPassthrough(t *testing.T) {
+	//Upstream terminating TLS by itself
+	upstream, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{testCertificate(t, "mail.example.com")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+	go serveTLS(upstream, "upstream")
+
+	db, err := database.NewDatabase(filepath.Join(t.TempDir(), "test.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	manager := sniproxy.NewSNIProxy(&sniproxy.Options{Database: db})
+	if _, err := manager.AddRoute("*.example.com", "no-port"); err == nil {
+		t.Fatal("upstream without port accepted")
+	}
+	routeUUID, err := manager.AddRoute("Mail.Example.com", upstream.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := manager.AddRoute("mail.example.com", upstream.Addr().String()); err == nil {
+		t.Fatal("duplicated hostname accepted")
+	}
+
+	//Shared listener, non matching connections are terminated here
+	rawListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared := tls.NewListener(manager.Listener(rawListener), &tls.Config{Certificates: []tls.Certificate{testCertificate(t, "proxy")}})
+	defer shared.Close()
+	go serveTLS(shared, "proxy")
+
+	dial := func(serverName string) (string, string) {
+		conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp", rawListener.Addr().String(), &tls.Config{
+			ServerName:         serverName,
+			InsecureSkipVerify: true,
+		})
+		if err != nil {
+			t.Fatalf("dial %s: %v", serverName, err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		conn.Write([]byte("ping"))
+		reply, _ := io.ReadAll(conn)
+		return conn.ConnectionState().PeerCertificates[0].Subject.CommonName, string(reply)
+	}
+
+	if commonName, reply := dial("mail.example.com"); commonName != "mail.example.com" || reply != "upstream" {
+		t.Fatalf("matching SNI not passed through, got certificate %s and reply %q", commonName, reply)
+	}
+	if commonName, reply := dial("www.example.com"); commonName != "proxy" || reply != "proxy" {
+		t.Fatalf("non matching SNI not terminated locally, got certificate %s and reply %q", commonName, reply)
+	}
+	aTob, bToa := manager.MatchRoute("mail.example.com").GetTransferredBytes()
+	if aTob == 0 || bToa == 0 {
+		t.Fatal("passthrough bytes not accounted")
+	}
+
+	//Disabled routes fall through
+	if err := manager.EditRoute(routeUUID, "", "", false); err != nil {
+		t.Fatal(err)
+	}
+	if commonName, _ := dial("mail.example.com"); commonName != "proxy" {
+		t.Fatal("disabled route still passed through")
+	}
+
+	//Wildcard routes
+	if _, err := manager.AddRoute("*.example.com", upstream.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	if commonName, _ := dial("k8s.example.com"); commonName != "mail.example.com" {
+		t.Fatal("wildcard route not passed through")
+	}
+	if manager.MatchRoute("a.b.example.com") != nil {
+		t.Fatal("wildcard matched multiple labels")
+	}
+}
@@ -0,0 +1,235 @@
+package analytic
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"imuslab.com/zoraxy/mod/statistic"
+	"imuslab.com/zoraxy/mod/utils"
+)
+
+/*
+	Endpoint.go
+
+	Load and export the statistic of a single proxy endpoint
+*/
+
+// Load the daily summary of the given date key, today summary is loaded from memory
+func (d *DataLoader) loadDailySummary(key string) (*statistic.DailySummaryExport, error) {
+	if isTodayDate(key) {
+		return d.StatisticCollector.GetExportSummary(), nil
+	}
+
+	thisStat := statistic.DailySummaryExport{}
+	err := d.Database.Read("stats", key, &thisStat)
+	if err != nil {
+		return nil, err
+	}
+	return &thisStat, nil
+}
+
+// GetEndpointSummaryInRange return the statistics of an endpoint within the time frame. The second array is the key (dates) of the statistic
+func (d *DataLoader) GetEndpointSummaryInRange(endpoint, start, end string) ([]*statistic.EndpointSummaryExport, []string, error) {
+	endpointSummaries := []*statistic.EndpointSummaryExport{}
+	collectedDates := []string{}
+	keys, err := generateDateRange(start, end)
+	if err != nil {
+		return endpointSummaries, collectedDates, err
+	}
+
+	for _, key := range keys {
+		thisStat, err := d.loadDailySummary(key)
+		if err != nil || thisStat.Endpoints == nil {
+			continue
+		}
+
+		endpointStat, ok := thisStat.Endpoints[endpoint]
+		if !ok {
+			continue
+		}
+		endpointSummaries = append(endpointSummaries, endpointStat)
+		collectedDates = append(collectedDates, key)
+	}
+
+	return endpointSummaries, collectedDates, nil
+}
+
+// List the endpoints that has statistic within the time frame
+func (d *DataLoader) ListEndpointsInRange(start, end string) ([]string, error) {
+	keys, err := generateDateRange(start, end)
+	if err != nil {
+		return []string{}, err
+	}
+
+	endpointSet := map[string]bool{}
+	for _, key := range keys {
+		thisStat, err := d.loadDailySummary(key)
+		if err != nil {
+			continue
+		}
+		for endpoint := range thisStat.Endpoints {
+			endpointSet[endpoint] = true
+		}
+	}
+
+	endpoints := []string{}
+	for endpoint := range endpointSet {
+		endpoints = append(endpoints, endpoint)
+	}
+	sort.Strings(endpoints)
+	return endpoints, nil
+}
+
+func getEndpointFromRequest(r *http.Request) (string, error) {
+	endpoint, err := utils.GetPara(r, "endpoint")
+	if err != nil {
+		return "", errors.New("endpoint cannot be empty")
+	}
+	return endpoint, nil
+}
+
+// List the endpoints with statistic in the given range
+func (d *DataLoader) HandleEndpointList(w http.ResponseWriter, r *http.Request) {
+	start, end, err := d.GetStartAndEndDatesFromRequest(r)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+
+	endpoints, err := d.ListEndpointsInRange(start, end)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+
+	js, _ := json.Marshal(endpoints)
+	utils.SendJSONResponse(w, string(js))
+}
+
+// Load the statistic of an endpoint in the given range
+func (d *DataLoader) HandleLoadEndpointRangeSummary(w http.ResponseWriter, r *http.Request) {
+	endpoint, err := getEndpointFromRequest(r)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+
+	start, end, err := d.GetStartAndEndDatesFromRequest(r)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+
+	endpointSummaries, dates, err := d.GetEndpointSummaryInRange(endpoint, start, end)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+
+	//Merge the summaries into one
+	mergedSummary := &statistic.EndpointSummaryExport{}
+	for _, summary := range endpointSummaries {
+		mergedSummary.Merge(summary)
+	}
+
+	js, _ := json.Marshal(struct {
+		Endpoint string
+		Summary  *statistic.EndpointSummaryExport
+		Records  []*statistic.EndpointSummaryExport
+		Dates    []string
+	}{
+		Endpoint: endpoint,
+		Summary:  mergedSummary,
+		Records:  endpointSummaries,
+		Dates:    dates,
+	})
+
+	utils.SendJSONResponse(w, string(js))
+}
+
+// Handle exporting the statistic of an endpoint in the given range
+func (d *DataLoader) HandleEndpointRangeExport(w http.ResponseWriter, r *http.Request) {
+	endpoint, err := getEndpointFromRequest(r)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+
+	start, end, err := d.GetStartAndEndDatesFromRequest(r)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+
+	endpointSummaries, dates, err := d.GetEndpointSummaryInRange(endpoint, start, end)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+
+	format, err := utils.GetPara(r, "format")
+	if err != nil {
+		format = "json"
+	}
+
+	filename := "analytics_" + sanitizeFilename(endpoint) + "_" + start + "_to_" + end
+	switch format {
+	case "csv":
+		var csvContent strings.Builder
+		writer := csv.NewWriter(&csvContent)
+
+		header := []string{"Date", "Endpoint", "TotalRequest", "ErrorRequest", "ValidRequest", "StatusCodes", "ForwardTypes", "RequestOrigin", "RequestClientIp", "RequestURL"}
+		for _, percentile := range statistic.LatencyPercentiles {
+			header = append(header, "LatencyP"+strconv.FormatFloat(percentile, 'f', -1, 64)+"Ms")
+		}
+		writer.Write(header)
+
+		for i, item := range endpointSummaries {
+			row := []string{
+				dates[i],
+				endpoint,
+				strconv.FormatInt(item.TotalRequest, 10),
+				strconv.FormatInt(item.ErrorRequest, 10),
+				strconv.FormatInt(item.ValidRequest, 10),
+				strings.Join(mapToCounterSlice(item.StatusCodes), ","),
+				strings.Join(mapToCounterSlice(item.ForwardTypes), ","),
+				strings.Join(mapToCounterSlice(item.RequestOrigin), ","),
+				strings.Join(mapToStringSlice(item.RequestClientIp), ","),
+				strings.Join(mapToStringSlice(item.RequestURL), ","),
+			}
+			for _, percentile := range statistic.LatencyPercentiles {
+				row = append(row, strconv.FormatFloat(statistic.EstimateLatencyPercentile(item.LatencyBuckets, percentile), 'f', 2, 64))
+			}
+			writer.Write(row)
+		}
+
+		writer.Flush()
+		if err := writer.Error(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", "attachment; filename="+filename+".csv")
+		w.Write([]byte(csvContent.String()))
+	case "json":
+		js, _ := json.MarshalIndent(struct {
+			Endpoint string
+			Stats    []*statistic.EndpointSummaryExport
+			Dates    []string
+		}{
+			Endpoint: endpoint,
+			Stats:    endpointSummaries,
+			Dates:    dates,
+		}, "", " ")
+		w.Header().Set("Content-Disposition", "attachment; filename="+filename+".json")
+		utils.SendJSONResponse(w, string(js))
+	default:
+		utils.SendErrorResponse(w, "Unsupported export format")
+	}
+}
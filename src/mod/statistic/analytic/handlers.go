@@ -77,7 +77,7 @@ func (d *DataLoader) HandleLoadTargetRangeSummary(w http.ResponseWriter, r *http
 	}
 
 	//Merge the summaries into one
-	mergedSummary := mergeDailySummaryExports(dailySummaries)
+	mergedSummary := statistic.MergeDailySummaryExports(dailySummaries)
 
 	js, _ := json.Marshal(struct {
 		Summary *statistic.DailySummaryExport
@@ -90,6 +90,37 @@ func (d *DataLoader) HandleLoadTargetRangeSummary(w http.ResponseWriter, r *http
 	utils.SendJSONResponse(w, string(js))
 }
 
+// List the months that has rolled up monthly summary
+func (d *DataLoader) HandleMonthlySummaryList(w http.ResponseWriter, r *http.Request) {
+	months, err := d.StatisticCollector.ListMonthlySummaries()
+	if err != nil {
+		utils.SendErrorResponse(w, "unable to load data from database")
+		return
+	}
+
+	js, _ := json.Marshal(months)
+	utils.SendJSONResponse(w, string(js))
+}
+
+// Load the rolled up summary of a month, e.g. id=2024_01
+func (d *DataLoader) HandleLoadTargetMonthSummary(w http.ResponseWriter, r *http.Request) {
+	month, err := utils.GetPara(r, "id")
+	if err != nil {
+		utils.SendErrorResponse(w, "id cannot be empty")
+		return
+	}
+	month = strings.ReplaceAll(month, "-", "_")
+
+	monthlySummary, err := d.StatisticCollector.LoadSummaryOfMonth(month)
+	if err != nil {
+		utils.SendErrorResponse(w, "target month data not found")
+		return
+	}
+
+	js, _ := json.Marshal(monthlySummary)
+	utils.SendJSONResponse(w, string(js))
+}
+
 // Handle exporting of a given range statistics
 func (d *DataLoader) HandleRangeExport(w http.ResponseWriter, r *http.Request) {
 	start, end, err := d.GetStartAndEndDatesFromRequest(r)
@@ -118,7 +149,7 @@ func (d *DataLoader) HandleRangeExport(w http.ResponseWriter, r *http.Request) {
 		writer := csv.NewWriter(&csvContent)
 
 		// Write the header row
-		header := []string{"Date", "TotalRequest", "ErrorRequest", "ValidRequest", "ForwardTypes", "RequestOrigin", "RequestClientIp", "Referer", "UserAgent", "RequestURL"}
+		header := []string{"Date", "TotalRequest", "ErrorRequest", "ValidRequest", "ForwardTypes", "RequestOrigin", "RequestClientIp", "Referer", "UserAgent", "RequestURL", "WafRuleHits", "RequestASN"}
 		err := writer.Write(header)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -139,6 +170,8 @@ func (d *DataLoader) HandleRangeExport(w http.ResponseWriter, r *http.Request) {
 				strings.Join(mapToStringSlice(item.Referer), ","),
 				strings.Join(mapToStringSlice(item.UserAgent), ","),
 				strings.Join(mapToStringSlice(item.RequestURL), ","),
+				strings.Join(mapToStringSlice(item.WafRuleHits), ","),
+				strings.Join(mapToStringSlice(item.RequestASN), ","),
 			}
 			err = writer.Write(row)
 			if err != nil {
@@ -0,0 +1,320 @@
+package analytic
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"imuslab.com/zoraxy/mod/statistic"
+	"imuslab.com/zoraxy/mod/utils"
+)
+
+/*
+	Query.go
+
+	Query the time series statistic with filters and grouping
+	for charting, e.g.
+	/api/analytic/query?from=2024-01-01&to=2024-01-07&endpoint=a.example.com&groupby=status&step=86400
+*/
+
+const (
+	Dimension_Endpoint    = "endpoint"
+	Dimension_StatusClass = "status"
+	Dimension_Country     = "country"
+	Dimension_ForwardType = "forwardtype"
+)
+
+// Max time range of a single query
+const maxQueryRange = 366 * 24 * time.Hour
+
+type TimeSeriesQuery struct {
+	From    time.Time
+	To      time.Time
+	Step    time.Duration       //Time resolution of the results, 0 to aggregate the whole range into one row
+	Filters map[string][]string //Dimension: accepted values, all values are accepted if not set
+	GroupBy []string            //Dimensions to group the results by
+}
+
+type TimeSeriesQueryRow struct {
+	Time          int64             //Unix timestamp of the start of this row
+	Group         map[string]string //Values of the grouped dimensions
+	Requests      int64
+	ErrorRequests int64
+	AvgLatencyMs  float64
+
+	latencySumMs float64
+}
+
+func isValidDimension(dimension string) bool {
+	return dimension == Dimension_Endpoint || dimension == Dimension_StatusClass || dimension == Dimension_Country || dimension == Dimension_ForwardType
+}
+
+func getDimensionValue(point *statistic.TimeSeriesPoint, dimension string) string {
+	switch dimension {
+	case Dimension_Endpoint:
+		return point.Endpoint
+	case Dimension_StatusClass:
+		return point.StatusClass
+	case Dimension_Country:
+		return point.Country
+	case Dimension_ForwardType:
+		return point.ForwardType
+	}
+	return ""
+}
+
+func (q *TimeSeriesQuery) matchFilters(point *statistic.TimeSeriesPoint) bool {
+	for dimension, acceptedValues := range q.Filters {
+		value := getDimensionValue(point, dimension)
+		matched := false
+		for _, acceptedValue := range acceptedValues {
+			if strings.EqualFold(value, acceptedValue) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// Query the time series with the given filters and grouping
+func (d *DataLoader) QueryTimeSeries(query *TimeSeriesQuery) ([]*TimeSeriesQueryRow, error) {
+	if query.To.Before(query.From) {
+		return nil, errors.New("end time is before start time")
+	}
+	if query.To.Sub(query.From) > maxQueryRange {
+		return nil, errors.New("time range cannot exceed 366 days")
+	}
+	for _, dimension := range query.GroupBy {
+		if !isValidDimension(dimension) {
+			return nil, errors.New("invalid group by dimension: " + dimension)
+		}
+	}
+	for dimension := range query.Filters {
+		if !isValidDimension(dimension) {
+			return nil, errors.New("invalid filter dimension: " + dimension)
+		}
+	}
+
+	buckets := d.StatisticCollector.LoadTimeSeries(query.From, query.To)
+	rows := map[string]*TimeSeriesQueryRow{}
+	for _, bucket := range buckets {
+		rowTime := query.From.Unix()
+		if query.Step > 0 {
+			rowTime = time.Unix(bucket.Start, 0).Truncate(query.Step).Unix()
+		}
+
+		for _, point := range bucket.Points {
+			if !query.matchFilters(point) {
+				continue
+			}
+
+			group := map[string]string{}
+			rowKey := strconv.FormatInt(rowTime, 10)
+			for _, dimension := range query.GroupBy {
+				value := getDimensionValue(point, dimension)
+				group[dimension] = value
+				rowKey += "\x00" + value
+			}
+
+			row, ok := rows[rowKey]
+			if !ok {
+				row = &TimeSeriesQueryRow{
+					Time:  rowTime,
+					Group: group,
+				}
+				rows[rowKey] = row
+			}
+			row.Requests += point.Requests
+			row.ErrorRequests += point.ErrorRequests
+			row.latencySumMs += point.LatencySumMs
+		}
+	}
+
+	results := make([]*TimeSeriesQueryRow, 0, len(rows))
+	for _, row := range rows {
+		if row.Requests > 0 {
+			row.AvgLatencyMs = row.latencySumMs / float64(row.Requests)
+		}
+		results = append(results, row)
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Time != results[j].Time {
+			return results[i].Time < results[j].Time
+		}
+		for _, dimension := range query.GroupBy {
+			if results[i].Group[dimension] != results[j].Group[dimension] {
+				return results[i].Group[dimension] < results[j].Group[dimension]
+			}
+		}
+		return false
+	})
+
+	return results, nil
+}
+
+// Parse the time given in unix timestamp, RFC3339 or date format. If
+// endOfDay is set, date only values are moved to the end of that day
+func parseQueryTime(value string, endOfDay bool) (time.Time, error) {
+	if unix, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(unix, 0), nil
+	}
+
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+
+	value = strings.ReplaceAll(value, "-", "_")
+	t, err := time.ParseInLocation("2006_01_02", value, time.Local)
+	if err != nil {
+		return time.Time{}, errors.New("invalid time format: " + value)
+	}
+	if endOfDay {
+		t = t.AddDate(0, 0, 1).Add(-time.Second)
+	}
+	return t, nil
+}
+
+func splitQueryValues(value string) []string {
+	results := []string{}
+	for _, v := range strings.Split(value, ",") {
+		v = strings.TrimSpace(v)
+		if v != "" {
+			results = append(results, v)
+		}
+	}
+	return results
+}
+
+// Parse the time series query from request parameters
+func (d *DataLoader) GetTimeSeriesQueryFromRequest(r *http.Request) (*TimeSeriesQuery, error) {
+	query := TimeSeriesQuery{
+		To:      time.Now(),
+		Step:    d.StatisticCollector.Option.TimeSeriesInterval,
+		Filters: map[string][]string{},
+		GroupBy: []string{},
+	}
+
+	to, err := utils.GetPara(r, "to")
+	if err == nil {
+		query.To, err = parseQueryTime(to, true)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	query.From = query.To.Add(-24 * time.Hour)
+	from, err := utils.GetPara(r, "from")
+	if err == nil {
+		query.From, err = parseQueryTime(from, false)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	step, err := utils.GetPara(r, "step")
+	if err == nil {
+		stepSeconds, err := strconv.Atoi(step)
+		if err != nil || stepSeconds < 0 {
+			return nil, errors.New("invalid step")
+		}
+		query.Step = time.Duration(stepSeconds) * time.Second
+		if query.Step > 0 && query.Step < d.StatisticCollector.Option.TimeSeriesInterval {
+			//Cannot be finer than the bucket interval
+			query.Step = d.StatisticCollector.Option.TimeSeriesInterval
+		}
+	}
+
+	for _, dimension := range []string{Dimension_Endpoint, Dimension_StatusClass, Dimension_Country, Dimension_ForwardType} {
+		value, err := utils.GetPara(r, dimension)
+		if err == nil && len(splitQueryValues(value)) > 0 {
+			query.Filters[dimension] = splitQueryValues(value)
+		}
+	}
+
+	groupBy, err := utils.GetPara(r, "groupby")
+	if err == nil {
+		query.GroupBy = splitQueryValues(groupBy)
+	}
+
+	return &query, nil
+}
+
+// Handle time series query, results are returned in JSON or CSV format
+func (d *DataLoader) HandleTimeSeriesQuery(w http.ResponseWriter, r *http.Request) {
+	query, err := d.GetTimeSeriesQueryFromRequest(r)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+
+	rows, err := d.QueryTimeSeries(query)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+
+	format, err := utils.GetPara(r, "format")
+	if err != nil {
+		format = "json"
+	}
+
+	switch format {
+	case "csv":
+		var csvContent strings.Builder
+		writer := csv.NewWriter(&csvContent)
+
+		header := []string{"Time"}
+		header = append(header, query.GroupBy...)
+		header = append(header, "Requests", "ErrorRequests", "AvgLatencyMs")
+		writer.Write(header)
+
+		for _, row := range rows {
+			record := []string{time.Unix(row.Time, 0).Format(time.RFC3339)}
+			for _, dimension := range query.GroupBy {
+				record = append(record, row.Group[dimension])
+			}
+			record = append(record,
+				strconv.FormatInt(row.Requests, 10),
+				strconv.FormatInt(row.ErrorRequests, 10),
+				strconv.FormatFloat(row.AvgLatencyMs, 'f', 2, 64),
+			)
+			writer.Write(record)
+		}
+
+		writer.Flush()
+		if err := writer.Error(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/csv")
+		w.Write([]byte(csvContent.String()))
+	case "json":
+		js, _ := json.Marshal(struct {
+			From    int64
+			To      int64
+			Step    int64
+			GroupBy []string
+			Rows    []*TimeSeriesQueryRow
+		}{
+			From:    query.From.Unix(),
+			To:      query.To.Unix(),
+			Step:    int64(query.Step.Seconds()),
+			GroupBy: query.GroupBy,
+			Rows:    rows,
+		})
+		utils.SendJSONResponse(w, string(js))
+	default:
+		utils.SendErrorResponse(w, "Unsupported export format")
+	}
+}
@@ -0,0 +1,93 @@
+package analytic_test
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"imuslab.com/zoraxy/mod/database"
+	"imuslab.com/zoraxy/mod/statistic"
+	"imuslab.com/zoraxy/mod/statistic/analytic"
+)
+
+func TestTimeSeriesQuery(t *testing.T) {
+	db, err := database.NewDatabase(filepath.Join(t.TempDir(), "test.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	collector, err := statistic.NewStatisticCollector(statistic.CollectorOption{
+		Database: db,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer collector.Close()
+
+	//Two hourly buckets in the past
+	firstHour := time.Now().Add(-3 * time.Hour).Truncate(time.Hour)
+	for i, start := range []time.Time{firstHour, firstHour.Add(time.Hour)} {
+		db.Write("stats_timeseries", start.UTC().Format("2006_01_02_15_04"), statistic.TimeSeriesBucket{
+			Start:    start.Unix(),
+			Interval: 3600,
+			Points: []*statistic.TimeSeriesPoint{
+				{
+					TimeSeriesDimensions: statistic.TimeSeriesDimensions{Endpoint: "a.example.com", StatusClass: "2xx", Country: "jp", ForwardType: "subdomain-http"},
+					Requests:             int64(10 * (i + 1)),
+					LatencySumMs:         float64(100 * (i + 1)),
+				},
+				{
+					TimeSeriesDimensions: statistic.TimeSeriesDimensions{Endpoint: "a.example.com", StatusClass: "5xx", Country: "us", ForwardType: "subdomain-http"},
+					Requests:             2,
+					ErrorRequests:        2,
+				},
+				{
+					TimeSeriesDimensions: statistic.TimeSeriesDimensions{Endpoint: "b.example.com", StatusClass: "2xx", Country: "jp", ForwardType: "subdomain-http"},
+					Requests:             5,
+				},
+			},
+		})
+	}
+
+	loader := analytic.NewDataLoader(db, collector)
+	rows, err := loader.QueryTimeSeries(&analytic.TimeSeriesQuery{
+		From:    firstHour.Add(-time.Minute),
+		To:      time.Now(),
+		Filters: map[string][]string{analytic.Dimension_Endpoint: {"a.example.com"}},
+		GroupBy: []string{analytic.Dimension_StatusClass},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rows) != 2 || rows[0].Group["status"] != "2xx" || rows[0].Requests != 30 || rows[1].ErrorRequests != 4 {
+		t.Fatalf("unexpected rows for whole range query: %+v", rows)
+	}
+	if rows[0].AvgLatencyMs != 10 {
+		t.Errorf("expected average latency 10ms, got %f", rows[0].AvgLatencyMs)
+	}
+
+	rows, err = loader.QueryTimeSeries(&analytic.TimeSeriesQuery{
+		From:    firstHour,
+		To:      time.Now(),
+		Step:    time.Hour,
+		Filters: map[string][]string{analytic.Dimension_Country: {"JP"}},
+		GroupBy: []string{analytic.Dimension_Endpoint},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 4 || rows[0].Time != firstHour.Unix() || rows[0].Group["endpoint"] != "a.example.com" || rows[2].Requests != 20 {
+		t.Fatalf("unexpected rows for hourly query: %+v", rows)
+	}
+
+	_, err = loader.QueryTimeSeries(&analytic.TimeSeriesQuery{
+		From:    firstHour,
+		To:      time.Now(),
+		GroupBy: []string{"useragent"},
+	})
+	if err == nil {
+		t.Errorf("expected error for invalid dimension")
+	}
+}
@@ -2,9 +2,10 @@ package analytic
 
 import (
 	"fmt"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
-
-	"imuslab.com/zoraxy/mod/statistic"
 )
 
 // Generate all the record keys from a given start and end dates
@@ -28,49 +29,6 @@ func generateDateRange(startDate, endDate string) ([]string, error) {
 	return dateRange, nil
 }
 
-func mergeDailySummaryExports(exports []*statistic.DailySummaryExport) *statistic.DailySummaryExport {
-	mergedExport := &statistic.DailySummaryExport{
-		ForwardTypes:    make(map[string]int),
-		RequestOrigin:   make(map[string]int),
-		RequestClientIp: make(map[string]int),
-		Referer:         make(map[string]int),
-		UserAgent:       make(map[string]int),
-		RequestURL:      make(map[string]int),
-	}
-
-	for _, export := range exports {
-		mergedExport.TotalRequest += export.TotalRequest
-		mergedExport.ErrorRequest += export.ErrorRequest
-		mergedExport.ValidRequest += export.ValidRequest
-
-		for key, value := range export.ForwardTypes {
-			mergedExport.ForwardTypes[key] += value
-		}
-
-		for key, value := range export.RequestOrigin {
-			mergedExport.RequestOrigin[key] += value
-		}
-
-		for key, value := range export.RequestClientIp {
-			mergedExport.RequestClientIp[key] += value
-		}
-
-		for key, value := range export.Referer {
-			mergedExport.Referer[key] += value
-		}
-
-		for key, value := range export.UserAgent {
-			mergedExport.UserAgent[key] += value
-		}
-
-		for key, value := range export.RequestURL {
-			mergedExport.RequestURL[key] += value
-		}
-	}
-
-	return mergedExport
-}
-
 func mapToStringSlice(m map[string]int) []string {
 	slice := make([]string, 0, len(m))
 	for k := range m {
@@ -79,6 +37,26 @@ func mapToStringSlice(m map[string]int) []string {
 	return slice
 }
 
+// Convert a counter map into key:value strings, sorted by key
+func mapToCounterSlice(m map[string]int) []string {
+	slice := make([]string, 0, len(m))
+	for k, v := range m {
+		slice = append(slice, k+":"+strconv.Itoa(v))
+	}
+	sort.Strings(slice)
+	return slice
+}
+
+// Replace the characters that are not safe in filename, e.g. / in vdir endpoints
+func sanitizeFilename(name string) string {
+	return strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '.' || r == '-' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
 func isTodayDate(dateStr string) bool {
 	today := time.Now().Local().Format("2006-01-02")
 	inputDate, err := time.Parse("2006-01-02", dateStr)
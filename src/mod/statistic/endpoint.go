@@ -0,0 +1,283 @@
+package statistic
+
+import (
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/*
+	Endpoint.go
+
+	Per proxy endpoint summary of the day, so the traffic of a
+	single host or virtual directory can be analyzed separately
+*/
+
+// Upper bounds of the latency histogram buckets in milliseconds. The last
+// bucket of the histogram counts the requests slower than the largest bound
+var LatencyBucketBounds = []float64{1, 2, 5, 10, 20, 50, 100, 200, 300, 500, 750, 1000, 2000, 5000, 10000, 30000, 60000}
+
+// Latency percentiles included in the exported endpoint summary
+var LatencyPercentiles = []float64{50, 90, 95, 99}
+
+// HyperLogLog precision of the unique visitor counters, the error
+// rate is about 0.8% for the daily summary and 1.6% for endpoints
+const (
+	uniqueVisitorPrecision         = 14
+	endpointUniqueVisitorPrecision = 12
+)
+
+type EndpointSummary struct {
+	TotalRequest    int64
+	ErrorRequest    int64
+	ValidRequest    int64
+	StatusCodes     map[string]int //Map that hold [status code]: counter
+	ForwardTypes    map[string]int //Map that hold the forward types
+	RequestOrigin   map[string]int //Map that hold [country ISO code]: visitor counter
+	RequestClientIp *TopK          //Top request IPs and their request counts
+	RequestURL      *TopK          //Top request URLs of the request object
+	UniqueVisitors  *HyperLogLog   //Estimated unique request IPs
+	LatencyBuckets  []int64        //Request counts of each latency bucket, see LatencyBucketBounds
+	mutex           sync.Mutex
+}
+
+type EndpointSummaryExport struct {
+	TotalRequest       int64
+	ErrorRequest       int64
+	ValidRequest       int64
+	StatusCodes        map[string]int
+	ForwardTypes       map[string]int
+	RequestOrigin      map[string]int
+	RequestClientIp    map[string]int
+	RequestURL         map[string]int
+	LatencyBuckets     []int64
+	LatencyPercentiles map[string]float64 //Estimated latency percentiles in milliseconds, e.g. p99
+
+	UniqueVisitors         int64
+	UniqueVisitorRegisters []byte
+}
+
+func newEndpointSummary(topKSize int) *EndpointSummary {
+	return &EndpointSummary{
+		StatusCodes:     map[string]int{},
+		ForwardTypes:    map[string]int{},
+		RequestOrigin:   map[string]int{},
+		RequestClientIp: NewTopK(topKSize),
+		RequestURL:      NewTopK(topKSize),
+		UniqueVisitors:  NewHyperLogLog(endpointUniqueVisitorPrecision),
+		LatencyBuckets:  make([]int64, len(LatencyBucketBounds)+1),
+	}
+}
+
+// Get the summary of an endpoint, create one if not exists
+func (d *DailySummary) getEndpointSummary(endpoint string) *EndpointSummary {
+	summary, ok := d.Endpoints.Load(endpoint)
+	if !ok {
+		summary, _ = d.Endpoints.LoadOrStore(endpoint, newEndpointSummary(d.topKSize))
+	}
+	return summary.(*EndpointSummary)
+}
+
+// Record a request to the summary of its endpoint
+func (s *EndpointSummary) record(ri *RequestInfo) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.TotalRequest++
+	if ri.Succ {
+		s.ValidRequest++
+	} else {
+		s.ErrorRequest++
+	}
+
+	s.StatusCodes[strconv.Itoa(ri.StatusCode)]++
+	s.ForwardTypes[ri.ForwardType]++
+	s.RequestOrigin[strings.ToLower(ri.RequestOriginalCountryISOCode)]++
+	s.RequestClientIp.Add(ri.IpAddr, 1)
+	s.UniqueVisitors.Add(ri.IpAddr)
+
+	latencyMs := float64(ri.Latency.Microseconds()) / 1000
+	s.LatencyBuckets[sort.SearchFloat64s(LatencyBucketBounds, latencyMs)]++
+
+	ext := filepath.Ext(ri.RequestURL)
+	if ext == "" || isWebPageExtension(ext) {
+		s.RequestURL.Add(ri.RequestURL, 1)
+	}
+}
+
+func (s *EndpointSummary) toExport() *EndpointSummaryExport {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	export := EndpointSummaryExport{
+		TotalRequest:    s.TotalRequest,
+		ErrorRequest:    s.ErrorRequest,
+		ValidRequest:    s.ValidRequest,
+		StatusCodes:     copyCounterMap(s.StatusCodes),
+		ForwardTypes:    copyCounterMap(s.ForwardTypes),
+		RequestOrigin:   copyCounterMap(s.RequestOrigin),
+		RequestClientIp: s.RequestClientIp.ToMap(),
+		RequestURL:      s.RequestURL.ToMap(),
+		LatencyBuckets:  append([]int64{}, s.LatencyBuckets...),
+
+		UniqueVisitors:         s.UniqueVisitors.Count(),
+		UniqueVisitorRegisters: s.UniqueVisitors.Registers(),
+	}
+	export.UpdateLatencyPercentiles()
+	return &export
+}
+
+func endpointSummaryFromExport(export *EndpointSummaryExport, topKSize int) *EndpointSummary {
+	summary := newEndpointSummary(topKSize)
+	summary.TotalRequest = export.TotalRequest
+	summary.ErrorRequest = export.ErrorRequest
+	summary.ValidRequest = export.ValidRequest
+	mergeCounterMap(summary.StatusCodes, export.StatusCodes)
+	mergeCounterMap(summary.ForwardTypes, export.ForwardTypes)
+	mergeCounterMap(summary.RequestOrigin, export.RequestOrigin)
+	summary.RequestClientIp.AddAll(export.RequestClientIp)
+	summary.RequestURL.AddAll(export.RequestURL)
+	if hll, err := HyperLogLogFromRegisters(export.UniqueVisitorRegisters); err == nil {
+		summary.UniqueVisitors = hll
+	}
+	for i := 0; i < len(export.LatencyBuckets) && i < len(summary.LatencyBuckets); i++ {
+		summary.LatencyBuckets[i] = export.LatencyBuckets[i]
+	}
+	return summary
+}
+
+// Merge another endpoint summary export into this one
+func (e *EndpointSummaryExport) Merge(other *EndpointSummaryExport) {
+	e.TotalRequest += other.TotalRequest
+	e.ErrorRequest += other.ErrorRequest
+	e.ValidRequest += other.ValidRequest
+	if e.StatusCodes == nil {
+		e.StatusCodes = map[string]int{}
+	}
+	if e.ForwardTypes == nil {
+		e.ForwardTypes = map[string]int{}
+	}
+	if e.RequestOrigin == nil {
+		e.RequestOrigin = map[string]int{}
+	}
+	if e.RequestClientIp == nil {
+		e.RequestClientIp = map[string]int{}
+	}
+	if e.RequestURL == nil {
+		e.RequestURL = map[string]int{}
+	}
+	mergeCounterMap(e.StatusCodes, other.StatusCodes)
+	mergeCounterMap(e.ForwardTypes, other.ForwardTypes)
+	mergeCounterMap(e.RequestOrigin, other.RequestOrigin)
+	mergeCounterMap(e.RequestClientIp, other.RequestClientIp)
+	mergeCounterMap(e.RequestURL, other.RequestURL)
+
+	if len(e.LatencyBuckets) != len(LatencyBucketBounds)+1 {
+		e.LatencyBuckets = append(e.LatencyBuckets, make([]int64, len(LatencyBucketBounds)+1-len(e.LatencyBuckets))...)
+	}
+	for i := 0; i < len(other.LatencyBuckets) && i < len(e.LatencyBuckets); i++ {
+		e.LatencyBuckets[i] += other.LatencyBuckets[i]
+	}
+	e.UpdateLatencyPercentiles()
+
+	e.UniqueVisitorRegisters, e.UniqueVisitors = mergeUniqueVisitors(e.UniqueVisitorRegisters, other.UniqueVisitorRegisters, e.UniqueVisitors+other.UniqueVisitors)
+}
+
+// Truncate the counter maps to keep only the top n keys
+func (e *EndpointSummaryExport) Truncate(n int) {
+	e.RequestClientIp = TruncateCounterMap(e.RequestClientIp, n)
+	e.RequestURL = TruncateCounterMap(e.RequestURL, n)
+}
+
+// Estimate the latency percentiles from the latency histogram
+func (e *EndpointSummaryExport) UpdateLatencyPercentiles() {
+	e.LatencyPercentiles = map[string]float64{}
+	for _, percentile := range LatencyPercentiles {
+		key := "p" + strconv.FormatFloat(percentile, 'f', -1, 64)
+		e.LatencyPercentiles[key] = EstimateLatencyPercentile(e.LatencyBuckets, percentile)
+	}
+}
+
+// Estimate the latency in milliseconds at the given percentile (0 - 100) by
+// linear interpolation within the bucket the percentile falls in
+func EstimateLatencyPercentile(buckets []int64, percentile float64) float64 {
+	total := int64(0)
+	for _, count := range buckets {
+		total += count
+	}
+	if total == 0 {
+		return 0
+	}
+
+	rank := percentile / 100 * float64(total)
+	cumulative := int64(0)
+	for i, count := range buckets {
+		if count == 0 {
+			continue
+		}
+		if float64(cumulative+count) >= rank {
+			if i >= len(LatencyBucketBounds) {
+				//Slower than the largest bound, no upper limit to interpolate with
+				return LatencyBucketBounds[len(LatencyBucketBounds)-1]
+			}
+			lowerBound := 0.0
+			if i > 0 {
+				lowerBound = LatencyBucketBounds[i-1]
+			}
+			upperBound := LatencyBucketBounds[i]
+			return lowerBound + (upperBound-lowerBound)*(rank-float64(cumulative))/float64(count)
+		}
+		cumulative += count
+	}
+
+	return LatencyBucketBounds[len(LatencyBucketBounds)-1]
+}
+
+// Merge the HyperLogLog registers of two summaries and return the merged registers
+// with its estimated count. If the registers cannot be merged, e.g. old records
+// without registers, fallback is returned as the count
+func mergeUniqueVisitors(a []byte, b []byte, fallback int64) ([]byte, int64) {
+	if len(a) == 0 && len(b) == 0 {
+		return nil, fallback
+	}
+
+	if len(a) == 0 {
+		a, b = b, a
+	}
+	merged, err := HyperLogLogFromRegisters(a)
+	if err != nil {
+		return nil, fallback
+	}
+	if len(b) > 0 {
+		other, err := HyperLogLogFromRegisters(b)
+		if err != nil || merged.Merge(other) != nil {
+			return nil, fallback
+		}
+	}
+	return merged.Registers(), merged.Count()
+}
+
+func copyCounterMap(source map[string]int) map[string]int {
+	result := make(map[string]int, len(source))
+	for key, value := range source {
+		result[key] = value
+	}
+	return result
+}
+
+func mergeCounterMap(target map[string]int, source map[string]int) {
+	for key, value := range source {
+		target[key] += value
+	}
+}
+
+// Get the summary of the given endpoint of today, return nil if there is no request recorded
+func (c *Collector) GetEndpointExportSummary(endpoint string) *EndpointSummaryExport {
+	summary, ok := c.DailySummary.Endpoints.Load(endpoint)
+	if !ok {
+		return nil
+	}
+	return summary.(*EndpointSummary).toExport()
+}
@@ -0,0 +1,49 @@
+package statistic_test
+
+import (
+	"testing"
+
+	"imuslab.com/zoraxy/mod/statistic"
+)
+
+func TestEndpointSummaryMerge(t *testing.T) {
+	buckets := make([]int64, len(statistic.LatencyBucketBounds)+1)
+	buckets[6] = 90  //50 - 100ms
+	buckets[11] = 10 //750 - 1000ms
+
+	day1 := &statistic.EndpointSummaryExport{
+		TotalRequest:   100,
+		ValidRequest:   100,
+		StatusCodes:    map[string]int{"200": 95, "404": 5},
+		LatencyBuckets: buckets,
+	}
+	day2 := &statistic.EndpointSummaryExport{
+		TotalRequest:   10,
+		ErrorRequest:   10,
+		StatusCodes:    map[string]int{"502": 10},
+		LatencyBuckets: make([]int64, len(statistic.LatencyBucketBounds)+1),
+	}
+	day2.LatencyBuckets[len(day2.LatencyBuckets)-1] = 10
+
+	merged := &statistic.EndpointSummaryExport{}
+	merged.Merge(day1)
+	merged.Merge(day2)
+
+	if merged.TotalRequest != 110 || merged.ErrorRequest != 10 || merged.StatusCodes["502"] != 10 || merged.StatusCodes["200"] != 95 {
+		t.Errorf("unexpected merged summary: %+v", merged)
+	}
+
+	p50 := merged.LatencyPercentiles["p50"]
+	if p50 < 50 || p50 > 100 {
+		t.Errorf("expected p50 within 50 - 100ms, got %f", p50)
+	}
+
+	p99 := merged.LatencyPercentiles["p99"]
+	if p99 != statistic.LatencyBucketBounds[len(statistic.LatencyBucketBounds)-1] {
+		t.Errorf("expected p99 at the largest bound, got %f", p99)
+	}
+
+	if statistic.EstimateLatencyPercentile(make([]int64, 3), 50) != 0 {
+		t.Errorf("expected 0 latency for empty histogram")
+	}
+}
@@ -0,0 +1,142 @@
+package statistic
+
+import (
+	"errors"
+	"hash/fnv"
+	"math"
+	"math/bits"
+	"sync"
+)
+
+/*
+	HyperLogLog.go
+
+	Estimate the number of unique keys (e.g. visitor IPs) with a fixed
+	amount of memory. With precision p, 2^p one byte registers are used
+	and the standard error of the estimation is about 1.04 / sqrt(2^p)
+*/
+
+const (
+	hllMinPrecision = 4
+	hllMaxPrecision = 16
+)
+
+type HyperLogLog struct {
+	precision uint8
+	registers []uint8
+	mutex     sync.Mutex
+}
+
+// Create a new HyperLogLog counter with the given precision (4 - 16)
+func NewHyperLogLog(precision uint8) *HyperLogLog {
+	if precision < hllMinPrecision {
+		precision = hllMinPrecision
+	} else if precision > hllMaxPrecision {
+		precision = hllMaxPrecision
+	}
+	return &HyperLogLog{
+		precision: precision,
+		registers: make([]uint8, 1<<precision),
+	}
+}
+
+// Load a HyperLogLog counter from its registers, the precision is
+// derived from the number of registers
+func HyperLogLogFromRegisters(registers []uint8) (*HyperLogLog, error) {
+	precision := uint8(bits.TrailingZeros(uint(len(registers))))
+	if len(registers) == 0 || 1<<precision != len(registers) || precision < hllMinPrecision || precision > hllMaxPrecision {
+		return nil, errors.New("invalid number of registers")
+	}
+
+	hll := NewHyperLogLog(precision)
+	copy(hll.registers, registers)
+	return hll, nil
+}
+
+// Hash the key into an uniformly distributed 64 bit value
+func hllHash(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	x := h.Sum64()
+
+	//Mix the bits as FNV alone is not uniform enough in the higher bits
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// Add a key to the counter
+func (h *HyperLogLog) Add(key string) {
+	x := hllHash(key)
+	index := x >> (64 - h.precision)
+	rank := uint8(bits.LeadingZeros64(x<<h.precision|1<<(h.precision-1))) + 1
+
+	h.mutex.Lock()
+	if rank > h.registers[index] {
+		h.registers[index] = rank
+	}
+	h.mutex.Unlock()
+}
+
+// Merge another counter into this one. Both counters must have the same precision
+func (h *HyperLogLog) Merge(other *HyperLogLog) error {
+	if other.precision != h.precision {
+		return errors.New("precision mismatch")
+	}
+
+	other.mutex.Lock()
+	registers := append([]uint8{}, other.registers...)
+	other.mutex.Unlock()
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for i, value := range registers {
+		if value > h.registers[i] {
+			h.registers[i] = value
+		}
+	}
+	return nil
+}
+
+// Estimate the number of unique keys added
+func (h *HyperLogLog) Count() int64 {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	m := float64(len(h.registers))
+	sum := 0.0
+	zeros := 0
+	for _, value := range h.registers {
+		sum += 1 / float64(uint64(1)<<value)
+		if value == 0 {
+			zeros++
+		}
+	}
+
+	alpha := 0.7213 / (1 + 1.079/m)
+	switch len(h.registers) {
+	case 16:
+		alpha = 0.673
+	case 32:
+		alpha = 0.697
+	case 64:
+		alpha = 0.709
+	}
+
+	estimate := alpha * m * m / sum
+	if estimate <= 2.5*m && zeros > 0 {
+		//Small range correction with linear counting
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return int64(estimate + 0.5)
+}
+
+// Get a copy of the registers for persisting the counter
+func (h *HyperLogLog) Registers() []uint8 {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return append([]uint8{}, h.registers...)
+}
@@ -0,0 +1,162 @@
+package statistic
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"time"
+)
+
+/*
+	Retention.go
+
+	Roll up the daily summaries that are older than the daily
+	retention period into monthly summaries and remove the monthly
+	summaries that are older than the monthly retention period.
+	Time series buckets follow the daily retention period
+*/
+
+// Monthly summary rolled up from daily summaries
+type MonthlySummaryExport struct {
+	Month   string              //Month of the summary in 2006_01 format
+	Dates   []string            //Dates that are rolled up into this summary
+	Summary *DailySummaryExport //Merged summary of the rolled up dates
+}
+
+// Keep only the top n keys in the counter maps of the summary and its endpoints
+func (e *DailySummaryExport) Truncate(n int) {
+	e.RequestClientIp = TruncateCounterMap(e.RequestClientIp, n)
+	e.Referer = TruncateCounterMap(e.Referer, n)
+	e.UserAgent = TruncateCounterMap(e.UserAgent, n)
+	e.RequestURL = TruncateCounterMap(e.RequestURL, n)
+	for _, endpoint := range e.Endpoints {
+		endpoint.Truncate(n)
+	}
+}
+
+// Load the monthly summary of the given month, e.g. 2024_01
+func (c *Collector) LoadSummaryOfMonth(month string) (*MonthlySummaryExport, error) {
+	if !c.Option.Database.KeyExists("stats_monthly", month) {
+		return nil, errors.New("monthly summary not found")
+	}
+
+	summary := MonthlySummaryExport{}
+	err := c.Option.Database.Read("stats_monthly", month, &summary)
+	if err != nil {
+		return nil, err
+	}
+	return &summary, nil
+}
+
+// List the months that has monthly summary
+func (c *Collector) ListMonthlySummaries() ([]string, error) {
+	entries, err := c.Option.Database.ListTable("stats_monthly")
+	if err != nil {
+		return []string{}, err
+	}
+
+	months := []string{}
+	for _, keypairs := range entries {
+		months = append(months, string(keypairs[0]))
+	}
+	sort.Strings(months)
+	return months, nil
+}
+
+// Roll up a daily summary into its monthly summary and remove the daily summary
+func (c *Collector) rollUpDailySummary(dateKey string, date time.Time) error {
+	daily := DailySummaryExport{}
+	err := c.Option.Database.Read("stats", dateKey, &daily)
+	if err != nil {
+		return err
+	}
+
+	monthKey := date.Format("2006_01")
+	monthly, err := c.LoadSummaryOfMonth(monthKey)
+	if err != nil {
+		monthly = &MonthlySummaryExport{
+			Month: monthKey,
+			Dates: []string{},
+		}
+	}
+
+	alreadyRolledUp := false
+	for _, rolledUpDate := range monthly.Dates {
+		if rolledUpDate == dateKey {
+			//Rolled up before but the daily summary was not removed
+			alreadyRolledUp = true
+			break
+		}
+	}
+
+	if !alreadyRolledUp {
+		summaries := []*DailySummaryExport{&daily}
+		if monthly.Summary != nil {
+			summaries = append(summaries, monthly.Summary)
+		}
+		monthly.Summary = MergeDailySummaryExports(summaries)
+		monthly.Summary.Truncate(c.Option.TopKSize)
+		monthly.Dates = append(monthly.Dates, dateKey)
+		sort.Strings(monthly.Dates)
+
+		err = c.Option.Database.Write("stats_monthly", monthKey, monthly)
+		if err != nil {
+			return err
+		}
+	}
+
+	return c.Option.Database.Delete("stats", dateKey)
+}
+
+// Apply the retention policy to the stored summaries
+func (c *Collector) ApplyRetentionPolicy() {
+	now := time.Now()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+
+	if c.Option.DailyRetentionDays > 0 {
+		dailyCutoff := today.AddDate(0, 0, -c.Option.DailyRetentionDays)
+		entries, err := c.Option.Database.ListTable("stats")
+		if err == nil {
+			rolledUp := 0
+			for _, keypairs := range entries {
+				dateKey := string(keypairs[0])
+				date, err := time.ParseInLocation("2006_01_02", dateKey, time.Local)
+				if err != nil || !date.Before(dailyCutoff) {
+					continue
+				}
+
+				err = c.rollUpDailySummary(dateKey, date)
+				if err != nil {
+					log.Println("[Statistic] Unable to roll up summary of " + dateKey + ": " + err.Error())
+					continue
+				}
+				rolledUp++
+			}
+
+			if rolledUp > 0 {
+				log.Printf("[Statistic] %d daily summaries rolled up to monthly summaries\n", rolledUp)
+			}
+		}
+
+		removed := c.removeTimeSeriesBefore(dailyCutoff)
+		if removed > 0 {
+			log.Printf("[Statistic] %d time series buckets removed\n", removed)
+		}
+	}
+
+	if c.Option.MonthlyRetentionMonth > 0 {
+		monthlyCutoff := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.Local).AddDate(0, -c.Option.MonthlyRetentionMonth, 0)
+		months, err := c.ListMonthlySummaries()
+		if err == nil {
+			for _, monthKey := range months {
+				month, err := time.ParseInLocation("2006_01", monthKey, time.Local)
+				if err != nil || !month.Before(monthlyCutoff) {
+					continue
+				}
+
+				log.Println("[Statistic] Removing monthly summary of " + monthKey)
+				c.Option.Database.Delete("stats_monthly", monthKey)
+			}
+		}
+	}
+}
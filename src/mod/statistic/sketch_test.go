@@ -0,0 +1,156 @@
+package statistic_test
+
+import (
+	"math"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"imuslab.com/zoraxy/mod/database"
+	"imuslab.com/zoraxy/mod/statistic"
+)
+
+func TestTopKHeavyHitters(t *testing.T) {
+	topk := statistic.NewTopK(10)
+
+	//Heavy hitters mixed with a scan of unique keys
+	for i := 0; i < 10000; i++ {
+		topk.Add("10.0.0."+strconv.Itoa(i%3), 1)
+		topk.Add("scan-"+strconv.Itoa(i), 1)
+	}
+
+	if topk.Len() != 10 {
+		t.Fatalf("expected 10 tracked keys, got %d", topk.Len())
+	}
+
+	for i := 0; i < 3; i++ {
+		key := "10.0.0." + strconv.Itoa(i)
+		if topk.Get(key) < 3333 {
+			t.Errorf("heavy hitter %s not tracked correctly, count %d", key, topk.Get(key))
+		}
+	}
+
+	truncated := statistic.TruncateCounterMap(topk.ToMap(), 3)
+	if len(truncated) != 3 {
+		t.Errorf("expected 3 keys after truncate, got %d", len(truncated))
+	}
+	for key := range truncated {
+		if key[:3] != "10." {
+			t.Errorf("unexpected key after truncate: %s", key)
+		}
+	}
+}
+
+func TestHyperLogLogCount(t *testing.T) {
+	hll := statistic.NewHyperLogLog(14)
+	other := statistic.NewHyperLogLog(14)
+	for i := 0; i < 50000; i++ {
+		hll.Add("192.168." + strconv.Itoa(i))
+		//Half overlap with the first counter
+		other.Add("192.168." + strconv.Itoa(i+25000))
+	}
+
+	count := hll.Count()
+	if math.Abs(float64(count)-50000)/50000 > 0.03 {
+		t.Errorf("estimated count %d too far from 50000", count)
+	}
+
+	err := hll.Merge(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	merged := hll.Count()
+	if math.Abs(float64(merged)-75000)/75000 > 0.03 {
+		t.Errorf("merged count %d too far from 75000", merged)
+	}
+
+	restored, err := statistic.HyperLogLogFromRegisters(hll.Registers())
+	if err != nil || restored.Count() != merged {
+		t.Errorf("restored counter does not match")
+	}
+
+	small := statistic.NewHyperLogLog(14)
+	for i := 0; i < 10; i++ {
+		small.Add("same")
+		small.Add(strconv.Itoa(i))
+	}
+	if small.Count() != 11 {
+		t.Errorf("expected exact small count of 11, got %d", small.Count())
+	}
+}
+
+func TestRetentionRollUp(t *testing.T) {
+	db, err := database.NewDatabase(filepath.Join(t.TempDir(), "test.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	collector, err := statistic.NewStatisticCollector(statistic.CollectorOption{
+		Database:           db,
+		TopKSize:           2,
+		DailyRetentionDays: 30,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer collector.Close()
+
+	oldDate := time.Now().AddDate(0, 0, -40)
+	oldKey := oldDate.Format("2006_01_02")
+	recentKey := time.Now().AddDate(0, 0, -1).Format("2006_01_02")
+	for _, key := range []string{oldKey, recentKey} {
+		db.Write("stats", key, statistic.DailySummaryExport{
+			TotalRequest:    3,
+			RequestClientIp: map[string]int{"1.1.1.1": 10, "2.2.2.2": 5, "3.3.3.3": 1},
+		})
+	}
+
+	collector.ApplyRetentionPolicy()
+	//Running again must not roll up the same day twice
+	collector.ApplyRetentionPolicy()
+
+	if db.KeyExists("stats", oldKey) {
+		t.Errorf("daily summary out of retention period not removed")
+	}
+	if !db.KeyExists("stats", recentKey) {
+		t.Errorf("daily summary within retention period removed")
+	}
+
+	monthly, err := collector.LoadSummaryOfMonth(oldDate.Format("2006_01"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if monthly.Summary.TotalRequest != 3 || len(monthly.Dates) != 1 || len(monthly.Summary.RequestClientIp) != 2 {
+		t.Errorf("unexpected monthly summary: %+v", monthly)
+	}
+}
+
+func TestTimeSeriesIntervalValidation(t *testing.T) {
+	db, err := database.NewDatabase(filepath.Join(t.TempDir(), "test.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	//Buckets are keyed by minute, sub-minute intervals would overwrite each other
+	for _, interval := range []time.Duration{30 * time.Second, 90 * time.Second} {
+		_, err := statistic.NewStatisticCollector(statistic.CollectorOption{
+			Database:           db,
+			TimeSeriesInterval: interval,
+		})
+		if err == nil {
+			t.Errorf("expected time series interval %v to be rejected", interval)
+		}
+	}
+
+	collector, err := statistic.NewStatisticCollector(statistic.CollectorOption{
+		Database:           db,
+		TimeSeriesInterval: 5 * time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	collector.Close()
+}
@@ -1,6 +1,7 @@
 package statistic
 
 import (
+	"errors"
 	"path/filepath"
 	"strings"
 	"sync"
@@ -24,17 +25,24 @@ type DailySummary struct {
 	ErrorRequest int64 //Invalid request of the day, including error or not found
 	ValidRequest int64 //Valid request of the day
 	//Type counters
-	ForwardTypes    *sync.Map //Map that hold the forward types
-	RequestOrigin   *sync.Map //Map that hold [country ISO code]: visitor counter
-	RequestClientIp *sync.Map //Map that hold all unique request IPs
-	Referer         *sync.Map //Map that store where the user was refered from
-	UserAgent       *sync.Map //Map that store the useragent of the request
-	RequestURL      *sync.Map //Request URL of the request object
+	ForwardTypes    *sync.Map    //Map that hold the forward types
+	RequestOrigin   *sync.Map    //Map that hold [country ISO code]: visitor counter
+	RequestClientIp *TopK        //Top request IPs and their request counts
+	Referer         *TopK        //Top referers where the user was refered from
+	UserAgent       *TopK        //Top useragents of the requests
+	RequestURL      *TopK        //Top request URLs of the request object
+	UniqueVisitors  *HyperLogLog //Estimated unique request IPs of the day
+	WafRuleHits     *sync.Map    //Map that hold [WAF rule ID]: match counter
+	RequestASN      *sync.Map    //Map that hold [ASN and organization]: visitor counter
+	Endpoints       *sync.Map    //Map that hold [proxy endpoint]: *EndpointSummary
+
+	topKSize int //Number of keys tracked by the top K counters
 }
 
 type RequestInfo struct {
 	IpAddr                        string
 	RequestOriginalCountryISOCode string
+	RequestASN                    string //ASN of the requester, e.g. AS13335 Cloudflare, Inc.
 	Succ                          bool
 	StatusCode                    int
 	ForwardType                   string
@@ -42,24 +50,47 @@ type RequestInfo struct {
 	UserAgent                     string
 	RequestURL                    string
 	Target                        string
+	Endpoint                      string        //Matched proxy endpoint (host or vdir), empty if not matched
+	Latency                       time.Duration //Time taken to serve the request
 }
 
 type CollectorOption struct {
-	Database *database.Database
+	Database              *database.Database
+	TopKSize              int           //Number of top IPs, URLs, referers and useragents to keep per day, default 1000
+	DailyRetentionDays    int           //Days to keep the daily summaries before rolling up to monthly, 0 to keep forever
+	MonthlyRetentionMonth int           //Months to keep the monthly summaries, 0 to keep forever
+	TimeSeriesInterval    time.Duration //Interval of the time series buckets, default 1 hour
 }
 
 type Collector struct {
-	rtdataStopChan chan bool
-	DailySummary   *DailySummary
-	Option         *CollectorOption
+	rtdataStopChan     chan bool
+	timeSeriesStopChan chan bool
+	DailySummary       *DailySummary
+	Option             *CollectorOption
+	timeSeries         *timeSeriesBuffer
 }
 
+// Default number of keys tracked by the top K counters
+const DefaultTopKSize = 1000
+
 func NewStatisticCollector(option CollectorOption) (*Collector, error) {
+	if option.TimeSeriesInterval <= 0 {
+		option.TimeSeriesInterval = DefaultTimeSeriesInterval
+	} else if option.TimeSeriesInterval%time.Minute != 0 {
+		//Time series buckets are keyed by minute
+		return nil, errors.New("time series interval must be a multiple of one minute")
+	}
+
 	option.Database.NewTable("stats")
+	option.Database.NewTable("stats_monthly")
+	option.Database.NewTable("stats_timeseries")
+	if option.TopKSize <= 0 {
+		option.TopKSize = DefaultTopKSize
+	}
 
 	//Create the collector object
 	thisCollector := Collector{
-		DailySummary: newDailySummary(),
+		DailySummary: newDailySummary(option.TopKSize),
 		Option:       &option,
 	}
 
@@ -70,10 +101,15 @@ func NewStatisticCollector(option CollectorOption) (*Collector, error) {
 	if summary != nil {
 		thisCollector.DailySummary = summary
 	}
+	thisCollector.timeSeries = thisCollector.newTimeSeriesBuffer()
+
+	//Roll up or remove the summaries that are out of retention period
+	thisCollector.ApplyRetentionPolicy()
 
 	//Schedule the realtime statistic clearing at midnight everyday
 	rtstatStopChan := thisCollector.ScheduleResetRealtimeStats()
 	thisCollector.rtdataStopChan = rtstatStopChan
+	thisCollector.timeSeriesStopChan = thisCollector.scheduleTimeSeriesFlush()
 
 	return &thisCollector, nil
 }
@@ -93,13 +129,13 @@ func (c *Collector) LoadSummaryOfDay(year int, month time.Month, day int) *Daily
 	summaryKey := date.Format("2006_01_02")
 	targetSummaryExport := DailySummaryExport{}
 	c.Option.Database.Read("stats", summaryKey, &targetSummaryExport)
-	targetSummary := DailySummaryExportToSummary(targetSummaryExport)
+	targetSummary := DailySummaryExportToSummary(targetSummaryExport, c.Option.TopKSize)
 	return &targetSummary
 }
 
 // Reset today summary, for debug or restoring injections
 func (c *Collector) ResetSummaryOfDay() {
-	c.DailySummary = newDailySummary()
+	c.DailySummary = newDailySummary(c.Option.TopKSize)
 }
 
 // This function gives the current slot in the 288- 5 minutes interval of the day
@@ -114,9 +150,11 @@ func (c *Collector) GetCurrentRealtimeStatIntervalId() int {
 func (c *Collector) Close() {
 	//Stop the ticker
 	c.rtdataStopChan <- true
+	c.timeSeriesStopChan <- true
 
 	//Write the buffered data into database
 	c.SaveSummaryOfDay()
+	c.SaveTimeSeries()
 
 }
 
@@ -148,6 +186,15 @@ func (c *Collector) RecordRequest(ri RequestInfo) {
 			c.DailySummary.RequestOrigin.Store(originISO, fo.(int)+1)
 		}
 
+		if ri.RequestASN != "" {
+			fa, ok := c.DailySummary.RequestASN.Load(ri.RequestASN)
+			if !ok {
+				c.DailySummary.RequestASN.Store(ri.RequestASN, 1)
+			} else {
+				c.DailySummary.RequestASN.Store(ri.RequestASN, fa.(int)+1)
+			}
+		}
+
 		//Filter out CF forwarded requests
 		if strings.Contains(ri.IpAddr, ",") {
 			ips := strings.Split(strings.TrimSpace(ri.IpAddr), ",")
@@ -158,32 +205,26 @@ func (c *Collector) RecordRequest(ri RequestInfo) {
 			}
 		}
 
-		fi, ok := c.DailySummary.RequestClientIp.Load(ri.IpAddr)
-		if !ok {
-			c.DailySummary.RequestClientIp.Store(ri.IpAddr, 1)
-		} else {
-			c.DailySummary.RequestClientIp.Store(ri.IpAddr, fi.(int)+1)
+		c.DailySummary.RequestClientIp.Add(ri.IpAddr, 1)
+		c.DailySummary.UniqueVisitors.Add(ri.IpAddr)
+
+		//Record the request into the summary of its endpoint
+		if ri.Endpoint != "" {
+			c.DailySummary.getEndpointSummary(ri.Endpoint).record(&ri)
 		}
 
+		//Record the request into the time series
+		c.recordTimeSeries(&ri)
+
 		//Record the referer
 		p := bluemonday.StripTagsPolicy()
 		filteredReferer := p.Sanitize(
 			ri.Referer,
 		)
-		rf, ok := c.DailySummary.Referer.Load(filteredReferer)
-		if !ok {
-			c.DailySummary.Referer.Store(filteredReferer, 1)
-		} else {
-			c.DailySummary.Referer.Store(filteredReferer, rf.(int)+1)
-		}
+		c.DailySummary.Referer.Add(filteredReferer, 1)
 
 		//Record the UserAgent
-		ua, ok := c.DailySummary.UserAgent.Load(ri.UserAgent)
-		if !ok {
-			c.DailySummary.UserAgent.Store(ri.UserAgent, 1)
-		} else {
-			c.DailySummary.UserAgent.Store(ri.UserAgent, ua.(int)+1)
-		}
+		c.DailySummary.UserAgent.Add(ri.UserAgent, 1)
 
 		//ADD MORE HERE IF NEEDED
 
@@ -194,11 +235,21 @@ func (c *Collector) RecordRequest(ri RequestInfo) {
 			return
 		}
 
-		ru, ok := c.DailySummary.RequestURL.Load(ri.RequestURL)
-		if !ok {
-			c.DailySummary.RequestURL.Store(ri.RequestURL, 1)
-		} else {
-			c.DailySummary.RequestURL.Store(ri.RequestURL, ru.(int)+1)
+		c.DailySummary.RequestURL.Add(ri.RequestURL, 1)
+	}()
+}
+
+// Record the WAF rule matches of a request. This is recorded seperately from
+// RecordRequest as detect mode matches do not alter the request outcome
+func (c *Collector) RecordWafMatches(ruleIDs []string) {
+	go func() {
+		for _, ruleID := range ruleIDs {
+			hits, ok := c.DailySummary.WafRuleHits.Load(ruleID)
+			if !ok {
+				c.DailySummary.WafRuleHits.Store(ruleID, 1)
+			} else {
+				c.DailySummary.WafRuleHits.Store(ruleID, hits.(int)+1)
+			}
 		}
 	}()
 }
@@ -223,7 +274,8 @@ func (c *Collector) ScheduleResetRealtimeStats() chan bool {
 			case <-time.After(duration):
 				// store daily summary to database and reset summary
 				c.SaveSummaryOfDay()
-				c.DailySummary = newDailySummary()
+				c.DailySummary = newDailySummary(c.Option.TopKSize)
+				c.ApplyRetentionPolicy()
 			case <-doneCh:
 				// stop the routine
 				return
@@ -234,16 +286,21 @@ func (c *Collector) ScheduleResetRealtimeStats() chan bool {
 	return doneCh
 }
 
-func newDailySummary() *DailySummary {
+func newDailySummary(topKSize int) *DailySummary {
 	return &DailySummary{
 		TotalRequest:    0,
 		ErrorRequest:    0,
 		ValidRequest:    0,
 		ForwardTypes:    &sync.Map{},
 		RequestOrigin:   &sync.Map{},
-		RequestClientIp: &sync.Map{},
-		Referer:         &sync.Map{},
-		UserAgent:       &sync.Map{},
-		RequestURL:      &sync.Map{},
+		RequestClientIp: NewTopK(topKSize),
+		Referer:         NewTopK(topKSize),
+		UserAgent:       NewTopK(topKSize),
+		RequestURL:      NewTopK(topKSize),
+		UniqueVisitors:  NewHyperLogLog(uniqueVisitorPrecision),
+		WafRuleHits:     &sync.Map{},
+		RequestASN:      &sync.Map{},
+		Endpoints:       &sync.Map{},
+		topKSize:        topKSize,
 	}
 }
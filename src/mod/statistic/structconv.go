@@ -1,7 +1,5 @@
 package statistic
 
-import "sync"
-
 type DailySummaryExport struct {
 	TotalRequest int64 //Total request of the day
 	ErrorRequest int64 //Invalid request of the day, including error or not found
@@ -13,19 +11,30 @@ type DailySummaryExport struct {
 	Referer         map[string]int
 	UserAgent       map[string]int
 	RequestURL      map[string]int
+	WafRuleHits     map[string]int
+	RequestASN      map[string]int
+	Endpoints       map[string]*EndpointSummaryExport
+
+	UniqueVisitors         int64  //Estimated number of unique request IPs
+	UniqueVisitorRegisters []byte //HyperLogLog registers for merging unique visitor counts
 }
 
 func DailySummaryToExport(summary DailySummary) DailySummaryExport {
 	export := DailySummaryExport{
-		TotalRequest:    summary.TotalRequest,
-		ErrorRequest:    summary.ErrorRequest,
-		ValidRequest:    summary.ValidRequest,
-		ForwardTypes:    make(map[string]int),
-		RequestOrigin:   make(map[string]int),
-		RequestClientIp: make(map[string]int),
-		Referer:         make(map[string]int),
-		UserAgent:       make(map[string]int),
-		RequestURL:      make(map[string]int),
+		TotalRequest:           summary.TotalRequest,
+		ErrorRequest:           summary.ErrorRequest,
+		ValidRequest:           summary.ValidRequest,
+		ForwardTypes:           make(map[string]int),
+		RequestOrigin:          make(map[string]int),
+		RequestClientIp:        summary.RequestClientIp.ToMap(),
+		Referer:                summary.Referer.ToMap(),
+		UserAgent:              summary.UserAgent.ToMap(),
+		RequestURL:             summary.RequestURL.ToMap(),
+		WafRuleHits:            make(map[string]int),
+		RequestASN:             make(map[string]int),
+		Endpoints:              make(map[string]*EndpointSummaryExport),
+		UniqueVisitors:         summary.UniqueVisitors.Count(),
+		UniqueVisitorRegisters: summary.UniqueVisitors.Registers(),
 	}
 
 	summary.ForwardTypes.Range(func(key, value interface{}) bool {
@@ -38,41 +47,29 @@ func DailySummaryToExport(summary DailySummary) DailySummaryExport {
 		return true
 	})
 
-	summary.RequestClientIp.Range(func(key, value interface{}) bool {
-		export.RequestClientIp[key.(string)] = value.(int)
+	summary.WafRuleHits.Range(func(key, value interface{}) bool {
+		export.WafRuleHits[key.(string)] = value.(int)
 		return true
 	})
 
-	summary.Referer.Range(func(key, value interface{}) bool {
-		export.Referer[key.(string)] = value.(int)
+	summary.RequestASN.Range(func(key, value interface{}) bool {
+		export.RequestASN[key.(string)] = value.(int)
 		return true
 	})
 
-	summary.UserAgent.Range(func(key, value interface{}) bool {
-		export.UserAgent[key.(string)] = value.(int)
-		return true
-	})
-
-	summary.RequestURL.Range(func(key, value interface{}) bool {
-		export.RequestURL[key.(string)] = value.(int)
+	summary.Endpoints.Range(func(key, value interface{}) bool {
+		export.Endpoints[key.(string)] = value.(*EndpointSummary).toExport()
 		return true
 	})
 
 	return export
 }
 
-func DailySummaryExportToSummary(export DailySummaryExport) DailySummary {
-	summary := DailySummary{
-		TotalRequest:    export.TotalRequest,
-		ErrorRequest:    export.ErrorRequest,
-		ValidRequest:    export.ValidRequest,
-		ForwardTypes:    &sync.Map{},
-		RequestOrigin:   &sync.Map{},
-		RequestClientIp: &sync.Map{},
-		Referer:         &sync.Map{},
-		UserAgent:       &sync.Map{},
-		RequestURL:      &sync.Map{},
-	}
+func DailySummaryExportToSummary(export DailySummaryExport, topKSize int) DailySummary {
+	summary := *newDailySummary(topKSize)
+	summary.TotalRequest = export.TotalRequest
+	summary.ErrorRequest = export.ErrorRequest
+	summary.ValidRequest = export.ValidRequest
 
 	for k, v := range export.ForwardTypes {
 		summary.ForwardTypes.Store(k, v)
@@ -82,25 +79,93 @@ func DailySummaryExportToSummary(export DailySummaryExport) DailySummary {
 		summary.RequestOrigin.Store(k, v)
 	}
 
-	for k, v := range export.RequestClientIp {
-		summary.RequestClientIp.Store(k, v)
+	summary.RequestClientIp.AddAll(export.RequestClientIp)
+	summary.Referer.AddAll(export.Referer)
+	summary.UserAgent.AddAll(export.UserAgent)
+	summary.RequestURL.AddAll(export.RequestURL)
+	if hll, err := HyperLogLogFromRegisters(export.UniqueVisitorRegisters); err == nil {
+		summary.UniqueVisitors = hll
 	}
 
-	for k, v := range export.Referer {
-		summary.Referer.Store(k, v)
+	for k, v := range export.WafRuleHits {
+		summary.WafRuleHits.Store(k, v)
 	}
 
-	for k, v := range export.UserAgent {
-		summary.UserAgent.Store(k, v)
+	for k, v := range export.RequestASN {
+		summary.RequestASN.Store(k, v)
 	}
 
-	for k, v := range export.RequestURL {
-		summary.RequestURL.Store(k, v)
+	for k, v := range export.Endpoints {
+		summary.Endpoints.Store(k, endpointSummaryFromExport(v, topKSize))
 	}
 
 	return summary
 }
 
+// Merge multiple daily summaries into one, e.g. for range queries or monthly roll up
+func MergeDailySummaryExports(exports []*DailySummaryExport) *DailySummaryExport {
+	mergedExport := &DailySummaryExport{
+		ForwardTypes:    make(map[string]int),
+		RequestOrigin:   make(map[string]int),
+		RequestClientIp: make(map[string]int),
+		Referer:         make(map[string]int),
+		UserAgent:       make(map[string]int),
+		RequestURL:      make(map[string]int),
+		WafRuleHits:     make(map[string]int),
+		RequestASN:      make(map[string]int),
+		Endpoints:       make(map[string]*EndpointSummaryExport),
+	}
+
+	for _, export := range exports {
+		mergedExport.TotalRequest += export.TotalRequest
+		mergedExport.ErrorRequest += export.ErrorRequest
+		mergedExport.ValidRequest += export.ValidRequest
+
+		for key, value := range export.ForwardTypes {
+			mergedExport.ForwardTypes[key] += value
+		}
+
+		for key, value := range export.RequestOrigin {
+			mergedExport.RequestOrigin[key] += value
+		}
+
+		for key, value := range export.RequestClientIp {
+			mergedExport.RequestClientIp[key] += value
+		}
+
+		for key, value := range export.Referer {
+			mergedExport.Referer[key] += value
+		}
+
+		for key, value := range export.UserAgent {
+			mergedExport.UserAgent[key] += value
+		}
+
+		for key, value := range export.RequestURL {
+			mergedExport.RequestURL[key] += value
+		}
+
+		for key, value := range export.WafRuleHits {
+			mergedExport.WafRuleHits[key] += value
+		}
+
+		for key, value := range export.RequestASN {
+			mergedExport.RequestASN[key] += value
+		}
+
+		for key, value := range export.Endpoints {
+			if _, ok := mergedExport.Endpoints[key]; !ok {
+				mergedExport.Endpoints[key] = &EndpointSummaryExport{}
+			}
+			mergedExport.Endpoints[key].Merge(value)
+		}
+
+		mergedExport.UniqueVisitorRegisters, mergedExport.UniqueVisitors = mergeUniqueVisitors(mergedExport.UniqueVisitorRegisters, export.UniqueVisitorRegisters, mergedExport.UniqueVisitors+export.UniqueVisitors)
+	}
+
+	return mergedExport
+}
+
 // External object function call
 func (c *Collector) GetExportSummary() *DailySummaryExport {
 	exportFormatDailySummary := DailySummaryToExport(*c.DailySummary)
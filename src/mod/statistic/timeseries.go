@@ -0,0 +1,231 @@
+package statistic
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+	Timeseries.go
+
+	Request counters aggregated into fixed interval time buckets
+	(hourly by default) and persisted into the stats_timeseries table.
+	Each bucket holds one point per combination of endpoint, status
+	class, country and forward type, so the analytic loader can filter
+	and group by any of those dimensions over an arbitrary time range
+*/
+
+// Default interval of the time series buckets
+const DefaultTimeSeriesInterval = time.Hour
+
+// Dimensions of a time series point
+type TimeSeriesDimensions struct {
+	Endpoint    string
+	StatusClass string //e.g. 2xx
+	Country     string //Country ISO code in lower case
+	ForwardType string
+}
+
+type TimeSeriesPoint struct {
+	TimeSeriesDimensions
+	Requests      int64
+	ErrorRequests int64
+	LatencySumMs  float64 //Total latency of the requests, for calculating average
+}
+
+type TimeSeriesBucket struct {
+	Start    int64 //Unix timestamp of the bucket start time
+	Interval int64 //Length of the bucket in seconds
+	Points   []*TimeSeriesPoint
+}
+
+type timeSeriesBuffer struct {
+	interval    time.Duration
+	bucketStart time.Time
+	points      map[TimeSeriesDimensions]*TimeSeriesPoint
+	mutex       sync.Mutex
+}
+
+// Get the status class of a status code, e.g. 404 to 4xx
+func StatusClass(statusCode int) string {
+	if statusCode < 100 || statusCode > 599 {
+		return "unknown"
+	}
+	return strconv.Itoa(statusCode/100) + "xx"
+}
+
+// Get the database key of the bucket starting at the given time
+func timeSeriesBucketKey(start time.Time) string {
+	return start.UTC().Format("2006_01_02_15_04")
+}
+
+func (c *Collector) newTimeSeriesBuffer() *timeSeriesBuffer {
+	buffer := timeSeriesBuffer{
+		interval:    c.Option.TimeSeriesInterval,
+		bucketStart: time.Now().Truncate(c.Option.TimeSeriesInterval),
+		points:      map[TimeSeriesDimensions]*TimeSeriesPoint{},
+	}
+
+	//Continue the current bucket if it was persisted before restart
+	key := timeSeriesBucketKey(buffer.bucketStart)
+	if c.Option.Database.KeyExists("stats_timeseries", key) {
+		bucket := TimeSeriesBucket{}
+		c.Option.Database.Read("stats_timeseries", key, &bucket)
+		for _, point := range bucket.Points {
+			buffer.points[point.TimeSeriesDimensions] = point
+		}
+	}
+
+	return &buffer
+}
+
+// Swap out the points of the current bucket if the bucket has ended. Must be called with mutex locked
+func (b *timeSeriesBuffer) rotate(now time.Time) *TimeSeriesBucket {
+	if now.Before(b.bucketStart.Add(b.interval)) {
+		return nil
+	}
+
+	bucket := b.snapshot()
+	b.bucketStart = now.Truncate(b.interval)
+	b.points = map[TimeSeriesDimensions]*TimeSeriesPoint{}
+	return bucket
+}
+
+// Copy the points of the current bucket. Must be called with mutex locked
+func (b *timeSeriesBuffer) snapshot() *TimeSeriesBucket {
+	bucket := TimeSeriesBucket{
+		Start:    b.bucketStart.Unix(),
+		Interval: int64(b.interval.Seconds()),
+		Points:   make([]*TimeSeriesPoint, 0, len(b.points)),
+	}
+	for _, point := range b.points {
+		thisPoint := *point
+		bucket.Points = append(bucket.Points, &thisPoint)
+	}
+	return &bucket
+}
+
+// Record a request into the current time series bucket
+func (c *Collector) recordTimeSeries(ri *RequestInfo) {
+	dimensions := TimeSeriesDimensions{
+		Endpoint:    ri.Endpoint,
+		StatusClass: StatusClass(ri.StatusCode),
+		Country:     strings.ToLower(ri.RequestOriginalCountryISOCode),
+		ForwardType: ri.ForwardType,
+	}
+
+	b := c.timeSeries
+	b.mutex.Lock()
+	endedBucket := b.rotate(time.Now())
+	point, ok := b.points[dimensions]
+	if !ok {
+		point = &TimeSeriesPoint{TimeSeriesDimensions: dimensions}
+		b.points[dimensions] = point
+	}
+	point.Requests++
+	if !ri.Succ {
+		point.ErrorRequests++
+	}
+	point.LatencySumMs += float64(ri.Latency.Microseconds()) / 1000
+	b.mutex.Unlock()
+
+	if endedBucket != nil {
+		c.writeTimeSeriesBucket(endedBucket)
+	}
+}
+
+func (c *Collector) writeTimeSeriesBucket(bucket *TimeSeriesBucket) {
+	if len(bucket.Points) == 0 {
+		return
+	}
+	c.Option.Database.Write("stats_timeseries", timeSeriesBucketKey(time.Unix(bucket.Start, 0)), bucket)
+}
+
+// Persist the current bucket, or the ended bucket if the interval has passed
+func (c *Collector) SaveTimeSeries() {
+	b := c.timeSeries
+	b.mutex.Lock()
+	bucket := b.rotate(time.Now())
+	if bucket == nil {
+		bucket = b.snapshot()
+	}
+	b.mutex.Unlock()
+	c.writeTimeSeriesBucket(bucket)
+}
+
+// Periodically persist the time series so an ended bucket is written even without new requests
+func (c *Collector) scheduleTimeSeriesFlush() chan bool {
+	stopChan := make(chan bool)
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				c.SaveTimeSeries()
+			case <-stopChan:
+				return
+			}
+		}
+	}()
+	return stopChan
+}
+
+// Load the time series buckets that start within the given time range, including
+// the current in-memory bucket. Buckets are sorted by their start time
+func (c *Collector) LoadTimeSeries(from time.Time, to time.Time) []*TimeSeriesBucket {
+	results := []*TimeSeriesBucket{}
+	interval := c.Option.TimeSeriesInterval
+
+	b := c.timeSeries
+	b.mutex.Lock()
+	currentBucket := b.snapshot()
+	b.mutex.Unlock()
+	currentStart := time.Unix(currentBucket.Start, 0)
+
+	for t := from.Truncate(interval); !t.After(to); t = t.Add(interval) {
+		if t.Equal(currentStart) {
+			results = append(results, currentBucket)
+			continue
+		}
+
+		key := timeSeriesBucketKey(t)
+		if !c.Option.Database.KeyExists("stats_timeseries", key) {
+			continue
+		}
+		bucket := TimeSeriesBucket{}
+		err := c.Option.Database.Read("stats_timeseries", key, &bucket)
+		if err != nil {
+			continue
+		}
+		results = append(results, &bucket)
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Start < results[j].Start
+	})
+	return results
+}
+
+// Remove the time series buckets that start before the cutoff time
+func (c *Collector) removeTimeSeriesBefore(cutoff time.Time) int {
+	entries, err := c.Option.Database.ListTable("stats_timeseries")
+	if err != nil {
+		return 0
+	}
+
+	removed := 0
+	for _, keypairs := range entries {
+		key := string(keypairs[0])
+		start, err := time.ParseInLocation("2006_01_02_15_04", key, time.UTC)
+		if err != nil || !start.Before(cutoff) {
+			continue
+		}
+		c.Option.Database.Delete("stats_timeseries", key)
+		removed++
+	}
+	return removed
+}
@@ -0,0 +1,164 @@
+package statistic
+
+import (
+	"container/heap"
+	"sort"
+	"sync"
+)
+
+/*
+	TopK.go
+
+	Heavy hitter counter base on the Space-Saving algorithm.
+	Only the top K keys are tracked so the memory usage is bounded
+	no matter how many unique keys are seen, e.g. during a scan.
+	When a new key arrive and the counter is full, the key with the
+	lowest count is evicted and the new key inherit its count, so
+	the counts of the reported keys are upper bounds of their real counts
+*/
+
+type topKItem struct {
+	key   string
+	count int
+	index int //Index of this item in the heap
+}
+
+// Min heap of the tracked items ordered by count
+type topKHeap []*topKItem
+
+func (h topKHeap) Len() int           { return len(h) }
+func (h topKHeap) Less(i, j int) bool { return h[i].count < h[j].count }
+func (h topKHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *topKHeap) Push(x interface{}) {
+	item := x.(*topKItem)
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+
+func (h *topKHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return item
+}
+
+type TopK struct {
+	capacity int
+	items    map[string]*topKItem
+	heap     topKHeap
+	mutex    sync.Mutex
+}
+
+// Create a new top K counter that track at most capacity keys
+func NewTopK(capacity int) *TopK {
+	if capacity <= 0 {
+		capacity = 1
+	}
+	return &TopK{
+		capacity: capacity,
+		items:    map[string]*topKItem{},
+		heap:     topKHeap{},
+	}
+}
+
+// Increase the count of a key by n
+func (t *TopK) Add(key string, n int) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if item, ok := t.items[key]; ok {
+		item.count += n
+		heap.Fix(&t.heap, item.index)
+		return
+	}
+
+	if len(t.heap) < t.capacity {
+		item := &topKItem{key: key, count: n}
+		t.items[key] = item
+		heap.Push(&t.heap, item)
+		return
+	}
+
+	//Counter is full, replace the key with the lowest count
+	minItem := t.heap[0]
+	delete(t.items, minItem.key)
+	minItem.key = key
+	minItem.count += n
+	t.items[key] = minItem
+	heap.Fix(&t.heap, 0)
+}
+
+// Get the count of a key, return 0 if the key is not tracked
+func (t *TopK) Get(key string) int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if item, ok := t.items[key]; ok {
+		return item.count
+	}
+	return 0
+}
+
+// Number of keys currently tracked
+func (t *TopK) Len() int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return len(t.heap)
+}
+
+// Iterate the tracked keys, stop if the callback return false
+func (t *TopK) Range(callback func(key string, count int) bool) {
+	for key, count := range t.ToMap() {
+		if !callback(key, count) {
+			return
+		}
+	}
+}
+
+// Export the tracked keys and their counts
+func (t *TopK) ToMap() map[string]int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	result := make(map[string]int, len(t.heap))
+	for _, item := range t.heap {
+		result[item.key] = item.count
+	}
+	return result
+}
+
+// Add all the counts from a map
+func (t *TopK) AddAll(counts map[string]int) {
+	for key, count := range counts {
+		t.Add(key, count)
+	}
+}
+
+// Keep only the n keys with the highest counts in a counter map
+func TruncateCounterMap(counts map[string]int, n int) map[string]int {
+	if n <= 0 || len(counts) <= n {
+		return counts
+	}
+
+	keys := make([]string, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if counts[keys[i]] != counts[keys[j]] {
+			return counts[keys[i]] > counts[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+
+	result := make(map[string]int, n)
+	for _, key := range keys[:n] {
+		result[key] = counts[key]
+	}
+	return result
+}
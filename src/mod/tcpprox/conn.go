@@ -8,7 +8,10 @@ import (
 	"net"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"imuslab.com/zoraxy/mod/utils"
 )
 
 func isValidIP(ip string) bool {
@@ -39,8 +42,9 @@ func isReachable(target string) bool {
 	return true
 }
 
+// Copy the traffic from conn2 to conn1 and add the copied bytes to accumulator
 func connCopy(conn1 net.Conn, conn2 net.Conn, wg *sync.WaitGroup, accumulator *int64) {
-	io.Copy(conn1, conn2)
+	io.Copy(&utils.AccumulatedWriter{Writer: conn1, Accumulator: accumulator}, conn2)
 	conn1.Close()
 	fmt.Printf("[←] close the connect at local:[%s] and remote:[%s]\n", conn1.LocalAddr().String(), conn1.RemoteAddr().String())
 	//conn2.Close()
@@ -48,13 +52,15 @@ func connCopy(conn1 net.Conn, conn2 net.Conn, wg *sync.WaitGroup, accumulator *i
 	wg.Done()
 }
 
+// Forward traffic between the A side (conn1) and B side (conn2) connections,
+// bytes sent from conn1 to conn2 are added to aTob and the reverse to bToa
 func forward(conn1 net.Conn, conn2 net.Conn, aTob *int64, bToa *int64) {
 	log.Printf("[+] start transmit. [%s],[%s] <-> [%s],[%s] \n", conn1.LocalAddr().String(), conn1.RemoteAddr().String(), conn2.LocalAddr().String(), conn2.RemoteAddr().String())
 	var wg sync.WaitGroup
 	// wait tow goroutines
 	wg.Add(2)
-	go connCopy(conn1, conn2, &wg, aTob)
-	go connCopy(conn2, conn1, &wg, bToa)
+	go connCopy(conn2, conn1, &wg, aTob)
+	go connCopy(conn1, conn2, &wg, bToa)
 	//blocking when the wg is locked
 	wg.Wait()
 }
@@ -68,7 +74,7 @@ func (c *ProxyRelayConfig) accept(listener net.Listener) (net.Conn, error) {
 
 	//Check if connection in blacklist or whitelist
 	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
-		if !c.parent.Options.AccessControlHandler(conn) {
+		if !c.parent.Options.AccessControlHandler(addr) {
 			time.Sleep(300 * time.Millisecond)
 			conn.Close()
 			log.Printf("[x] Connection from %s rejected by access control policy\n", addr.IP.String())
@@ -128,6 +134,31 @@ func (c *ProxyRelayConfig) ValidateConfigs() error {
 			return errors.New("second address is unreachable")
 		}
 
+		return nil
+	} else if c.Mode == ProxyMode_UDPListen {
+		//UDP Port2Port: Both port are port number
+		if !isValidPort(c.PortA) {
+			return errors.New("first address is not a valid port number")
+		}
+
+		if !isValidPort(c.PortB) {
+			return errors.New("second address is not a valid port number")
+		}
+
+		if c.PortA == c.PortB {
+			return errors.New("first and second port cannot be the same")
+		}
+		return nil
+	} else if c.Mode == ProxyMode_UDPTransport {
+		//UDP Port2Host: PortA int, PortB host:port
+		if !isValidPort(c.PortA) {
+			return errors.New("first address must be a valid port number")
+		}
+
+		//UDP is connectionless, only check if the target is resolvable
+		if !isValidUDPTarget(c.PortB) {
+			return errors.New("second address is not a valid UDP address")
+		}
 		return nil
 	} else {
 		return errors.New("invalid mode given")
@@ -160,6 +191,10 @@ func (c *ProxyRelayConfig) Start() error {
 			err = c.Port2port(c.PortA, c.PortB, stopChan)
 		case ProxyMode_Starter:
 			err = c.Host2host(c.PortA, c.PortB, stopChan)
+		case ProxyMode_UDPListen:
+			err = c.UDPPort2port(c.PortA, c.PortB, stopChan)
+		case ProxyMode_UDPTransport:
+			err = c.UDPPort2host(c.PortA, c.PortB, stopChan)
 		default:
 			break
 		}
@@ -173,7 +208,12 @@ func (c *ProxyRelayConfig) Start() error {
 	return nil
 }
 
-// Stop a running proxy if running
+// Get the accumulated bytes transfered from A to B and from B to A
+func (c *ProxyRelayConfig) GetTransferredBytes() (int64, int64) {
+	return atomic.LoadInt64(&c.aTobAccumulatedByteTransfer), atomic.LoadInt64(&c.bToaAccumulatedByteTransfer)
+}
+
+// Check if the proxy is running
 func (c *ProxyRelayConfig) IsRunning() bool {
 	return c.Running || c.stopChan != nil
 }
@@ -287,7 +327,7 @@ func (c *ProxyRelayConfig) Port2host(allowPort string, targetAddress string, sto
 				return
 			}
 			log.Printf("[→] connect target address [%s] success.\n", targetAddress)
-			forward(target, conn, &c.aTobAccumulatedByteTransfer, &c.bToaAccumulatedByteTransfer)
+			forward(conn, target, &c.aTobAccumulatedByteTransfer, &c.bToaAccumulatedByteTransfer)
 		}(targetAddress)
 	}
 }
@@ -309,7 +349,7 @@ func (c *ProxyRelayConfig) Host2host(address1, address2 string, stopChan chan bo
 		var host1, host2 net.Conn
 		var err error
 		for {
-			d := net.Dialer{Timeout: time.Duration(c.Timeout)}
+			d := net.Dialer{Timeout: time.Duration(c.Timeout) * time.Second}
 			host1, err = d.Dial("tcp", address1)
 			if err == nil {
 				log.Printf("[→] connect [%s] success.\n", address1)
@@ -324,7 +364,7 @@ func (c *ProxyRelayConfig) Host2host(address1, address2 string, stopChan chan bo
 			}
 		}
 		for {
-			d := net.Dialer{Timeout: time.Duration(c.Timeout)}
+			d := net.Dialer{Timeout: time.Duration(c.Timeout) * time.Second}
 			host2, err = d.Dial("tcp", address2)
 			if err == nil {
 				log.Printf("[→] connect [%s] success.\n", address2)
@@ -338,7 +378,8 @@ func (c *ProxyRelayConfig) Host2host(address1, address2 string, stopChan chan bo
 				return nil
 			}
 		}
-		go forward(host1, host2, &c.aTobAccumulatedByteTransfer, &c.bToaAccumulatedByteTransfer)
+		//Wait for the current pair of connections to close before connecting again
+		forward(host1, host2, &c.aTobAccumulatedByteTransfer, &c.bToaAccumulatedByteTransfer)
 	}
 
 	return nil
@@ -48,14 +48,20 @@ func (m *Manager) HandleAddProxyConfig(w http.ResponseWriter, r *http.Request) {
 	mode, err := utils.PostPara(r, "mode")
 	if err != nil || mode == "" {
 		utils.SendErrorResponse(w, "no mode given")
+		return
 	} else if mode == "listen" {
 		modeValue = ProxyMode_Listen
 	} else if mode == "transport" {
 		modeValue = ProxyMode_Transport
 	} else if mode == "starter" {
 		modeValue = ProxyMode_Starter
+	} else if mode == "udplisten" {
+		modeValue = ProxyMode_UDPListen
+	} else if mode == "udptransport" {
+		modeValue = ProxyMode_UDPTransport
 	} else {
-		utils.SendErrorResponse(w, "invalid mode given. Only support listen / transport / starter")
+		utils.SendErrorResponse(w, "invalid mode given. Only support listen / transport / starter / udplisten / udptransport")
+		return
 	}
 
 	//Create the target config
@@ -92,6 +98,10 @@ func (m *Manager) HandleEditProxyConfigs(w http.ResponseWriter, r *http.Request)
 			newMode = 1
 		case "starter":
 			newMode = 2
+		case "udplisten":
+			newMode = ProxyMode_UDPListen
+		case "udptransport":
+			newMode = ProxyMode_UDPTransport
 		default:
 			utils.SendErrorResponse(w, "invalid new mode value")
 			return
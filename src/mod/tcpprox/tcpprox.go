@@ -13,13 +13,16 @@ import (
 
 	Forward port from one port to another
 	Also accept active connection and passive
-	connection
+	connection. UDP ports can be forwarded with
+	the UDP modes, see udpprox.go
 */
 
 const (
-	ProxyMode_Listen    = 0
-	ProxyMode_Transport = 1
-	ProxyMode_Starter   = 2
+	ProxyMode_Listen       = 0
+	ProxyMode_Transport    = 1
+	ProxyMode_Starter      = 2
+	ProxyMode_UDPListen    = 3 //UDP port to port on this host
+	ProxyMode_UDPTransport = 4 //UDP port to host
 )
 
 type ProxyRelayOptions struct {
@@ -31,16 +34,18 @@ type ProxyRelayOptions struct {
 }
 
 type ProxyRelayConfig struct {
-	UUID                        string    //A UUIDv4 representing this config
-	Name                        string    //Name of the config
-	Running                     bool      //If the service is running
-	PortA                       string    //Ports A (config depends on mode)
-	PortB                       string    //Ports B (config depends on mode)
-	Mode                        int       //Operation Mode
-	Timeout                     int       //Timeout for connection in sec
-	stopChan                    chan bool //Stop channel to stop the listener
-	aTobAccumulatedByteTransfer int64     //Accumulated byte transfer from A to B
-	bToaAccumulatedByteTransfer int64     //Accumulated byte transfer from B to A
+	aTobAccumulatedByteTransfer int64 //Accumulated byte transfer from A to B, keep first for 64 bit alignment
+	bToaAccumulatedByteTransfer int64 //Accumulated byte transfer from B to A
+	udpSessionCount             int64 //Number of active UDP client sessions
+
+	UUID     string    //A UUIDv4 representing this config
+	Name     string    //Name of the config
+	Running  bool      //If the service is running
+	PortA    string    //Ports A (config depends on mode)
+	PortB    string    //Ports B (config depends on mode)
+	Mode     int       //Operation Mode
+	Timeout  int       //Timeout for connection in sec, idle timeout of client sessions in UDP modes
+	stopChan chan bool //Stop channel to stop the listener
 
 	parent *Manager `json:"-"`
 }
@@ -48,7 +53,8 @@ type ProxyRelayConfig struct {
 type Options struct {
 	Database             *database.Database
 	DefaultTimeout       int
-	AccessControlHandler func(net.Conn) bool
+	AccessControlHandler func(net.Addr) bool //Check if the remote TCP / UDP address is allowed
+	MaxUDPSessions       int                 //Maximum number of client sessions of each UDP config, set to 0 for default (1024)
 }
 
 type Manager struct {
@@ -71,12 +77,16 @@ func NewTCProxy(options *Options) *Manager {
 
 	//Check if the AccessControlHandler is empty. If yes, set it to always allow access
 	if options.AccessControlHandler == nil {
-		options.AccessControlHandler = func(conn net.Conn) bool {
+		options.AccessControlHandler = func(addr net.Addr) bool {
 			//Always allow access
 			return true
 		}
 	}
 
+	if options.MaxUDPSessions <= 0 {
+		options.MaxUDPSessions = udpDefaultMaxSessions
+	}
+
 	//Create a new proxy manager for TCP
 	thisManager := Manager{
 		Options:     options,
@@ -144,7 +154,7 @@ func (m *Manager) EditConfig(configUUID string, newName string, newPortA string,
 		foundConfig.PortB = newPortB
 	}
 	if newMode != -1 {
-		if newMode > 2 || newMode < 0 {
+		if newMode > ProxyMode_UDPTransport || newMode < 0 {
 			return errors.New("invalid mode given")
 		}
 		foundConfig.Mode = newMode
@@ -1,9 +1,14 @@
 package tcpprox_test
 
 import (
+	"io"
+	"net"
+	"path/filepath"
+	"strconv"
 	"testing"
 	"time"
 
+	"imuslab.com/zoraxy/mod/database"
 	"imuslab.com/zoraxy/mod/tcpprox"
 )
 
@@ -40,3 +45,140 @@ func TestPort2Port(t *testing.T) {
 		t.Errorf("port2port did not stop as expected")
 	}
 }
+
+// Get a free TCP port on localhost
+func getFreeTCPPort(t *testing.T) string {
+	probe, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer probe.Close()
+	return strconv.Itoa(probe.Addr().(*net.TCPAddr).Port)
+}
+
+// Start a TCP proxy config with the given mode and return the config
+func startTestTCPConfig(t *testing.T, mode int, portA string, portB string) *tcpprox.ProxyRelayConfig {
+	db, err := database.NewDatabase(filepath.Join(t.TempDir(), "test.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(db.Close)
+	manager := tcpprox.NewTCProxy(&tcpprox.Options{
+		Database:             db,
+		AccessControlHandler: func(addr net.Addr) bool { return true },
+	})
+	configUUID := manager.NewConfig(&tcpprox.ProxyRelayOptions{
+		Name:    "tcp",
+		PortA:   portA,
+		PortB:   portB,
+		Timeout: 1,
+		Mode:    mode,
+	})
+	config, _ := manager.GetConfigByUUID(configUUID)
+	if err := config.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { config.Stop() })
+	time.Sleep(100 * time.Millisecond)
+	return config
+}
+
+// Accept and close the connection made by the reachable check when the config start
+func discardReachableCheck(t *testing.T, listener net.Listener) {
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
+
+// Send request from connA to connB and response back, then check the per direction counters
+func checkTransferredBytes(t *testing.T, config *tcpprox.ProxyRelayConfig, connA net.Conn, connB net.Conn) {
+	connA.SetDeadline(time.Now().Add(5 * time.Second))
+	connB.SetDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 64)
+	connA.Write([]byte("hello"))
+	if _, err := io.ReadFull(connB, buf[:5]); err != nil {
+		t.Fatalf("request not forwarded: %v", err)
+	}
+	connB.Write([]byte("hello world"))
+	if _, err := io.ReadFull(connA, buf[:11]); err != nil {
+		t.Fatalf("response not forwarded: %v", err)
+	}
+
+	aTob, bToa := config.GetTransferredBytes()
+	if aTob != 5 || bToa != 11 {
+		t.Errorf("expected 5 bytes from A to B and 11 bytes from B to A, got %d and %d", aTob, bToa)
+	}
+}
+
+func TestTransferredBytesPort2Host(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+
+	portA := getFreeTCPPort(t)
+	config := startTestTCPConfig(t, tcpprox.ProxyMode_Transport, portA, target.Addr().String())
+	discardReachableCheck(t, target)
+	connA, err := net.Dial("tcp", "127.0.0.1:"+portA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer connA.Close()
+	connB, err := target.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer connB.Close()
+
+	checkTransferredBytes(t, config, connA, connB)
+}
+
+func TestTransferredBytesPort2Port(t *testing.T) {
+	portA := getFreeTCPPort(t)
+	portB := getFreeTCPPort(t)
+	config := startTestTCPConfig(t, tcpprox.ProxyMode_Listen, portA, portB)
+	connA, err := net.Dial("tcp", "127.0.0.1:"+portA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer connA.Close()
+	connB, err := net.Dial("tcp", "127.0.0.1:"+portB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer connB.Close()
+
+	checkTransferredBytes(t, config, connA, connB)
+}
+
+func TestTransferredBytesHost2Host(t *testing.T) {
+	hostA, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hostA.Close()
+	hostB, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hostB.Close()
+
+	config := startTestTCPConfig(t, tcpprox.ProxyMode_Starter, hostA.Addr().String(), hostB.Addr().String())
+	discardReachableCheck(t, hostA)
+	discardReachableCheck(t, hostB)
+	connA, err := hostA.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer connA.Close()
+	connB, err := hostB.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer connB.Close()
+
+	checkTransferredBytes(t, config, connA, connB)
+}
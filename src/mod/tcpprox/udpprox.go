@@ -0,0 +1,206 @@
+package tcpprox
+
+import (
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+	UDP Proxy
+
+	Forward UDP datagrams from a port to a target address.
+	Each client source address gets its own upstream socket
+	so replies can be routed back to the client, and the
+	session is closed after the idle timeout (the config
+	Timeout in seconds) without traffic in both directions
+*/
+
+// Idle timeout of UDP sessions if the config timeout is not set
+const udpDefaultIdleTimeout = 60 * time.Second
+
+// Maximum number of client sessions of each config if not set in options
+const udpDefaultMaxSessions = 1024
+
+// Maximum size of a UDP datagram
+const udpMaxDatagramSize = 65535
+
+type udpSession struct {
+	lastActive int64 //Unix nano time of the last datagram in either direction, keep first for 64 bit alignment
+
+	clientAddr *net.UDPAddr
+	upstream   *net.UDPConn
+}
+
+// Get the number of active UDP client sessions
+func (c *ProxyRelayConfig) GetUDPSessionCount() int64 {
+	return atomic.LoadInt64(&c.udpSessionCount)
+}
+
+func (c *ProxyRelayConfig) udpIdleTimeout() time.Duration {
+	if c.Timeout <= 0 {
+		return udpDefaultIdleTimeout
+	}
+	return time.Duration(c.Timeout) * time.Second
+}
+
+// Check if the address is a valid UDP target with host and port
+func isValidUDPTarget(address string) bool {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil || host == "" || !isValidPort(port) {
+		return false
+	}
+	_, err = net.ResolveUDPAddr("udp", address)
+	return err == nil
+}
+
+/*
+portA -> server
+server -> 127.0.0.1:portB
+*/
+func (c *ProxyRelayConfig) UDPPort2port(port1 string, port2 string, stopChan chan bool) error {
+	return c.UDPPort2host(port1, "127.0.0.1:"+port2, stopChan)
+}
+
+/*
+portA -> server
+server -> host:port
+*/
+func (c *ProxyRelayConfig) UDPPort2host(allowPort string, targetAddress string, stopChan chan bool) error {
+	target, err := net.ResolveUDPAddr("udp", targetAddress)
+	if err != nil {
+		return err
+	}
+	listenAddr, err := net.ResolveUDPAddr("udp", "0.0.0.0:"+allowPort)
+	if err != nil {
+		return err
+	}
+	log.Printf("[+] try to start UDP server on:[%s]\n", listenAddr.String())
+	listener, err := net.ListenUDP("udp", listenAddr)
+	if err != nil {
+		return errors.New("listen UDP address [" + listenAddr.String() + "] faild")
+	}
+	log.Printf("[√] start listen at UDP address:[%s]\n", listenAddr.String())
+	c.Running = true
+
+	sessions := map[string]*udpSession{}
+	sessionsMutex := sync.Mutex{}
+
+	//Start stop handler
+	go func() {
+		<-stopChan
+		log.Println("[x]", "Received stop signal. Exiting UDP Port to Host forwarder")
+		c.Running = false
+		listener.Close()
+		sessionsMutex.Lock()
+		for _, session := range sessions {
+			session.upstream.Close()
+		}
+		sessionsMutex.Unlock()
+	}()
+
+	idleTimeout := c.udpIdleTimeout()
+	buf := make([]byte, udpMaxDatagramSize)
+	for {
+		n, clientAddr, err := listener.ReadFromUDP(buf)
+		if err != nil {
+			if !c.Running || errors.Is(err, net.ErrClosed) {
+				//Terminate by stop chan. Exit listener loop
+				return nil
+			}
+
+			//Read error. Retry
+			continue
+		}
+
+		sessionKey := clientAddr.String()
+		sessionsMutex.Lock()
+		session := sessions[sessionKey]
+		sessionCount := len(sessions)
+		sessionsMutex.Unlock()
+
+		if session == nil {
+			//New client. Check if the source address in blacklist or whitelist.
+			//Rejected datagrams are dropped silently to avoid flooding the log
+			if !c.parent.Options.AccessControlHandler(clientAddr) {
+				continue
+			}
+
+			//Drop new clients if the session limit is reached, as each session holds an upstream socket
+			if sessionCount >= c.parent.Options.MaxUDPSessions {
+				continue
+			}
+
+			upstream, err := net.DialUDP("udp", nil, target)
+			if err != nil {
+				log.Printf("[x] connect UDP target address [%s] faild: %s\n", targetAddress, err.Error())
+				continue
+			}
+			session = &udpSession{
+				lastActive: time.Now().UnixNano(),
+				clientAddr: clientAddr,
+				upstream:   upstream,
+			}
+
+			sessionsMutex.Lock()
+			if !c.Running {
+				//Stopped while dialing the upstream
+				sessionsMutex.Unlock()
+				upstream.Close()
+				return nil
+			}
+			sessions[sessionKey] = session
+			atomic.AddInt64(&c.udpSessionCount, 1)
+			sessionsMutex.Unlock()
+			log.Printf("[√] new UDP session. client address:[%s], upstream address:[%s]\n", sessionKey, upstream.LocalAddr().String())
+
+			go c.udpSessionReturn(listener, session, idleTimeout, func() {
+				sessionsMutex.Lock()
+				delete(sessions, sessionKey)
+				atomic.AddInt64(&c.udpSessionCount, -1)
+				sessionsMutex.Unlock()
+			})
+		}
+
+		atomic.StoreInt64(&session.lastActive, time.Now().UnixNano())
+		written, err := session.upstream.Write(buf[:n])
+		if err == nil {
+			atomic.AddInt64(&c.aTobAccumulatedByteTransfer, int64(written))
+		}
+	}
+}
+
+// Relay the datagrams from the upstream back to the client until the session is idle or closed
+func (c *ProxyRelayConfig) udpSessionReturn(listener *net.UDPConn, session *udpSession, idleTimeout time.Duration, onClose func()) {
+	defer func() {
+		session.upstream.Close()
+		onClose()
+		log.Printf("[←] close the UDP session of client:[%s]\n", session.clientAddr.String())
+	}()
+
+	buf := make([]byte, udpMaxDatagramSize)
+	for {
+		session.upstream.SetReadDeadline(time.Now().Add(idleTimeout))
+		n, err := session.upstream.Read(buf)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				//Keep the session if the client is still sending
+				lastActive := time.Unix(0, atomic.LoadInt64(&session.lastActive))
+				if time.Since(lastActive) < idleTimeout {
+					continue
+				}
+			}
+			return
+		}
+
+		atomic.StoreInt64(&session.lastActive, time.Now().UnixNano())
+		written, err := listener.WriteToUDP(buf[:n], session.clientAddr)
+		if err != nil {
+			return
+		}
+		atomic.AddInt64(&c.bToaAccumulatedByteTransfer, int64(written))
+	}
+}
@@ -0,0 +1,115 @@
+package tcpprox_test
+
+import (
+	"net"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"imuslab.com/zoraxy/mod/database"
+	"imuslab.com/zoraxy/mod/tcpprox"
+)
+
+func TestUDPPort2Host(t *testing.T) {
+	//UDP echo server as the forward target
+	echoServer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echoServer.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := echoServer.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			echoServer.WriteToUDP(buf[:n], addr)
+		}
+	}()
+
+	//Find a free UDP port for the proxy
+	probe, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxyPort := strconv.Itoa(probe.LocalAddr().(*net.UDPAddr).Port)
+	probe.Close()
+
+	db, err := database.NewDatabase(filepath.Join(t.TempDir(), "test.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	checkedAddrs := make(chan net.Addr, 10)
+	manager := tcpprox.NewTCProxy(&tcpprox.Options{
+		Database:       db,
+		MaxUDPSessions: 1,
+		AccessControlHandler: func(addr net.Addr) bool {
+			checkedAddrs <- addr
+			return true
+		},
+	})
+	configUUID := manager.NewConfig(&tcpprox.ProxyRelayOptions{
+		Name:    "udp",
+		PortA:   proxyPort,
+		PortB:   echoServer.LocalAddr().String(),
+		Timeout: 1,
+		Mode:    tcpprox.ProxyMode_UDPTransport,
+	})
+	config, _ := manager.GetConfigByUUID(configUUID)
+	if err := config.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer config.Stop()
+	time.Sleep(100 * time.Millisecond)
+
+	client, err := net.Dial("udp", "127.0.0.1:"+proxyPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	for _, message := range []string{"hello", "world"} {
+		client.Write([]byte(message))
+		buf := make([]byte, 1500)
+		n, err := client.Read(buf)
+		if err != nil || string(buf[:n]) != message {
+			t.Fatalf("unexpected echo %q: %v", buf[:n], err)
+		}
+	}
+
+	//New clients are dropped once the session limit is reached
+	otherClient, err := net.Dial("udp", "127.0.0.1:"+proxyPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer otherClient.Close()
+	otherClient.SetDeadline(time.Now().Add(500 * time.Millisecond))
+	otherClient.Write([]byte("dropped"))
+	if _, err := otherClient.Read(make([]byte, 1500)); err == nil {
+		t.Fatal("client over the session limit is forwarded")
+	}
+	<-checkedAddrs //The dropped client is also checked
+
+	if len(checkedAddrs) != 1 {
+		t.Fatalf("access control checked %d times, expected once per session", len(checkedAddrs))
+	}
+	if checkedAddr, ok := (<-checkedAddrs).(*net.UDPAddr); !ok {
+		t.Fatalf("access control not checked with UDP source address: %v", checkedAddr)
+	}
+	if count := config.GetUDPSessionCount(); count != 1 {
+		t.Fatalf("expected 1 UDP session, got %d", count)
+	}
+	aTob, bToa := config.GetTransferredBytes()
+	if aTob != 10 || bToa != 10 {
+		t.Fatalf("unexpected transferred bytes %d / %d", aTob, bToa)
+	}
+
+	//Session is closed after the idle timeout
+	time.Sleep(2500 * time.Millisecond)
+	if count := config.GetUDPSessionCount(); count != 0 {
+		t.Fatalf("idle UDP session not closed, %d sessions active", count)
+	}
+}
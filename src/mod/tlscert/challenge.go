@@ -0,0 +1,60 @@
+package tlscert
+
+import (
+	"crypto/tls"
+	"errors"
+	"strings"
+)
+
+/*
+	Challenge.go
+
+	Serve ACME TLS-ALPN-01 challenge certificates on the main TLS listener,
+	so certificates can be obtained with only the TLS port reachable.
+	The challenge certificates are injected by the ACME handler during
+	issuance and removed after validation
+*/
+
+// Set the challenge certificate to serve for the domain
+func (m *Manager) SetChallengeCert(domain string, cert *tls.Certificate) {
+	m.challengeMutex.Lock()
+	defer m.challengeMutex.Unlock()
+	m.challengeCerts[strings.ToLower(domain)] = cert
+}
+
+// Remove the challenge certificate of the domain
+func (m *Manager) RemoveChallengeCert(domain string) {
+	m.challengeMutex.Lock()
+	defer m.challengeMutex.Unlock()
+	delete(m.challengeCerts, strings.ToLower(domain))
+}
+
+func (m *Manager) getChallengeCert(serverName string) (*tls.Certificate, error) {
+	m.challengeMutex.RLock()
+	defer m.challengeMutex.RUnlock()
+	cert, ok := m.challengeCerts[strings.ToLower(serverName)]
+	if !ok {
+		return nil, errors.New("no pending ACME challenge for " + serverName)
+	}
+	return cert, nil
+}
+
+// Override the TLS config for ACME challenge handshakes so the acme-tls/1
+// protocol is negotiated. Other handshakes use the TLS policy config, or
+// the listener config as is if no policy is set
+func (m *Manager) GetConfigForClient(helloInfo *tls.ClientHelloInfo) (*tls.Config, error) {
+	if !isACMEChallengeHello(helloInfo) {
+		return m.policyConfigForClient(helloInfo), nil
+	}
+	return &tls.Config{
+		GetCertificate: m.GetCert,
+		NextProtos:     []string{ACMETLS1Protocol},
+		MinVersion:     tls.VersionTLS12,
+	}, nil
+}
+
+// Check if the client hello only offers the acme-tls/1 protocol,
+// as required for challenge validation requests
+func isACMEChallengeHello(helloInfo *tls.ClientHelloInfo) bool {
+	return len(helloInfo.SupportedProtos) == 1 && helloInfo.SupportedProtos[0] == ACMETLS1Protocol
+}
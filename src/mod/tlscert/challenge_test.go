@@ -0,0 +1,79 @@
+package tlscert_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"testing"
+
+	"github.com/go-acme/lego/v4/challenge/tlsalpn01"
+	"imuslab.com/zoraxy/mod/tlscert"
+)
+
+func TestTLSALPNChallenge(t *testing.T) {
+	manager, err := tlscert.NewManager(t.TempDir(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	challengeCert, err := tlsalpn01.ChallengeCert("example.com", "token.keyauth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	manager.SetChallengeCert("Example.com", challengeCert)
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		GetCertificate:     manager.GetCert,
+		GetConfigForClient: manager.GetConfigForClient,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				conn.(*tls.Conn).Handshake()
+				conn.Close()
+			}()
+		}
+	}()
+
+	handshake := func(serverName string) (tls.ConnectionState, error) {
+		conn, err := tls.DialWithDialer(&net.Dialer{}, "tcp", ln.Addr().String(), &tls.Config{
+			ServerName:         serverName,
+			NextProtos:         []string{tlscert.ACMETLS1Protocol},
+			InsecureSkipVerify: true,
+		})
+		if err != nil {
+			return tls.ConnectionState{}, err
+		}
+		defer conn.Close()
+		return conn.ConnectionState(), nil
+	}
+
+	state, err := handshake("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.NegotiatedProtocol != tlscert.ACMETLS1Protocol {
+		t.Errorf("expected acme-tls/1 to be negotiated, got %q", state.NegotiatedProtocol)
+	}
+	expected, _ := x509.ParseCertificate(challengeCert.Certificate[0])
+	if len(state.PeerCertificates) == 0 || !state.PeerCertificates[0].Equal(expected) {
+		t.Error("challenge certificate not served")
+	}
+
+	//Domains without pending challenge and removed challenges must fail the handshake
+	if _, err := handshake("other.com"); err == nil {
+		t.Error("expected handshake failure for domain without challenge")
+	}
+	manager.RemoveChallengeCert("example.com")
+	if _, err := handshake("example.com"); err == nil {
+		t.Error("expected handshake failure after challenge removed")
+	}
+}
@@ -0,0 +1,230 @@
+package tlscert
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+	Index.go
+
+	Index the certificates in the cert store by their subject
+	alternative names, so a single certificate covering multiple
+	domains (or a wildcard) does not need to be copied under each
+	domain filename. The index is rebuilt when the cert store changes
+*/
+
+// Metadata of a certificate in the cert store
+type CertInfo struct {
+	Name         string   //Filename of the certificate without extension
+	Subject      string   //Subject common name
+	Issuer       string   //Issuer common name, or organization if common name is empty
+	SANs         []string //DNS names and IP addresses covered by the certificate
+	NotBefore    int64
+	NotAfter     int64
+	KeyType      string //e.g. RSA 2048, ECDSA P-256, Ed25519
+	Fingerprint  string //SHA-256 fingerprint of the leaf certificate
+	LastModified int64  //Modification time of the certificate file
+}
+
+type certIndex struct {
+	signature string               //Names, sizes and modification times of the indexed files
+	certs     map[string]*CertInfo //Keyed by certificate name
+	sans      map[string][]string  //Lowercase SAN to certificate names
+}
+
+// Get the certificate index, rebuild it if the cert store has changed
+func (m *Manager) getIndex() *certIndex {
+	entries, err := os.ReadDir(m.CertStore)
+	if err != nil {
+		return &certIndex{certs: map[string]*CertInfo{}, sans: map[string][]string{}}
+	}
+
+	//Only index certificates with a matching private key
+	filenames := []string{}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			filenames = append(filenames, entry.Name())
+		}
+	}
+	names := getCertPairs(filenames)
+	sort.Strings(names)
+
+	signature := strings.Builder{}
+	fileInfos := map[string]os.FileInfo{}
+	for _, name := range names {
+		info, err := os.Stat(filepath.Join(m.CertStore, name+".crt"))
+		if err != nil {
+			continue
+		}
+		fileInfos[name] = info
+		signature.WriteString(name + "|" + strconv.FormatInt(info.Size(), 10) + "|" + strconv.FormatInt(info.ModTime().UnixNano(), 10) + "\n")
+	}
+
+	m.indexMutex.Lock()
+	defer m.indexMutex.Unlock()
+	if m.index != nil && m.index.signature == signature.String() {
+		return m.index
+	}
+
+	index := certIndex{
+		signature: signature.String(),
+		certs:     map[string]*CertInfo{},
+		sans:      map[string][]string{},
+	}
+	for name, fileInfo := range fileInfos {
+		certBytes, err := os.ReadFile(filepath.Join(m.CertStore, name+".crt"))
+		if err != nil {
+			continue
+		}
+		info := parseCertInfo(name, certBytes)
+		if info == nil {
+			//Keep invalid certificates listed so they can be removed
+			info = &CertInfo{Name: name, SANs: []string{}}
+		}
+		info.LastModified = fileInfo.ModTime().Unix()
+		index.certs[name] = info
+		for _, san := range info.SANs {
+			san = strings.ToLower(san)
+			index.sans[san] = append(index.sans[san], name)
+		}
+	}
+	m.index = &index
+	return m.index
+}
+
+// Parse the leaf certificate of a PEM file into certificate info
+func parseCertInfo(name string, certBytes []byte) *CertInfo {
+	block, _ := pem.Decode(certBytes)
+	if block == nil {
+		return nil
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil
+	}
+
+	sans := []string{}
+	sans = append(sans, cert.DNSNames...)
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	if len(sans) == 0 && cert.Subject.CommonName != "" {
+		//Legacy certificates without SAN extension
+		sans = append(sans, cert.Subject.CommonName)
+	}
+
+	issuer := cert.Issuer.CommonName
+	if issuer == "" && len(cert.Issuer.Organization) > 0 {
+		issuer = cert.Issuer.Organization[0]
+	}
+
+	fingerprint := sha256.Sum256(cert.Raw)
+	return &CertInfo{
+		Name:        name,
+		Subject:     cert.Subject.CommonName,
+		Issuer:      issuer,
+		SANs:        sans,
+		NotBefore:   cert.NotBefore.Unix(),
+		NotAfter:    cert.NotAfter.Unix(),
+		KeyType:     getKeyType(cert),
+		Fingerprint: strings.ToUpper(hex.EncodeToString(fingerprint[:])),
+	}
+}
+
+func getKeyType(cert *x509.Certificate) string {
+	switch key := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		return "RSA " + strconv.Itoa(key.N.BitLen())
+	case *ecdsa.PublicKey:
+		return "ECDSA " + key.Curve.Params().Name
+	case ed25519.PublicKey:
+		return "Ed25519"
+	}
+	return cert.PublicKeyAlgorithm.String()
+}
+
+// Find the certificate covering the server name by its SANs. Exact names are
+// preferred over wildcards, and valid certificates with the latest expiry over others.
+// Return empty string if no certificate covers the server name
+func (m *Manager) MatchCertBySAN(serverName string) string {
+	serverName = strings.ToLower(strings.TrimSuffix(serverName, "."))
+	if serverName == "" {
+		return ""
+	}
+	index := m.getIndex()
+
+	if name := pickBestCert(index, index.sans[serverName]); name != "" {
+		return name
+	}
+
+	//Wildcard only covers a single label
+	if dot := strings.Index(serverName, "."); dot > 0 {
+		return pickBestCert(index, index.sans["*"+serverName[dot:]])
+	}
+	return ""
+}
+
+func pickBestCert(index *certIndex, names []string) string {
+	now := time.Now().Unix()
+	bestName := ""
+	var best *CertInfo
+	for _, name := range names {
+		info := index.certs[name]
+		if best == nil {
+			bestName, best = name, info
+			continue
+		}
+		infoValid := info.NotBefore <= now && now < info.NotAfter
+		bestValid := best.NotBefore <= now && now < best.NotAfter
+		if (infoValid && !bestValid) || (infoValid == bestValid && info.NotAfter > best.NotAfter) {
+			bestName, best = name, info
+		}
+	}
+	return bestName
+}
+
+// Get the name of the certificate that would be served for the server name,
+// or empty string if the default or build-in certificate would be used
+func (m *Manager) MatchCert(serverName string) string {
+	serverName = strings.ToLower(serverName)
+	if _, ok := m.getIndex().certs[serverName]; ok {
+		return serverName
+	}
+	if name := m.MatchCertBySAN(serverName); name != "" {
+		return name
+	}
+	domainCerts, _ := m.ListCertDomains()
+	return matchClosestDomainCertificate(serverName, domainCerts)
+}
+
+// Check if the certificate of the given name has expired
+func (m *Manager) certExpired(name string) bool {
+	info, ok := m.getIndex().certs[name]
+	return ok && info.NotAfter > 0 && info.NotAfter <= time.Now().Unix()
+}
+
+// List the metadata of all certificates in the cert store, sorted by name
+func (m *Manager) ListCertInfo() []*CertInfo {
+	index := m.getIndex()
+	results := []*CertInfo{}
+	for _, info := range index.certs {
+		infoCopy := *info
+		results = append(results, &infoCopy)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Name < results[j].Name
+	})
+	return results
+}
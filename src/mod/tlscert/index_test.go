@@ -0,0 +1,93 @@
+package tlscert_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"imuslab.com/zoraxy/mod/tlscert"
+)
+
+// Write a self signed certificate covering the names to the cert store
+func writeTestCert(t *testing.T, dir string, name string, names []string, notAfter time.Time) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: names[0]},
+		Issuer:       pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, _ := x509.MarshalPKCS8PrivateKey(key)
+	os.WriteFile(filepath.Join(dir, name+".crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	os.WriteFile(filepath.Join(dir, name+".key"), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600)
+}
+
+func TestSANIndex(t *testing.T) {
+	dir := t.TempDir()
+	manager, err := tlscert.NewManager(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeTestCert(t, dir, "multi", []string{"a.example.com", "B.example.org", "*.apps.example.net"}, time.Now().Add(30*24*time.Hour))
+	//Expired certificate covering the same name
+	writeTestCert(t, dir, "old", []string{"a.example.com"}, time.Now().Add(-time.Minute))
+	//Certificate without private key is not indexed
+	writeTestCert(t, dir, "nokey", []string{"nokey.example.com"}, time.Now().Add(time.Hour))
+	os.Remove(filepath.Join(dir, "nokey.key"))
+
+	tests := map[string]string{
+		"a.example.com":          "multi",
+		"b.example.org":          "multi",
+		"web.apps.example.net":   "multi",
+		"x.web.apps.example.net": "",
+		"apps.example.net":       "",
+		"nokey.example.com":      "",
+		"old":                    "old",
+	}
+	for serverName, expected := range tests {
+		if got := manager.MatchCert(serverName); got != expected {
+			t.Errorf("MatchCert(%s) = %q, expected %q", serverName, got, expected)
+		}
+	}
+
+	//Certificate is served by its SAN
+	cert, err := manager.GetCert(&tls.ClientHelloInfo{ServerName: "b.example.org"})
+	if err != nil || cert == nil {
+		t.Fatal("certificate not served by SAN")
+	}
+	leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+	if leaf.Subject.CommonName != "a.example.com" {
+		t.Fatalf("wrong certificate served: %s", leaf.Subject.CommonName)
+	}
+
+	infos := manager.ListCertInfo()
+	if len(infos) != 2 || infos[0].Name != "multi" || len(infos[0].SANs) != 3 || infos[0].KeyType != "ECDSA P-256" || infos[0].Issuer != "a.example.com" || len(infos[0].Fingerprint) != 64 {
+		t.Fatalf("unexpected certificate info: %+v", infos)
+	}
+
+	//Index is refreshed when the cert store changes
+	writeTestCert(t, dir, "other", []string{"new.example.com"}, time.Now().Add(time.Hour))
+	if manager.MatchCert("new.example.com") != "other" {
+		t.Fatal("index not refreshed after adding certificate")
+	}
+	manager.RemoveCert("multi")
+	if manager.MatchCert("b.example.org") != "" {
+		t.Fatal("index not refreshed after removing certificate")
+	}
+}
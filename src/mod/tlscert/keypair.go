@@ -0,0 +1,188 @@
+package tlscert
+
+import (
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+/*
+	Keypair.go
+
+	Parsing, import and export of certificate key pairs.
+	Supports PKCS#1, SEC1 (EC) and PKCS#8 private keys,
+	full-chain PEM bundles and PKCS#12 / PFX archives
+*/
+
+// Parse the private key in a PEM file. Other blocks like EC PARAMETERS are skipped
+func ParsePrivateKeyPEM(keyPEM []byte) (crypto.Signer, error) {
+	for block, rest := pem.Decode(keyPEM); block != nil; block, rest = pem.Decode(rest) {
+		switch block.Type {
+		case "RSA PRIVATE KEY":
+			return x509.ParsePKCS1PrivateKey(block.Bytes)
+		case "EC PRIVATE KEY":
+			return x509.ParseECPrivateKey(block.Bytes)
+		case "PRIVATE KEY":
+			key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			signer, ok := key.(crypto.Signer)
+			if !ok {
+				return nil, errors.New("unsupported private key type")
+			}
+			return signer, nil
+		case "ENCRYPTED PRIVATE KEY":
+			return nil, errors.New("encrypted private keys are not supported, remove the passphrase or upload as PFX")
+		}
+	}
+	return nil, errors.New("no private key found")
+}
+
+// Parse all certificates in a PEM file, the leaf certificate comes first
+func ParseCertificateChainPEM(certPEM []byte) ([]*x509.Certificate, error) {
+	certs := []*x509.Certificate{}
+	for block, rest := pem.Decode(certPEM); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("no certificate found")
+	}
+	return certs, nil
+}
+
+// Encode certificates as a PEM chain
+func encodeCertificateChain(certs []*x509.Certificate) []byte {
+	chainPEM := []byte{}
+	for _, cert := range certs {
+		chainPEM = append(chainPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+	}
+	return chainPEM
+}
+
+// Encode the private key in PKCS#8 PEM format
+func encodePrivateKey(key interface{}) ([]byte, error) {
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), nil
+}
+
+// Split a PEM bundle into the certificate chain and the private key.
+// The key is nil if the bundle only contains certificates
+func SplitPEMBundle(bundle []byte) (certPEM []byte, keyPEM []byte, err error) {
+	certs, err := ParseCertificateChainPEM(bundle)
+	if err != nil {
+		return nil, nil, err
+	}
+	certPEM = encodeCertificateChain(certs)
+	if strings.Contains(string(bundle), "PRIVATE KEY-----") {
+		key, err := ParsePrivateKeyPEM(bundle)
+		if err != nil {
+			return nil, nil, err
+		}
+		keyPEM, err = encodePrivateKey(key)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return certPEM, keyPEM, nil
+}
+
+// Extract the certificate chain and private key in PEM format from a PKCS#12 / PFX archive
+func ParsePKCS12(pfxData []byte, password string) (certPEM []byte, keyPEM []byte, err error) {
+	key, cert, caCerts, err := pkcs12.DecodeChain(pfxData, password)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPEM, err = encodePrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return encodeCertificateChain(append([]*x509.Certificate{cert}, caCerts...)), keyPEM, nil
+}
+
+// Check if the public key of the certificate matches the private key
+func keyMatchesCertificate(cert *x509.Certificate, key crypto.Signer) bool {
+	pub, ok := cert.PublicKey.(interface{ Equal(crypto.PublicKey) bool })
+	return ok && pub.Equal(key.Public())
+}
+
+// Validate the certificate chain and private key, then write them to the cert store
+func (m *Manager) ImportKeyPair(name string, certPEM []byte, keyPEM []byte) error {
+	if name == "" || strings.ContainsAny(name, "/\\") || strings.Contains(name, "..") {
+		return errors.New("invalid certificate name")
+	}
+	certs, err := ParseCertificateChainPEM(certPEM)
+	if err != nil {
+		return err
+	}
+	key, err := ParsePrivateKeyPEM(keyPEM)
+	if err != nil {
+		return err
+	}
+	if !keyMatchesCertificate(certs[0], key) {
+		return errors.New("private key does not match the certificate")
+	}
+
+	os.MkdirAll(m.CertStore, 0775)
+	err = os.WriteFile(filepath.Join(m.CertStore, name+".crt"), certPEM, 0644)
+	if err != nil {
+		return err
+	}
+	return WritePrivateKeyFile(filepath.Join(m.CertStore, name+".key"), keyPEM)
+}
+
+// Write a private key file readable by the owner only. The permission is also
+// fixed if the file already exists, as os.WriteFile only applies it on creation
+func WritePrivateKeyFile(filename string, keyPEM []byte) error {
+	err := os.WriteFile(filename, keyPEM, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Chmod(filename, 0600)
+}
+
+// Export the certificate chain and private key in the cert store as a PKCS#12 / PFX archive
+func (m *Manager) ExportPKCS12(name string, password string) ([]byte, error) {
+	if name == "" || strings.ContainsAny(name, "/\\") || strings.Contains(name, "..") {
+		return nil, errors.New("invalid certificate name")
+	}
+	certPEM, err := os.ReadFile(filepath.Join(m.CertStore, name+".crt"))
+	if err != nil {
+		return nil, errors.New("certificate not found")
+	}
+	keyPEM, err := os.ReadFile(filepath.Join(m.CertStore, name+".key"))
+	if err != nil {
+		return nil, errors.New("private key not found")
+	}
+
+	//Make sure the pair is loadable before exporting
+	if _, err := tls.X509KeyPair(certPEM, keyPEM); err != nil {
+		return nil, err
+	}
+	certs, err := ParseCertificateChainPEM(certPEM)
+	if err != nil {
+		return nil, err
+	}
+	key, err := ParsePrivateKeyPEM(keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	return pkcs12.Modern.Encode(key, certs[0], certs[1:], password)
+}
@@ -0,0 +1,92 @@
+package tlscert_test
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"imuslab.com/zoraxy/mod/tlscert"
+)
+
+func TestKeyPairImportExport(t *testing.T) {
+	dir := t.TempDir()
+	manager, err := tlscert.NewManager(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestCert(t, dir, "source", []string{"ec.example.com"}, time.Now().Add(time.Hour))
+	certPEM, _ := os.ReadFile(filepath.Join(dir, "source.crt"))
+	keyPEM, _ := os.ReadFile(filepath.Join(dir, "source.key"))
+
+	//EC certificates only have digital signature key usage
+	if !tlscert.IsValidTLSFile(bytes.NewReader(certPEM)) || !tlscert.IsValidTLSFile(bytes.NewReader(keyPEM)) {
+		t.Fatal("EC certificate or PKCS#8 key rejected")
+	}
+
+	//SEC1 EC private key with parameters block
+	key, err := tlscert.ParsePrivateKeyPEM(keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecDER, _ := x509.MarshalECPrivateKey(key.(*ecdsa.PrivateKey))
+	ecPEM := append([]byte("-----BEGIN EC PARAMETERS-----\nBggqhkjOPQMBBw==\n-----END EC PARAMETERS-----\n"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: ecDER})...)
+	if !tlscert.IsValidTLSFile(bytes.NewReader(ecPEM)) {
+		t.Fatal("EC private key rejected")
+	}
+	err = manager.ImportKeyPair("sec1", certPEM, ecPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//Full chain bundle with private key
+	bundle := append(append([]byte{}, certPEM...), keyPEM...)
+	bundleCert, bundleKey, err := tlscert.SplitPEMBundle(bundle)
+	if err != nil || bundleKey == nil {
+		t.Fatal("unable to split PEM bundle")
+	}
+	err = manager.ImportKeyPair("bundle", bundleCert, bundleKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(filepath.Join(dir, "bundle.key")); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatal("private key is readable by others")
+	}
+
+	//Mismatched key is rejected
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	otherDER, _ := x509.MarshalPKCS8PrivateKey(otherKey)
+	err = manager.ImportKeyPair("mismatch", certPEM, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: otherDER}))
+	if err == nil {
+		t.Fatal("mismatched private key accepted")
+	}
+	if manager.ImportKeyPair("../escape", certPEM, keyPEM) == nil {
+		t.Fatal("path traversal in certificate name accepted")
+	}
+
+	//PFX round trip with password
+	pfxData, err := manager.ExportPKCS12("sec1", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := tlscert.ParsePKCS12(pfxData, "wrong"); err == nil {
+		t.Fatal("PFX opened with wrong password")
+	}
+	pfxCert, pfxKey, err := tlscert.ParsePKCS12(pfxData, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = manager.ImportKeyPair("imported", pfxCert, pfxKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manager.MatchCert("ec.example.com") == "" {
+		t.Fatal("imported certificate not indexed")
+	}
+}
@@ -0,0 +1,292 @@
+package tlscert
+
+import (
+	"crypto/tls"
+	"errors"
+	"sort"
+	"strings"
+)
+
+/*
+	Policy.go
+
+	TLS security policy of the proxy listener. Profiles follow the
+	Mozilla server side TLS recommendations, or a custom policy can
+	be defined with explicit cipher suites and curves. Minimum
+	versions and ALPN protocols can be overridden per host, and are
+	applied in GetConfigForClient at handshake time
+
+	Note that TLS 1.3 cipher suites are not configurable in Go, the
+	cipher suite list only applies to TLS 1.2 and below
+*/
+
+const (
+	TLSProfile_Default      = ""             //Go defaults, minimum version follows the force latest TLS setting
+	TLSProfile_Modern       = "modern"       //TLS 1.3 only
+	TLSProfile_Intermediate = "intermediate" //TLS 1.2+ with AEAD cipher suites
+	TLSProfile_Legacy       = "legacy"       //TLS 1.0+ for old clients
+	TLSProfile_Custom       = "custom"       //Explicit versions, cipher suites and curves
+)
+
+type TLSPolicy struct {
+	Profile      string
+	MinVersion   string                    //Custom profile only, 1.0 / 1.1 / 1.2 / 1.3
+	CipherSuites []string                  //Custom profile only, IANA names. Empty to use Go defaults
+	Curves       []string                  //Custom profile only. Empty to use Go defaults
+	Hosts        map[string]*HostTLSPolicy //Per host overrides, keyed by hostname or wildcard (*.example.com)
+}
+
+type HostTLSPolicy struct {
+	MinVersion string   //Empty to inherit from the policy
+	ALPN       []string //Protocols to negotiate, h2 and/or http/1.1. Empty to inherit
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var tlsCurves = map[string]tls.CurveID{
+	"X25519": tls.X25519,
+	"P-256":  tls.CurveP256,
+	"P-384":  tls.CurveP384,
+	"P-521":  tls.CurveP521,
+}
+
+var supportedALPN = []string{"h2", "http/1.1"}
+
+var intermediateCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+}
+
+var legacyCipherSuites = append(append([]uint16{}, intermediateCipherSuites...),
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+	tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+	tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+	tls.TLS_RSA_WITH_3DES_EDE_CBC_SHA,
+)
+
+var profileCurves = []tls.CurveID{tls.X25519, tls.CurveP256, tls.CurveP384}
+
+// Get the cipher suite ID by its IANA name
+func cipherSuiteByName(name string) (uint16, bool) {
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		if suite.Name == name {
+			return suite.ID, true
+		}
+	}
+	return 0, false
+}
+
+// List the names of the cipher suites, curves and versions that can be used in a custom policy
+func SupportedTLSOptions() (cipherSuites []string, curves []string, versions []string) {
+	cipherSuites = []string{}
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		if !isTLS13Only(suite) {
+			cipherSuites = append(cipherSuites, suite.Name)
+		}
+	}
+	curves = []string{}
+	for name := range tlsCurves {
+		curves = append(curves, name)
+	}
+	versions = []string{}
+	for name := range tlsVersions {
+		versions = append(versions, name)
+	}
+	sort.Strings(curves)
+	sort.Strings(versions)
+	return cipherSuites, curves, versions
+}
+
+func isTLS13Only(suite *tls.CipherSuite) bool {
+	for _, version := range suite.SupportedVersions {
+		if version != tls.VersionTLS13 {
+			return false
+		}
+	}
+	return true
+}
+
+// Validate the policy before applying
+func (p *TLSPolicy) Validate() error {
+	switch p.Profile {
+	case TLSProfile_Default, TLSProfile_Modern, TLSProfile_Intermediate, TLSProfile_Legacy:
+	case TLSProfile_Custom:
+		if _, ok := tlsVersions[p.MinVersion]; !ok {
+			return errors.New("invalid minimum TLS version " + p.MinVersion)
+		}
+		for _, name := range p.CipherSuites {
+			if _, ok := cipherSuiteByName(name); !ok {
+				return errors.New("unsupported cipher suite " + name)
+			}
+		}
+		for _, name := range p.Curves {
+			if _, ok := tlsCurves[name]; !ok {
+				return errors.New("unsupported curve " + name)
+			}
+		}
+	default:
+		return errors.New("unknown TLS profile " + p.Profile)
+	}
+
+	for host, hostPolicy := range p.Hosts {
+		if err := hostPolicy.Validate(); err != nil {
+			return errors.New(host + ": " + err.Error())
+		}
+	}
+	return nil
+}
+
+// Validate the per host overrides
+func (h *HostTLSPolicy) Validate() error {
+	if h.MinVersion != "" {
+		if _, ok := tlsVersions[h.MinVersion]; !ok {
+			return errors.New("invalid minimum TLS version " + h.MinVersion)
+		}
+	}
+	for _, protocol := range h.ALPN {
+		if !contains(supportedALPN, protocol) {
+			return errors.New("unsupported ALPN protocol " + protocol)
+		}
+	}
+	return nil
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Apply the version, cipher suite and curve settings of the policy to the config
+func (p *TLSPolicy) apply(config *tls.Config) {
+	switch p.Profile {
+	case TLSProfile_Modern:
+		config.MinVersion = tls.VersionTLS13
+		config.CurvePreferences = profileCurves
+	case TLSProfile_Intermediate:
+		config.MinVersion = tls.VersionTLS12
+		config.CipherSuites = intermediateCipherSuites
+		config.CurvePreferences = profileCurves
+	case TLSProfile_Legacy:
+		config.MinVersion = tls.VersionTLS10
+		config.CipherSuites = legacyCipherSuites
+		config.CurvePreferences = profileCurves
+	case TLSProfile_Custom:
+		config.MinVersion = tlsVersions[p.MinVersion]
+		config.CipherSuites = nil
+		for _, name := range p.CipherSuites {
+			id, _ := cipherSuiteByName(name)
+			config.CipherSuites = append(config.CipherSuites, id)
+		}
+		config.CurvePreferences = nil
+		for _, name := range p.Curves {
+			config.CurvePreferences = append(config.CurvePreferences, tlsCurves[name])
+		}
+	}
+}
+
+// Find the override of the server name, exact hostnames are preferred over wildcards
+func (p *TLSPolicy) matchHost(serverName string) *HostTLSPolicy {
+	serverName = strings.ToLower(strings.TrimSuffix(serverName, "."))
+	if hostPolicy, ok := p.Hosts[serverName]; ok {
+		return hostPolicy
+	}
+	if dot := strings.Index(serverName, "."); dot > 0 {
+		if hostPolicy, ok := p.Hosts["*"+serverName[dot:]]; ok {
+			return hostPolicy
+		}
+	}
+	return nil
+}
+
+// Set the TLS policy, applied to new handshakes immediately
+func (m *Manager) SetPolicy(policy *TLSPolicy) error {
+	if policy.Hosts == nil {
+		policy.Hosts = map[string]*HostTLSPolicy{}
+	}
+	err := policy.Validate()
+	if err != nil {
+		return err
+	}
+
+	//Hostnames are matched case insensitively
+	hosts := map[string]*HostTLSPolicy{}
+	for host, hostPolicy := range policy.Hosts {
+		hosts[strings.ToLower(host)] = hostPolicy
+	}
+	policy.Hosts = hosts
+
+	m.policyMutex.Lock()
+	m.policy = policy
+	m.policyMutex.Unlock()
+	return nil
+}
+
+// Get a copy of the current TLS policy
+func (m *Manager) GetPolicy() *TLSPolicy {
+	m.policyMutex.RLock()
+	defer m.policyMutex.RUnlock()
+	if m.policy == nil {
+		return &TLSPolicy{Hosts: map[string]*HostTLSPolicy{}}
+	}
+	policy := *m.policy
+	policy.Hosts = map[string]*HostTLSPolicy{}
+	for host, hostPolicy := range m.policy.Hosts {
+		policy.Hosts[host] = hostPolicy
+	}
+	return &policy
+}
+
+// Build the TLS config of the handshake from the policy. Return nil
+// to use the listener config if the policy does not change anything
+func (m *Manager) policyConfigForClient(helloInfo *tls.ClientHelloInfo) *tls.Config {
+	policy := m.GetPolicy()
+	hostPolicy := policy.matchHost(helloInfo.ServerName)
+	if policy.Profile == TLSProfile_Default && hostPolicy == nil {
+		return nil
+	}
+
+	config := &tls.Config{
+		GetCertificate: m.GetCert,
+	}
+	if policy.Profile == TLSProfile_Default {
+		m.policyMutex.RLock()
+		config.MinVersion = m.defaultMinVersion
+		m.policyMutex.RUnlock()
+	}
+	policy.apply(config)
+	if hostPolicy != nil {
+		if hostPolicy.MinVersion != "" {
+			config.MinVersion = tlsVersions[hostPolicy.MinVersion]
+		}
+		if len(hostPolicy.ALPN) > 0 {
+			config.NextProtos = hostPolicy.ALPN
+		}
+	}
+	return config
+}
+
+// Set the minimum TLS version of the default profile, which is
+// used by the listener config when there is no policy set
+func (m *Manager) SetDefaultMinVersion(version uint16) {
+	m.policyMutex.Lock()
+	defer m.policyMutex.Unlock()
+	m.defaultMinVersion = version
+}
@@ -0,0 +1,106 @@
+package tlscert_test
+
+import (
+	"crypto/tls"
+	"net"
+	"testing"
+	"time"
+
+	"imuslab.com/zoraxy/mod/tlscert"
+)
+
+func TestTLSPolicy(t *testing.T) {
+	dir := t.TempDir()
+	manager, err := tlscert.NewManager(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestCert(t, dir, "example", []string{"example.com", "*.example.com"}, time.Now().Add(time.Hour))
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		GetCertificate:     manager.GetCert,
+		GetConfigForClient: manager.GetConfigForClient,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				conn.(*tls.Conn).Handshake()
+				conn.Close()
+			}()
+		}
+	}()
+
+	handshake := func(serverName string, maxVersion uint16, protos []string) (tls.ConnectionState, error) {
+		conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp", ln.Addr().String(), &tls.Config{
+			ServerName:         serverName,
+			MaxVersion:         maxVersion,
+			NextProtos:         protos,
+			InsecureSkipVerify: true,
+		})
+		if err != nil {
+			return tls.ConnectionState{}, err
+		}
+		defer conn.Close()
+		return conn.ConnectionState(), nil
+	}
+
+	//Invalid policies are rejected
+	if manager.SetPolicy(&tlscert.TLSPolicy{Profile: "unknown"}) == nil {
+		t.Fatal("unknown profile accepted")
+	}
+	if manager.SetPolicy(&tlscert.TLSPolicy{Profile: tlscert.TLSProfile_Custom, MinVersion: "1.2", CipherSuites: []string{"TLS_FAKE"}}) == nil {
+		t.Fatal("unknown cipher suite accepted")
+	}
+	if manager.SetPolicy(&tlscert.TLSPolicy{Hosts: map[string]*tlscert.HostTLSPolicy{"a.example.com": {ALPN: []string{"spdy/3"}}}}) == nil {
+		t.Fatal("unsupported ALPN protocol accepted")
+	}
+
+	//Modern profile only accepts TLS 1.3
+	err = manager.SetPolicy(&tlscert.TLSPolicy{Profile: tlscert.TLSProfile_Modern})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := handshake("example.com", tls.VersionTLS12, nil); err == nil {
+		t.Fatal("TLS 1.2 accepted by modern profile")
+	}
+	if state, err := handshake("example.com", 0, nil); err != nil || state.Version != tls.VersionTLS13 {
+		t.Fatalf("TLS 1.3 handshake failed: %v", err)
+	}
+
+	//Custom profile with explicit cipher suite, host overrides for minimum version and ALPN
+	err = manager.SetPolicy(&tlscert.TLSPolicy{
+		Profile:      tlscert.TLSProfile_Custom,
+		MinVersion:   "1.2",
+		CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384"},
+		Curves:       []string{"P-256"},
+		Hosts: map[string]*tlscert.HostTLSPolicy{
+			"Secure.example.com": {MinVersion: "1.3"},
+			"*.example.com":      {ALPN: []string{"h2", "http/1.1"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, err := handshake("example.com", tls.VersionTLS12, []string{"h2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.CipherSuite != tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384 || state.NegotiatedProtocol != "" {
+		t.Fatal("custom cipher suite not applied or ALPN negotiated without override")
+	}
+	if _, err := handshake("secure.example.com", tls.VersionTLS12, nil); err == nil {
+		t.Fatal("TLS 1.2 accepted on host with TLS 1.3 override")
+	}
+	state, err = handshake("app.example.com", tls.VersionTLS12, []string{"h2", "http/1.1"})
+	if err != nil || state.NegotiatedProtocol != "h2" {
+		t.Fatal("ALPN override not applied on wildcard host")
+	}
+}
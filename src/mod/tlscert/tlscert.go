@@ -9,16 +9,40 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 
 	"imuslab.com/zoraxy/mod/utils"
 )
 
+// ALPN protocol of the ACME TLS-ALPN-01 challenge (RFC 8737)
+const ACMETLS1Protocol = "acme-tls/1"
+
+// Issuer of certificates for server names without certificate at handshake time
+type OnDemandIssuer interface {
+	//Obtain the certificate of the server name, return true if it is ready in the cert store.
+	//The client address is used for rate limiting and can be nil
+	IssueOnDemand(serverName string, clientAddr net.Addr) bool
+}
+
 type Manager struct {
 	CertStore string
+	OnDemand  OnDemandIssuer //On-demand certificate issuer, can be nil
 	verbal    bool
+
+	challengeCerts map[string]*tls.Certificate //TLS-ALPN-01 challenge certificates, keyed by domain
+	challengeMutex sync.RWMutex
+
+	index      *certIndex //Certificates indexed by SANs
+	indexMutex sync.Mutex
+
+	policy            *TLSPolicy //TLS policy applied at handshake, nil for Go defaults
+	defaultMinVersion uint16     //Minimum TLS version of the listener config
+	policyMutex       sync.RWMutex
 }
 
 //go:embed localhost.crt localhost.key
@@ -30,8 +54,10 @@ func NewManager(certStore string, verbal bool) (*Manager, error) {
 	}
 
 	thisManager := Manager{
-		CertStore: certStore,
-		verbal:    verbal,
+		CertStore:         certStore,
+		verbal:            verbal,
+		challengeCerts:    map[string]*tls.Certificate{},
+		defaultMinVersion: tls.VersionTLS10,
 	}
 
 	return &thisManager, nil
@@ -66,6 +92,11 @@ func (m *Manager) ListCerts() ([]string, error) {
 }
 
 func (m *Manager) GetCert(helloInfo *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if isACMEChallengeHello(helloInfo) {
+		//Answer the TLS-ALPN-01 challenge with the injected challenge certificate
+		return m.getChallengeCert(helloInfo.ServerName)
+	}
+
 	//Check if the domain corrisponding cert exists
 	pubKey := "./tmp/localhost.crt"
 	priKey := "./tmp/localhost.key"
@@ -85,9 +116,17 @@ func (m *Manager) GetCert(helloInfo *tls.ClientHelloInfo) (*tls.Certificate, err
 	keyName := fmt.Sprintf("%s.key", helloInfo.ServerName)
 
 	if utils.FileExists(filepath.Join(m.CertStore, crtName)) && utils.FileExists(filepath.Join(m.CertStore, keyName)) {
+		if m.OnDemand != nil && m.certExpired(helloInfo.ServerName) {
+			//Try to issue the expired certificate again, keep serving it if failed
+			m.OnDemand.IssueOnDemand(helloInfo.ServerName, getClientAddr(helloInfo))
+		}
 		pubKey = filepath.Join(m.CertStore, crtName)
 		priKey = filepath.Join(m.CertStore, keyName)
 
+	} else if sanCert := m.MatchCertBySAN(helloInfo.ServerName); sanCert != "" {
+		//A certificate covers this server name in its SANs
+		pubKey = filepath.Join(m.CertStore, sanCert+".crt")
+		priKey = filepath.Join(m.CertStore, sanCert+".key")
 	} else {
 		domainCerts, _ := m.ListCertDomains()
 		cloestDomainCert := matchClosestDomainCertificate(helloInfo.ServerName, domainCerts)
@@ -95,6 +134,10 @@ func (m *Manager) GetCert(helloInfo *tls.ClientHelloInfo) (*tls.Certificate, err
 			//There is a matching parent domain for this subdomain. Use this instead.
 			pubKey = filepath.Join(m.CertStore, fmt.Sprintf("%s.crt", cloestDomainCert))
 			priKey = filepath.Join(m.CertStore, fmt.Sprintf("%s.key", cloestDomainCert))
+		} else if helloInfo.ServerName != "" && m.OnDemand != nil && m.OnDemand.IssueOnDemand(helloInfo.ServerName, getClientAddr(helloInfo)) {
+			//Certificate obtained for this server name at handshake
+			pubKey = filepath.Join(m.CertStore, strings.ToLower(crtName))
+			priKey = filepath.Join(m.CertStore, strings.ToLower(keyName))
 		} else if m.DefaultCertExists() {
 			//Use default.crt and default.key
 			pubKey = filepath.Join(m.CertStore, "default.crt")
@@ -119,6 +162,43 @@ func (m *Manager) GetCert(helloInfo *tls.ClientHelloInfo) (*tls.Certificate, err
 	return &cer, nil
 }
 
+// Get the remote address of the handshake connection, nil if not available
+func getClientAddr(helloInfo *tls.ClientHelloInfo) net.Addr {
+	if helloInfo.Conn == nil {
+		return nil
+	}
+	return helloInfo.Conn.RemoteAddr()
+}
+
+// Get the expiry time of all the certificates in the cert store, keyed by domain
+func (m *Manager) GetCertExpiryTimes() (map[string]time.Time, error) {
+	domains, err := m.ListCertDomains()
+	if err != nil {
+		return nil, err
+	}
+
+	results := map[string]time.Time{}
+	for _, domain := range domains {
+		certBytes, err := os.ReadFile(filepath.Join(m.CertStore, domain+".crt"))
+		if err != nil {
+			continue
+		}
+
+		block, _ := pem.Decode(certBytes)
+		if block == nil {
+			continue
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			continue
+		}
+		results[domain] = cert.NotAfter
+	}
+
+	return results, nil
+}
+
 // Check if both the default cert public key and private key exists
 func (m *Manager) DefaultCertExists() bool {
 	return utils.FileExists(filepath.Join(m.CertStore, "default.crt")) && utils.FileExists(filepath.Join(m.CertStore, "default.key"))
@@ -168,17 +248,17 @@ func IsValidTLSFile(file io.Reader) bool {
 
 	// Parse the certificate or key
 	if strings.Contains(block.Type, "CERTIFICATE") {
-		// The file contains a certificate
-		cert, err := x509.ParseCertificate(block.Bytes)
+		// The file contains a certificate or a full chain, the leaf comes first
+		certs, err := ParseCertificateChainPEM(contents)
 		if err != nil {
-			// Handle the error
 			return false
 		}
-		// Check if the certificate is a valid TLS/SSL certificate
-		return !cert.IsCA && cert.KeyUsage&x509.KeyUsageDigitalSignature != 0 && cert.KeyUsage&x509.KeyUsageKeyEncipherment != 0
-	} else if strings.Contains(block.Type, "PRIVATE KEY") {
-		// The file contains a private key
-		_, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		// Check if the certificate can be used for TLS. EC certificates only have digital signature usage
+		cert := certs[0]
+		return cert.KeyUsage == 0 || cert.KeyUsage&(x509.KeyUsageDigitalSignature|x509.KeyUsageKeyEncipherment) != 0
+	} else if strings.Contains(block.Type, "PRIVATE KEY") || block.Type == "EC PARAMETERS" {
+		// The file contains a PKCS#1, EC or PKCS#8 private key
+		_, err := ParsePrivateKeyPEM(contents)
 		return err == nil
 	}
 	return false
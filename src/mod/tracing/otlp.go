@@ -0,0 +1,189 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+/*
+	otlp.go
+
+	Encode the spans with the OTLP/HTTP JSON protocol and
+	send them to the collector
+*/
+
+type otlpAnyValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"` //int64 are encoded as string in OTLP JSON
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	TraceState        string         `json:"traceState,omitempty"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpExportRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+func toOtlpKeyValue(attr Attribute) otlpKeyValue {
+	kv := otlpKeyValue{Key: attr.Key}
+	switch v := attr.Value.(type) {
+	case string:
+		kv.Value.StringValue = &v
+	case bool:
+		kv.Value.BoolValue = &v
+	case int:
+		s := strconv.Itoa(v)
+		kv.Value.IntValue = &s
+	case int64:
+		s := strconv.FormatInt(v, 10)
+		kv.Value.IntValue = &s
+	case float64:
+		kv.Value.DoubleValue = &v
+	default:
+		s := ""
+		kv.Value.StringValue = &s
+	}
+	return kv
+}
+
+// Encode the spans into an OTLP JSON export request
+func (t *Tracer) encodeSpans(spans []*Span) ([]byte, error) {
+	otlpSpans := []otlpSpan{}
+	for _, span := range spans {
+		span.mutex.Lock()
+		thisSpan := otlpSpan{
+			TraceID:           span.Context.TraceID.String(),
+			SpanID:            span.Context.SpanID.String(),
+			TraceState:        span.Context.TraceState,
+			Name:              span.Name,
+			Kind:              span.Kind,
+			StartTimeUnixNano: strconv.FormatInt(span.StartTime.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.EndTime.UnixNano(), 10),
+			Status: otlpStatus{
+				Code:    span.StatusCode,
+				Message: span.StatusMsg,
+			},
+		}
+		if span.ParentSpanID.IsValid() {
+			thisSpan.ParentSpanID = span.ParentSpanID.String()
+		}
+		for _, attr := range span.Attributes {
+			thisSpan.Attributes = append(thisSpan.Attributes, toOtlpKeyValue(attr))
+		}
+		span.mutex.Unlock()
+		otlpSpans = append(otlpSpans, thisSpan)
+	}
+
+	request := otlpExportRequest{
+		ResourceSpans: []otlpResourceSpans{
+			{
+				Resource: otlpResource{
+					Attributes: []otlpKeyValue{
+						toOtlpKeyValue(Attribute{"service.name", t.Option.ServiceName}),
+					},
+				},
+				ScopeSpans: []otlpScopeSpans{
+					{
+						Scope: otlpScope{Name: "imuslab.com/zoraxy/mod/tracing"},
+						Spans: otlpSpans,
+					},
+				},
+			},
+		},
+	}
+
+	return json.Marshal(request)
+}
+
+// Send the spans to the collector
+func (t *Tracer) export(spans []*Span) error {
+	if t.Option.Endpoint == "" {
+		return errors.New("collector endpoint not set")
+	}
+
+	payload, err := t.encodeSpans(spans)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, t.Option.Endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range t.Option.Headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.New("collector responded with status " + resp.Status)
+	}
+	return nil
+}
+
+// Parse the collector headers in key=value pairs seperated by comma,
+// the same format as OTEL_EXPORTER_OTLP_HEADERS
+func ParseHeaders(value string) map[string]string {
+	headers := map[string]string{}
+	for _, pair := range strings.Split(value, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			continue
+		}
+		headers[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	return headers
+}
@@ -0,0 +1,129 @@
+package tracing
+
+import (
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+/*
+	propagation.go
+
+	Parse and format the W3C Trace Context headers
+	https://www.w3.org/TR/trace-context/
+*/
+
+const (
+	Header_TraceParent = "traceparent"
+	Header_TraceState  = "tracestate"
+
+	flagSampled = 0x01
+)
+
+type TraceID [16]byte
+type SpanID [8]byte
+
+func (t TraceID) String() string {
+	return hex.EncodeToString(t[:])
+}
+
+func (t TraceID) IsValid() bool {
+	return t != TraceID{}
+}
+
+func (s SpanID) String() string {
+	return hex.EncodeToString(s[:])
+}
+
+func (s SpanID) IsValid() bool {
+	return s != SpanID{}
+}
+
+// SpanContext is the part of a span that propagates across services
+type SpanContext struct {
+	TraceID    TraceID
+	SpanID     SpanID
+	Flags      byte
+	TraceState string
+}
+
+func (sc SpanContext) IsSampled() bool {
+	return sc.Flags&flagSampled != 0
+}
+
+// Format the span context as a traceparent header value
+func (sc SpanContext) TraceParent() string {
+	return "00-" + sc.TraceID.String() + "-" + sc.SpanID.String() + "-" + hex.EncodeToString([]byte{sc.Flags})
+}
+
+// Parse a traceparent header value, e.g.
+// 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01
+func ParseTraceParent(value string) (SpanContext, error) {
+	sc := SpanContext{}
+	value = strings.TrimSpace(value)
+	parts := strings.Split(value, "-")
+	if len(parts) < 4 {
+		return sc, errors.New("invalid traceparent format")
+	}
+
+	version, err := hex.DecodeString(parts[0])
+	if err != nil || len(version) != 1 || version[0] == 0xff {
+		return sc, errors.New("invalid traceparent version")
+	}
+
+	if version[0] == 0 && len(parts) != 4 {
+		//Version 00 must not contain extra fields
+		return sc, errors.New("invalid traceparent format")
+	}
+
+	if len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return sc, errors.New("invalid traceparent field length")
+	}
+
+	if strings.ToLower(value) != value {
+		return sc, errors.New("traceparent must be lowercase")
+	}
+
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return sc, errors.New("invalid trace id")
+	}
+
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return sc, errors.New("invalid parent id")
+	}
+
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return sc, errors.New("invalid trace flags")
+	}
+	sc.Flags = flags[0]
+
+	if !sc.TraceID.IsValid() || !sc.SpanID.IsValid() {
+		return sc, errors.New("trace id and parent id must not be all zero")
+	}
+
+	return sc, nil
+}
+
+// Extract the span context from the incoming request headers
+func Extract(header http.Header) (SpanContext, bool) {
+	sc, err := ParseTraceParent(header.Get(Header_TraceParent))
+	if err != nil {
+		return SpanContext{}, false
+	}
+
+	//Multiple tracestate headers are combined as a single list
+	sc.TraceState = strings.Join(header.Values(Header_TraceState), ",")
+	return sc, true
+}
+
+// Inject the span context into the outgoing request headers
+func Inject(header http.Header, sc SpanContext) {
+	header.Set(Header_TraceParent, sc.TraceParent())
+	if sc.TraceState != "" {
+		header.Set(Header_TraceState, sc.TraceState)
+	} else {
+		header.Del(Header_TraceState)
+	}
+}
@@ -0,0 +1,282 @@
+package tracing
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+	Tracing
+
+	This module creates spans for proxied requests, continues the
+	W3C trace context of incoming requests and exports the finished
+	spans to an OpenTelemetry collector over OTLP/HTTP
+*/
+
+const (
+	SpanKind_Server = 2
+	SpanKind_Client = 3
+
+	StatusCode_Unset = 0
+	StatusCode_Ok    = 1
+	StatusCode_Error = 2
+)
+
+type Options struct {
+	ServiceName   string            //Service name reported to the collector, default to zoraxy
+	Endpoint      string            //OTLP/HTTP traces endpoint, e.g. http://localhost:4318/v1/traces
+	Headers       map[string]string //Extra headers sent to the collector, e.g. authorization
+	SampleRatio   float64           //Ratio of new traces to be sampled, 0 to 1
+	ParentBased   bool              //Follow the sampling decision of the incoming traceparent
+	BatchSize     int               //Max number of spans per export request
+	FlushInterval time.Duration     //Max time a finished span waits before export
+	QueueSize     int               //Max number of spans waiting for export, overflowed spans are dropped
+}
+
+type Attribute struct {
+	Key   string
+	Value interface{} //string, bool, int, int64 or float64
+}
+
+type Span struct {
+	Name         string
+	Kind         int
+	Context      SpanContext
+	ParentSpanID SpanID
+	StartTime    time.Time
+	EndTime      time.Time
+	Attributes   []Attribute
+	StatusCode   int
+	StatusMsg    string
+
+	tracer *Tracer
+	ended  bool
+	mutex  sync.Mutex
+}
+
+type Tracer struct {
+	exported uint64 //Keep 64 bit fields on top for atomic alignment
+	dropped  uint64
+	failed   uint64
+
+	Option     *Options
+	queue      chan *Span
+	closeChan  chan bool
+	closeWait  sync.WaitGroup
+	closeMutex sync.RWMutex
+	closed     bool
+	client     *http.Client
+}
+
+// Create a new tracer and start its background exporter
+func NewTracer(option *Options) *Tracer {
+	if option.ServiceName == "" {
+		option.ServiceName = "zoraxy"
+	}
+	if option.SampleRatio < 0 {
+		option.SampleRatio = 0
+	} else if option.SampleRatio > 1 {
+		option.SampleRatio = 1
+	}
+	if option.BatchSize <= 0 {
+		option.BatchSize = 512
+	}
+	if option.FlushInterval <= 0 {
+		option.FlushInterval = 5 * time.Second
+	}
+	if option.QueueSize <= 0 {
+		option.QueueSize = 4096
+	}
+
+	t := &Tracer{
+		Option:    option,
+		queue:     make(chan *Span, option.QueueSize),
+		closeChan: make(chan bool),
+		client: &http.Client{
+			Timeout: 10 * time.Second,
+		},
+	}
+
+	t.closeWait.Add(1)
+	go t.exportLoop()
+	return t
+}
+
+// Decide if a new trace should be sampled base on its trace ID
+func (t *Tracer) shouldSample(traceID TraceID) bool {
+	if t.Option.SampleRatio >= 1 {
+		return true
+	} else if t.Option.SampleRatio <= 0 {
+		return false
+	}
+
+	//Use the random lower bits of the trace ID so all services
+	//using the same ratio make the same decision
+	bound := uint64(t.Option.SampleRatio * (1 << 63))
+	return binary.BigEndian.Uint64(traceID[8:])>>1 < bound
+}
+
+// Start a new span. If parent is valid, the span continue the trace of
+// the parent, otherwise a new trace is started
+func (t *Tracer) StartSpan(name string, kind int, parent SpanContext) *Span {
+	span := Span{
+		Name:      name,
+		Kind:      kind,
+		StartTime: time.Now(),
+		tracer:    t,
+	}
+
+	rand.Read(span.Context.SpanID[:])
+	if parent.TraceID.IsValid() {
+		span.Context.TraceID = parent.TraceID
+		span.Context.TraceState = parent.TraceState
+		span.ParentSpanID = parent.SpanID
+	} else {
+		rand.Read(span.Context.TraceID[:])
+	}
+
+	sampled := false
+	if parent.TraceID.IsValid() && t.Option.ParentBased {
+		sampled = parent.IsSampled()
+	} else {
+		sampled = t.shouldSample(span.Context.TraceID)
+	}
+	if sampled {
+		span.Context.Flags |= flagSampled
+	}
+
+	return &span
+}
+
+// Start a server span for an incoming request, continuing its trace context if any
+func (t *Tracer) StartRequestSpan(name string, r *http.Request) *Span {
+	parent, _ := Extract(r.Header)
+	return t.StartSpan(name, SpanKind_Server, parent)
+}
+
+// Get the number of exported, dropped and failed spans
+func (t *Tracer) GetStats() (uint64, uint64, uint64) {
+	return atomic.LoadUint64(&t.exported), atomic.LoadUint64(&t.dropped), atomic.LoadUint64(&t.failed)
+}
+
+func (t *Tracer) enqueue(span *Span) {
+	t.closeMutex.RLock()
+	defer t.closeMutex.RUnlock()
+	if t.closed {
+		return
+	}
+
+	select {
+	case t.queue <- span:
+	default:
+		//Export cannot keep up, drop the span instead of blocking requests
+		atomic.AddUint64(&t.dropped, 1)
+	}
+}
+
+// Flush the pending spans and stop the exporter
+func (t *Tracer) Close() {
+	t.closeMutex.Lock()
+	if t.closed {
+		t.closeMutex.Unlock()
+		return
+	}
+	t.closed = true
+	t.closeMutex.Unlock()
+
+	close(t.closeChan)
+	t.closeWait.Wait()
+}
+
+func (t *Tracer) exportLoop() {
+	defer t.closeWait.Done()
+	ticker := time.NewTicker(t.Option.FlushInterval)
+	defer ticker.Stop()
+
+	batch := []*Span{}
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		err := t.export(batch)
+		if err != nil {
+			log.Println("[Tracing] Unable to export spans: " + err.Error())
+			atomic.AddUint64(&t.failed, uint64(len(batch)))
+		} else {
+			atomic.AddUint64(&t.exported, uint64(len(batch)))
+		}
+		batch = []*Span{}
+	}
+
+	for {
+		select {
+		case span := <-t.queue:
+			batch = append(batch, span)
+			if len(batch) >= t.Option.BatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-t.closeChan:
+			//Drain the spans still in queue
+			for {
+				select {
+				case span := <-t.queue:
+					batch = append(batch, span)
+					if len(batch) >= t.Option.BatchSize {
+						flush()
+					}
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+// Set an attribute of the span. All span methods are no-op on nil span
+// so callers do not need to check if tracing is enabled
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.Attributes = append(s.Attributes, Attribute{Key: key, Value: value})
+}
+
+// Set the status of the span
+func (s *Span) SetStatus(code int, message string) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.StatusCode = code
+	s.StatusMsg = message
+}
+
+// Finish the span and queue it for export if it is sampled
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	if s.ended {
+		s.mutex.Unlock()
+		return
+	}
+	s.ended = true
+	s.EndTime = time.Now()
+	s.mutex.Unlock()
+
+	if s.Context.IsSampled() && s.tracer != nil {
+		s.tracer.enqueue(s)
+	}
+}
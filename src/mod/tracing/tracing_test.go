@@ -0,0 +1,100 @@
+package tracing_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"imuslab.com/zoraxy/mod/tracing"
+)
+
+func TestParseTraceParent(t *testing.T) {
+	sc, err := tracing.ParseTraceParent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sc.TraceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" || sc.SpanID.String() != "00f067aa0ba902b7" || !sc.IsSampled() {
+		t.Errorf("unexpected span context: %+v", sc)
+	}
+	if sc.TraceParent() != "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01" {
+		t.Errorf("traceparent not formatted back correctly: %s", sc.TraceParent())
+	}
+
+	invalidValues := []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+	}
+	for _, value := range invalidValues {
+		if _, err := tracing.ParseTraceParent(value); err == nil {
+			t.Errorf("expected error for traceparent %q", value)
+		}
+	}
+}
+
+func TestSpanExport(t *testing.T) {
+	received := make(chan map[string]interface{}, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer test" {
+			t.Errorf("collector header not forwarded")
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		payload := map[string]interface{}{}
+		json.Unmarshal(body, &payload)
+		received <- payload
+	}))
+	defer collector.Close()
+
+	tracer := tracing.NewTracer(&tracing.Options{
+		Endpoint:      collector.URL,
+		Headers:       tracing.ParseHeaders("Authorization=Bearer test"),
+		SampleRatio:   0,
+		ParentBased:   true,
+		FlushInterval: time.Hour,
+	})
+
+	//Not sampled by ratio, will not be exported
+	tracer.StartSpan("dropped", tracing.SpanKind_Server, tracing.SpanContext{}).End()
+
+	//Sampled by the incoming parent
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	r.Header.Set("tracestate", "vendor=value")
+	span := tracer.StartRequestSpan("GET host", r)
+	span.SetAttribute("http.response.status_code", 502)
+	span.SetStatus(tracing.StatusCode_Error, "bad gateway")
+
+	outgoing := http.Header{}
+	tracing.Inject(outgoing, span.Context)
+	injected, ok := tracing.Extract(outgoing)
+	if !ok || injected.TraceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" || injected.SpanID == span.ParentSpanID || injected.TraceState != "vendor=value" {
+		t.Errorf("unexpected injected trace context: %v", outgoing)
+	}
+	span.End()
+	tracer.Close()
+
+	payload := <-received
+	spans := payload["resourceSpans"].([]interface{})[0].(map[string]interface{})["scopeSpans"].([]interface{})[0].(map[string]interface{})["spans"].([]interface{})
+	if len(spans) != 1 {
+		t.Fatalf("expected 1 exported span, got %d", len(spans))
+	}
+	exported := spans[0].(map[string]interface{})
+	if exported["name"] != "GET host" || exported["parentSpanId"] != "00f067aa0ba902b7" || exported["traceId"] != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("unexpected exported span: %v", exported)
+	}
+	if exported["status"].(map[string]interface{})["code"].(float64) != tracing.StatusCode_Error {
+		t.Errorf("span status not exported")
+	}
+
+	exportedCount, droppedCount, failedCount := tracer.GetStats()
+	if exportedCount != 1 || droppedCount != 0 || failedCount != 0 {
+		t.Errorf("unexpected stats: %d %d %d", exportedCount, droppedCount, failedCount)
+	}
+}
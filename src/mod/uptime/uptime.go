@@ -4,7 +4,9 @@ import (
 	"encoding/json"
 	"log"
 	"net/http"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"imuslab.com/zoraxy/mod/utils"
@@ -32,11 +34,13 @@ type Config struct {
 	Targets         []*Target
 	Interval        int
 	MaxRecordsStore int
+	OnStateChange   func(previous *Record, current *Record) //Called when a target goes online or offline, previous is nil for the first record
 }
 
 type Monitor struct {
 	Config          *Config
 	OnlineStatusLog map[string][]*Record
+	logMutex        sync.RWMutex //Protect the OnlineStatusLog
 }
 
 // Default configs
@@ -98,7 +102,13 @@ func (m *Monitor) ExecuteUptimeCheck() {
 			continue
 		}
 
+		m.logMutex.Lock()
 		thisRecords, ok := m.OnlineStatusLog[target.ID]
+		var previousRecord *Record
+		if len(thisRecords) > 0 {
+			previousRecord = thisRecords[len(thisRecords)-1]
+		}
+
 		if !ok {
 			//First record. Create the array
 			m.OnlineStatusLog[target.ID] = []*Record{&thisRecord}
@@ -113,6 +123,13 @@ func (m *Monitor) ExecuteUptimeCheck() {
 
 			m.OnlineStatusLog[target.ID] = thisRecords
 		}
+		m.logMutex.Unlock()
+
+		if m.Config.OnStateChange != nil {
+			if (previousRecord == nil && !thisRecord.Online) || (previousRecord != nil && previousRecord.Online != thisRecord.Online) {
+				m.Config.OnStateChange(previousRecord, &thisRecord)
+			}
+		}
 	}
 
 	//TODO: Write results to db
@@ -123,7 +140,9 @@ func (m *Monitor) AddTargetToMonitor(target *Target) {
 	m.Config.Targets = append(m.Config.Targets, target)
 
 	// Add target to OnlineStatusLog
+	m.logMutex.Lock()
 	m.OnlineStatusLog[target.ID] = []*Record{}
+	m.logMutex.Unlock()
 }
 
 func (m *Monitor) RemoveTargetFromMonitor(targetId string) {
@@ -136,7 +155,28 @@ func (m *Monitor) RemoveTargetFromMonitor(targetId string) {
 	}
 
 	// Remove target from OnlineStatusLog
+	m.logMutex.Lock()
 	delete(m.OnlineStatusLog, targetId)
+	m.logMutex.Unlock()
+}
+
+// Get the latest record of each monitored target, sorted by target ID
+func (m *Monitor) GetLatestRecords() []*Record {
+	m.logMutex.RLock()
+	defer m.logMutex.RUnlock()
+	results := []*Record{}
+	for _, records := range m.OnlineStatusLog {
+		if len(records) == 0 {
+			continue
+		}
+		latest := *records[len(records)-1]
+		results = append(results, &latest)
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].ID < results[j].ID
+	})
+	return results
 }
 
 // Scan the config target. If a target exists in m.OnlineStatusLog no longer
@@ -150,6 +190,8 @@ func (m *Monitor) CleanRecords() {
 
 	// Iterate over all log entries and remove any that have a target ID that
 	// is not in the set of current target IDs
+	m.logMutex.Lock()
+	defer m.logMutex.Unlock()
 	newStatusLog := m.OnlineStatusLog
 	for id, _ := range m.OnlineStatusLog {
 		_, idExistsInTargets := targetIDs[id]
@@ -167,6 +209,8 @@ func (m *Monitor) CleanRecords() {
 
 func (m *Monitor) HandleUptimeLogRead(w http.ResponseWriter, r *http.Request) {
 	id, _ := utils.GetPara(r, "id")
+	m.logMutex.RLock()
+	defer m.logMutex.RUnlock()
 	if id == "" {
 		js, _ := json.Marshal(m.OnlineStatusLog)
 		w.Header().Set("Content-Type", "application/json")
@@ -0,0 +1,19 @@
+package utils
+
+import (
+	"io"
+	"sync/atomic"
+)
+
+// Writer that add the number of bytes written to an accumulator, for
+// counting the traffic of proxied connections
+type AccumulatedWriter struct {
+	io.Writer
+	Accumulator *int64 //Updated atomically
+}
+
+func (w *AccumulatedWriter) Write(b []byte) (int, error) {
+	n, err := w.Writer.Write(b)
+	atomic.AddInt64(w.Accumulator, int64(n))
+	return n, err
+}
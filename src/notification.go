@@ -0,0 +1,106 @@
+package main
+
+import (
+	"strconv"
+
+	"imuslab.com/zoraxy/mod/email"
+	"imuslab.com/zoraxy/mod/notify"
+	"imuslab.com/zoraxy/mod/uptime"
+)
+
+/*
+	Notification.go
+
+	This script connect the events of system modules to the
+	notification manager for alerting
+*/
+
+// Create the notification manager and start the traffic anomaly monitor
+func initNotification() error {
+	var err error
+	notificationManager, err = notify.NewManager(&notify.Options{
+		Database: sysdb,
+		GetEmailSender: func() *email.Sender {
+			return EmailSender
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	trafficMonitor = notify.NewTrafficMonitor(notificationManager, getTrafficCounters, &notify.TrafficOptions{})
+	trafficMonitor.Start()
+	return nil
+}
+
+// Get the request counters of today from the statistic collector
+func getTrafficCounters() (int64, int64) {
+	if statisticCollector == nil || statisticCollector.DailySummary == nil {
+		return 0, 0
+	}
+	summary := statisticCollector.DailySummary
+	return summary.TotalRequest, summary.ErrorRequest
+}
+
+// Emit an event when an uptime monitor target goes online or offline
+func notifyUptimeStateChange(previous *uptime.Record, current *uptime.Record) {
+	target := current.Name + " (" + current.URL + ")"
+	event := notify.Event{
+		Source: notify.Source_Uptime,
+		Key:    current.ID,
+		Fields: map[string]string{
+			"name":        current.Name,
+			"url":         current.URL,
+			"status_code": strconv.Itoa(current.StatusCode),
+		},
+	}
+
+	if current.Online {
+		event.Type = "online"
+		event.Severity = notify.Severity_Info
+		event.Title = "Upstream " + current.Name + " is back online"
+		event.Message = target + " is back online with status code " + strconv.Itoa(current.StatusCode) + ", latency " + strconv.FormatInt(current.Latency, 10) + "ms"
+		event.Recovery = true
+	} else {
+		event.Type = "offline"
+		event.Severity = notify.Severity_Critical
+		event.Title = "Upstream " + current.Name + " is offline"
+		event.Message = target + " is not responding"
+		if current.StatusCode > 0 {
+			event.Message = target + " responded with status code " + strconv.Itoa(current.StatusCode)
+		}
+	}
+
+	notificationManager.Notify(&event)
+}
+
+// Emit an event when the reverse proxy service is started, stopped or failed to start
+func notifyProxyStateChange(running bool, err error) {
+	event := notify.Event{
+		Source: notify.Source_Proxy,
+		Key:    "main",
+		Fields: map[string]string{
+			"port": strconv.Itoa(dynamicProxyRouter.Option.Port),
+		},
+	}
+
+	if err != nil {
+		event.Type = "start_failed"
+		event.Severity = notify.Severity_Critical
+		event.Title = "Reverse proxy failed to start"
+		event.Message = "Unable to start the reverse proxy service on port " + strconv.Itoa(dynamicProxyRouter.Option.Port) + ": " + err.Error()
+	} else if running {
+		event.Type = "started"
+		event.Severity = notify.Severity_Info
+		event.Title = "Reverse proxy started"
+		event.Message = "Reverse proxy service is listening on port " + strconv.Itoa(dynamicProxyRouter.Option.Port)
+		event.Recovery = true
+	} else {
+		event.Type = "stopped"
+		event.Severity = notify.Severity_Warning
+		event.Title = "Reverse proxy stopped"
+		event.Message = "Reverse proxy service on port " + strconv.Itoa(dynamicProxyRouter.Option.Port) + " has been stopped"
+	}
+
+	notificationManager.Notify(&event)
+}
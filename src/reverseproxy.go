@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
 	"path/filepath"
@@ -10,8 +11,10 @@ import (
 	"strings"
 	"time"
 
+	"imuslab.com/zoraxy/mod/accesslog"
 	"imuslab.com/zoraxy/mod/auth"
 	"imuslab.com/zoraxy/mod/dynamicproxy"
+	"imuslab.com/zoraxy/mod/dynamicproxy/waf"
 	"imuslab.com/zoraxy/mod/uptime"
 	"imuslab.com/zoraxy/mod/utils"
 )
@@ -64,6 +67,13 @@ func ReverseProxtInit() {
 		RedirectRuleTable:  redirectTable,
 		GeodbStore:         geodbStore,
 		StatisticCollector: statisticCollector,
+		WafEngine:          wafEngine,
+		AutobanTracker:     autobanTracker,
+		AccessLogger:       accessLogger,
+		MetricsCollector:   metricsCollector,
+		Tracer:             requestTracer,
+		LiveStream:         liveStreamHub,
+		SNIRouter:          sniProxyManager,
 	})
 	if err != nil {
 		log.Println(err.Error())
@@ -96,6 +106,11 @@ func ReverseProxtInit() {
 				RequireBasicAuth:        record.RequireBasicAuth,
 				BasicAuthCredentials:    record.BasicAuthCredentials,
 				BasicAuthExceptionRules: record.BasicAuthExceptionRules,
+				WafMode:                 record.WafMode,
+				AccessLogFormat:         record.AccessLogFormat,
+				AutoCert:                record.AutoCert,
+				HttpsRedirect:           record.HttpsRedirect,
+				HSTS:                    record.HSTS,
 			})
 		case "vdir":
 			dynamicProxyRouter.AddVirtualDirectoryProxyService(&dynamicproxy.VdirOptions{
@@ -106,6 +121,8 @@ func ReverseProxtInit() {
 				RequireBasicAuth:        record.RequireBasicAuth,
 				BasicAuthCredentials:    record.BasicAuthCredentials,
 				BasicAuthExceptionRules: record.BasicAuthExceptionRules,
+				WafMode:                 record.WafMode,
+				AccessLogFormat:         record.AccessLogFormat,
 			})
 		default:
 			log.Printf("Unsupported endpoint type: %s. Skipping %s\n", record.ProxyType, filepath.Base(conf))
@@ -116,7 +133,10 @@ func ReverseProxtInit() {
 	//Not sure why but delay must be added if you have another
 	//reverse proxy server in front of this service
 	time.Sleep(300 * time.Millisecond)
-	dynamicProxyRouter.StartProxyService()
+	err = dynamicProxyRouter.StartProxyService()
+	if err != nil {
+		notifyProxyStateChange(false, err)
+	}
 	log.Println("Dynamic Reverse Proxy service started")
 
 	//Add all proxy services to uptime monitor
@@ -127,6 +147,7 @@ func ReverseProxtInit() {
 			Targets:         GetUptimeTargetsFromReverseProxyRules(dynamicProxyRouter),
 			Interval:        300, //5 minutes
 			MaxRecordsStore: 288, //1 day
+			OnStateChange:   notifyUptimeStateChange,
 		})
 		log.Println("Uptime Monitor background service started")
 	}()
@@ -138,9 +159,11 @@ func ReverseProxyHandleOnOff(w http.ResponseWriter, r *http.Request) {
 	if enable == "true" {
 		err := dynamicProxyRouter.StartProxyService()
 		if err != nil {
+			notifyProxyStateChange(false, err)
 			utils.SendErrorResponse(w, err.Error())
 			return
 		}
+		notifyProxyStateChange(true, nil)
 	} else {
 		//Check if it is loopback
 		if dynamicProxyRouter.IsProxiedSubdomain(r) {
@@ -155,6 +178,7 @@ func ReverseProxyHandleOnOff(w http.ResponseWriter, r *http.Request) {
 			utils.SendErrorResponse(w, err.Error())
 			return
 		}
+		notifyProxyStateChange(false, nil)
 	}
 
 	utils.SendOK(w)
@@ -194,6 +218,37 @@ func ReverseProxyHandleAddEndpoint(w http.ResponseWriter, r *http.Request) {
 
 	requireBasicAuth := (rba == "true")
 
+	wafMode, _ := utils.PostPara(r, "waf")
+	if wafMode == "off" {
+		wafMode = waf.Mode_Off
+	}
+	if !waf.IsValidMode(wafMode) {
+		utils.SendErrorResponse(w, "invalid waf mode given")
+		return
+	}
+
+	logFormat, _ := utils.PostPara(r, "accesslog")
+	if !accesslog.IsValidFormat(logFormat) {
+		utils.SendErrorResponse(w, "invalid access log format given")
+		return
+	}
+
+	autoCert, _ := utils.PostBool(r, "autocert")
+	if autoCert && eptype != "subd" {
+		utils.SendErrorResponse(w, "automatic certificate is only supported on subdomain endpoints")
+		return
+	}
+
+	httpsRedirect, hsts, err := parseHttpsRedirectSettings(r, &dynamicproxy.ProxyEndpoint{})
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+	if (httpsRedirect != dynamicproxy.HttpsRedirect_Default || hsts != nil) && eptype != "subd" {
+		utils.SendErrorResponse(w, "https redirect and HSTS settings are only supported on subdomain endpoints")
+		return
+	}
+
 	//Prase the basic auth to correct structure
 	cred, _ := utils.PostPara(r, "cred")
 	basicAuthCredentials := []*dynamicproxy.BasicAuthCredentials{}
@@ -244,6 +299,8 @@ func ReverseProxyHandleAddEndpoint(w http.ResponseWriter, r *http.Request) {
 			SkipCertValidations:  skipTlsValidation,
 			RequireBasicAuth:     requireBasicAuth,
 			BasicAuthCredentials: basicAuthCredentials,
+			WafMode:              wafMode,
+			AccessLogFormat:      logFormat,
 		}
 		dynamicProxyRouter.AddVirtualDirectoryProxyService(&thisOption)
 	case "subd":
@@ -260,6 +317,11 @@ func ReverseProxyHandleAddEndpoint(w http.ResponseWriter, r *http.Request) {
 			SkipCertValidations:  skipTlsValidation,
 			RequireBasicAuth:     requireBasicAuth,
 			BasicAuthCredentials: basicAuthCredentials,
+			WafMode:              wafMode,
+			AccessLogFormat:      logFormat,
+			AutoCert:             autoCert,
+			HttpsRedirect:        httpsRedirect,
+			HSTS:                 hsts,
 		}
 		dynamicProxyRouter.AddSubdomainRoutingService(&thisOption)
 	case "root":
@@ -284,9 +346,18 @@ func ReverseProxyHandleAddEndpoint(w http.ResponseWriter, r *http.Request) {
 		SkipTlsValidation:    skipTlsValidation,
 		RequireBasicAuth:     requireBasicAuth,
 		BasicAuthCredentials: basicAuthCredentials,
+		WafMode:              wafMode,
+		AccessLogFormat:      logFormat,
+		AutoCert:             autoCert,
+		HttpsRedirect:        httpsRedirect,
+		HSTS:                 hsts,
 	}
 	SaveReverseProxyConfigToFile(&thisProxyConfigRecord)
 
+	if autoCert || (eptype == "subd" && pkiManager.ManagesDomain(rootname)) {
+		requestAutoCert(rootname)
+	}
+
 	//Update utm if exists
 	if uptimeMonitor != nil {
 		uptimeMonitor.Config.Targets = GetUptimeTargetsFromReverseProxyRules(dynamicProxyRouter)
@@ -349,6 +420,49 @@ func ReverseProxyHandleEditEndpoint(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	//Keep the current WAF mode if it is not given
+	wafMode, err := utils.PostPara(r, "waf")
+	if err != nil {
+		wafMode = targetProxyEntry.WafMode
+	} else if wafMode == "off" {
+		wafMode = waf.Mode_Off
+	}
+	if !waf.IsValidMode(wafMode) {
+		utils.SendErrorResponse(w, "invalid waf mode given")
+		return
+	}
+
+	//Keep the current access log format if it is not given
+	logFormat, err := utils.PostPara(r, "accesslog")
+	if err != nil {
+		logFormat = targetProxyEntry.AccessLogFormat
+	}
+	if !accesslog.IsValidFormat(logFormat) {
+		utils.SendErrorResponse(w, "invalid access log format given")
+		return
+	}
+
+	//Keep the current automatic certificate setting if it is not given
+	autoCert, err := utils.PostBool(r, "autocert")
+	if err != nil {
+		autoCert = targetProxyEntry.AutoCert
+	}
+	if autoCert && eptype != "subd" {
+		utils.SendErrorResponse(w, "automatic certificate is only supported on subdomain endpoints")
+		return
+	}
+
+	//Keep the current https redirect and HSTS settings if they are not given
+	httpsRedirect, hsts, err := parseHttpsRedirectSettings(r, targetProxyEntry)
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+	if (httpsRedirect != dynamicproxy.HttpsRedirect_Default || hsts != nil) && eptype != "subd" {
+		utils.SendErrorResponse(w, "https redirect and HSTS settings are only supported on subdomain endpoints")
+		return
+	}
+
 	switch eptype {
 	case "vdir":
 		thisOption := dynamicproxy.VdirOptions{
@@ -358,6 +472,8 @@ func ReverseProxyHandleEditEndpoint(w http.ResponseWriter, r *http.Request) {
 			SkipCertValidations:  skipTlsValidation,
 			RequireBasicAuth:     requireBasicAuth,
 			BasicAuthCredentials: targetProxyEntry.BasicAuthCredentials,
+			WafMode:              wafMode,
+			AccessLogFormat:      logFormat,
 		}
 		targetProxyEntry.Remove()
 		dynamicProxyRouter.AddVirtualDirectoryProxyService(&thisOption)
@@ -369,6 +485,11 @@ func ReverseProxyHandleEditEndpoint(w http.ResponseWriter, r *http.Request) {
 			SkipCertValidations:  skipTlsValidation,
 			RequireBasicAuth:     requireBasicAuth,
 			BasicAuthCredentials: targetProxyEntry.BasicAuthCredentials,
+			WafMode:              wafMode,
+			AccessLogFormat:      logFormat,
+			AutoCert:             autoCert,
+			HttpsRedirect:        httpsRedirect,
+			HSTS:                 hsts,
 		}
 		targetProxyEntry.Remove()
 		dynamicProxyRouter.AddSubdomainRoutingService(&thisOption)
@@ -385,11 +506,61 @@ func ReverseProxyHandleEditEndpoint(w http.ResponseWriter, r *http.Request) {
 		SkipTlsValidation:    skipTlsValidation,
 		RequireBasicAuth:     requireBasicAuth,
 		BasicAuthCredentials: targetProxyEntry.BasicAuthCredentials,
+		WafMode:              wafMode,
+		AccessLogFormat:      logFormat,
+		AutoCert:             autoCert,
+		HttpsRedirect:        httpsRedirect,
+		HSTS:                 hsts,
 	}
 	SaveReverseProxyConfigToFile(&thisProxyConfigRecord)
+
+	if autoCert || (eptype == "subd" && pkiManager.ManagesDomain(targetProxyEntry.RootOrMatchingDomain)) {
+		requestAutoCert(targetProxyEntry.RootOrMatchingDomain)
+	}
 	utils.SendOK(w)
 }
 
+// Parse the https redirect mode and HSTS policy of an endpoint from the request.
+// Settings that are not given are inherited from the current endpoint
+func parseHttpsRedirectSettings(r *http.Request, current *dynamicproxy.ProxyEndpoint) (string, *dynamicproxy.HSTSPolicy, error) {
+	httpsRedirect, err := utils.PostPara(r, "httpsredirect")
+	if err != nil {
+		httpsRedirect = current.HttpsRedirect
+	}
+	if !dynamicproxy.IsValidHttpsRedirectMode(httpsRedirect) {
+		return "", nil, errors.New("invalid https redirect mode given")
+	}
+
+	hsts := dynamicproxy.HSTSPolicy{}
+	if current.HSTS != nil {
+		hsts = *current.HSTS
+	}
+	if maxAge, err := utils.PostPara(r, "hstsmaxage"); err == nil {
+		hsts.MaxAge, err = strconv.Atoi(maxAge)
+		if err != nil || hsts.MaxAge < 0 {
+			return "", nil, errors.New("invalid HSTS max-age given")
+		}
+	}
+	if includeSubDomains, err := utils.PostBool(r, "hstsincsub"); err == nil {
+		hsts.IncludeSubDomains = includeSubDomains
+	}
+	if preload, err := utils.PostBool(r, "hstspreload"); err == nil {
+		hsts.Preload = preload
+	}
+
+	if hsts.MaxAge == 0 {
+		//HSTS disabled
+		return httpsRedirect, nil, nil
+	}
+	if httpsRedirect == dynamicproxy.HttpsRedirect_None {
+		return "", nil, errors.New("HSTS cannot be enabled on endpoints served over plain HTTP")
+	}
+	if err := hsts.Validate(); err != nil {
+		return "", nil, err
+	}
+	return httpsRedirect, &hsts, nil
+}
+
 func DeleteProxyEndpoint(w http.ResponseWriter, r *http.Request) {
 	ep, err := utils.GetPara(r, "ep")
 	if err != nil {
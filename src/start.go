@@ -8,20 +8,28 @@ import (
 	"strings"
 	"time"
 
+	"imuslab.com/zoraxy/mod/accesslog"
 	"imuslab.com/zoraxy/mod/acme"
 	"imuslab.com/zoraxy/mod/auth"
+	"imuslab.com/zoraxy/mod/autoban"
 	"imuslab.com/zoraxy/mod/database"
 	"imuslab.com/zoraxy/mod/dynamicproxy/redirection"
+	"imuslab.com/zoraxy/mod/dynamicproxy/waf"
 	"imuslab.com/zoraxy/mod/ganserv"
 	"imuslab.com/zoraxy/mod/geodb"
+	"imuslab.com/zoraxy/mod/livestream"
 	"imuslab.com/zoraxy/mod/mdns"
+	"imuslab.com/zoraxy/mod/metrics"
 	"imuslab.com/zoraxy/mod/netstat"
 	"imuslab.com/zoraxy/mod/pathrule"
+	"imuslab.com/zoraxy/mod/pki"
+	"imuslab.com/zoraxy/mod/sniproxy"
 	"imuslab.com/zoraxy/mod/sshprox"
 	"imuslab.com/zoraxy/mod/statistic"
 	"imuslab.com/zoraxy/mod/statistic/analytic"
 	"imuslab.com/zoraxy/mod/tcpprox"
 	"imuslab.com/zoraxy/mod/tlscert"
+	"imuslab.com/zoraxy/mod/tracing"
 )
 
 /*
@@ -68,6 +76,14 @@ func startupSequence() {
 	if err != nil {
 		panic(err)
 	}
+	if sysdb.KeyExists("settings", "tlsPolicy") {
+		tlsPolicy := tlscert.TLSPolicy{}
+		sysdb.Read("settings", "tlsPolicy", &tlsPolicy)
+		err = tlsCertManager.SetPolicy(&tlsPolicy)
+		if err != nil {
+			log.Println("[TLS] Unable to load TLS policy, using defaults: " + err.Error())
+		}
+	}
 
 	//Create a redirection rule table
 	redirectTable, err = redirection.NewRuleTable("./conf/redirect")
@@ -79,14 +95,72 @@ func startupSequence() {
 	geodbStore, err = geodb.NewGeoDb(sysdb, &geodb.StoreOptions{
 		AllowSlowIpv4LookUp: !*enableHighSpeedGeoIPLookup,
 		AllowSloeIpv6Lookup: !*enableHighSpeedGeoIPLookup,
+		CountryDatabase:     *geoipDatabase,
+		AsnDatabase:         *asnDatabase,
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	//Create a behaviour tracker for auto banning abusive clients
+	autobanTracker, err = autoban.NewTracker(&autoban.Options{
+		Database:   sysdb,
+		GeodbStore: geodbStore,
 	})
 	if err != nil {
 		panic(err)
 	}
 
+	//Create a web application firewall rule engine
+	wafEngine, err = waf.NewRuleEngine(&waf.Options{
+		Database:     sysdb,
+		ConfigFolder: "./conf/rules/waf",
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	//Create an access logger for proxy requests
+	accessLogger, err = accesslog.NewLogger(&accesslog.Options{
+		LogFolder:      "./log/access",
+		DefaultFormat:  *accessLogFormat,
+		MaxFileSize:    100 * 1024 * 1024, //100MB
+		RotateInterval: 24 * time.Hour,
+		MaxBackups:     30,
+		Compress:       true,
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	//Create a Prometheus metrics collector
+	metricsCollector = metrics.NewCollector(&metrics.Options{
+		BearerToken: *metricsToken,
+	})
+
+	//Create a tracer for proxied requests if collector endpoint is set
+	if *tracingEndpoint != "" {
+		requestTracer = tracing.NewTracer(&tracing.Options{
+			Endpoint:    *tracingEndpoint,
+			Headers:     tracing.ParseHeaders(*tracingHeaders),
+			SampleRatio: *tracingSampleRatio,
+			ParentBased: *tracingParentBased,
+		})
+		log.Println("[Tracing] Exporting traces to " + *tracingEndpoint)
+	}
+
+	//Create the live request stream hub
+	liveStreamHub = livestream.NewHub(&livestream.Options{
+		MaxSubscribers: *liveStreamViewers,
+	})
+
 	//Create a statistic collector
 	statisticCollector, err = statistic.NewStatisticCollector(statistic.CollectorOption{
-		Database: sysdb,
+		Database:              sysdb,
+		TopKSize:              *statsTopKSize,
+		DailyRetentionDays:    *statsRetentionDays,
+		MonthlyRetentionMonth: *statsMonthlyRetention,
+		TimeSeriesInterval:    time.Duration(*statsInterval) * time.Second,
 	})
 	if err != nil {
 		panic(err)
@@ -185,7 +259,13 @@ func startupSequence() {
 	//Create TCP Proxy Manager
 	tcpProxyManager = tcpprox.NewTCProxy(&tcpprox.Options{
 		Database:             sysdb,
-		AccessControlHandler: geodbStore.AllowConnectionAccess,
+		AccessControlHandler: geodbStore.AllowAddrAccess,
+	})
+
+	//Create SNI Passthrough Router
+	sniProxyManager = sniproxy.NewSNIProxy(&sniproxy.Options{
+		Database:             sysdb,
+		AccessControlHandler: geodbStore.AllowAddrAccess,
 	})
 
 	//Create WoL MAC storage table
@@ -195,6 +275,12 @@ func startupSequence() {
 	sysdb.NewTable("smtp")
 	EmailSender = loadSMTPConfig()
 
+	//Create the notification manager
+	err = initNotification()
+	if err != nil {
+		panic(err)
+	}
+
 	//Create an analytic loader
 	AnalyticLoader = analytic.NewDataLoader(sysdb, statisticCollector)
 
@@ -204,14 +290,46 @@ func startupSequence() {
 		Obtaining certificates from ACME Server
 	*/
 	acmeHandler = initACME()
-	acmeAutoRenewer, err = acme.NewAutoRenewer("./conf/acme_conf.json", "./conf/certs/", int64(*acmeAutoRenewInterval), acmeHandler)
+	acmeAutoRenewer, err = acme.NewAutoRenewer("./conf/acme_conf.json", "./conf/certs/", int64(*acmeAutoRenewInterval), acmeHandler, notificationManager)
+	if err != nil {
+		log.Fatal(err)
+	}
+	acmeOnDemandIssuer, err = acme.NewOnDemandIssuer("./conf/acme_ondemand.json", "./conf/certs/", acmeHandler)
 	if err != nil {
 		log.Fatal(err)
 	}
+	acmeOnDemandIssuer.AutoRenewer = acmeAutoRenewer
+	tlsCertManager.OnDemand = acmeOnDemandIssuer
+
+	/*
+		Private CA
+
+		Issue certificates for LAN services from the built-in CA
+	*/
+	pkiManager, err = pki.NewManager(&pki.Options{
+		Database:  sysdb,
+		StorePath: "./conf/pki",
+		CertStore: "./conf/certs",
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	acmeAutoRenewer.ExcludeCert = pkiManager.IsIssuedByCA
+	pkiManager.ConfigChanged = checkAutoCertEndpoints
+	pkiManager.StartRotation()
 }
 
 // This sequence start after everything is initialized
 func finalSequence() {
 	//Start ACME renew agent
 	acmeRegisterSpecialRoutingRule()
+
+	//Obtain certificates of endpoints with automatic certificate enabled
+	checkAutoCertEndpoints()
+
+	//Register metrics of other modules and start the metrics listener if set
+	registerMetricSources()
+	if *metricsListenAddr != "" {
+		startMetricsListener(*metricsListenAddr)
+	}
 }
@@ -72,28 +72,14 @@ func HandleCheckSiteSupportTLS(w http.ResponseWriter, r *http.Request) {
 // Handle conversion of statistic daily summary to country summary
 func HandleCountryDistrSummary(w http.ResponseWriter, r *http.Request) {
 	requestClientCountry := map[string]int{}
-	statisticCollector.DailySummary.RequestClientIp.Range(func(key, value interface{}) bool {
-		//Get this client country of original
-		clientIp := key.(string)
-		//requestCount := value.(int)
-
-		ci, err := geodbStore.ResolveCountryCodeFromIP(clientIp)
-		if err != nil {
-			return true
-		}
-
-		isoCode := ci.CountryIsoCode
+	statisticCollector.DailySummary.RequestOrigin.Range(func(key, value interface{}) bool {
+		//Origins are counted per country when the request is recorded
+		isoCode := strings.ToUpper(key.(string))
 		if isoCode == "" {
 			//local or reserved addr
 			isoCode = "local"
 		}
-		uc, ok := requestClientCountry[isoCode]
-		if !ok {
-			//Create the counter
-			requestClientCountry[isoCode] = 1
-		} else {
-			requestClientCountry[isoCode] = uc + 1
-		}
+		requestClientCountry[isoCode] += value.(int)
 		return true
 	})
 
@@ -351,3 +337,19 @@ func HandleGeoIpLookup(w http.ResponseWriter, r *http.Request) {
 	js, _ := json.Marshal(cc)
 	utils.SendJSONResponse(w, string(js))
 }
+
+// Get the status of the loaded geoip and ASN databases
+func HandleGeoIpDatabaseStatus(w http.ResponseWriter, r *http.Request) {
+	js, _ := json.Marshal(geodbStore.GetGeoDatabaseStatus())
+	utils.SendJSONResponse(w, string(js))
+}
+
+// Reload the geoip and ASN databases from disk
+func HandleGeoIpDatabaseReload(w http.ResponseWriter, r *http.Request) {
+	err := geodbStore.ReloadGeoDatabases()
+	if err != nil {
+		utils.SendErrorResponse(w, err.Error())
+		return
+	}
+	utils.SendOK(w)
+}